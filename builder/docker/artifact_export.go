@@ -9,6 +9,9 @@ import (
 // exported from docker into a single flat file.
 type ExportArtifact struct {
 	path string
+
+	// Name of the driver the container was exported with
+	driver string
 }
 
 func (*ExportArtifact) BuilderId() string {
@@ -28,6 +31,9 @@ func (a *ExportArtifact) String() string {
 }
 
 func (a *ExportArtifact) State(name string) interface{} {
+	if name == "driver" {
+		return a.driver
+	}
 	return nil
 }
 
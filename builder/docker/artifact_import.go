@@ -28,7 +28,10 @@ func (a *ImportArtifact) String() string {
 	return fmt.Sprintf("Imported Docker image: %s", a.Id())
 }
 
-func (*ImportArtifact) State(name string) interface{} {
+func (a *ImportArtifact) State(name string) interface{} {
+	if name == "driver" && a.Driver != nil {
+		return driverName(a.Driver)
+	}
 	return nil
 }
 
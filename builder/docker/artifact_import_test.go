@@ -56,3 +56,36 @@ func TestImportArtifactDestroy(t *testing.T) {
 		t.Fatalf("err: %#v", err)
 	}
 }
+
+func TestArtifactDriver(t *testing.T) {
+	// The driver of an import artifact is used as is
+	d := new(MockDriver)
+	driver, err := ArtifactDriver(&ImportArtifact{Driver: d}, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if driver != d {
+		t.Fatalf("bad driver: %#v", driver)
+	}
+
+	// Artifacts from another plugin only have the name of the driver
+	a := &packer.MockArtifact{StateValues: map[string]interface{}{
+		"driver": (&ImportArtifact{Driver: new(PodmanDriver)}).State("driver"),
+	}}
+	driver, err = ArtifactDriver(a, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := driver.(*PodmanDriver); !ok {
+		t.Fatalf("bad driver: %#v", driver)
+	}
+
+	// Other artifacts use the docker CLI
+	driver, err = ArtifactDriver(new(packer.MockArtifact), nil, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := driver.(*DockerDriver); !ok {
+		t.Fatalf("bad driver: %#v", driver)
+	}
+}
@@ -31,7 +31,10 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 }
 
 func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
-	driver := &DockerDriver{Ctx: &b.config.ctx, Ui: ui}
+	driver, err := NewDriver(b.config.Driver, ui, &b.config.ctx)
+	if err != nil {
+		return nil, err
+	}
 	if err := driver.Verify(); err != nil {
 		return nil, err
 	}
@@ -40,7 +43,7 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("[DEBUG] Docker version: %s", version.String())
+	log.Printf("[DEBUG] %s version: %s", b.config.Driver, version.String())
 
 	steps := []multistep.Step{
 		&StepTempDir{},
@@ -105,7 +108,7 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Driver:         driver,
 		}
 	} else {
-		artifact = &ExportArtifact{path: b.config.ExportPath}
+		artifact = &ExportArtifact{path: b.config.ExportPath, driver: b.config.Driver}
 	}
 
 	return artifact, nil
@@ -2,6 +2,7 @@ package docker
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -27,11 +28,31 @@ type Communicator struct {
 	ContainerUser string
 	lock          sync.Mutex
 	EntryPoint    []string
+
+	// When set, commands and file transfers go through the engine API
+	// rather than the docker CLI.
+	engine containerEngine
+}
+
+// containerEngine is implemented by drivers that can run commands in a
+// container and copy files in and out of it themselves.
+type containerEngine interface {
+	Exec(id string, user string, tty bool, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	CopyToContainer(id, dir string, archive io.Reader) error
+	CopyFromContainer(id, path string) (io.ReadCloser, error)
+	ContainerPathExists(id, path string) (bool, error)
+	ContainerUser(id string) (string, error)
 }
 
 var _ packer.Communicator = new(Communicator)
 
 func (c *Communicator) Start(ctx context.Context, remote *packer.RemoteCmd) error {
+	if c.engine != nil {
+		cmd := append(append([]string{}, c.EntryPoint...), fmt.Sprintf("(%s)", remote.Command))
+		go c.runEngine(remote, cmd)
+		return nil
+	}
+
 	dockerArgs := []string{
 		"exec",
 		"-i",
@@ -49,7 +70,7 @@ func (c *Communicator) Start(ctx context.Context, remote *packer.RemoteCmd) erro
 			append([]string{"-u", c.Config.ExecUser}, dockerArgs[2:]...)...)
 	}
 
-	cmd := exec.Command("docker", dockerArgs...)
+	cmd := exec.Command(c.Config.executable(), dockerArgs...)
 
 	var (
 		stdin_w io.WriteCloser
@@ -111,7 +132,11 @@ func (c *Communicator) uploadFile(dst string, src io.Reader, fi *os.FileInfo) er
 	// command format: docker cp /path/to/infile containerid:/path/to/outfile
 	log.Printf("Copying to %s on container %s.", dst, c.ContainerID)
 
-	localCmd := exec.Command("docker", "cp", "-",
+	if c.engine != nil {
+		return c.uploadEngine(dst, src, fi)
+	}
+
+	localCmd := exec.Command(c.Config.executable(), "cp", "-",
 		fmt.Sprintf("%s:%s", c.ContainerID, filepath.Dir(dst)))
 
 	stderrP, err := localCmd.StderrPipe()
@@ -186,6 +211,10 @@ func (c *Communicator) UploadDir(dst string, src string, exclude []string) error
 
 	*/
 
+	if c.engine != nil {
+		return c.uploadDirEngine(dst, src)
+	}
+
 	var dockerSource string
 
 	if src[len(src)-1] == '/' {
@@ -195,7 +224,7 @@ func (c *Communicator) UploadDir(dst string, src string, exclude []string) error
 	}
 
 	// Make the directory, then copy into it
-	localCmd := exec.Command("docker", "cp", dockerSource, fmt.Sprintf("%s:%s", c.ContainerID, dst))
+	localCmd := exec.Command(c.Config.executable(), "cp", dockerSource, fmt.Sprintf("%s:%s", c.ContainerID, dst))
 
 	stderrP, err := localCmd.StderrPipe()
 	if err != nil {
@@ -226,7 +255,11 @@ func (c *Communicator) UploadDir(dst string, src string, exclude []string) error
 // cp to write to stdout, and then copy the stream to our destination io.Writer.
 func (c *Communicator) Download(src string, dst io.Writer) error {
 	log.Printf("Downloading file from container: %s:%s", c.ContainerID, src)
-	localCmd := exec.Command("docker", "cp", fmt.Sprintf("%s:%s", c.ContainerID, src), "-")
+	if c.engine != nil {
+		return c.downloadEngine(src, dst)
+	}
+
+	localCmd := exec.Command(c.Config.executable(), "cp", fmt.Sprintf("%s:%s", c.ContainerID, src), "-")
 
 	pipe, err := localCmd.StdoutPipe()
 	if err != nil {
@@ -346,8 +379,22 @@ func (c *Communicator) fixDestinationOwner(destination string) error {
 		owner = "root"
 	}
 
+	if c.engine != nil {
+		var output bytes.Buffer
+		status, err := c.engine.Exec(c.ContainerID, "root", false,
+			[]string{"/bin/sh", "-c", fmt.Sprintf("chown -R %s %s", owner, destination)},
+			nil, &output, &output)
+		if err == nil && status != 0 {
+			err = fmt.Errorf("exit status %d", status)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to set owner of the uploaded file: %s, %s", err, output.String())
+		}
+		return nil
+	}
+
 	chownArgs := []string{
-		"docker", "exec", "--user", "root", c.ContainerID, "/bin/sh", "-c",
+		c.Config.executable(), "exec", "--user", "root", c.ContainerID, "/bin/sh", "-c",
 		fmt.Sprintf("chown -R %s %s", owner, destination),
 	}
 	if output, err := exec.Command(chownArgs[0], chownArgs[1:]...).CombinedOutput(); err != nil {
@@ -356,3 +403,163 @@ func (c *Communicator) fixDestinationOwner(destination string) error {
 
 	return nil
 }
+
+// runEngine runs the command through the engine API and blocks until
+// completion.
+func (c *Communicator) runEngine(remote *packer.RemoteCmd, cmd []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stdout, stderr := remote.Stdout, remote.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	log.Printf("Executing %s:", strings.Join(cmd, " "))
+	exitStatus, err := c.engine.Exec(c.ContainerID, c.Config.ExecUser, c.Config.Pty,
+		cmd, remote.Stdin, stdout, stderr)
+	if err != nil {
+		log.Printf("Error executing: %s", err)
+		exitStatus = 254
+	}
+
+	remote.SetExited(exitStatus)
+}
+
+// uploadEngine sends the file as a single entry archive to the directory
+// of dst.
+func (c *Communicator) uploadEngine(dst string, src io.Reader, fi *os.FileInfo) error {
+	header, err := tar.FileInfoHeader(*fi, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(dst)
+
+	r, w := io.Pipe()
+	go func() {
+		archive := tar.NewWriter(w)
+		err := archive.WriteHeader(header)
+		if err == nil {
+			_, err = io.Copy(archive, src)
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	if err := c.engine.CopyToContainer(c.ContainerID, filepath.Dir(dst), r); err != nil {
+		r.CloseWithError(err)
+		return fmt.Errorf("Failed to upload to '%s' in container: %s", dst, err)
+	}
+
+	return c.fixDestinationOwner(dst)
+}
+
+// uploadDirEngine archives the directory and extracts it in the container,
+// following the same rules as `docker cp` in UploadDir.
+func (c *Communicator) uploadDirEngine(dst string, src string) error {
+	exists, err := c.engine.ContainerPathExists(c.ContainerID, dst)
+	if err != nil {
+		return err
+	}
+
+	// The archive is extracted in dir, with its content under prefix.
+	dir, prefix := filepath.Dir(dst), filepath.Base(dst)
+	if exists {
+		dir, prefix = dst, filepath.Base(src)
+		if strings.HasSuffix(src, "/") {
+			prefix = ""
+		}
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(tarDirectory(w, src, prefix))
+	}()
+
+	if err := c.engine.CopyToContainer(c.ContainerID, dir, r); err != nil {
+		r.CloseWithError(err)
+		return fmt.Errorf("Failed to upload to '%s' in container: %s", dst, err)
+	}
+
+	return c.fixDestinationOwner(dst)
+}
+
+// tarDirectory writes the content of the directory src to w as a tar
+// archive, with every entry under prefix.
+func tarDirectory(w io.Writer, src string, prefix string) error {
+	archive := tar.NewWriter(w)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+		if name == "." {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(archive, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func (c *Communicator) downloadEngine(src string, dst io.Writer) error {
+	r, err := c.engine.CopyFromContainer(c.ContainerID, src)
+	if err != nil {
+		return fmt.Errorf("Failed to download '%s' from container: %s", src, err)
+	}
+	defer r.Close()
+
+	archive := tar.NewReader(r)
+	if _, err := archive.Next(); err != nil {
+		return fmt.Errorf("Failed to read header from tar stream: %s", err)
+	}
+
+	numBytes, err := io.Copy(dst, archive)
+	if err != nil {
+		return fmt.Errorf("Failed to pipe download: %s", err)
+	}
+	log.Printf("Copied %d bytes for %s", numBytes, src)
+
+	return nil
+}
@@ -18,9 +18,16 @@ var (
 	errArtifactNotUsed     = fmt.Errorf("No instructions given for handling the artifact; expected commit, discard, or export_path")
 	errArtifactUseConflict = fmt.Errorf("Cannot specify more than one of commit, discard, and export_path")
 	errExportPathNotFile   = fmt.Errorf("export_path must be a file, not a directory")
+	errExportFormatNoPath  = fmt.Errorf("export_format and export_tag can only be used with export_path")
 	errImageNotSpecified   = fmt.Errorf("Image must be specified")
 )
 
+const (
+	DriverDocker    = "docker"
+	DriverDockerAPI = "docker-api"
+	DriverPodman    = "podman"
+)
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 	Comm                communicator.Config `mapstructure:",squash"`
@@ -42,12 +49,33 @@ type Config struct {
 	// the [artifice
 	// post-processor](https://www.packer.io/docs/post-processors/artifice.html).
 	Discard bool `mapstructure:"discard" required:"true"`
+	// The container engine used to run the build, one of `docker`,
+	// `docker-api` or `podman`. This defaults to `docker`, which runs the
+	// docker CLI. `docker-api` talks to the Docker Engine API directly, using
+	// `DOCKER_HOST`, `DOCKER_TLS_VERIFY` and `DOCKER_CERT_PATH` like the CLI
+	// does, and doesn't need the docker binary to build Linux containers.
+	// With `podman`, containers are run with the podman CLI, which doesn't
+	// need a daemon. When podman runs rootless, the container is started with
+	// `--userns=keep-id` so that the files Packer shares with it are owned by
+	// your user, and volumes are relabelled for SELinux.
+	Driver string `mapstructure:"driver" required:"false"`
 	// Username (UID) to run remote commands with. You can also set the group
 	// name/ID if you want: (UID or UID:GID). You may need this if you get
 	// permission errors trying to run the shell or other provisioners.
 	ExecUser string `mapstructure:"exec_user" required:"false"`
 	// The path where the final container will be exported as a tar file.
 	ExportPath string `mapstructure:"export_path" required:"true"`
+	// The format of the file written to `export_path`. `tar`, the default, is
+	// the flat root filesystem produced by `docker export`. `oci` writes an
+	// OCI image layout archive and `docker-archive` writes a tarball that can
+	// be loaded with `docker load`. Both image formats include the `changes`
+	// as image config, so they can be loaded by podman, containerd or Docker
+	// without another commit. Note that the image config of the base image,
+	// such as its `PATH`, is not carried over.
+	ExportFormat string `mapstructure:"export_format" required:"false"`
+	// The image name and tag recorded in an `oci` or `docker-archive` export,
+	// for example `myorg/app:1.0`. Defaults to `latest` if no tag is given.
+	ExportTag string `mapstructure:"export_tag" required:"false"`
 	// The base image for the Docker container that will be started. This image
 	// will be pulled from the Docker registry if it doesn't already exist.
 	Image string `mapstructure:"image" required:"true"`
@@ -167,6 +195,20 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 		errs = packer.MultiErrorAppend(errs, errArtifactUseConflict)
 	}
 
+	switch c.Driver {
+	case "":
+		c.Driver = DriverDocker
+	case DriverDocker, DriverDockerAPI, DriverPodman:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf(
+			"driver must be one of: %s, %s, %s", DriverDocker, DriverDockerAPI, DriverPodman))
+	}
+
+	if c.Driver == DriverPodman && c.WindowsContainer {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf(
+			"windows_container can't be used with the %s driver", DriverPodman))
+	}
+
 	if c.ExportPath == "" && !c.Commit && !c.Discard {
 		errs = packer.MultiErrorAppend(errs, errArtifactNotUsed)
 	}
@@ -177,6 +219,26 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 		}
 	}
 
+	switch c.ExportFormat {
+	case "":
+		c.ExportFormat = ExportFormatTar
+	case ExportFormatTar, ExportFormatOCI, ExportFormatDockerArchive:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf(
+			"export_format must be one of: %s, %s, %s",
+			ExportFormatTar, ExportFormatOCI, ExportFormatDockerArchive))
+	}
+
+	if c.ExportPath == "" && (c.ExportFormat != ExportFormatTar || c.ExportTag != "") {
+		errs = packer.MultiErrorAppend(errs, errExportFormatNoPath)
+	}
+
+	if c.ExportFormat == ExportFormatOCI || c.ExportFormat == ExportFormatDockerArchive {
+		if _, err := ParseChanges(c.Changes); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
 	if c.ContainerDir == "" {
 		if c.WindowsContainer {
 			c.ContainerDir = "c:/packer-files"
@@ -195,3 +257,12 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 
 	return c, nil, nil
 }
+
+// executable returns the name of the CLI used to talk to the container
+// engine.
+func (c *Config) executable() string {
+	if c.Driver == DriverPodman {
+		return "podman"
+	}
+	return "docker"
+}
@@ -108,6 +108,70 @@ func TestConfigPrepare_exportDiscard(t *testing.T) {
 	testConfigOk(t, warns, errs)
 }
 
+func TestConfigPrepare_exportFormat(t *testing.T) {
+	raw := testConfig()
+
+	// Default
+	c, warns, errs := NewConfig(raw)
+	testConfigOk(t, warns, errs)
+	if c.ExportFormat != ExportFormatTar {
+		t.Fatalf("bad export format: %s", c.ExportFormat)
+	}
+
+	// Image archive with changes
+	raw["export_format"] = "oci"
+	raw["changes"] = []string{"ENV FOO=bar", "ENTRYPOINT [\"/app\"]"}
+	_, warns, errs = NewConfig(raw)
+	testConfigOk(t, warns, errs)
+
+	// Changes that can't be turned into image config
+	raw["changes"] = []string{"RUN make"}
+	_, warns, errs = NewConfig(raw)
+	testConfigErr(t, warns, errs)
+
+	// Bad format
+	delete(raw, "changes")
+	raw["export_format"] = "qcow2"
+	_, warns, errs = NewConfig(raw)
+	testConfigErr(t, warns, errs)
+
+	// Image archive without export path
+	raw["export_format"] = "docker-archive"
+	raw["commit"] = true
+	delete(raw, "export_path")
+	_, warns, errs = NewConfig(raw)
+	testConfigErr(t, warns, errs)
+}
+
+func TestConfigPrepare_driver(t *testing.T) {
+	raw := testConfig()
+
+	// Default
+	c, warns, errs := NewConfig(raw)
+	testConfigOk(t, warns, errs)
+	if c.Driver != DriverDocker {
+		t.Fatalf("bad driver: %s", c.Driver)
+	}
+
+	raw["driver"] = "podman"
+	c, warns, errs = NewConfig(raw)
+	testConfigOk(t, warns, errs)
+	if c.executable() != "podman" {
+		t.Fatalf("bad executable: %s", c.executable())
+	}
+
+	// Podman doesn't run windows containers
+	raw["windows_container"] = true
+	_, warns, errs = NewConfig(raw)
+	testConfigErr(t, warns, errs)
+
+	// Bad driver
+	delete(raw, "windows_container")
+	raw["driver"] = "lxc"
+	_, warns, errs = NewConfig(raw)
+	testConfigErr(t, warns, errs)
+}
+
 func TestConfigPrepare_image(t *testing.T) {
 	raw := testConfig()
 
@@ -2,8 +2,11 @@ package docker
 
 import (
 	"io"
+	"os"
 
 	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
 )
 
 // Driver is the interface that has to be implemented to communicate with
@@ -22,6 +25,10 @@ type Driver interface {
 	// Import imports a container from a tar file
 	Import(path string, changes []string, repo string) (string, error)
 
+	// InspectImage returns the platform and the runtime configuration of the
+	// image with the given ID.
+	InspectImage(id string) (*ImageInfo, error)
+
 	// IPAddress returns the address of the container that can be used
 	// for external access.
 	IPAddress(id string) (string, error)
@@ -62,6 +69,53 @@ type Driver interface {
 	Version() (*version.Version, error)
 }
 
+// NewDriver creates the driver with the given name, one of the values of the
+// driver option. An empty name is the docker CLI driver.
+func NewDriver(name string, ui packer.Ui, ctx *interpolate.Context) (Driver, error) {
+	switch name {
+	case DriverDockerAPI:
+		return NewEngineDriver(ui, ctx)
+	case DriverPodman:
+		return &PodmanDriver{Ctx: ctx, Ui: ui, Rootless: os.Geteuid() != 0}, nil
+	default:
+		return &DockerDriver{Ctx: ctx, Ui: ui}, nil
+	}
+}
+
+// driverName returns the name of the driver option that creates d.
+func driverName(d Driver) string {
+	switch d.(type) {
+	case *EngineDriver:
+		return DriverDockerAPI
+	case *PodmanDriver:
+		return DriverPodman
+	default:
+		return DriverDocker
+	}
+}
+
+// ArtifactDriver returns the driver the post-processors use for the images
+// of artifact. That is the driver of an ImportArtifact, or else the driver
+// named by the "driver" state of the artifact, which is still there when
+// the artifact comes from another plugin. Other artifacts use the docker
+// CLI driver.
+func ArtifactDriver(artifact packer.Artifact, ui packer.Ui, ctx *interpolate.Context) (Driver, error) {
+	if a, ok := artifact.(*ImportArtifact); ok && a.Driver != nil {
+		return a.Driver, nil
+	}
+
+	name, _ := artifact.State("driver").(string)
+	return NewDriver(name, ui, ctx)
+}
+
+// ImageInfo is the part of an inspected image that is carried over to the
+// image archives written by the builder.
+type ImageInfo struct {
+	Architecture string
+	Os           string
+	Config       ImageConfig
+}
+
 // ContainerConfig is the configuration used to start a container.
 type ContainerConfig struct {
 	Image      string
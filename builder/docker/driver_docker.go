@@ -142,6 +142,18 @@ func (d *DockerDriver) Import(path string, changes []string, repo string) (strin
 	return strings.TrimSpace(stdout.String()), nil
 }
 
+func (d *DockerDriver) InspectImage(id string) (*ImageInfo, error) {
+	var stderr, stdout bytes.Buffer
+	cmd := exec.Command("docker", "image", "inspect", id)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error inspecting image: %s\n\nStderr: %s", err, stderr.String())
+	}
+
+	return parseImageInspect(stdout.Bytes())
+}
+
 func (d *DockerDriver) IPAddress(id string) (string, error) {
 	var stderr, stdout bytes.Buffer
 	cmd := exec.Command(
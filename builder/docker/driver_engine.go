@@ -0,0 +1,732 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// EngineDriver is a Driver that talks to the Docker Engine API directly
+// instead of running the docker CLI.
+type EngineDriver struct {
+	Ui  packer.Ui
+	Ctx *interpolate.Context
+
+	client *engineClient
+
+	// The X-Registry-Auth header set by Login and sent with pulls and
+	// pushes until Logout.
+	auth string
+
+	l sync.Mutex
+}
+
+// NewEngineDriver creates a driver for the engine configured in the
+// environment, with DOCKER_HOST and the related variables.
+func NewEngineDriver(ui packer.Ui, ctx *interpolate.Context) (*EngineDriver, error) {
+	client, err := newEngineClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EngineDriver{Ui: ui, Ctx: ctx, client: client}, nil
+}
+
+func (d *EngineDriver) Commit(id string, author string, changes []string, message string) (string, error) {
+	query := url.Values{"container": {id}}
+	if author != "" {
+		query.Set("author", author)
+	}
+	if message != "" {
+		query.Set("comment", message)
+	}
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+
+	log.Printf("Committing container %s", id)
+	var resp struct {
+		ID string `json:"Id"`
+	}
+	if err := d.client.doJSON("POST", "/commit", query, nil, &resp); err != nil {
+		return "", fmt.Errorf("Error committing container: %s", err)
+	}
+
+	return resp.ID, nil
+}
+
+func (d *EngineDriver) DeleteImage(id string) error {
+	log.Printf("Deleting image: %s", id)
+	if err := d.client.doJSON("DELETE", "/images/"+id, nil, nil, nil); err != nil {
+		return fmt.Errorf("Error deleting image: %s", err)
+	}
+
+	return nil
+}
+
+// stream copies the body of a GET request to dst.
+func (d *EngineDriver) stream(apiPath string, dst io.Writer) error {
+	resp, err := d.client.do("GET", apiPath, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
+
+func (d *EngineDriver) Export(id string, dst io.Writer) error {
+	log.Printf("Exporting container: %s", id)
+	if err := d.stream("/containers/"+id+"/export", dst); err != nil {
+		return fmt.Errorf("Error exporting: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) Import(path string, changes []string, repo string) (string, error) {
+	name, tag := splitImageTag(repo)
+	query := url.Values{"fromSrc": {"-"}, "repo": {name}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+
+	// There should be only one artifact of the Docker builder
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	log.Printf("Importing tarball %s as %s", path, repo)
+	resp, err := d.client.do("POST", "/images/create", query, nil, file)
+	if err != nil {
+		return "", fmt.Errorf("Error importing container: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// The ID of the new image is the status of the last message.
+	var id string
+	err = readJSONMessages(resp.Body, func(msg *jsonMessage) {
+		id = msg.Status
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error importing container: %s", err)
+	}
+
+	return strings.TrimSpace(id), nil
+}
+
+func (d *EngineDriver) InspectImage(id string) (*ImageInfo, error) {
+	var info ImageInfo
+	if err := d.client.doJSON("GET", "/images/"+id+"/json", nil, nil, &info); err != nil {
+		return nil, fmt.Errorf("Error inspecting image: %s", err)
+	}
+
+	return &info, nil
+}
+
+func (d *EngineDriver) IPAddress(id string) (string, error) {
+	var container struct {
+		NetworkSettings struct {
+			IPAddress string
+		}
+	}
+	if err := d.client.doJSON("GET", "/containers/"+id+"/json", nil, nil, &container); err != nil {
+		return "", err
+	}
+
+	return container.NetworkSettings.IPAddress, nil
+}
+
+func (d *EngineDriver) Login(repo, user, pass string) error {
+	d.l.Lock()
+
+	auth := map[string]string{
+		"username":      user,
+		"password":      pass,
+		"serveraddress": repo,
+	}
+	if err := d.client.doJSON("POST", "/auth", nil, auth, nil); err != nil {
+		d.l.Unlock()
+		return fmt.Errorf("Error logging in: %s", err)
+	}
+
+	data, err := json.Marshal(auth)
+	if err != nil {
+		d.l.Unlock()
+		return err
+	}
+	d.auth = base64.URLEncoding.EncodeToString(data)
+
+	return nil
+}
+
+func (d *EngineDriver) Logout(repo string) error {
+	d.auth = ""
+	d.l.Unlock()
+	return nil
+}
+
+func (d *EngineDriver) authHeader() http.Header {
+	if d.auth == "" {
+		return nil
+	}
+	return http.Header{"X-Registry-Auth": {d.auth}}
+}
+
+func (d *EngineDriver) Pull(image string) error {
+	name, tag := splitImageTag(image)
+	query := url.Values{"fromImage": {name}}
+	// Without a tag the engine pulls every tag of the repository.
+	if tag == "" && !strings.Contains(name, "@") {
+		tag = "latest"
+	}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+
+	resp, err := d.client.do("POST", "/images/create", query, d.authHeader(), nil)
+	if err != nil {
+		return fmt.Errorf("Error pulling image: %s", err)
+	}
+	defer resp.Body.Close()
+
+	progress := newPullProgress(d.Ui)
+	defer progress.Close()
+	err = readJSONMessages(resp.Body, func(msg *jsonMessage) {
+		switch {
+		case msg.Status == "Downloading" && msg.Progress != nil && msg.Progress.Total > 0:
+			progress.Update(msg.ID, msg.Progress.Current, msg.Progress.Total)
+		case msg.Status == "Download complete":
+			progress.Finish(msg.ID)
+		case msg.Progress == nil || msg.Progress.Total == 0:
+			d.Ui.Message(msg.String())
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Error pulling image: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) Push(name string) error {
+	repo, tag := splitImageTag(name)
+	query := url.Values{}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+
+	// The engine requires an auth header on pushes, even if it is empty.
+	header := d.authHeader()
+	if header == nil {
+		header = http.Header{"X-Registry-Auth": {base64.URLEncoding.EncodeToString([]byte("{}"))}}
+	}
+
+	resp, err := d.client.do("POST", "/images/"+repo+"/push", query, header, nil)
+	if err != nil {
+		return fmt.Errorf("Error pushing image: %s", err)
+	}
+	defer resp.Body.Close()
+
+	err = readJSONMessages(resp.Body, func(msg *jsonMessage) {
+		if msg.Progress == nil || msg.Progress.Total == 0 {
+			d.Ui.Message(msg.String())
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Error pushing image: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) SaveImage(id string, dst io.Writer) error {
+	log.Printf("Exporting image: %s", id)
+	if err := d.stream("/images/"+id+"/get", dst); err != nil {
+		return fmt.Errorf("Error exporting: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) StartContainer(config *ContainerConfig) (string, error) {
+	// Build up the template data
+	var tplData startContainerTemplate
+	tplData.Image = config.Image
+	ictx := *d.Ctx
+	ictx.Data = &tplData
+
+	args := make([]string, 0, len(config.RunCommand))
+	for _, v := range config.RunCommand {
+		v, err := interpolate.Render(v, &ictx)
+		if err != nil {
+			return "", err
+		}
+
+		args = append(args, v)
+	}
+	d.Ui.Message(fmt.Sprintf(
+		"Run command: docker run %s", strings.Join(args, " ")))
+
+	create, err := parseRunCommand(args)
+	if err != nil {
+		return "", err
+	}
+	if config.Privileged {
+		create.HostConfig.Privileged = true
+	}
+	for host, guest := range config.Volumes {
+		create.HostConfig.Binds = append(create.HostConfig.Binds, fmt.Sprintf("%s:%s", host, guest))
+	}
+
+	query := url.Values{}
+	if create.name != "" {
+		query.Set("name", create.name)
+	}
+
+	log.Printf("Creating container from image %s", create.Image)
+	var resp struct {
+		ID       string `json:"Id"`
+		Warnings []string
+	}
+	if err := d.client.doJSON("POST", "/containers/create", query, create, &resp); err != nil {
+		return "", fmt.Errorf("Error creating container: %s", err)
+	}
+	for _, warning := range resp.Warnings {
+		d.Ui.Message(warning)
+	}
+
+	if err := d.client.doJSON("POST", "/containers/"+resp.ID+"/start", nil, nil, nil); err != nil {
+		return "", fmt.Errorf("Error starting container: %s", err)
+	}
+
+	return resp.ID, nil
+}
+
+func (d *EngineDriver) StopContainer(id string) error {
+	return d.client.doJSON("POST", "/containers/"+id+"/stop", nil, nil, nil)
+}
+
+func (d *EngineDriver) KillContainer(id string) error {
+	if err := d.client.doJSON("POST", "/containers/"+id+"/kill", nil, nil, nil); err != nil {
+		return err
+	}
+
+	return d.client.doJSON("DELETE", "/containers/"+id, nil, nil, nil)
+}
+
+func (d *EngineDriver) TagImage(id string, repo string, force bool) error {
+	name, tag := splitImageTag(repo)
+	query := url.Values{"repo": {name}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	if force {
+		query.Set("force", "1")
+	}
+
+	if err := d.client.doJSON("POST", "/images/"+id+"/tag", query, nil, nil); err != nil {
+		return fmt.Errorf("Error tagging image: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) Verify() error {
+	if err := d.client.doJSON("GET", "/_ping", nil, nil, nil); err != nil {
+		return fmt.Errorf("Error connecting to the Docker Engine API: %s", err)
+	}
+
+	return nil
+}
+
+func (d *EngineDriver) Version() (*version.Version, error) {
+	var resp struct {
+		Version string
+	}
+	if err := d.client.doJSON("GET", "/version", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return version.NewVersion(resp.Version)
+}
+
+// CopyToContainer extracts the tar archive into the directory dir in the
+// container.
+func (d *EngineDriver) CopyToContainer(id, dir string, archive io.Reader) error {
+	query := url.Values{"path": {dir}}
+	return d.client.doJSON("PUT", "/containers/"+id+"/archive", query, archive, nil)
+}
+
+// CopyFromContainer returns a tar archive of the file or directory at path
+// in the container.
+func (d *EngineDriver) CopyFromContainer(id, path string) (io.ReadCloser, error) {
+	query := url.Values{"path": {path}}
+	resp, err := d.client.do("GET", "/containers/"+id+"/archive", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// ContainerPathExists reports whether path exists in the container.
+func (d *EngineDriver) ContainerPathExists(id, path string) (bool, error) {
+	query := url.Values{"path": {path}}
+	resp, err := d.client.do("HEAD", "/containers/"+id+"/archive", query, nil, nil)
+	if engineErr, ok := err.(*EngineError); ok && engineErr.NotFound() {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// ContainerUser returns the user the commands of the container run as by
+// default.
+func (d *EngineDriver) ContainerUser(id string) (string, error) {
+	var container struct {
+		Config struct {
+			User string
+		}
+	}
+	if err := d.client.doJSON("GET", "/containers/"+id+"/json", nil, nil, &container); err != nil {
+		return "", fmt.Errorf("Failed to inspect the container: %s", err)
+	}
+
+	return container.Config.User, nil
+}
+
+// Exec runs cmd in the container and returns its exit status. The output is
+// written to stdout and stderr, which are the same stream if tty is set.
+func (d *EngineDriver) Exec(id string, user string, tty bool, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	create := map[string]interface{}{
+		"AttachStdin":  stdin != nil,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          tty,
+		"User":         user,
+		"Cmd":          cmd,
+	}
+	var exec struct {
+		ID string `json:"Id"`
+	}
+	if err := d.client.doJSON("POST", "/containers/"+id+"/exec", nil, create, &exec); err != nil {
+		return 0, err
+	}
+
+	conn, err := d.client.hijack("POST", "/exec/"+exec.ID+"/start",
+		map[string]interface{}{"Detach": false, "Tty": tty})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			conn.CloseWrite()
+		}()
+	}
+
+	if tty {
+		_, err = io.Copy(stdout, conn)
+	} else {
+		err = demuxStream(conn, stdout, stderr)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var inspect struct {
+		ExitCode int
+	}
+	if err := d.client.doJSON("GET", "/exec/"+exec.ID+"/json", nil, nil, &inspect); err != nil {
+		return 0, err
+	}
+
+	return inspect.ExitCode, nil
+}
+
+// demuxStream splits the output of a container without a TTY, where each
+// frame is prefixed by a header with the stream it belongs to and its size.
+func demuxStream(r io.Reader, stdout, stderr io.Writer) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if w == nil {
+			w = ioutil.Discard
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// splitImageTag splits an image reference into the repository and the tag,
+// which is empty if the reference doesn't have one.
+func splitImageTag(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
+
+// jsonMessage is a message in the progress stream of a pull, push or import.
+type jsonMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress *struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+func (m *jsonMessage) String() string {
+	if m.ID == "" {
+		return m.Status
+	}
+	return fmt.Sprintf("%s: %s", m.ID, m.Status)
+}
+
+// readJSONMessages calls fn for every message in the stream, and returns
+// the first error reported by the engine.
+func readJSONMessages(r io.Reader, fn func(*jsonMessage)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg jsonMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		fn(&msg)
+	}
+}
+
+// pullProgress shows the download of each layer as a progress bar. The bars
+// track pipes that are fed as many bytes as the engine reports downloaded.
+type pullProgress struct {
+	ui     packer.Ui
+	layers map[string]*layerProgress
+}
+
+type layerProgress struct {
+	w       *io.PipeWriter
+	done    chan struct{}
+	current int64
+}
+
+func newPullProgress(ui packer.Ui) *pullProgress {
+	return &pullProgress{ui: ui, layers: make(map[string]*layerProgress)}
+}
+
+func (p *pullProgress) Update(id string, current, total int64) {
+	l, ok := p.layers[id]
+	if !ok {
+		r, w := io.Pipe()
+		l = &layerProgress{w: w, done: make(chan struct{})}
+		tracked := p.ui.TrackProgress(id, 0, total, r)
+		go func() {
+			io.Copy(ioutil.Discard, tracked)
+			tracked.Close()
+			close(l.done)
+		}()
+		p.layers[id] = l
+	}
+
+	if current > l.current {
+		io.CopyN(l.w, zeroReader{}, current-l.current)
+		l.current = current
+	}
+}
+
+func (p *pullProgress) Finish(id string) {
+	l, ok := p.layers[id]
+	if !ok {
+		return
+	}
+	l.w.Close()
+	<-l.done
+	delete(p.layers, id)
+}
+
+func (p *pullProgress) Close() {
+	for id := range p.layers {
+		p.Finish(id)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// containerCreate is the body of a container create request, built from
+// the arguments of `docker run`.
+type containerCreate struct {
+	Image      string
+	Cmd        []string `json:",omitempty"`
+	Entrypoint []string `json:",omitempty"`
+	Env        []string `json:",omitempty"`
+	User       string   `json:",omitempty"`
+	WorkingDir string   `json:",omitempty"`
+	Hostname   string   `json:",omitempty"`
+	Labels     map[string]string
+	Tty        bool
+	OpenStdin  bool
+	HostConfig struct {
+		Binds       []string `json:",omitempty"`
+		Privileged  bool
+		AutoRemove  bool
+		NetworkMode string `json:",omitempty"`
+	}
+
+	name string
+}
+
+// parseRunCommand turns the arguments of `docker run` into a container
+// create request. Only the options commonly used in run_command are
+// supported.
+func parseRunCommand(args []string) (*containerCreate, error) {
+	c := &containerCreate{Labels: make(map[string]string)}
+
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			if arg == "--" {
+				if len(args) == 0 {
+					return nil, fmt.Errorf("run_command is missing the image")
+				}
+				arg, args = args[0], args[1:]
+			}
+			c.Image = arg
+			c.Cmd = args
+			break
+		}
+
+		// Split --flag=value and take the value from the next argument
+		// for flags that need one.
+		name, value, hasValue := arg, "", false
+		if i := strings.Index(arg, "="); i > 0 {
+			name, value, hasValue = arg[:i], arg[i+1:], true
+		}
+		needValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if len(args) == 0 {
+				return "", fmt.Errorf("run_command option %s needs a value", name)
+			}
+			v := args[0]
+			args = args[1:]
+			return v, nil
+		}
+
+		var err error
+		switch name {
+		case "-d", "--detach":
+		case "-i", "--interactive":
+			c.OpenStdin = true
+		case "-t", "--tty":
+			c.Tty = true
+		case "--privileged":
+			c.HostConfig.Privileged = true
+		case "--rm":
+			c.HostConfig.AutoRemove = true
+		case "--entrypoint":
+			var v string
+			v, err = needValue()
+			c.Entrypoint = []string{v}
+		case "-e", "--env":
+			var v string
+			v, err = needValue()
+			c.Env = append(c.Env, v)
+		case "-u", "--user":
+			c.User, err = needValue()
+		case "-w", "--workdir":
+			c.WorkingDir, err = needValue()
+		case "-h", "--hostname":
+			c.Hostname, err = needValue()
+		case "--name":
+			c.name, err = needValue()
+		case "--network", "--net":
+			c.HostConfig.NetworkMode, err = needValue()
+		case "-v", "--volume":
+			var v string
+			v, err = needValue()
+			c.HostConfig.Binds = append(c.HostConfig.Binds, v)
+		case "-l", "--label":
+			var v string
+			v, err = needValue()
+			parts := strings.SplitN(v, "=", 2)
+			c.Labels[parts[0]] = ""
+			if len(parts) == 2 {
+				c.Labels[parts[0]] = parts[1]
+			}
+		default:
+			// Combined short options, such as -dit
+			if !strings.HasPrefix(arg, "--") && len(arg) > 2 && strings.Trim(arg[1:], "dit") == "" {
+				c.OpenStdin = c.OpenStdin || strings.Contains(arg, "i")
+				c.Tty = c.Tty || strings.Contains(arg, "t")
+				continue
+			}
+			return nil, fmt.Errorf(
+				"run_command option %s is not supported by the docker-api driver", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Image == "" {
+		return nil, fmt.Errorf("run_command is missing the image")
+	}
+	return c, nil
+}
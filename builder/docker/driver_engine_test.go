@@ -0,0 +1,421 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+func TestEngineDriver_impl(t *testing.T) {
+	var _ Driver = new(EngineDriver)
+	var _ containerEngine = new(EngineDriver)
+}
+
+// progressUi records the progress bars created by TrackProgress and the
+// number of bytes read through each of them.
+type progressUi struct {
+	packer.Ui
+
+	sync.Mutex
+	totals map[string]int64
+	read   map[string]int64
+}
+
+func (u *progressUi) TrackProgress(src string, _, total int64, stream io.ReadCloser) io.ReadCloser {
+	u.Lock()
+	u.totals[src] = total
+	u.Unlock()
+
+	return &countingReadCloser{stream, func(n int) {
+		u.Lock()
+		u.read[src] += int64(n)
+		u.Unlock()
+	}}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	count func(int)
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count(n)
+	return n, err
+}
+
+func testEngineDriver(t *testing.T, handler http.HandlerFunc) (*EngineDriver, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	client, err := newEngineClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return &EngineDriver{Ui: packer.TestUi(t), Ctx: &interpolate.Context{}, client: client}, server
+}
+
+func TestEngineDriver_Pull(t *testing.T) {
+	var auth string
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/auth":
+			w.Write([]byte(`{"Status":"Login Succeeded"}`))
+		case "/v1.24/images/create":
+			if r.URL.Query().Get("fromImage") != "ubuntu" || r.URL.Query().Get("tag") != "latest" {
+				t.Errorf("bad query: %s", r.URL.RawQuery)
+			}
+			auth = r.Header.Get("X-Registry-Auth")
+
+			enc := json.NewEncoder(w)
+			enc.Encode(map[string]interface{}{"status": "Pulling from library/ubuntu", "id": "latest"})
+			for _, current := range []int{100, 600, 1000} {
+				enc.Encode(map[string]interface{}{
+					"status":         "Downloading",
+					"id":             "abcd",
+					"progressDetail": map[string]int{"current": current, "total": 1000},
+				})
+			}
+			enc.Encode(map[string]interface{}{"status": "Download complete", "id": "abcd"})
+			enc.Encode(map[string]interface{}{"status": "Pull complete", "id": "abcd"})
+		default:
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+	})
+	defer server.Close()
+
+	ui := &progressUi{Ui: d.Ui, totals: map[string]int64{}, read: map[string]int64{}}
+	d.Ui = ui
+
+	if err := d.Login("registry.example.com", "user", "pass"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.Pull("ubuntu"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d.Logout("registry.example.com")
+
+	if ui.totals["abcd"] != 1000 || ui.read["abcd"] != 1000 {
+		t.Fatalf("bad progress: %v %v", ui.totals, ui.read)
+	}
+
+	data, err := base64.URLEncoding.DecodeString(auth)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var creds map[string]string
+	json.Unmarshal(data, &creds)
+	if creds["username"] != "user" || creds["serveraddress"] != "registry.example.com" {
+		t.Fatalf("bad auth: %s", data)
+	}
+}
+
+func TestEngineDriver_errors(t *testing.T) {
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/images/create":
+			json.NewEncoder(w).Encode(map[string]string{"error": "manifest unknown"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container: foo"}`))
+		}
+	})
+	defer server.Close()
+
+	err := d.StopContainer("foo")
+	engineErr, ok := err.(*EngineError)
+	if !ok || !engineErr.NotFound() || engineErr.Message != "No such container: foo" {
+		t.Fatalf("bad error: %#v", err)
+	}
+
+	exists, err := d.ContainerPathExists("foo", "/tmp")
+	if err != nil || exists {
+		t.Fatalf("path should not exist: %v", err)
+	}
+
+	if err := d.Pull("ubuntu:bad"); err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Fatalf("bad error: %v", err)
+	}
+
+	// Errors of the other requests keep the message of the engine
+	err = d.TagImage("foo", "bar:latest", false)
+	if err == nil || !strings.Contains(err.Error(), "No such container: foo") {
+		t.Fatalf("bad error: %v", err)
+	}
+	if _, err := d.Commit("foo", "", nil, ""); err == nil || !strings.Contains(err.Error(), "No such container: foo") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestEngineDriver_ContainerUser(t *testing.T) {
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.24/containers/c0ffee/json" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		w.Write([]byte(`{"Id":"c0ffee","Config":{"User":"packer"}}`))
+	})
+	defer server.Close()
+
+	user, err := d.ContainerUser("c0ffee")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if user != "packer" {
+		t.Fatalf("bad user: %s", user)
+	}
+}
+
+func TestEngineDriver_InspectImage(t *testing.T) {
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.24/images/ubuntu:18.04/json" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		w.Write([]byte(`{"Id":"sha256:c0ffee","Architecture":"arm64","Os":"linux","Config":{"Env":["PATH=/usr/bin"],"Cmd":["/bin/bash"]}}`))
+	})
+	defer server.Close()
+
+	info, err := d.InspectImage("ubuntu:18.04")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := &ImageInfo{
+		Architecture: "arm64",
+		Os:           "linux",
+		Config: ImageConfig{
+			Env: []string{"PATH=/usr/bin"},
+			Cmd: []string{"/bin/bash"},
+		},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestEngineDriver_StartContainer(t *testing.T) {
+	var create map[string]interface{}
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/containers/create":
+			json.NewDecoder(r.Body).Decode(&create)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"c0ffee"}`))
+		case "/v1.24/containers/c0ffee/start":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+	})
+	defer server.Close()
+
+	id, err := d.StartContainer(&ContainerConfig{
+		Image:      "ubuntu",
+		RunCommand: []string{"-d", "-i", "-t", "--entrypoint=/bin/sh", "--", "{{.Image}}"},
+		Volumes:    map[string]string{"/tmp/packer": "/packer-files"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if id != "c0ffee" {
+		t.Fatalf("bad id: %s", id)
+	}
+
+	if create["Image"] != "ubuntu" || create["Tty"] != true || create["OpenStdin"] != true {
+		t.Fatalf("bad create request: %#v", create)
+	}
+	if !reflect.DeepEqual(create["Entrypoint"], []interface{}{"/bin/sh"}) {
+		t.Fatalf("bad entrypoint: %#v", create["Entrypoint"])
+	}
+	hostConfig := create["HostConfig"].(map[string]interface{})
+	if !reflect.DeepEqual(hostConfig["Binds"], []interface{}{"/tmp/packer:/packer-files"}) {
+		t.Fatalf("bad binds: %#v", hostConfig["Binds"])
+	}
+}
+
+func TestEngineDriver_Exec(t *testing.T) {
+	d, server := testEngineDriver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.24/containers/c0ffee/exec":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"e1"}`))
+		case "/v1.24/exec/e1/start":
+			if r.Header.Get("Upgrade") != "tcp" {
+				t.Errorf("exec should upgrade the connection")
+			}
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("err: %s", err)
+				return
+			}
+			defer conn.Close()
+
+			buf.WriteString("HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			for _, frame := range []struct {
+				stream byte
+				data   string
+			}{{1, "hello "}, {2, "oops"}, {1, "world"}} {
+				header := make([]byte, 8)
+				header[0] = frame.stream
+				binary.BigEndian.PutUint32(header[4:], uint32(len(frame.data)))
+				buf.Write(header)
+				buf.WriteString(frame.data)
+			}
+			buf.Flush()
+		case "/v1.24/exec/e1/json":
+			w.Write([]byte(`{"ExitCode":3}`))
+		default:
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+	})
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	status, err := d.Exec("c0ffee", "", false, []string{"/bin/sh", "-c", "true"}, nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status != 3 {
+		t.Fatalf("bad exit status: %d", status)
+	}
+	if stdout.String() != "hello world" || stderr.String() != "oops" {
+		t.Fatalf("bad output: %q %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestParseRunCommand(t *testing.T) {
+	c, err := parseRunCommand([]string{
+		"-dit", "-e", "FOO=bar", "--user=nobody", "--name", "build", "-v", "/a:/b",
+		"ubuntu", "/bin/sh", "-c", "sleep 1"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.Image != "ubuntu" || !c.Tty || !c.OpenStdin || c.User != "nobody" || c.name != "build" {
+		t.Fatalf("bad: %#v", c)
+	}
+	if !reflect.DeepEqual(c.Cmd, []string{"/bin/sh", "-c", "sleep 1"}) {
+		t.Fatalf("bad cmd: %#v", c.Cmd)
+	}
+	if !reflect.DeepEqual(c.Env, []string{"FOO=bar"}) || !reflect.DeepEqual(c.HostConfig.Binds, []string{"/a:/b"}) {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	for _, args := range [][]string{
+		{"-d"},
+		{"--cap-add", "SYS_ADMIN", "ubuntu"},
+		{"-d", "--entrypoint"},
+	} {
+		if _, err := parseRunCommand(args); err == nil {
+			t.Fatalf("%v: should error", args)
+		}
+	}
+}
+
+func TestSplitImageTag(t *testing.T) {
+	cases := map[string][2]string{
+		"ubuntu":                         {"ubuntu", ""},
+		"ubuntu:18.04":                   {"ubuntu", "18.04"},
+		"localhost:5000/foo/bar":         {"localhost:5000/foo/bar", ""},
+		"localhost:5000/foo/bar:1.0":     {"localhost:5000/foo/bar", "1.0"},
+		"ubuntu@sha256:0123456789abcdef": {"ubuntu@sha256:0123456789abcdef", ""},
+	}
+	for image, expected := range cases {
+		name, tag := splitImageTag(image)
+		if name != expected[0] || tag != expected[1] {
+			t.Fatalf("%s: bad: %s %s", image, name, tag)
+		}
+	}
+}
+
+// mockEngine records the archives uploaded through the engine API.
+type mockEngine struct {
+	existing map[string]bool
+	dir      string
+	entries  []string
+}
+
+func (e *mockEngine) Exec(id string, user string, tty bool, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return 0, nil
+}
+
+func (e *mockEngine) CopyToContainer(id, dir string, archive io.Reader) error {
+	e.dir = dir
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e.entries = append(e.entries, hdr.Name)
+	}
+}
+
+func (e *mockEngine) CopyFromContainer(id, path string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (e *mockEngine) ContainerPathExists(id, path string) (bool, error) {
+	return e.existing[path], nil
+}
+
+func (e *mockEngine) ContainerUser(id string) (string, error) {
+	return "", nil
+}
+
+func TestCommunicator_UploadDirEngine(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	src := filepath.Join(td, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("hello"), 0644)
+
+	cases := []struct {
+		src      string
+		exists   bool
+		dir      string
+		expected []string
+	}{
+		// Like `docker cp`, a directory is copied into an existing
+		// destination, and otherwise becomes the destination.
+		{src, true, "/dst", []string{"src/", "src/sub/", "src/sub/file"}},
+		{src, false, "/", []string{"dst/", "dst/sub/", "dst/sub/file"}},
+		{src + "/", true, "/dst", []string{"sub/", "sub/file"}},
+	}
+	for _, tc := range cases {
+		engine := &mockEngine{existing: map[string]bool{"/dst": tc.exists}}
+		comm := &Communicator{
+			ContainerID: "c0ffee",
+			Config:      &Config{},
+			engine:      engine,
+		}
+		if err := comm.UploadDir("/dst", tc.src, nil); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		sort.Strings(engine.entries)
+		if engine.dir != tc.dir || !reflect.DeepEqual(engine.entries, tc.expected) {
+			t.Fatalf("%s (exists: %t): bad upload to %s: %v", tc.src, tc.exists, engine.dir, engine.entries)
+		}
+	}
+}
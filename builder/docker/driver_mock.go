@@ -23,6 +23,11 @@ type MockDriver struct {
 	ImportId     string
 	ImportErr    error
 
+	InspectImageCalled bool
+	InspectImageId     string
+	InspectImageInfo   *ImageInfo
+	InspectImageErr    error
+
 	IPAddressCalled bool
 	IPAddressID     string
 	IPAddressResult string
@@ -112,6 +117,12 @@ func (d *MockDriver) Import(path string, changes []string, repo string) (string,
 	return d.ImportId, d.ImportErr
 }
 
+func (d *MockDriver) InspectImage(id string) (*ImageInfo, error) {
+	d.InspectImageCalled = true
+	d.InspectImageId = id
+	return d.InspectImageInfo, d.InspectImageErr
+}
+
 func (d *MockDriver) IPAddress(id string) (string, error) {
 	d.IPAddressCalled = true
 	d.IPAddressID = id
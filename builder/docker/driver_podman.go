@@ -0,0 +1,281 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// PodmanDriver is a Driver that runs containers with the podman CLI instead
+// of the Docker daemon.
+type PodmanDriver struct {
+	Ui  packer.Ui
+	Ctx *interpolate.Context
+
+	// Rootless is true when podman runs as an unprivileged user. Containers
+	// then run in a user namespace, so the user and volumes are mapped to
+	// keep the shared files accessible from both sides.
+	Rootless bool
+
+	l sync.Mutex
+}
+
+// run runs podman with the given arguments, writing its output to stdout,
+// and includes podman's stderr in the returned error.
+func (d *PodmanDriver) run(stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("podman", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s\nStderr: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) DeleteImage(id string) error {
+	log.Printf("Deleting image: %s", id)
+	if err := d.run(nil, "rmi", id); err != nil {
+		return fmt.Errorf("Error deleting image: %s", err)
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) Commit(id string, author string, changes []string, message string) (string, error) {
+	// Without --quiet, podman prints the progress of writing the image to
+	// stdout along with the image ID.
+	args := []string{"commit", "--quiet"}
+	if author != "" {
+		args = append(args, "--author", author)
+	}
+	for _, change := range changes {
+		args = append(args, "--change", change)
+	}
+	if message != "" {
+		args = append(args, "--message", message)
+	}
+	args = append(args, id)
+
+	log.Printf("Committing container with args: %v", args)
+	var stdout bytes.Buffer
+	if err := d.run(&stdout, args...); err != nil {
+		return "", fmt.Errorf("Error committing container: %s", err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (d *PodmanDriver) Export(id string, dst io.Writer) error {
+	log.Printf("Exporting container: %s", id)
+	if err := d.run(dst, "export", id); err != nil {
+		return fmt.Errorf("Error exporting: %s", err)
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) Import(path string, changes []string, repo string) (string, error) {
+	args := []string{"import", "--quiet"}
+	for _, change := range changes {
+		args = append(args, "--change", change)
+	}
+	args = append(args, path, repo)
+
+	log.Printf("Importing tarball with args: %v", args)
+	var stdout bytes.Buffer
+	if err := d.run(&stdout, args...); err != nil {
+		return "", fmt.Errorf("Error importing container: %s", err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (d *PodmanDriver) InspectImage(id string) (*ImageInfo, error) {
+	var stdout bytes.Buffer
+	if err := d.run(&stdout, "image", "inspect", id); err != nil {
+		return nil, fmt.Errorf("Error inspecting image: %s", err)
+	}
+
+	return parseImageInspect(stdout.Bytes())
+}
+
+func (d *PodmanDriver) IPAddress(id string) (string, error) {
+	var stdout bytes.Buffer
+	err := d.run(&stdout, "inspect", "--format", "{{ .NetworkSettings.IPAddress }}", id)
+	if err != nil {
+		return "", fmt.Errorf("Error: %s", err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (d *PodmanDriver) Login(repo, user, pass string) error {
+	d.l.Lock()
+
+	cmd := exec.Command("podman", "login")
+	if user != "" {
+		cmd.Args = append(cmd.Args, "-u", user)
+	}
+	if pass != "" {
+		cmd.Args = append(cmd.Args, "--password-stdin")
+		cmd.Stdin = strings.NewReader(pass)
+	}
+	if repo != "" {
+		cmd.Args = append(cmd.Args, repo)
+	}
+
+	if err := runAndStream(cmd, d.Ui); err != nil {
+		d.l.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) Logout(repo string) error {
+	args := []string{"logout"}
+	if repo != "" {
+		args = append(args, repo)
+	}
+
+	cmd := exec.Command("podman", args...)
+	err := runAndStream(cmd, d.Ui)
+	d.l.Unlock()
+	return err
+}
+
+func (d *PodmanDriver) Pull(image string) error {
+	cmd := exec.Command("podman", "pull", image)
+	return runAndStream(cmd, d.Ui)
+}
+
+func (d *PodmanDriver) Push(name string) error {
+	cmd := exec.Command("podman", "push", name)
+	return runAndStream(cmd, d.Ui)
+}
+
+func (d *PodmanDriver) SaveImage(id string, dst io.Writer) error {
+	log.Printf("Exporting image: %s", id)
+	if err := d.run(dst, "save", "--format", "docker-archive", id); err != nil {
+		return fmt.Errorf("Error exporting: %s", err)
+	}
+
+	return nil
+}
+
+// runArgs builds the arguments to `podman run` for the given container.
+func (d *PodmanDriver) runArgs(config *ContainerConfig) ([]string, error) {
+	// Build up the template data
+	var tplData startContainerTemplate
+	tplData.Image = config.Image
+	ictx := *d.Ctx
+	ictx.Data = &tplData
+
+	args := []string{"run"}
+	if config.Privileged {
+		args = append(args, "--privileged")
+	}
+	if d.Rootless {
+		// Map the invoking user to the same UID inside the container,
+		// otherwise files created in the shared temp directory belong to a
+		// subordinate UID that can't be cleaned up afterwards.
+		args = append(args, "--userns=keep-id")
+	}
+	for host, guest := range config.Volumes {
+		volume := fmt.Sprintf("%s:%s", host, guest)
+		// Relabel volumes that don't set their own options so that SELinux
+		// lets the unprivileged container use them.
+		if d.Rootless && strings.Count(volume, ":") == 1 {
+			volume += ":z"
+		}
+		args = append(args, "-v", volume)
+	}
+	for _, v := range config.RunCommand {
+		v, err := interpolate.Render(v, &ictx)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, v)
+	}
+
+	return args, nil
+}
+
+func (d *PodmanDriver) StartContainer(config *ContainerConfig) (string, error) {
+	args, err := d.runArgs(config)
+	if err != nil {
+		return "", err
+	}
+	d.Ui.Message(fmt.Sprintf(
+		"Run command: podman %s", strings.Join(args, " ")))
+
+	// Start the container
+	var stdout bytes.Buffer
+	log.Printf("Starting container with args: %v", args)
+	if err := d.run(&stdout, args...); err != nil {
+		return "", fmt.Errorf("Podman exited with a non-zero exit status: %s", err)
+	}
+
+	// Capture the container ID, which is alone on stdout
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (d *PodmanDriver) StopContainer(id string) error {
+	return exec.Command("podman", "stop", id).Run()
+}
+
+func (d *PodmanDriver) KillContainer(id string) error {
+	if err := exec.Command("podman", "kill", id).Run(); err != nil {
+		return err
+	}
+
+	return exec.Command("podman", "rm", id).Run()
+}
+
+func (d *PodmanDriver) TagImage(id string, repo string, force bool) error {
+	// podman always moves an existing tag, so force is implied.
+	if err := d.run(nil, "tag", id, repo); err != nil {
+		return fmt.Errorf("Error tagging image: %s", err)
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) Verify() error {
+	if _, err := exec.LookPath("podman"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *PodmanDriver) Version() (*version.Version, error) {
+	output, err := exec.Command("podman", "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	match := regexp.MustCompile(version.VersionRegexpRaw).FindSubmatch(output)
+	if match == nil {
+		return nil, fmt.Errorf("unknown version: %s", output)
+	}
+
+	return version.NewVersion(string(match[0]))
+}
@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+func TestPodmanDriver_impl(t *testing.T) {
+	var _ Driver = new(PodmanDriver)
+}
+
+func TestPodmanDriver_runArgs(t *testing.T) {
+	config := &ContainerConfig{
+		Image:      "ubuntu",
+		RunCommand: []string{"-d", "--", "{{.Image}}"},
+		Volumes: map[string]string{
+			"/tmp/packer": "/packer-files",
+		},
+	}
+
+	d := &PodmanDriver{Ctx: &interpolate.Context{}}
+	args, err := d.runArgs(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"run", "-v", "/tmp/packer:/packer-files", "-d", "--", "ubuntu"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("bad: %#v", args)
+	}
+
+	// Rootless containers keep the user's ID and relabel volumes, unless
+	// the volume has its own options.
+	d.Rootless = true
+	config.Volumes["/data"] = "/data:ro"
+	args, err = d.runArgs(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if args[1] != "--userns=keep-id" {
+		t.Fatalf("bad: %#v", args)
+	}
+	volumes := map[string]bool{}
+	for i, arg := range args {
+		if arg == "-v" {
+			volumes[args[i+1]] = true
+		}
+	}
+	if !volumes["/tmp/packer:/packer-files:z"] || !volumes["/data:/data:ro"] {
+		t.Fatalf("bad volumes: %#v", volumes)
+	}
+}
@@ -0,0 +1,296 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultDockerHost = "unix:///var/run/docker.sock"
+
+	// The oldest API version with everything the engine driver uses, which
+	// is served by Docker 1.12 and later.
+	engineAPIVersion = "1.24"
+)
+
+// EngineError is an error response returned by the Docker Engine API.
+type EngineError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *EngineError) Error() string {
+	return fmt.Sprintf("Docker Engine API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// NotFound reports whether the error means the container, image or path
+// doesn't exist.
+func (e *EngineError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// engineClient sends requests to the Docker Engine API, either over a unix
+// socket or TCP.
+type engineClient struct {
+	proto string
+	addr  string
+	tls   *tls.Config
+
+	client *http.Client
+}
+
+// newEngineClientFromEnv connects to the engine the same way the docker CLI
+// does, using DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH.
+func newEngineClientFromEnv() (*engineClient, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	var tlsConfig *tls.Config
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		certPath := os.Getenv("DOCKER_CERT_PATH")
+		if certPath == "" {
+			home, _ := os.UserHomeDir()
+			certPath = filepath.Join(home, ".docker")
+		}
+
+		var err error
+		tlsConfig, err = engineTLSConfig(certPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newEngineClient(host, tlsConfig)
+}
+
+func engineTLSConfig(certPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Error loading Docker client certificate: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Error loading Docker CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", filepath.Join(certPath, "ca.pem"))
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// newEngineClient creates a client for the engine listening on host, which
+// is a unix:// or tcp:// URL.
+func newEngineClient(host string, tlsConfig *tls.Config) (*engineClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Docker host %q: %s", host, err)
+	}
+
+	c := &engineClient{tls: tlsConfig}
+	switch u.Scheme {
+	case "unix":
+		c.proto, c.addr = "unix", u.Path
+	case "tcp", "http", "https":
+		c.proto, c.addr = "tcp", u.Host
+		if c.tls != nil {
+			c.tls = c.tls.Clone()
+			c.tls.ServerName = u.Hostname()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported Docker host %q", host)
+	}
+
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return c.dial(ctx)
+			},
+		},
+	}
+	return c, nil
+}
+
+// dial opens a connection to the engine. TLS is handled here rather than by
+// the HTTP transport so that hijacked connections can use it too.
+func (c *engineClient) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.proto, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, c.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// request builds a request for an API path such as "/containers/json". The
+// host is a placeholder, since the transport always dials the engine.
+func (c *engineClient) request(method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "docker",
+		Path:     "/v" + engineAPIVersion + path,
+		RawQuery: query.Encode(),
+	}
+
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+		contentType = "application/x-tar"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// do sends a request and returns the response if it succeeded. Bodies that
+// aren't an io.Reader are sent as JSON.
+func (c *engineClient) do(method, path string, query url.Values, header http.Header, body interface{}) (*http.Response, error) {
+	req, err := c.request(method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the Docker daemon: %s", err)
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, responseEngineError(resp)
+	}
+	return resp, nil
+}
+
+// doJSON sends a request and decodes the JSON response into v, if v isn't
+// nil.
+func (c *engineClient) doJSON(method, path string, query url.Values, body, v interface{}) error {
+	resp, err := c.do(method, path, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func responseEngineError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(data))
+	if err := json.Unmarshal(data, &body); err == nil && body.Message != "" {
+		message = body.Message
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	return &EngineError{StatusCode: resp.StatusCode, Message: message}
+}
+
+// hijack sends a request that upgrades the connection to a raw stream, as
+// done when attaching to an exec instance. The returned connection carries
+// the stream in both directions.
+func (c *engineClient) hijack(method, path string, body interface{}) (*hijackedConn, error) {
+	req, err := c.request(method, path, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the Docker daemon: %s", err)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer conn.Close()
+		return nil, responseEngineError(resp)
+	}
+
+	return &hijackedConn{Conn: conn, r: br}, nil
+}
+
+// hijackedConn is a connection taken over from the HTTP client, whose
+// buffered reader may already hold the start of the stream.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite signals the end of stdin while still reading the output.
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ExportFormatTar           = "tar"
+	ExportFormatOCI           = "oci"
+	ExportFormatDockerArchive = "docker-archive"
+
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+type imageDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type imageManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        imageDescriptor   `json:"config"`
+	Layers        []imageDescriptor `json:"layers"`
+}
+
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Manifests     []imageDescriptor `json:"manifests"`
+}
+
+type imageHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type image struct {
+	Created      time.Time      `json:"created"`
+	Author       string         `json:"author,omitempty"`
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       ImageConfig    `json:"config"`
+	RootFS       imageRootFS    `json:"rootfs"`
+	History      []imageHistory `json:"history"`
+}
+
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// blob is a file or buffer that is added to an image archive under its
+// content digest.
+type blob struct {
+	digest string
+	size   int64
+	path   string
+	data   []byte
+}
+
+func newBlob(data []byte) *blob {
+	sum := sha256.Sum256(data)
+	return &blob{
+		digest: "sha256:" + hex.EncodeToString(sum[:]),
+		size:   int64(len(data)),
+		data:   data,
+	}
+}
+
+func (b *blob) hex() string {
+	return strings.TrimPrefix(b.digest, "sha256:")
+}
+
+func (b *blob) open() (io.ReadCloser, error) {
+	if b.path != "" {
+		return os.Open(b.path)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+// hashFile computes the digest of the file at path while copying it to w,
+// which may be nil.
+func hashFile(path string, w io.Writer) (*blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	dst := io.Writer(h)
+	if w != nil {
+		dst = io.MultiWriter(h, w)
+	}
+	size, err := io.Copy(dst, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blob{
+		digest: "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		size:   size,
+		path:   path,
+	}, nil
+}
+
+// ImageArchive turns the flat file system produced by `docker export` into
+// a single layer image.
+type ImageArchive struct {
+	// Path to the tar file produced by `docker export`.
+	RootFS string
+	Config *ImageConfig
+	Author string
+	// Reference to record in the archive, such as "myorg/app:latest".
+	Tag string
+	// Platform of the image, as reported by the base image.
+	Architecture string
+	OS           string
+}
+
+// Write writes the image as an archive in the given format to path.
+func (a *ImageArchive) Write(format, path string) error {
+	switch format {
+	case ExportFormatOCI:
+		return a.writeOCI(path)
+	case ExportFormatDockerArchive:
+		return a.writeDockerArchive(path)
+	default:
+		return fmt.Errorf("Unknown image export format: %s", format)
+	}
+}
+
+func (a *ImageArchive) config(diffID string) (*blob, error) {
+	created := time.Now().UTC()
+	img := image{
+		Created:      created,
+		Author:       a.Author,
+		Architecture: a.Architecture,
+		OS:           a.OS,
+		Config:       *a.Config,
+		RootFS: imageRootFS{
+			Type:    "layers",
+			DiffIDs: []string{diffID},
+		},
+		History: []imageHistory{{Created: created, CreatedBy: "packer"}},
+	}
+
+	data, err := json.Marshal(img)
+	if err != nil {
+		return nil, err
+	}
+	return newBlob(data), nil
+}
+
+func (a *ImageArchive) writeOCI(path string) error {
+	// Compress the layer into a temporary file next to the output, keeping
+	// track of the digest of both the uncompressed and compressed data.
+	tf, err := ioutil.TempFile(filepath.Dir(path), "packer-layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	gz := gzip.NewWriter(tf)
+	uncompressed, err := hashFile(a.RootFS, gz)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := tf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error compressing layer: %s", err)
+	}
+
+	layer, err := hashFile(tf.Name(), nil)
+	if err != nil {
+		return err
+	}
+	config, err := a.config(uncompressed.digest)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := json.Marshal(imageManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config: imageDescriptor{
+			MediaType: mediaTypeOCIConfig,
+			Digest:    config.digest,
+			Size:      config.size,
+		},
+		Layers: []imageDescriptor{{
+			MediaType: mediaTypeOCILayer,
+			Digest:    layer.digest,
+			Size:      layer.size,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	manifest := newBlob(manifestData)
+
+	descriptor := imageDescriptor{
+		MediaType: mediaTypeOCIManifest,
+		Digest:    manifest.digest,
+		Size:      manifest.size,
+	}
+	if a.Tag != "" {
+		ref := normalizeTag(a.Tag)
+		descriptor.Annotations = map[string]string{
+			"io.containerd.image.name":          ref,
+			"org.opencontainers.image.ref.name": ref[strings.LastIndex(ref, ":")+1:],
+		}
+	}
+	index, err := json.Marshal(imageIndex{
+		SchemaVersion: 2,
+		Manifests:     []imageDescriptor{descriptor},
+	})
+	if err != nil {
+		return err
+	}
+
+	files := []*archiveEntry{
+		{name: "oci-layout", blob: newBlob([]byte(`{"imageLayoutVersion":"1.0.0"}`))},
+		{name: "index.json", blob: newBlob(index)},
+		{name: "blobs/", dir: true},
+		{name: "blobs/sha256/", dir: true},
+	}
+	for _, b := range []*blob{manifest, config, layer} {
+		files = append(files, &archiveEntry{name: "blobs/sha256/" + b.hex(), blob: b})
+	}
+
+	return writeArchive(path, files)
+}
+
+func (a *ImageArchive) writeDockerArchive(path string) error {
+	layer, err := hashFile(a.RootFS, nil)
+	if err != nil {
+		return err
+	}
+	config, err := a.config(layer.digest)
+	if err != nil {
+		return err
+	}
+
+	var repoTags []string
+	if a.Tag != "" {
+		repoTags = []string{normalizeTag(a.Tag)}
+	}
+	manifest, err := json.Marshal([]dockerArchiveManifest{{
+		Config:   config.hex() + ".json",
+		RepoTags: repoTags,
+		Layers:   []string{layer.hex() + "/layer.tar"},
+	}})
+	if err != nil {
+		return err
+	}
+
+	return writeArchive(path, []*archiveEntry{
+		{name: layer.hex() + "/", dir: true},
+		{name: layer.hex() + "/VERSION", blob: newBlob([]byte("1.0"))},
+		{name: layer.hex() + "/layer.tar", blob: layer},
+		{name: config.hex() + ".json", blob: config},
+		{name: "manifest.json", blob: newBlob(manifest)},
+	})
+}
+
+type archiveEntry struct {
+	name string
+	dir  bool
+	blob *blob
+}
+
+func writeArchive(path string, entries []*archiveEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	modTime := time.Now()
+	for _, e := range entries {
+		if e.dir {
+			err := tw.WriteHeader(&tar.Header{
+				Name:     e.name,
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  modTime,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     e.blob.size,
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		r, err := e.blob.open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// normalizeTag adds the implicit "latest" tag to an image reference that
+// doesn't have one.
+func normalizeTag(ref string) string {
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if strings.Contains(name, ":") || strings.Contains(name, "@") {
+		return ref
+	}
+	return ref + ":latest"
+}
@@ -0,0 +1,227 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ImageConfig is the runtime configuration stored in an image, using the
+// field names shared by the OCI image spec and Docker.
+type ImageConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// ParseChanges applies Dockerfile instructions, as given to `docker commit
+// --change`, to an empty image config. Only the instructions that `docker
+// commit` accepts and that map to image config are supported.
+func ParseChanges(changes []string) (*ImageConfig, error) {
+	c := &ImageConfig{}
+	if err := c.ApplyChanges(changes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyChanges applies Dockerfile instructions on top of the config, the
+// way `docker commit --change` does on top of the config of the base image.
+func (c *ImageConfig) ApplyChanges(changes []string) error {
+	for _, change := range changes {
+		if err := c.apply(change); err != nil {
+			return fmt.Errorf("Error parsing change %q: %s", change, err)
+		}
+	}
+	return nil
+}
+
+// parseImageInspect parses the output of `docker image inspect` and `podman
+// image inspect` for a single image.
+func parseImageInspect(out []byte) (*ImageInfo, error) {
+	var infos []ImageInfo
+	if err := json.Unmarshal(out, &infos); err != nil {
+		return nil, fmt.Errorf("Error parsing image inspect output: %s", err)
+	}
+	if len(infos) != 1 {
+		return nil, fmt.Errorf("Expected 1 inspected image, got %d", len(infos))
+	}
+	return &infos[0], nil
+}
+
+func (c *ImageConfig) apply(change string) error {
+	change = strings.TrimSpace(change)
+	parts := strings.SplitN(change, " ", 2)
+	instruction := strings.ToUpper(parts[0])
+	args := ""
+	if len(parts) > 1 {
+		args = strings.TrimSpace(parts[1])
+	}
+	if args == "" {
+		return fmt.Errorf("%s requires at least one argument", instruction)
+	}
+
+	switch instruction {
+	case "CMD":
+		c.Cmd = parseCommand(args)
+	case "ENTRYPOINT":
+		c.Entrypoint = parseCommand(args)
+	case "ENV":
+		pairs, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			c.setEnv(pair[0], pair[1])
+		}
+	case "EXPOSE":
+		if c.ExposedPorts == nil {
+			c.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			c.ExposedPorts[port] = struct{}{}
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		for _, pair := range pairs {
+			c.Labels[pair[0]] = pair[1]
+		}
+	case "STOPSIGNAL":
+		c.StopSignal = args
+	case "USER":
+		c.User = args
+	case "VOLUME":
+		var volumes []string
+		if err := json.Unmarshal([]byte(args), &volumes); err != nil {
+			volumes = strings.Fields(args)
+		}
+		if c.Volumes == nil {
+			c.Volumes = make(map[string]struct{})
+		}
+		for _, v := range volumes {
+			c.Volumes[v] = struct{}{}
+		}
+	case "WORKDIR":
+		c.WorkingDir = args
+	default:
+		return fmt.Errorf("unsupported instruction %s", instruction)
+	}
+	return nil
+}
+
+func (c *ImageConfig) setEnv(key, value string) {
+	entry := key + "=" + value
+	for i, e := range c.Env {
+		if strings.HasPrefix(e, key+"=") {
+			c.Env[i] = entry
+			return
+		}
+	}
+	c.Env = append(c.Env, entry)
+}
+
+// parseCommand handles both the exec (JSON array) and shell forms of CMD and
+// ENTRYPOINT.
+func parseCommand(args string) []string {
+	var command []string
+	if err := json.Unmarshal([]byte(args), &command); err == nil {
+		return command
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseKeyValues parses the arguments of ENV and LABEL, either in the
+// `key=value key2="value 2"` form or the legacy `key value` form.
+func parseKeyValues(args string) ([][2]string, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(words[0], "=") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s must have a value", parts[0])
+		}
+		value, err := splitWords(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		return [][2]string{{parts[0], strings.Join(value, " ")}}, nil
+	}
+
+	var pairs [][2]string
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// splitWords splits s on whitespace, honoring quotes and backslash escapes
+// the way the Dockerfile parser does.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && quote != '\'':
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("missing arguments")
+	}
+	return words, nil
+}
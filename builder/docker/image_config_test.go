@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChanges(t *testing.T) {
+	c, err := ParseChanges([]string{
+		"ENV PATH=/usr/local/bin:/usr/bin:/bin",
+		"ENV GREETING hello world",
+		`ENV A="quoted value" B=plain\ escaped`,
+		"ENV A=replaced",
+		`ENTRYPOINT ["/usr/bin/app", "--serve"]`,
+		"CMD echo hello",
+		`LABEL maintainer="ops@example.com" version=1.0`,
+		"EXPOSE 8080 53/udp",
+		"USER app:app",
+		"WORKDIR /srv",
+		`VOLUME ["/data"]`,
+		"STOPSIGNAL SIGTERM",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &ImageConfig{
+		User: "app:app",
+		ExposedPorts: map[string]struct{}{
+			"8080/tcp": {},
+			"53/udp":   {},
+		},
+		Env: []string{
+			"PATH=/usr/local/bin:/usr/bin:/bin",
+			"GREETING=hello world",
+			"A=replaced",
+			"B=plain escaped",
+		},
+		Entrypoint: []string{"/usr/bin/app", "--serve"},
+		Cmd:        []string{"/bin/sh", "-c", "echo hello"},
+		Volumes:    map[string]struct{}{"/data": {}},
+		WorkingDir: "/srv",
+		Labels: map[string]string{
+			"maintainer": "ops@example.com",
+			"version":    "1.0",
+		},
+		StopSignal: "SIGTERM",
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("bad config:\n%#v\nexpected:\n%#v", c, expected)
+	}
+}
+
+func TestParseChanges_invalid(t *testing.T) {
+	invalid := []string{
+		"RUN apt-get update",
+		"ENV",
+		`LABEL a="unterminated`,
+		"LABEL =value",
+	}
+	for _, change := range invalid {
+		if _, err := ParseChanges([]string{change}); err == nil {
+			t.Fatalf("%q: should error", change)
+		}
+	}
+}
+
+func TestParseImageInspect(t *testing.T) {
+	info, err := parseImageInspect([]byte(`[{"Id":"sha256:c0ffee","Architecture":"ppc64le","Os":"linux","Config":{"Entrypoint":["/init"],"Labels":{"a":"b"}}}]`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Architecture != "ppc64le" || info.Os != "linux" {
+		t.Fatalf("bad platform: %#v", info)
+	}
+	if !reflect.DeepEqual(info.Config.Entrypoint, []string{"/init"}) || info.Config.Labels["a"] != "b" {
+		t.Fatalf("bad config: %#v", info.Config)
+	}
+
+	if _, err := parseImageInspect([]byte(`[]`)); err == nil {
+		t.Fatal("should error")
+	}
+}
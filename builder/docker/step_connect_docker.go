@@ -24,7 +24,16 @@ func (s *StepConnectDocker) Run(ctx context.Context, state multistep.StateBag) m
 		return multistep.ActionHalt
 	}
 
-	containerUser, err := getContainerUser(containerId)
+	// Drivers that talk to the engine API run commands and copy files
+	// themselves.
+	engine, _ := driver.(containerEngine)
+
+	var containerUser string
+	if engine != nil {
+		containerUser, err = engine.ContainerUser(containerId)
+	} else {
+		containerUser, err = getContainerUser(config.executable(), containerId)
+	}
 	if err != nil {
 		state.Put("error", err)
 		return multistep.ActionHalt
@@ -41,6 +50,7 @@ func (s *StepConnectDocker) Run(ctx context.Context, state multistep.StateBag) m
 			Config:        config,
 			ContainerUser: containerUser,
 			EntryPoint:    []string{"powershell"},
+			engine:        engine,
 		},
 		}
 		state.Put("communicator", comm)
@@ -54,6 +64,7 @@ func (s *StepConnectDocker) Run(ctx context.Context, state multistep.StateBag) m
 			Config:        config,
 			ContainerUser: containerUser,
 			EntryPoint:    []string{"/bin/sh", "-c"},
+			engine:        engine,
 		}
 		state.Put("communicator", comm)
 	}
@@ -62,8 +73,8 @@ func (s *StepConnectDocker) Run(ctx context.Context, state multistep.StateBag) m
 
 func (s *StepConnectDocker) Cleanup(state multistep.StateBag) {}
 
-func getContainerUser(containerId string) (string, error) {
-	inspectArgs := []string{"docker", "inspect", "--format", "{{.Config.User}}", containerId}
+func getContainerUser(executable, containerId string) (string, error) {
+	inspectArgs := []string{executable, "inspect", "--format", "{{.Config.User}}", containerId}
 	stdout, err := exec.Command(inspectArgs[0], inspectArgs[1:]...).Output()
 	if err != nil {
 		errStr := fmt.Sprintf("Failed to inspect the container: %s", err)
@@ -3,6 +3,7 @@ package docker
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -10,7 +11,8 @@ import (
 	"github.com/hashicorp/packer/packer"
 )
 
-// StepExport exports the container to a flat tar file.
+// StepExport exports the container to a flat tar file, and optionally turns
+// that into an image archive.
 type StepExport struct{}
 
 func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -35,8 +37,24 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 		return multistep.ActionHalt
 	}
 
+	// When writing an image archive, the flat export is only an intermediate
+	// file that becomes the image's layer.
+	exportPath := config.ExportPath
+	if config.ExportFormat != ExportFormatTar {
+		tf, err := ioutil.TempFile(exportDir, "packer-export")
+		if err != nil {
+			err := fmt.Errorf("Error creating temporary export file: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		tf.Close()
+		exportPath = tf.Name()
+		defer os.Remove(exportPath)
+	}
+
 	// Open the file that we're going to write to
-	f, err := os.Create(config.ExportPath)
+	f, err := os.Create(exportPath)
 	if err != nil {
 		err := fmt.Errorf("Error creating output file: %s", err)
 		state.Put("error", err)
@@ -55,6 +73,51 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 	}
 
 	f.Close()
+
+	if config.ExportFormat == ExportFormatTar {
+		return multistep.ActionContinue
+	}
+
+	// The image keeps the platform and the runtime configuration of the base
+	// image, like `docker commit` does
+	base, err := driver.InspectImage(config.Image)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	imageConfig := base.Config
+	if err := imageConfig.ApplyChanges(config.Changes); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	archive := &ImageArchive{
+		RootFS:       exportPath,
+		Config:       &imageConfig,
+		Author:       config.Author,
+		Tag:          config.ExportTag,
+		Architecture: base.Architecture,
+		OS:           base.Os,
+	}
+	if archive.OS == "" {
+		archive.OS = "linux"
+		if config.WindowsContainer {
+			archive.OS = "windows"
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Writing %s image archive", config.ExportFormat))
+	if err := archive.Write(config.ExportFormat, config.ExportPath); err != nil {
+		os.Remove(config.ExportPath)
+
+		err := fmt.Errorf("Error writing image archive: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	return multistep.ActionContinue
 }
 
@@ -1,11 +1,20 @@
 package docker
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer/helper/multistep"
@@ -99,3 +108,175 @@ func TestStepExport_error(t *testing.T) {
 		t.Fatal("export path shouldn't exist")
 	}
 }
+
+func testRootFS(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: 4})
+	tw.Write([]byte("box\n"))
+	if err := tw.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// readTestArchive returns the regular files in the tar file at path.
+func readTestArchive(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		files[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	return files
+}
+
+func testStepExportImage(t *testing.T, format string) map[string][]byte {
+	state := testStepExportState(t)
+	step := new(StepExport)
+	defer step.Cleanup(state)
+
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config := state.Get("config").(*Config)
+	config.ExportPath = filepath.Join(td, "image.tar")
+	config.ExportFormat = format
+	config.ExportTag = "example/app"
+	config.Changes = []string{"ENV FOO=bar", "CMD [\"/bin/app\"]"}
+	driver := state.Get("driver").(*MockDriver)
+	driver.ExportReader = bytes.NewReader(testRootFS(t))
+	driver.InspectImageInfo = &ImageInfo{
+		Architecture: "arm64",
+		Os:           "linux",
+		Config: ImageConfig{
+			Env:        []string{"PATH=/usr/bin", "FOO=base"},
+			Entrypoint: []string{"/entrypoint.sh"},
+			Cmd:        []string{"/bin/sh"},
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", state.Get("error"))
+	}
+	if driver.InspectImageId != config.Image {
+		t.Fatalf("should inspect the base image: %s", driver.InspectImageId)
+	}
+
+	// Only the image archive should be left behind
+	entries, _ := ioutil.ReadDir(td)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the export in %s, found %d files", td, len(entries))
+	}
+
+	return readTestArchive(t, config.ExportPath)
+}
+
+func digest(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func TestStepExport_oci(t *testing.T) {
+	files := testStepExportImage(t, ExportFormatOCI)
+
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Fatalf("bad oci-layout: %s", files["oci-layout"])
+	}
+
+	// Every blob is stored under its own digest
+	for name, content := range files {
+		if strings.HasPrefix(name, "blobs/sha256/") && digest(content) != "sha256:"+filepath.Base(name) {
+			t.Fatalf("bad digest for %s", name)
+		}
+	}
+
+	var index imageIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("bad index: %s", files["index.json"])
+	}
+	if ref := index.Manifests[0].Annotations["io.containerd.image.name"]; ref != "example/app:latest" {
+		t.Fatalf("bad image name: %s", ref)
+	}
+
+	var manifest imageManifest
+	json.Unmarshal(files["blobs/sha256/"+strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")], &manifest)
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != mediaTypeOCILayer {
+		t.Fatalf("bad manifest: %#v", manifest)
+	}
+
+	var img image
+	json.Unmarshal(files["blobs/sha256/"+strings.TrimPrefix(manifest.Config.Digest, "sha256:")], &img)
+	// The config of the base image is kept, with the changes on top
+	if !reflect.DeepEqual(img.Config.Env, []string{"PATH=/usr/bin", "FOO=bar"}) || !reflect.DeepEqual(img.Config.Cmd, []string{"/bin/app"}) {
+		t.Fatalf("bad image config: %#v", img.Config)
+	}
+	if !reflect.DeepEqual(img.Config.Entrypoint, []string{"/entrypoint.sh"}) {
+		t.Fatalf("bad image config: %#v", img.Config)
+	}
+	if img.Architecture != "arm64" || img.OS != "linux" {
+		t.Fatalf("bad platform: %s/%s", img.OS, img.Architecture)
+	}
+
+	// The diff ID is the digest of the uncompressed layer
+	gz, err := gzip.NewReader(bytes.NewReader(files["blobs/sha256/"+strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:")]))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	layer, _ := ioutil.ReadAll(gz)
+	if !bytes.Equal(layer, testRootFS(t)) {
+		t.Fatal("layer should contain the exported file system")
+	}
+	if img.RootFS.DiffIDs[0] != digest(layer) {
+		t.Fatalf("bad diff ID: %s", img.RootFS.DiffIDs[0])
+	}
+}
+
+func TestStepExport_dockerArchive(t *testing.T) {
+	files := testStepExportImage(t, ExportFormatDockerArchive)
+
+	var manifest []dockerArchiveManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(manifest) != 1 || !reflect.DeepEqual(manifest[0].RepoTags, []string{"example/app:latest"}) {
+		t.Fatalf("bad manifest: %s", files["manifest.json"])
+	}
+
+	layer := files[manifest[0].Layers[0]]
+	if !bytes.Equal(layer, testRootFS(t)) {
+		t.Fatal("layer should contain the exported file system")
+	}
+
+	var img image
+	json.Unmarshal(files[manifest[0].Config], &img)
+	if img.RootFS.DiffIDs[0] != digest(layer) {
+		t.Fatalf("bad diff ID: %s", img.RootFS.DiffIDs[0])
+	}
+	if !reflect.DeepEqual(img.Config.Env, []string{"PATH=/usr/bin", "FOO=bar"}) {
+		t.Fatalf("bad image config: %#v", img.Config)
+	}
+	if img.Architecture != "arm64" {
+		t.Fatalf("bad architecture: %s", img.Architecture)
+	}
+}
@@ -34,7 +34,13 @@ func (s *StepMountSecondaryDvdImages) Run(ctx context.Context, state multistep.S
 	// For IDE, there are only 2 controllers (0,1) with 2 locations each (0,1)
 	var dvdProperties []DvdControllerProperties
 
-	for _, isoPath := range s.IsoPaths {
+	// Mount the CD built from cd_files and cd_content too, if we have one
+	isoPaths := append([]string{}, s.IsoPaths...)
+	if cdPathRaw, ok := state.GetOk("cd_path"); ok {
+		isoPaths = append(isoPaths, cdPathRaw.(string))
+	}
+
+	for _, isoPath := range isoPaths {
 		var properties DvdControllerProperties
 
 		controllerNumber, controllerLocation, err := driver.CreateDvdDrive(vmName, isoPath, s.Generation)
@@ -246,6 +246,26 @@ func TestBuilderPrepare_InvalidFloppies(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_CDFiles(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["cd_files"] = []string{"../../../common/test-fixtures/floppies/bar.bat"}
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// The CD takes one of the two ide controllers left on generation 1
+	config["secondary_iso_images"] = []string{"builder_test.go", "builder.go"}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
 func TestBuilderPrepare_InvalidKey(t *testing.T) {
 	var b Builder
 	config := testConfig()
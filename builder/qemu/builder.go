@@ -99,6 +99,7 @@ type Config struct {
 	shutdowncommand.ShutdownConfig `mapstructure:",squash"`
 	Comm                           communicator.Config `mapstructure:",squash"`
 	common.FloppyConfig            `mapstructure:",squash"`
+	common.CDConfig                `mapstructure:",squash"`
 	// Use iso from provided url. Qemu must support
 	// curl block device. This defaults to `false`.
 	ISOSkipCache bool `mapstructure:"iso_skip_cache" required:"false"`
@@ -131,6 +132,30 @@ type Config struct {
 	// Each additional disk uses the same disk parameters as the default disk.
 	// Unset by default.
 	AdditionalDiskSize []string `mapstructure:"disk_additional_size" required:"false"`
+	// Attach a cloud-init [NoCloud](https://cloudinit.readthedocs.io/en/latest/topics/datasources/nocloud.html)
+	// seed, a CD labeled `cidata`, to the VM. This is most useful with
+	// `disk_image` set to `true` and an upstream cloud image, which then
+	// boots and connects without any `boot_command`. This is enabled
+	// automatically when any of the `cloud_init_*` options is set. Defaults
+	// to `false`.
+	CloudInit bool `mapstructure:"cloud_init" required:"false"`
+	// The content of the `user-data` file of the seed. By default, the seed
+	// creates the `ssh_username` user with passwordless sudo, authorizes the
+	// SSH key of the communicator, a temporary one unless
+	// `ssh_private_key_file` is set, and sets `ssh_password` if set. This is
+	// a [template engine](/docs/templates/engine.html), where the
+	// `SSHPublicKey`, `SSHUsername`, `SSHPassword` and `Name` variables are
+	// available, so a custom `user-data` can authorize the key too.
+	CloudInitUserData string `mapstructure:"cloud_init_user_data" required:"false"`
+	// The content of the `meta-data` file of the seed. Defaults to an
+	// `instance-id` and a `local-hostname` set to `vm_name`. This is a
+	// template with the same variables as `cloud_init_user_data`.
+	CloudInitMetaData string `mapstructure:"cloud_init_meta_data" required:"false"`
+	// The content of the `network-config` file of the seed, a version 1 or 2
+	// network configuration. The file is not created by default, and the
+	// image configures its network itself. This is a template with the same
+	// variables as `cloud_init_user_data`.
+	CloudInitNetworkConfig string `mapstructure:"cloud_init_network_config" required:"false"`
 	// The number of cpus to use when building the VM.
 	//  The default is `1` CPU.
 	CpuCount int `mapstructure:"cpus" required:"false"`
@@ -334,6 +359,9 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		InterpolateFilter: &interpolate.RenderFilter{
 			Exclude: []string{
 				"boot_command",
+				"cloud_init_user_data",
+				"cloud_init_meta_data",
+				"cloud_init_network_config",
 				"qemuargs",
 			},
 		},
@@ -433,7 +461,13 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		b.config.Format = "qcow2"
 	}
 
+	if b.config.CloudInitUserData != "" || b.config.CloudInitMetaData != "" ||
+		b.config.CloudInitNetworkConfig != "" {
+		b.config.CloudInit = true
+	}
+
 	errs = packer.MultiErrorAppend(errs, b.config.FloppyConfig.Prepare(&b.config.ctx)...)
+	errs = packer.MultiErrorAppend(errs, b.config.CDConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(errs, b.config.VNCConfig.Prepare(&b.config.ctx)...)
 
 	if b.config.NetDevice == "" {
@@ -593,6 +627,15 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Directories: b.config.FloppyConfig.FloppyDirectories,
 			Label:       b.config.FloppyConfig.FloppyLabel,
 		},
+		&common.StepCreateCD{
+			Files:   b.config.CDConfig.CDFiles,
+			Content: b.config.CDConfig.CDContent,
+			Label:   b.config.CDConfig.CDLabel,
+		},
+		&stepCreateCloudInitSeed{
+			Debug:        b.config.PackerDebug,
+			DebugKeyPath: fmt.Sprintf("%s.pem", b.config.PackerBuildName),
+		},
 		new(stepCreateDisk),
 		new(stepCopyDisk),
 		new(stepResizeDisk),
@@ -347,6 +347,52 @@ func TestBuilderPrepare_InvalidFloppies(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_CDFiles(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["cd_files"] = []string{"../../common/test-fixtures/floppies/bar.bat"}
+	config["cd_content"] = map[string]string{"meta-data": "instance-id: {{build_name}}"}
+	config["cd_label"] = "cidata"
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.CDContent["meta-data"] != "instance-id: foo" || b.config.CDLabel != "cidata" {
+		t.Fatalf("bad: %#v", b.config.CDConfig)
+	}
+
+	config["cd_files"] = []string{"nonexistent.bat"}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("nonexistent CD files should error")
+	}
+}
+
+func TestBuilderPrepare_CloudInit(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["disk_image"] = true
+	config["cloud_init_user_data"] = "#cloud-config\nssh_authorized_keys: [{{ .SSHPublicKey }}]"
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if !b.config.CloudInit {
+		t.Fatal("cloud_init should be enabled")
+	}
+	// Rendered when the seed is created
+	if b.config.CloudInitUserData != "#cloud-config\nssh_authorized_keys: [{{ .SSHPublicKey }}]" {
+		t.Fatalf("bad: %s", b.config.CloudInitUserData)
+	}
+}
+
 func TestBuilderPrepare_InvalidKey(t *testing.T) {
 	var b Builder
 	config := testConfig()
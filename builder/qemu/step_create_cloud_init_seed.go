@@ -0,0 +1,218 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer/common/iso9660"
+	"github.com/hashicorp/packer/common/uuid"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/helper/ssh"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/packer/tmp"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+type cloudInitTemplateData struct {
+	Name         string
+	SSHUsername  string
+	SSHPassword  string
+	SSHPublicKey string
+}
+
+// stepCreateCloudInitSeed creates a cloud-init NoCloud seed, a CD labeled
+// cidata, authorizing the SSH key of the communicator. Unless a password or
+// a private key file is configured, the key is a temporary one created here.
+//
+// Produces:
+//   cloud_init_seed_path string - The path to the seed image.
+type stepCreateCloudInitSeed struct {
+	Debug        bool
+	DebugKeyPath string
+
+	seedPath string
+}
+
+func (s *stepCreateCloudInitSeed) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	if !config.CloudInit {
+		return multistep.ActionContinue
+	}
+
+	publicKey, err := s.publicKey(ui, config)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Creating cloud-init seed...")
+
+	ictx := config.ctx
+	ictx.Data = &cloudInitTemplateData{
+		Name:         config.VMName,
+		SSHUsername:  config.Comm.SSHUsername,
+		SSHPassword:  config.Comm.SSHPassword,
+		SSHPublicKey: publicKey,
+	}
+
+	files := []struct {
+		name     string
+		template string
+		def      string
+	}{
+		{"user-data", config.CloudInitUserData,
+			defaultUserData(config.Comm.SSHUsername, config.Comm.SSHPassword, publicKey)},
+		{"meta-data", config.CloudInitMetaData,
+			fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", config.VMName, config.VMName)},
+		{"network-config", config.CloudInitNetworkConfig, ""},
+	}
+
+	img := iso9660.New("cidata")
+	for _, f := range files {
+		content := f.def
+		if f.template != "" {
+			var err error
+			content, err = interpolate.Render(f.template, &ictx)
+			if err != nil {
+				err := fmt.Errorf("Error rendering cloud-init %s: %s", f.name, err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+		}
+		if content == "" {
+			continue
+		}
+
+		if err := img.AddContent(f.name, []byte(content)); err != nil {
+			err := fmt.Errorf("Error adding cloud-init %s: %s", f.name, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	seedF, err := tmp.File("packer-cidata*.iso")
+	if err != nil {
+		err := fmt.Errorf("Error creating temporary file for cloud-init seed: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer seedF.Close()
+
+	// Set the path so we can remove it later
+	s.seedPath = seedF.Name()
+	log.Printf("cloud-init seed path: %s", s.seedPath)
+
+	if _, err := img.WriteTo(seedF); err != nil {
+		err := fmt.Errorf("Error creating cloud-init seed: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("cloud_init_seed_path", s.seedPath)
+	return multistep.ActionContinue
+}
+
+// publicKey returns the authorized_keys line of the SSH key the communicator
+// connects with, creating a temporary key pair if needed. It returns an empty
+// string if no key is used.
+func (s *stepCreateCloudInitSeed) publicKey(ui packer.Ui, config *Config) (string, error) {
+	comm := &config.Comm
+	if comm.Type != "ssh" || comm.SSHPassword != "" || comm.SSHAgentAuth {
+		return "", nil
+	}
+
+	if comm.SSHPrivateKeyFile != "" {
+		privateKeyBytes, err := comm.ReadSSHPrivateKeyFile()
+		if err != nil {
+			return "", err
+		}
+		kp, err := ssh.KeyPairFromPrivateKey(ssh.FromPrivateKeyConfig{
+			RawPrivateKeyPemBlock: privateKeyBytes,
+			Comment:               fmt.Sprintf("packer_%s", uuid.TimeOrderedUUID()),
+		})
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(kp.PublicKeyAuthorizedKeysLine)), nil
+	}
+
+	ui.Say("Creating ephemeral key pair for SSH communicator...")
+	kp, err := ssh.NewKeyPair(ssh.CreateKeyPairConfig{
+		Comment: fmt.Sprintf("packer_%s", uuid.TimeOrderedUUID()),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error creating temporary keypair: %s", err)
+	}
+
+	comm.SSHKeyPairName = kp.Comment
+	comm.SSHTemporaryKeyPairName = kp.Comment
+	comm.SSHPrivateKey = kp.PrivateKeyPemBlock
+	comm.SSHPublicKey = kp.PublicKeyAuthorizedKeysLine
+	comm.SSHClearAuthorizedKeys = true
+
+	// If we're in debug mode, output the private key to the working
+	// directory.
+	if s.Debug {
+		ui.Message(fmt.Sprintf("Saving communicator private key for debug purposes: %s", s.DebugKeyPath))
+		if err := ioutil.WriteFile(s.DebugKeyPath, kp.PrivateKeyPemBlock, 0600); err != nil {
+			return "", fmt.Errorf("Error saving debug key: %s", err)
+		}
+	}
+
+	return strings.TrimSpace(string(kp.PublicKeyAuthorizedKeysLine)), nil
+}
+
+func (s *stepCreateCloudInitSeed) Cleanup(state multistep.StateBag) {
+	if s.seedPath != "" {
+		log.Printf("Deleting cloud-init seed: %s", s.seedPath)
+		os.Remove(s.seedPath)
+	}
+
+	if s.Debug {
+		config := state.Get("config").(*Config)
+		if config.Comm.SSHTemporaryKeyPairName != "" {
+			os.Remove(s.DebugKeyPath)
+		}
+	}
+}
+
+// defaultUserData returns a cloud-config creating the user with passwordless
+// sudo, and authorizing the key or setting the password.
+func defaultUserData(username, password, publicKey string) string {
+	quote := func(s string) string {
+		// JSON strings are valid YAML double-quoted scalars
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	var b strings.Builder
+	b.WriteString("#cloud-config\n")
+	b.WriteString("users:\n")
+	fmt.Fprintf(&b, "  - name: %s\n", quote(username))
+	b.WriteString("    sudo: \"ALL=(ALL) NOPASSWD:ALL\"\n")
+	b.WriteString("    shell: /bin/bash\n")
+	if password != "" {
+		b.WriteString("    lock_passwd: false\n")
+		fmt.Fprintf(&b, "    plain_text_passwd: %s\n", quote(password))
+	}
+	if publicKey != "" {
+		b.WriteString("    ssh_authorized_keys:\n")
+		fmt.Fprintf(&b, "      - %s\n", quote(publicKey))
+	}
+	if password != "" {
+		b.WriteString("ssh_pwauth: true\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package qemu
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+func TestStepCreateCloudInitSeed(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["disk_image"] = true
+	config["cloud_init"] = true
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("ui", packer.TestUi(t))
+
+	step := new(stepCreateCloudInitSeed)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %s", action, state.Get("error"))
+	}
+
+	// A temporary key is created for the communicator
+	if len(b.config.Comm.SSHPrivateKey) == 0 || b.config.Comm.SSHTemporaryKeyPairName == "" {
+		t.Fatal("should create a temporary key pair")
+	}
+
+	seedPath := state.Get("cloud_init_seed_path").(string)
+	if _, err := os.Stat(seedPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(seedPath); !os.IsNotExist(err) {
+		t.Fatal("seed should be removed")
+	}
+}
+
+func TestStepCreateCloudInitSeed_disabled(t *testing.T) {
+	var b Builder
+	if _, err := b.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("ui", packer.TestUi(t))
+
+	step := new(stepCreateCloudInitSeed)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("cloud_init_seed_path"); ok {
+		t.Fatal("should not create a seed")
+	}
+}
+
+func TestDefaultUserData(t *testing.T) {
+	userData := defaultUserData("packer", "", "ssh-rsa AAAA packer_1")
+	expected := `#cloud-config
+users:
+  - name: "packer"
+    sudo: "ALL=(ALL) NOPASSWD:ALL"
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - "ssh-rsa AAAA packer_1"
+`
+	if userData != expected {
+		t.Fatalf("bad: %s", userData)
+	}
+
+	userData = defaultUserData("packer", `pa"ss`, "")
+	if !strings.Contains(userData, `plain_text_passwd: "pa\"ss"`) || !strings.Contains(userData, "ssh_pwauth: true") {
+		t.Fatalf("bad: %s", userData)
+	}
+}
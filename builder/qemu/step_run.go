@@ -179,6 +179,16 @@ func getCommandArgs(bootDrive string, state multistep.StateBag) ([]string, error
 		}
 	}
 
+	// Determine if we have a CD to attach
+	if cdPathRaw, ok := state.GetOk("cd_path"); ok {
+		driveArgs = append(driveArgs, fmt.Sprintf("file=%s,media=cdrom", cdPathRaw.(string)))
+	}
+
+	// Determine if we have a cloud-init seed to attach
+	if seedPathRaw, ok := state.GetOk("cloud_init_seed_path"); ok {
+		driveArgs = append(driveArgs, fmt.Sprintf("file=%s,media=cdrom", seedPathRaw.(string)))
+	}
+
 	defaultArgs["-device"] = deviceArgs
 	defaultArgs["-drive"] = driveArgs
 
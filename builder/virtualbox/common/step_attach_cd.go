@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// This step attaches the CD created from cd_files and cd_content to the
+// virtual machine.
+//
+// Uses:
+//   cd_path string
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+type StepAttachCD struct {
+	// The interface of the controller to attach the CD to, ide or sata.
+	Interface string
+
+	cdPath string
+}
+
+func (s *StepAttachCD) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	// Determine if we even have a CD to attach
+	cdPathRaw, ok := state.GetOk("cd_path")
+	if !ok {
+		log.Println("No CD, not attaching.")
+		return multistep.ActionContinue
+	}
+	cdPath := cdPathRaw.(string)
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	ui.Say("Attaching CD...")
+
+	controllerName, port, device := cdAttachment(s.Interface)
+	command := []string{
+		"storageattach", vmName,
+		"--storagectl", controllerName,
+		"--port", port,
+		"--device", device,
+		"--type", "dvddrive",
+		"--medium", cdPath,
+	}
+	if err := driver.VBoxManage(command...); err != nil {
+		err := fmt.Errorf("Error attaching CD: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// Track the path so that we can unregister it from VirtualBox later
+	s.cdPath = cdPath
+
+	// Set some state so we know to remove
+	state.Put("attachedCD", true)
+	if controllerName == "SATA Controller" {
+		state.Put("attachedCDOnSata", true)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepAttachCD) Cleanup(state multistep.StateBag) {
+	if s.cdPath == "" {
+		return
+	}
+
+	driver := state.Get("driver").(Driver)
+	vmName := state.Get("vmName").(string)
+
+	controllerName, port, device := cdAttachment(s.Interface)
+	command := []string{
+		"storageattach", vmName,
+		"--storagectl", controllerName,
+		"--port", port,
+		"--device", device,
+		"--medium", "none",
+	}
+
+	// Remove the CD. Note that this will probably fail since
+	// StepRemoveDevices does this as well. No big deal.
+	driver.VBoxManage(command...)
+}
+
+// cdAttachment returns the controller, port and device the CD is attached
+// to. They are distinct from the ones of the installation ISO and of the
+// guest additions.
+func cdAttachment(iface string) (controllerName, port, device string) {
+	if iface == "sata" {
+		return "SATA Controller", "3", "0"
+	}
+	return "IDE Controller", "1", "1"
+}
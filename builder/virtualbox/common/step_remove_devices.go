@@ -101,6 +101,28 @@ func (s *StepRemoveDevices) Run(ctx context.Context, state multistep.StateBag) m
 		}
 	}
 
+	if _, ok := state.GetOk("attachedCD"); ok {
+		ui.Message("Removing CD drive...")
+		iface := "ide"
+		if _, ok := state.GetOk("attachedCDOnSata"); ok {
+			iface = "sata"
+		}
+		controllerName, port, device := cdAttachment(iface)
+		command := []string{
+			"storageattach", vmName,
+			"--storagectl", controllerName,
+			"--port", port,
+			"--device", device,
+			"--medium", "none",
+		}
+		if err := driver.VBoxManage(command...); err != nil {
+			err := fmt.Errorf("Error removing CD: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	if _, ok := state.GetOk("guest_additions_attached"); ok {
 		ui.Message("Removing guest additions drive...")
 		controllerName := "IDE Controller"
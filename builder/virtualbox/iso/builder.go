@@ -30,6 +30,7 @@ type Config struct {
 	common.HTTPConfig               `mapstructure:",squash"`
 	common.ISOConfig                `mapstructure:",squash"`
 	common.FloppyConfig             `mapstructure:",squash"`
+	common.CDConfig                 `mapstructure:",squash"`
 	bootcommand.BootConfig          `mapstructure:",squash"`
 	vboxcommon.ExportConfig         `mapstructure:",squash"`
 	vboxcommon.OutputConfig         `mapstructure:",squash"`
@@ -146,6 +147,7 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 	errs = packer.MultiErrorAppend(errs, b.config.ExportConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(errs, b.config.ExportConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(errs, b.config.FloppyConfig.Prepare(&b.config.ctx)...)
+	errs = packer.MultiErrorAppend(errs, b.config.CDConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(
 		errs, b.config.OutputConfig.Prepare(&b.config.ctx, &b.config.PackerConfig)...)
 	errs = packer.MultiErrorAppend(errs, b.config.HTTPConfig.Prepare(&b.config.ctx)...)
@@ -211,6 +213,13 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 			errs, errors.New("iso_interface can only be ide or sata"))
 	}
 
+	// The CD is attached to the fourth port of the SATA controller
+	if (len(b.config.CDFiles) > 0 || len(b.config.CDContent) > 0) &&
+		b.config.GuestAdditionsInterface == "sata" && b.config.SATAPortCount < 4 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("sata_port_count must be at least 4 to attach cd_files or cd_content on sata"))
+	}
+
 	validMode := false
 	validModes := []string{
 		vboxcommon.GuestAdditionsModeDisable,
@@ -280,6 +289,11 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Directories: b.config.FloppyConfig.FloppyDirectories,
 			Label:       b.config.FloppyConfig.FloppyLabel,
 		},
+		&common.StepCreateCD{
+			Files:   b.config.CDConfig.CDFiles,
+			Content: b.config.CDConfig.CDContent,
+			Label:   b.config.CDConfig.CDLabel,
+		},
 		&common.StepHTTPServer{
 			HTTPDir:     b.config.HTTPDir,
 			HTTPPortMin: b.config.HTTPPortMin,
@@ -304,6 +318,9 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			VRDPPortMax:     b.config.VRDPPortMax,
 		},
 		new(vboxcommon.StepAttachFloppy),
+		&vboxcommon.StepAttachCD{
+			Interface: b.config.GuestAdditionsInterface,
+		},
 		&vboxcommon.StepForwardSSH{
 			CommConfig:     &b.config.SSHConfig.Comm,
 			HostPortMin:    b.config.SSHHostPortMin,
@@ -327,6 +327,26 @@ func TestBuilderPrepare_InvalidKey(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_CDOnSATA(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["iso_interface"] = "sata"
+	config["cd_content"] = map[string]string{"meta-data": ""}
+
+	// The default sata_port_count is too low for the CD
+	_, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["sata_port_count"] = 4
+	b = Builder{}
+	_, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
 func TestBuilderPrepare_ISOInterface(t *testing.T) {
 	var b Builder
 	config := testConfig()
@@ -53,6 +53,22 @@ func TestNewConfig_InvalidFloppies(t *testing.T) {
 	}
 }
 
+func TestNewConfig_CDFiles(t *testing.T) {
+	c := testConfig(t)
+	c["cd_files"] = []string{"../../../common/test-fixtures/floppies/bar.bat"}
+	c["cd_label"] = "cidata"
+	_, _, err := NewConfig(c)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	c["cd_files"] = []string{"nonexistent.bat"}
+	_, _, err = NewConfig(c)
+	if err == nil {
+		t.Fatal("Nonexistent CD files should error")
+	}
+}
+
 func TestNewConfig_sourcePath(t *testing.T) {
 	// Okay, because it gets caught during download
 	c := testConfig(t)
@@ -18,6 +18,7 @@ type Config struct {
 	common.PackerConfig          `mapstructure:",squash"`
 	common.HTTPConfig            `mapstructure:",squash"`
 	common.FloppyConfig          `mapstructure:",squash"`
+	common.CDConfig              `mapstructure:",squash"`
 	bootcommand.BootConfig       `mapstructure:",squash"`
 	vboxcommon.ExportConfig      `mapstructure:",squash"`
 	vboxcommon.OutputConfig      `mapstructure:",squash"`
@@ -77,6 +78,7 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 	var errs *packer.MultiError
 	errs = packer.MultiErrorAppend(errs, c.ExportConfig.Prepare(&c.ctx)...)
 	errs = packer.MultiErrorAppend(errs, c.FloppyConfig.Prepare(&c.ctx)...)
+	errs = packer.MultiErrorAppend(errs, c.CDConfig.Prepare(&c.ctx)...)
 	errs = packer.MultiErrorAppend(errs, c.HTTPConfig.Prepare(&c.ctx)...)
 	errs = packer.MultiErrorAppend(errs, c.OutputConfig.Prepare(&c.ctx, &c.PackerConfig)...)
 	errs = packer.MultiErrorAppend(errs, c.RunConfig.Prepare(&c.ctx)...)
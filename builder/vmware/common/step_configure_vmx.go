@@ -12,7 +12,8 @@ import (
 )
 
 // This step configures a VMX by setting some default settings as well
-// as taking in custom data to set, attaching a floppy if it exists, etc.
+// as taking in custom data to set, attaching a floppy or a CD if they exist,
+// etc.
 //
 // Uses:
 //   vmx_path string
@@ -79,6 +80,18 @@ func (s *StepConfigureVMX) Run(ctx context.Context, state multistep.StateBag) mu
 			tmpBuildDevices = append(tmpBuildDevices, "floppy0")
 		}
 
+		// Set a CD if we have one. The secondary IDE controller is never
+		// used by the installation ISO, so it's free for it.
+		if cdPathRaw, ok := state.GetOk("cd_path"); ok {
+			log.Println("CD path present, setting in VMX")
+			vmxData["ide1:0.present"] = "TRUE"
+			vmxData["ide1:0.filename"] = cdPathRaw.(string)
+			vmxData["ide1:0.devicetype"] = "cdrom-image"
+
+			// Add it to our list of build devices to later remove
+			tmpBuildDevices = append(tmpBuildDevices, "ide1:0")
+		}
+
 		// Build the list back in our statebag
 		state.Put("temporaryDevices", tmpBuildDevices)
 	}
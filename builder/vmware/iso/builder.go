@@ -95,6 +95,18 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Checksum:     "",
 			ChecksumType: "none",
 		},
+		&common.StepCreateCD{
+			Files:   b.config.CDConfig.CDFiles,
+			Content: b.config.CDConfig.CDContent,
+			Label:   b.config.CDConfig.CDLabel,
+		},
+		&vmwcommon.StepRemoteUpload{
+			Key:          "cd_path",
+			Message:      "Uploading CD to remote machine...",
+			DoCleanup:    true,
+			Checksum:     "",
+			ChecksumType: "none",
+		},
 		&vmwcommon.StepRemoteUpload{
 			Key:          "iso_path",
 			Message:      "Uploading ISO to remote machine...",
@@ -91,6 +91,18 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Checksum:     "",
 			ChecksumType: "none",
 		},
+		&common.StepCreateCD{
+			Files:   b.config.CDConfig.CDFiles,
+			Content: b.config.CDConfig.CDContent,
+			Label:   b.config.CDConfig.CDLabel,
+		},
+		&vmwcommon.StepRemoteUpload{
+			Key:          "cd_path",
+			Message:      "Uploading CD to remote machine...",
+			DoCleanup:    true,
+			Checksum:     "",
+			ChecksumType: "none",
+		},
 		&StepCloneVMX{
 			OutputDir: b.config.OutputDir,
 			Path:      b.config.SourcePath,
@@ -8,6 +8,7 @@ import (
 	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -57,6 +58,7 @@ type Config struct {
 	ParallelBuilds                 int64
 	OnError                        string
 	Path                           string
+	RecordSessions                 string
 }
 
 func (c *BuildCommand) ParseArgs(args []string) (Config, int) {
@@ -72,6 +74,7 @@ func (c *BuildCommand) ParseArgs(args []string) (Config, int) {
 	flags.Var(flagOnError, "on-error", "")
 	flags.BoolVar(&parallel, "parallel", true, "")
 	flags.Int64Var(&cfg.ParallelBuilds, "parallel-builds", 0, "")
+	flags.StringVar(&cfg.RecordSessions, "record-sessions", "", "")
 	if err := flags.Parse(args); err != nil {
 		return cfg, 1
 	}
@@ -172,12 +175,22 @@ func (c *BuildCommand) RunContext(buildCtx context.Context, args []string) int {
 	log.Printf("Force build: %v", cfg.Force)
 	log.Printf("On error: %v", cfg.OnError)
 
+	if cfg.RecordSessions != "" {
+		if err := os.MkdirAll(cfg.RecordSessions, 0755); err != nil {
+			c.Ui.Error(fmt.Sprintf("Failed to create session recording directory: %s", err))
+			return 1
+		}
+	}
+
 	// Set the debug and force mode and prepare all the builds
 	for _, b := range builds {
 		log.Printf("Preparing build: %s", b.Name())
 		b.SetDebug(cfg.Debug)
 		b.SetForce(cfg.Force)
 		b.SetOnError(cfg.OnError)
+		if cfg.RecordSessions != "" {
+			b.SetSessionRecording(filepath.Join(cfg.RecordSessions, b.Name()+".jsonl"))
+		}
 
 		warnings, err := b.Prepare()
 		if err != nil {
@@ -362,6 +375,7 @@ Options:
   -on-error=[cleanup|abort|ask] If the build fails do: clean up (default), abort, or ask.
   -parallel=false               Disable parallelization. (Default: true)
   -parallel-builds=1            Number of builds to run in parallel. 0 means no limit (Default: 0)
+  -record-sessions=path         Record what the provisioners of each build run to a file in this directory.
   -timestamp-ui                 Enable prefixing of each ui output with an RFC3339 timestamp.
   -var 'key=value'              Variable for templates, can be used multiple times.
   -var-file=path                JSON file containing user variables.
@@ -388,6 +402,7 @@ func (*BuildCommand) AutocompleteFlags() complete.Flags {
 		"-machine-readable": complete.PredictNothing,
 		"-on-error":         complete.PredictNothing,
 		"-parallel":         complete.PredictNothing,
+		"-record-sessions":  complete.PredictDirs("*"),
 		"-timestamp-ui":     complete.PredictNothing,
 		"-var":              complete.PredictNothing,
 		"-var-file":         complete.PredictNothing,
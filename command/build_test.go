@@ -279,6 +279,16 @@ func TestBuildCommand_ParseArgs(t *testing.T) {
 			},
 			0,
 		},
+		{fields{defaultMeta},
+			args{[]string{"-record-sessions=recordings", "file.json"}},
+			Config{
+				Path:           "file.json",
+				ParallelBuilds: math.MaxInt64,
+				Color:          true,
+				RecordSessions: "recordings",
+			},
+			0,
+		},
 		{fields{defaultMeta},
 			args{[]string{"-parallel=false", "-parallel-builds=5", "otherfile.json"}},
 			Config{
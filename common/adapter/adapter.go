@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/google/shlex"
@@ -17,7 +18,9 @@ import (
 )
 
 // An adapter satisfies SSH requests (from an Ansible client) by delegating SSH
-// exec and subsystem commands to a packer.Communicator.
+// exec and subsystem commands to a packer.Communicator. Port and agent
+// forwarding are delegated to communicators that are a packer.Dialer and a
+// packer.AgentForwarder.
 type Adapter struct {
 	done    <-chan struct{}
 	l       net.Listener
@@ -65,7 +68,7 @@ func (c *Adapter) Serve() {
 
 func (c *Adapter) Handle(conn net.Conn, ui packer.Ui) error {
 	log.Print("SSH proxy: accepted connection")
-	_, chans, reqs, err := ssh.NewServerConn(conn, c.config)
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, c.config)
 	if err != nil {
 		return errors.New("failed to handshake")
 	}
@@ -75,22 +78,70 @@ func (c *Adapter) Handle(conn net.Conn, ui packer.Ui) error {
 
 	// Service the incoming NewChannels
 	for newChannel := range chans {
-		if newChannel.ChannelType() != "session" {
+		switch newChannel.ChannelType() {
+		case "session":
+			go func(ch ssh.NewChannel) {
+				if err := c.handleSession(sshConn, ch); err != nil {
+					c.ui.Error(err.Error())
+				}
+			}(newChannel)
+		case "direct-tcpip":
+			go func(ch ssh.NewChannel) {
+				if err := c.handleDirectTCPIP(ch); err != nil {
+					log.Printf("SSH proxy: %s", err)
+				}
+			}(newChannel)
+		default:
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
 		}
+	}
 
-		go func(ch ssh.NewChannel) {
-			if err := c.handleSession(ch); err != nil {
-				c.ui.Error(err.Error())
-			}
-		}(newChannel)
+	return nil
+}
+
+// handleDirectTCPIP forwards a connection from the machine, for local port
+// forwarding. See RFC 4254, section 7.2.
+func (c *Adapter) handleDirectTCPIP(newChannel ssh.NewChannel) error {
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return err
+	}
+	address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	log.Printf("new direct-tcpip request: %s", address)
+
+	d, ok := c.comm.(packer.Dialer)
+	if !ok {
+		newChannel.Reject(ssh.Prohibited, packer.ErrDialUnsupported.Error())
+		return packer.ErrDialUnsupported
+	}
+	conn, err := d.Dial("tcp", address)
+	if err == packer.ErrDialUnsupported {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return err
+	}
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return fmt.Errorf("failed to forward connection to %s: %s", address, err)
+	}
+	defer conn.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return err
 	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
 
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
 	return nil
 }
 
-func (c *Adapter) handleSession(newChannel ssh.NewChannel) error {
+func (c *Adapter) handleSession(sshConn *ssh.ServerConn, newChannel ssh.NewChannel) error {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		return err
@@ -103,8 +154,31 @@ func (c *Adapter) handleSession(newChannel ssh.NewChannel) error {
 	// see RFC 4254, section 6
 	go func(in <-chan *ssh.Request) {
 		env := make([]envRequestPayload, 4)
+
+		// Opens connections to the agent of the client, once it asked
+		// for agent forwarding
+		var dialAgent func() (io.ReadWriteCloser, error)
+
 		for req := range in {
 			switch req.Type {
+			case "auth-agent-req@openssh.com":
+				if _, ok := c.comm.(packer.AgentForwarder); !ok {
+					log.Println("rejecting auth-agent-req request: the communicator can't forward agents")
+					req.Reply(false, nil)
+					continue
+				}
+
+				log.Println("new auth-agent-req request")
+				dialAgent = func() (io.ReadWriteCloser, error) {
+					channel, requests, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+					if err != nil {
+						return nil, err
+					}
+					go ssh.DiscardRequests(requests)
+					return channel, nil
+				}
+				req.Reply(true, nil)
+
 			case "pty-req":
 				log.Println("ansible provisioner pty-req request")
 				// accept pty-req requests, but don't actually do anything. Necessary for OpenSSH and sudo.
@@ -137,14 +211,14 @@ func (c *Adapter) handleSession(newChannel ssh.NewChannel) error {
 					return
 				}
 
-				go func(channel ssh.Channel) {
-					exit := c.exec(string(req.Payload), channel, channel, channel.Stderr())
+				go func(channel ssh.Channel, dialAgent func() (io.ReadWriteCloser, error)) {
+					exit := c.exec(string(req.Payload), channel, channel, channel.Stderr(), dialAgent)
 
 					exitStatus := make([]byte, 4)
 					binary.BigEndian.PutUint32(exitStatus, uint32(exit))
 					channel.SendRequest("exit-status", false, exitStatus)
 					close(done)
-				}(channel)
+				}(channel, dialAgent)
 				req.Reply(true, nil)
 			case "subsystem":
 				req, err := newSubsystemRequest(req)
@@ -164,7 +238,7 @@ func (c *Adapter) handleSession(newChannel ssh.NewChannel) error {
 
 					log.Print("starting sftp subsystem")
 					go func() {
-						_ = c.remoteExec(sftpCmd, channel, channel, channel.Stderr())
+						_ = c.remoteExec(sftpCmd, channel, channel, channel.Stderr(), nil)
 						close(done)
 					}()
 					req.Reply(true, nil)
@@ -187,7 +261,7 @@ func (c *Adapter) Shutdown() {
 	c.l.Close()
 }
 
-func (c *Adapter) exec(command string, in io.Reader, out io.Writer, err io.Writer) int {
+func (c *Adapter) exec(command string, in io.Reader, out io.Writer, err io.Writer, dialAgent func() (io.ReadWriteCloser, error)) int {
 	var exitStatus int
 	switch {
 	case strings.HasPrefix(command, "scp ") && serveSCP(command[4:]):
@@ -197,7 +271,7 @@ func (c *Adapter) exec(command string, in io.Reader, out io.Writer, err io.Write
 			exitStatus = 1
 		}
 	default:
-		exitStatus = c.remoteExec(command, in, out, err)
+		exitStatus = c.remoteExec(command, in, out, err, dialAgent)
 	}
 	return exitStatus
 }
@@ -227,17 +301,35 @@ func (c *Adapter) scpExec(args string, in io.Reader, out io.Writer) error {
 	return errors.New("no scp mode specified")
 }
 
-func (c *Adapter) remoteExec(command string, in io.Reader, out io.Writer, err io.Writer) int {
-	cmd := &packer.RemoteCmd{
-		Stdin:   in,
-		Stdout:  out,
-		Stderr:  err,
-		Command: command,
+// remoteExec runs the command with the communicator, forwarding the agent
+// dialAgent connects to if it isn't nil.
+func (c *Adapter) remoteExec(command string, in io.Reader, out io.Writer, err io.Writer, dialAgent func() (io.ReadWriteCloser, error)) int {
+	newCmd := func() *packer.RemoteCmd {
+		return &packer.RemoteCmd{
+			Stdin:   in,
+			Stdout:  out,
+			Stderr:  err,
+			Command: command,
+		}
 	}
 	ctx := context.TODO()
 
-	if err := c.comm.Start(ctx, cmd); err != nil {
-		c.ui.Error(err.Error())
+	var cmd *packer.RemoteCmd
+	startErr := packer.ErrAgentForwardingUnsupported
+	if f, ok := c.comm.(packer.AgentForwarder); ok && dialAgent != nil {
+		cmd = newCmd()
+		startErr = f.StartWithAgent(ctx, cmd, dialAgent)
+		if startErr == packer.ErrAgentForwardingUnsupported {
+			log.Printf("the communicator can't forward agents, running without agent: %s", command)
+		}
+	}
+	if startErr == packer.ErrAgentForwardingUnsupported {
+		// The command that wasn't started never exits
+		cmd = newCmd()
+		startErr = c.comm.Start(ctx, cmd)
+	}
+	if startErr != nil {
+		c.ui.Error(startErr.Error())
 	}
 
 	cmd.Wait()
@@ -245,6 +337,13 @@ func (c *Adapter) remoteExec(command string, in io.Reader, out io.Writer, err io
 	return cmd.ExitStatus()
 }
 
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
 type envRequest struct {
 	*ssh.Request
 	Payload envRequestPayload
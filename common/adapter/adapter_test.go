@@ -2,7 +2,9 @@ package adapter
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -12,7 +14,9 @@ import (
 
 	"github.com/hashicorp/packer/packer"
 
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestAdapter_Serve(t *testing.T) {
@@ -115,3 +119,203 @@ func (c communicator) Download(string, io.Writer) error {
 func (c communicator) DownloadDir(src string, dst string, exclude []string) error {
 	return errors.New("communicator not supported")
 }
+
+// forwardingCommunicator forwards connections from the host, and answers
+// commands started with an agent with the keys of the agent.
+type forwardingCommunicator struct {
+	communicator
+}
+
+func (c forwardingCommunicator) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func (c forwardingCommunicator) StartWithAgent(ctx context.Context, cmd *packer.RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	go func() {
+		status := 1
+		defer func() { cmd.SetExited(status) }()
+
+		conn, err := dial()
+		if err != nil {
+			fmt.Fprintln(cmd.Stderr, err)
+			return
+		}
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		if err != nil {
+			fmt.Fprintln(cmd.Stderr, err)
+			return
+		}
+		for _, key := range keys {
+			fmt.Fprintln(cmd.Stdout, key.Comment)
+		}
+		status = 0
+	}()
+	return nil
+}
+
+// noAgentCommunicator can't forward the agent once it tried to, and runs
+// commands without it.
+type noAgentCommunicator struct {
+	communicator
+	agentCmd *packer.RemoteCmd
+}
+
+func (c *noAgentCommunicator) StartWithAgent(ctx context.Context, cmd *packer.RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	c.agentCmd = cmd
+	return packer.ErrAgentForwardingUnsupported
+}
+
+func (c *noAgentCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	go func() {
+		if cmd == c.agentCmd {
+			fmt.Fprintln(cmd.Stderr, "the command that wasn't started is started again")
+			cmd.SetExited(1)
+			return
+		}
+		fmt.Fprintln(cmd.Stdout, "no agent")
+		cmd.SetExited(0)
+	}()
+	return nil
+}
+
+func newTestAdapter(t *testing.T, comm packer.Communicator) (*ssh.Client, func()) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	done := make(chan struct{})
+	sut := NewAdapter(done, l, config, "", new(packer.NoopUi), comm)
+	go sut.Serve()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return client, func() {
+		client.Close()
+		close(done)
+		sut.Shutdown()
+	}
+}
+
+func TestAdapter_directTCPIP(t *testing.T) {
+	// An echo server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	client, shutdown := newTestAdapter(t, forwardingCommunicator{})
+	defer shutdown()
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	// Communicators that can't forward connections reject them
+	client, shutdown = newTestAdapter(t, communicator{})
+	defer shutdown()
+	if _, err := client.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestAdapter_agentForwarding(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test key"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client, shutdown := newTestAdapter(t, forwardingCommunicator{})
+	defer shutdown()
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer session.Close()
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out, err := session.Output("ssh-add -l")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(out) != "test key\n" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestAdapter_agentForwardingUnsupported(t *testing.T) {
+	client, shutdown := newTestAdapter(t, new(noAgentCommunicator))
+	defer shutdown()
+	if err := agent.ForwardToAgent(client, agent.NewKeyring()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer session.Close()
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out, err := session.Output("ssh-add -l")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(out) != "no agent\n" {
+		t.Fatalf("bad: %q", out)
+	}
+}
@@ -0,0 +1,67 @@
+//go:generate struct-markdown
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// A CD can be made available for your build. This is most useful for
+// installers and cloud-init, which read answer files and seed data from a
+// CD, where a floppy is too small or not supported. By default, no CD will
+// be attached. The CD is an ISO9660 image with Joliet extensions, created
+// without any external tool, and is attached in addition to the
+// installation ISO.
+type CDConfig struct {
+	// A list of files to place onto a CD that is attached when the VM is
+	// booted. Files are placed into the root directory of the CD. Directories
+	// are copied with their structure, as a directory of the same name, or
+	// into the root directory if the path ends with a slash. Wildcard
+	// characters (\*, ?, and \[\]) are allowed.
+	CDFiles []string `mapstructure:"cd_files"`
+	// Files to create on the CD, with their content. The keys are the paths
+	// of the files on the CD, which can include directories, and the values
+	// their content. This is useful to write cloud-init seeds with user
+	// variables in them.
+	CDContent map[string]string `mapstructure:"cd_content"`
+	// The volume label of the CD, at most 32 characters. Defaults to
+	// `packer`. cloud-init looks for a CD labeled `cidata`.
+	CDLabel string `mapstructure:"cd_label"`
+}
+
+func (c *CDConfig) Prepare(ctx *interpolate.Context) []error {
+	var errs []error
+	var err error
+
+	if c.CDFiles == nil {
+		c.CDFiles = make([]string, 0)
+	}
+
+	for _, path := range c.CDFiles {
+		if strings.ContainsAny(path, "*?[") {
+			_, err = filepath.Glob(path)
+		} else {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad CD disk file '%s': %s", path, err))
+		}
+	}
+
+	for path := range c.CDContent {
+		if strings.Trim(filepath.ToSlash(path), "/") == "" {
+			errs = append(errs, fmt.Errorf("Bad CD content path '%s'", path))
+		}
+	}
+
+	if len(c.CDLabel) > 32 {
+		errs = append(errs, fmt.Errorf("cd_label must be at most 32 characters: %s", c.CDLabel))
+	}
+
+	return errs
+}
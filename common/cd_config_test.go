@@ -0,0 +1,31 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCDConfigPrepare(t *testing.T) {
+	c := CDConfig{}
+	if errs := c.Prepare(nil); len(errs) != 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = CDConfig{
+		CDFiles:   []string{"cd_config.go", "test-fixtures/floppies/*"},
+		CDContent: map[string]string{"meta-data": "instance-id: packer"},
+		CDLabel:   "cidata",
+	}
+	if errs := c.Prepare(nil); len(errs) != 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = CDConfig{
+		CDFiles:   []string{"does_not_exist.go"},
+		CDContent: map[string]string{"/": "foo"},
+		CDLabel:   strings.Repeat("a", 33),
+	}
+	if errs := c.Prepare(nil); len(errs) != 3 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
@@ -0,0 +1,651 @@
+// Package iso9660 writes ISO9660 images with Joliet extensions, the format
+// of CDs and of the seed images read by installers and cloud-init.
+//
+// File names are kept as is in the Joliet directory tree, which is the one
+// read by Linux and Windows. The primary tree, for the readers that only
+// understand plain ISO9660, has names mapped to upper case d-characters.
+package iso9660
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// The volume descriptors start after the system area.
+	systemAreaSectors = 16
+
+	// The maximum length of the names of files and directories in the
+	// primary tree, following level 2 of ISO9660, and in the Joliet tree,
+	// in characters.
+	maxPrimaryNameLen = 30
+	maxJolietNameLen  = 64
+
+	// The size of the data of a file is recorded on 32 bits.
+	maxFileSize = 1<<32 - 1
+
+	flagDirectory = 0x02
+)
+
+// An Image is an ISO9660 image being put together. Files are only read
+// when the image is written.
+type Image struct {
+	// The volume label of the image.
+	Label string
+
+	// The time recorded for every file and directory.
+	Time time.Time
+
+	root *node
+}
+
+// New returns an empty image with the given volume label.
+func New(label string) *Image {
+	return &Image{
+		Label: label,
+		Time:  time.Now(),
+		root:  &node{name: "", children: make(map[string]*node)},
+	}
+}
+
+// node is a file or a directory of the image.
+type node struct {
+	name     string
+	parent   *node
+	children map[string]*node
+
+	size int64
+	open func() (io.ReadCloser, error)
+
+	// The names, sorted children, extents and path table numbers of the
+	// node in each of the trees.
+	trees [2]treeEntry
+
+	// The extent of the data of a file, shared by both trees.
+	dataLBA uint32
+}
+
+type treeEntry struct {
+	name   string
+	id     []byte
+	sorted []*node
+	lba    uint32
+	size   uint32
+	number uint16
+}
+
+func (n *node) isDir() bool {
+	return n.children != nil
+}
+
+// AddFile adds the local file src to the image at the slash separated path
+// name. Missing parent directories are created.
+func (img *Image) AddFile(name string, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+	return img.add(name, info.Size(), func() (io.ReadCloser, error) {
+		return os.Open(src)
+	})
+}
+
+// AddContent adds a file with the given content to the image at the slash
+// separated path name. Missing parent directories are created.
+func (img *Image) AddContent(name string, content []byte) error {
+	return img.add(name, int64(len(content)), func() (io.ReadCloser, error) {
+		return nopCloser{bytes.NewReader(content)}, nil
+	})
+}
+
+// AddDir adds an empty directory to the image at the slash separated path
+// name, with its missing parents.
+func (img *Image) AddDir(name string) error {
+	_, err := img.dir(strings.Split(cleanPath(name), "/"))
+	return err
+}
+
+func (img *Image) add(name string, size int64, open func() (io.ReadCloser, error)) error {
+	name = cleanPath(name)
+	if name == "" {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if size > maxFileSize {
+		return fmt.Errorf("%s is too large for an ISO9660 image", name)
+	}
+
+	dir, base := path.Split(name)
+	parent, err := img.dir(strings.Split(strings.TrimSuffix(dir, "/"), "/"))
+	if err != nil {
+		return err
+	}
+	if existing, ok := parent.children[base]; ok && existing.isDir() {
+		return fmt.Errorf("%s is already a directory", name)
+	}
+	parent.children[base] = &node{name: base, parent: parent, size: size, open: open}
+	return nil
+}
+
+// dir returns the directory with the given path components, creating it
+// and its parents if needed.
+func (img *Image) dir(components []string) (*node, error) {
+	dir := img.root
+	for _, c := range components {
+		if c == "" {
+			continue
+		}
+		child, ok := dir.children[c]
+		if !ok {
+			child = &node{name: c, parent: dir, children: make(map[string]*node)}
+			dir.children[c] = child
+		} else if !child.isDir() {
+			return nil, fmt.Errorf("%s is already a file", c)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func cleanPath(name string) string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	return strings.TrimPrefix(name, "/")
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+const (
+	primaryTree = 0
+	jolietTree  = 1
+)
+
+// layout is the position of everything in the image.
+type layout struct {
+	// The directories of each tree, in path table order.
+	dirs [2][]*node
+	// The files, in the order their data is written.
+	files []*node
+
+	pathTableSize [2]uint32
+	// The extents of the L and M path tables of each tree.
+	pathTableLBA [2][2]uint32
+
+	sectors uint32
+}
+
+// WriteTo writes the image to w.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	l := img.layout()
+	cw := &countingWriter{w: w}
+
+	if _, err := cw.Write(make([]byte, systemAreaSectors*sectorSize)); err != nil {
+		return cw.n, err
+	}
+	for _, vd := range [][]byte{
+		img.volumeDescriptor(l, primaryTree),
+		img.volumeDescriptor(l, jolietTree),
+		terminator(),
+	} {
+		if _, err := cw.Write(vd); err != nil {
+			return cw.n, err
+		}
+	}
+
+	for tree := range l.dirs {
+		for _, bigEndian := range []bool{false, true} {
+			if _, err := cw.Write(pad(pathTable(l.dirs[tree], tree, bigEndian))); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+
+	for tree := range l.dirs {
+		for _, dir := range l.dirs[tree] {
+			if _, err := cw.Write(img.directory(dir, tree)); err != nil {
+				return cw.n, err
+			}
+		}
+	}
+
+	for _, file := range l.files {
+		if err := writeFile(cw, file); err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, nil
+}
+
+func writeFile(w io.Writer, file *node) error {
+	r, err := file.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(w, io.LimitReader(r, file.size))
+	if err != nil {
+		return err
+	}
+	if n != file.size {
+		return fmt.Errorf("%s changed size while writing the image", file.name)
+	}
+
+	if rest := n % sectorSize; rest != 0 {
+		_, err = w.Write(make([]byte, sectorSize-rest))
+	}
+	return err
+}
+
+func (img *Image) layout() *layout {
+	l := new(layout)
+	for tree := range l.dirs {
+		l.dirs[tree] = sortTree(img.root, tree)
+		for i, dir := range l.dirs[tree] {
+			dir.trees[tree].number = uint16(i + 1)
+			dir.trees[tree].size = directorySize(dir, tree)
+		}
+		l.pathTableSize[tree] = uint32(len(pathTable(l.dirs[tree], tree, false)))
+	}
+
+	lba := uint32(systemAreaSectors + 3)
+	for tree := range l.dirs {
+		for i := range l.pathTableLBA[tree] {
+			l.pathTableLBA[tree][i] = lba
+			lba += sectors(int64(l.pathTableSize[tree]))
+		}
+	}
+	for tree := range l.dirs {
+		for _, dir := range l.dirs[tree] {
+			dir.trees[tree].lba = lba
+			lba += sectors(int64(dir.trees[tree].size))
+		}
+	}
+	for _, dir := range l.dirs[primaryTree] {
+		for _, child := range dir.trees[primaryTree].sorted {
+			if child.isDir() {
+				continue
+			}
+			child.dataLBA = lba
+			lba += sectors(child.size)
+			l.files = append(l.files, child)
+		}
+	}
+
+	l.sectors = lba
+	return l
+}
+
+// sortTree names and sorts the children of every directory of a tree, and
+// returns its directories in path table order: by level, then by parent,
+// then by name.
+func sortTree(root *node, tree int) []*node {
+	root.trees[tree].id = []byte{0}
+	dirs := []*node{root}
+	for i := 0; i < len(dirs); i++ {
+		dir := dirs[i]
+		entries := nameChildren(dir, tree)
+		dir.trees[tree].sorted = entries
+		for _, child := range entries {
+			if child.isDir() {
+				dirs = append(dirs, child)
+			}
+		}
+	}
+	return dirs
+}
+
+// nameChildren computes the names of the children of dir in a tree, making
+// them unique, and returns the children sorted by name.
+func nameChildren(dir *node, tree int) []*node {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	used := make(map[string]bool)
+	children := make([]*node, 0, len(names))
+	for _, name := range names {
+		child := dir.children[name]
+		var id string
+		for i := 0; ; i++ {
+			if tree == primaryTree {
+				id = primaryName(name, child.isDir(), i)
+			} else {
+				id = jolietName(name, i)
+			}
+			if !used[id] {
+				break
+			}
+		}
+		used[id] = true
+
+		child.trees[tree].name = id
+		if tree == primaryTree {
+			child.trees[tree].id = []byte(id)
+		} else {
+			child.trees[tree].id = ucs2(id)
+		}
+		children = append(children, child)
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(children[i].trees[tree].id, children[j].trees[tree].id) < 0
+	})
+	return children
+}
+
+// primaryName maps name to d-characters. Files get an extension and a
+// version number, as ISO9660 requires. A non zero n makes the name unique.
+func primaryName(name string, isDir bool, n int) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r == '.' && !isDir:
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	base, ext := mapped, ""
+	if i := strings.LastIndex(mapped, "."); i >= 0 {
+		base, ext = mapped[:i], mapped[i+1:]
+	}
+	base = strings.Replace(base, ".", "_", -1)
+
+	limit := maxPrimaryNameLen
+	if !isDir {
+		ext = truncate(ext, 10)
+		limit -= 1 + len(ext)
+	}
+	if n > 0 {
+		suffix := fmt.Sprintf("~%d", n)
+		base = truncate(base, limit-len(suffix)) + suffix
+	} else {
+		base = truncate(base, limit)
+	}
+
+	if isDir {
+		return base
+	}
+	return base + "." + ext + ";1"
+}
+
+// jolietName replaces the characters Joliet doesn't allow in name. A non
+// zero n makes the name unique.
+func jolietName(name string, n int) string {
+	runes := []rune(strings.Map(func(r rune) rune {
+		if strings.ContainsRune("*/:;?\\", r) || r > 0xffff {
+			return '_'
+		}
+		return r
+	}, name))
+
+	suffix := ""
+	if n > 0 {
+		suffix = fmt.Sprintf("~%d", n)
+	}
+	if max := maxJolietNameLen - len(suffix); len(runes) > max {
+		runes = runes[:max]
+	}
+	return string(runes) + suffix
+}
+
+func truncate(s string, n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// ucs2 encodes s in big endian UCS-2, as Joliet does.
+func ucs2(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		b[2*i] = byte(c >> 8)
+		b[2*i+1] = byte(c)
+	}
+	return b
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+func pad(b []byte) []byte {
+	if rest := len(b) % sectorSize; rest != 0 {
+		b = append(b, make([]byte, sectorSize-rest)...)
+	}
+	return b
+}
+
+func recordLen(idLen int) int {
+	return 33 + idLen + (idLen+1)%2
+}
+
+// directorySize returns the size of the extent of the records of dir.
+// Records don't cross sector boundaries.
+func directorySize(dir *node, tree int) uint32 {
+	size := 0
+	add := func(n int) {
+		if size%sectorSize+n > sectorSize {
+			size += sectorSize - size%sectorSize
+		}
+		size += n
+	}
+
+	add(recordLen(1))
+	add(recordLen(1))
+	for _, child := range dir.trees[tree].sorted {
+		add(recordLen(len(child.trees[tree].id)))
+	}
+	return sectors(int64(size)) * sectorSize
+}
+
+// directory returns the extent of the records of dir in a tree.
+func (img *Image) directory(dir *node, tree int) []byte {
+	b := make([]byte, 0, dir.trees[tree].size)
+	add := func(rec []byte) {
+		if len(b)%sectorSize+len(rec) > sectorSize {
+			b = append(b, make([]byte, sectorSize-len(b)%sectorSize)...)
+		}
+		b = append(b, rec...)
+	}
+
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+	add(img.record([]byte{0}, dir.trees[tree].lba, dir.trees[tree].size, true))
+	add(img.record([]byte{1}, parent.trees[tree].lba, parent.trees[tree].size, true))
+	for _, child := range dir.trees[tree].sorted {
+		if child.isDir() {
+			add(img.record(child.trees[tree].id, child.trees[tree].lba, child.trees[tree].size, true))
+		} else {
+			add(img.record(child.trees[tree].id, child.dataLBA, uint32(child.size), false))
+		}
+	}
+	return pad(b)
+}
+
+// record returns a directory record.
+func (img *Image) record(id []byte, lba uint32, size uint32, isDir bool) []byte {
+	rec := make([]byte, recordLen(len(id)))
+	rec[0] = byte(len(rec))
+	putBoth32(rec[2:], lba)
+	putBoth32(rec[10:], size)
+	copy(rec[18:25], recordTime(img.Time))
+	if isDir {
+		rec[25] = flagDirectory
+	}
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(id))
+	copy(rec[33:], id)
+	return rec
+}
+
+// pathTable returns the path table of the directories of a tree.
+func pathTable(dirs []*node, tree int, bigEndian bool) []byte {
+	var b []byte
+	for _, dir := range dirs {
+		id := dir.trees[tree].id
+		entry := make([]byte, 8+len(id)+len(id)%2)
+		entry[0] = byte(len(id))
+
+		parent := uint16(1)
+		if dir.parent != nil {
+			parent = dir.parent.trees[tree].number
+		}
+		if bigEndian {
+			putBE32(entry[2:], dir.trees[tree].lba)
+			putBE16(entry[6:], parent)
+		} else {
+			putLE32(entry[2:], dir.trees[tree].lba)
+			putLE16(entry[6:], parent)
+		}
+		copy(entry[8:], id)
+		b = append(b, entry...)
+	}
+	return b
+}
+
+// volumeDescriptor returns the primary volume descriptor, or the Joliet
+// supplementary one.
+func (img *Image) volumeDescriptor(l *layout, tree int) []byte {
+	vd := make([]byte, sectorSize)
+	vd[0] = 1
+	copy(vd[1:6], "CD001")
+	vd[6] = 1
+
+	text := func(b []byte, s string) {
+		if tree == primaryTree {
+			copy(b, s+strings.Repeat(" ", len(b)))
+			return
+		}
+		copy(b, ucs2(s+strings.Repeat(" ", len(b)/2)))
+	}
+
+	text(vd[8:40], "")
+	text(vd[40:72], img.Label)
+	if tree == jolietTree {
+		vd[0] = 2
+		// UCS-2 level 3
+		copy(vd[88:91], "%/E")
+	}
+	putBoth32(vd[80:], l.sectors)
+	putBoth16(vd[120:], 1)
+	putBoth16(vd[124:], 1)
+	putBoth16(vd[128:], sectorSize)
+	putBoth32(vd[132:], l.pathTableSize[tree])
+	putLE32(vd[140:], l.pathTableLBA[tree][0])
+	putBE32(vd[148:], l.pathTableLBA[tree][1])
+
+	root := img.root.trees[tree]
+	copy(vd[156:190], img.record([]byte{0}, root.lba, root.size, true))
+
+	for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {702, 739}, {739, 776}, {776, 813}} {
+		text(vd[field[0]:field[1]], "")
+	}
+	text(vd[574:702], "PACKER")
+
+	created := volumeTime(img.Time)
+	copy(vd[813:830], created)
+	copy(vd[830:847], created)
+	copy(vd[847:864], volumeTime(time.Time{}))
+	copy(vd[864:881], created)
+	vd[881] = 1
+	return vd
+}
+
+func terminator() []byte {
+	vd := make([]byte, sectorSize)
+	vd[0] = 255
+	copy(vd[1:6], "CD001")
+	vd[6] = 1
+	return vd
+}
+
+// recordTime encodes t for directory records.
+func recordTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{
+		byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()),
+		0,
+	}
+}
+
+// volumeTime encodes t for volume descriptors. The zero time means not
+// specified.
+func volumeTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+	t = t.UTC()
+	s := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e7)
+	return append([]byte(s), 0)
+}
+
+func putLE16(b []byte, v uint16) {
+	b[0], b[1] = byte(v), byte(v>>8)
+}
+
+func putBE16(b []byte, v uint16) {
+	b[0], b[1] = byte(v>>8), byte(v)
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+}
+
+func putBE32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+}
+
+// putBoth16 and putBoth32 encode v in both byte orders, as most numbers of
+// ISO9660 are.
+func putBoth16(b []byte, v uint16) {
+	putLE16(b, v)
+	putBE16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	putLE32(b, v)
+	putBE32(b[4:], v)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,168 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// readTree returns the content of the files of the tree of the volume
+// descriptor at sector vd, by path.
+func readTree(t *testing.T, image []byte, vd int) map[string]string {
+	desc := image[vd*sectorSize : (vd+1)*sectorSize]
+	if string(desc[1:6]) != "CD001" {
+		t.Fatalf("bad volume descriptor: %q", desc[:7])
+	}
+	joliet := desc[0] == 2
+
+	files := make(map[string]string)
+	var walk func(dir string, lba, size uint32)
+	walk = func(dir string, lba, size uint32) {
+		extent := image[lba*sectorSize : lba*sectorSize+size]
+		for i := 0; i < len(extent); {
+			n := int(extent[i])
+			if n == 0 {
+				// Padding up to the next sector
+				i = (i/sectorSize + 1) * sectorSize
+				continue
+			}
+			rec := extent[i : i+n]
+			i += n
+
+			id := rec[33 : 33+int(rec[32])]
+			if len(id) == 1 && id[0] <= 1 {
+				continue
+			}
+			name := string(id)
+			if joliet {
+				u := make([]uint16, len(id)/2)
+				for j := range u {
+					u[j] = binary.BigEndian.Uint16(id[2*j:])
+				}
+				name = string(utf16.Decode(u))
+			}
+
+			childLBA := binary.LittleEndian.Uint32(rec[2:])
+			childSize := binary.LittleEndian.Uint32(rec[10:])
+			if rec[25]&flagDirectory != 0 {
+				walk(path.Join(dir, name), childLBA, childSize)
+				continue
+			}
+			files[path.Join(dir, name)] = string(image[childLBA*sectorSize : childLBA*sectorSize+childSize])
+		}
+	}
+
+	root := desc[156:190]
+	walk("", binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]))
+	return files
+}
+
+func TestImage(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.WriteString("#cloud-config\n")
+	tf.Close()
+
+	img := New("cidata")
+	if err := img.AddFile("user-data", tf.Name()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := img.AddContent("meta-data", []byte("instance-id: packer\n")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := img.AddContent("openstack/latest/meta_data.json", []byte("{}")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := img.AddContent("empty", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Enough files for the records of a directory to span several sectors
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("drivers/a-rather-long-driver-name-%d.inf", i)
+		if err := img.AddContent(name, bytes.Repeat([]byte{byte(i)}, i*50)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := img.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	image := buf.Bytes()
+	if n != int64(len(image)) || len(image)%sectorSize != 0 {
+		t.Fatalf("bad size: %d", n)
+	}
+	if label := string(image[16*sectorSize+40 : 16*sectorSize+46]); label != "cidata" {
+		t.Fatalf("bad label: %s", label)
+	}
+
+	joliet := readTree(t, image, 17)
+	if len(joliet) != 104 {
+		t.Fatalf("bad: %d files", len(joliet))
+	}
+	expected := map[string]string{
+		"user-data":                       "#cloud-config\n",
+		"meta-data":                       "instance-id: packer\n",
+		"openstack/latest/meta_data.json": "{}",
+		"empty":                           "",
+		"drivers/a-rather-long-driver-name-42.inf": strings.Repeat("\x2a", 42*50),
+	}
+	for name, content := range expected {
+		if joliet[name] != content {
+			t.Fatalf("bad %s: %q", name, joliet[name])
+		}
+	}
+
+	primary := readTree(t, image, 16)
+	if len(primary) != 104 {
+		t.Fatalf("bad: %d files", len(primary))
+	}
+	if primary["USER_DATA.;1"] != "#cloud-config\n" || primary["OPENSTACK/LATEST/META_DATA.JSON;1"] != "{}" {
+		t.Fatalf("bad: %#v", primary)
+	}
+}
+
+func TestImage_conflicts(t *testing.T) {
+	img := New("packer")
+	if err := img.AddContent("foo/bar", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := img.AddContent("foo", nil); err == nil {
+		t.Fatal("should not replace a directory with a file")
+	}
+	if err := img.AddContent("foo/bar/baz", nil); err == nil {
+		t.Fatal("should not replace a file with a directory")
+	}
+}
+
+func TestPrimaryName(t *testing.T) {
+	cases := []struct {
+		name  string
+		isDir bool
+		n     int
+		want  string
+	}{
+		{"user-data", false, 0, "USER_DATA.;1"},
+		{"autounattend.xml", false, 0, "AUTOUNATTEND.XML;1"},
+		{"archive.tar.gz", false, 0, "ARCHIVE_TAR.GZ;1"},
+		{"my.drivers", true, 0, "MY_DRIVERS"},
+		{"setup.exe", false, 2, "SETUP~2.EXE;1"},
+		{strings.Repeat("a", 40) + ".txt", false, 0, strings.Repeat("A", 26) + ".TXT;1"},
+	}
+
+	for _, tc := range cases {
+		if got := primaryName(tc.name, tc.isDir, tc.n); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
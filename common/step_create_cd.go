@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer/common/iso9660"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/packer/tmp"
+)
+
+// StepCreateCD will create a CD image with the given files and content.
+//
+// Produces:
+//   cd_path string - The path to the CD image.
+type StepCreateCD struct {
+	Files   []string
+	Content map[string]string
+	Label   string
+
+	cdPath string
+
+	FilesAdded map[string]bool
+}
+
+func (s *StepCreateCD) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if len(s.Files) == 0 && len(s.Content) == 0 {
+		log.Println("No CD files specified. CD disk will not be made.")
+		return multistep.ActionContinue
+	}
+
+	if s.Label == "" {
+		s.Label = "packer"
+	} else {
+		log.Printf("CD label is set to %s", s.Label)
+	}
+
+	s.FilesAdded = make(map[string]bool)
+
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say("Creating CD disk...")
+
+	img := iso9660.New(s.Label)
+	for _, pattern := range s.Files {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(pattern); err != nil {
+				state.Put("error", fmt.Errorf("Error adding path %s to CD: %s", pattern, err))
+				return multistep.ActionHalt
+			}
+		}
+
+		for _, src := range matches {
+			if err := s.add(ui, img, src); err != nil {
+				state.Put("error", fmt.Errorf("Error adding path %s to CD: %s", src, err))
+				return multistep.ActionHalt
+			}
+		}
+	}
+
+	names := make([]string, 0, len(s.Content))
+	for name := range s.Content {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ui.Message(fmt.Sprintf("Adding content: %s", name))
+		if err := img.AddContent(filepath.ToSlash(name), []byte(s.Content[name])); err != nil {
+			state.Put("error", fmt.Errorf("Error adding %s to CD: %s", name, err))
+			return multistep.ActionHalt
+		}
+	}
+
+	// Create a temporary file to be our CD
+	cdF, err := tmp.File("packer*.iso")
+	if err != nil {
+		state.Put("error",
+			fmt.Errorf("Error creating temporary file for CD: %s", err))
+		return multistep.ActionHalt
+	}
+	defer cdF.Close()
+
+	// Set the path so we can remove it later
+	s.cdPath = cdF.Name()
+	log.Printf("CD path: %s", s.cdPath)
+
+	if _, err := img.WriteTo(cdF); err != nil {
+		state.Put("error", fmt.Errorf("Error creating CD: %s", err))
+		return multistep.ActionHalt
+	}
+
+	// Set the path to the CD so it can be used later
+	state.Put("cd_path", s.cdPath)
+
+	return multistep.ActionContinue
+}
+
+// add adds the file or directory src to the image. A directory is added as
+// a directory of the same name, or into the root if src ends with a slash.
+func (s *StepCreateCD) add(ui packer.Ui, img *iso9660.Image, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		ui.Message(fmt.Sprintf("Adding file: %s", src))
+		s.FilesAdded[src] = true
+		return img.AddFile(filepath.Base(src), src)
+	}
+
+	ui.Message(fmt.Sprintf("Adding directory: %s", src))
+	prefix := ""
+	if !strings.HasSuffix(filepath.ToSlash(src), "/") {
+		prefix = filepath.Base(src)
+	}
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			if name == "." || name == "" {
+				return nil
+			}
+			return img.AddDir(name)
+		}
+		s.FilesAdded[p] = true
+		return img.AddFile(name, p)
+	})
+}
+
+func (s *StepCreateCD) Cleanup(multistep.StateBag) {
+	if s.cdPath != "" {
+		log.Printf("Deleting CD disk: %s", s.cdPath)
+		os.Remove(s.cdPath)
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+func TestStepCreateCD_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(StepCreateCD)
+	if _, ok := raw.(multistep.Step); !ok {
+		t.Fatalf("StepCreateCD should be a step")
+	}
+}
+
+func TestStepCreateCD(t *testing.T) {
+	state := testStepCreateFloppyState(t)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "drivers", "net"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files := []string{
+		filepath.Join(dir, "Autounattend.xml"),
+		filepath.Join(dir, "drivers", "net", "e1000.inf"),
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(f, []byte("foo"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	step := &StepCreateCD{
+		Files:   []string{filepath.Join(dir, "*.xml"), filepath.Join(dir, "drivers")},
+		Content: map[string]string{"meta-data": "instance-id: packer"},
+		Label:   "cidata",
+	}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("state should be ok: %s", state.Get("error"))
+	}
+
+	cdPath := state.Get("cd_path").(string)
+	info, err := os.Stat(cdPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Size() == 0 || info.Size()%2048 != 0 {
+		t.Fatalf("bad size: %d", info.Size())
+	}
+	for _, f := range files {
+		if !step.FilesAdded[f] {
+			t.Fatalf("%s should have been added: %#v", f, step.FilesAdded)
+		}
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(cdPath); !os.IsNotExist(err) {
+		t.Fatalf("CD should be removed: %s", cdPath)
+	}
+}
+
+func TestStepCreateCD_noFiles(t *testing.T) {
+	state := testStepCreateFloppyState(t)
+	step := new(StepCreateCD)
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("cd_path"); ok {
+		t.Fatal("should not create a CD")
+	}
+}
+
+func TestStepCreateCD_missingFile(t *testing.T) {
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateCD{Files: []string{"does-not-exist"}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should error")
+	}
+}
@@ -1,9 +1,13 @@
 package ssh
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/packer/packer"
@@ -33,6 +38,16 @@ type comm struct {
 	config  *Config
 	conn    net.Conn
 	address string
+
+	// The agents forwarded to the machine: the local agent, and the ones
+	// of the commands started with StartWithAgent, latest last.
+	agentLock  sync.Mutex
+	localAgent agent.Agent
+	agentDials []*agentDial
+}
+
+type agentDial struct {
+	dial func() (io.ReadWriteCloser, error)
 }
 
 // TunnelDirection is the supported tunnel directions
@@ -104,6 +119,42 @@ func New(address string, config *Config) (result *comm, err error) {
 }
 
 func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
+	return c.start(cmd, nil)
+}
+
+// StartWithAgent implements packer.AgentForwarder.
+func (c *comm) StartWithAgent(ctx context.Context, cmd *packer.RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	// The agent must be known before the command can connect to it
+	d := &agentDial{dial: dial}
+	c.agentLock.Lock()
+	c.agentDials = append(c.agentDials, d)
+	c.agentLock.Unlock()
+
+	removeAgent := func() {
+		c.agentLock.Lock()
+		defer c.agentLock.Unlock()
+		for i, other := range c.agentDials {
+			if other == d {
+				c.agentDials = append(c.agentDials[:i], c.agentDials[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if err := c.start(cmd, agent.RequestAgentForwarding); err != nil {
+		removeAgent()
+		return err
+	}
+
+	go func() {
+		cmd.Wait()
+		removeAgent()
+	}()
+	return nil
+}
+
+// start starts cmd in a new session, set up by setup if it isn't nil.
+func (c *comm) start(cmd *packer.RemoteCmd, setup func(*ssh.Session) error) (err error) {
 	session, err := c.newSession()
 	if err != nil {
 		return
@@ -114,6 +165,13 @@ func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
 	session.Stdout = cmd.Stdout
 	session.Stderr = cmd.Stderr
 
+	if setup != nil {
+		if err = setup(session); err != nil {
+			session.Close()
+			return
+		}
+	}
+
 	if c.config.Pty {
 		// Request a PTY
 		termModes := ssh.TerminalModes{
@@ -133,6 +191,62 @@ func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
 		return
 	}
 
+	c.waitSession(session, cmd)
+	return
+}
+
+// StartPty implements packer.PtyStarter.
+func (c *comm) StartPty(ctx context.Context, cmd *packer.RemoteCmd, term string, size packer.PtySize, resize <-chan packer.PtySize) (err error) {
+	session, err := c.newSession()
+	if err != nil {
+		return
+	}
+
+	// Setup our session
+	session.Stdin = cmd.Stdin
+	session.Stdout = cmd.Stdout
+	session.Stderr = cmd.Stderr
+
+	termModes := ssh.TerminalModes{
+		ssh.ECHO:          1,     // echo, the session is interactive
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	if err = session.RequestPty(term, size.Height, size.Width, termModes); err != nil {
+		session.Close()
+		return
+	}
+
+	if cmd.Command == "" {
+		log.Printf("[DEBUG] starting remote shell")
+		err = session.Shell()
+	} else {
+		log.Printf("[DEBUG] starting remote command in pty: %s", cmd.Command)
+		err = session.Start(cmd.Command)
+	}
+	if err != nil {
+		session.Close()
+		return
+	}
+
+	if resize != nil {
+		go func() {
+			for size := range resize {
+				if err := session.WindowChange(size.Height, size.Width); err != nil {
+					log.Printf("[WARN] Error resizing pty: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	c.waitSession(session, cmd)
+	return
+}
+
+// waitSession keeps the started session alive and sets the exit status of
+// cmd once it ends.
+func (c *comm) waitSession(session *ssh.Session, cmd *packer.RemoteCmd) {
 	go func() {
 		if c.config.KeepAliveInterval <= 0 {
 			return
@@ -168,7 +282,6 @@ func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
 		}
 		cmd.SetExited(exitStatus)
 	}()
-	return
 }
 
 func (c *comm) Upload(path string, input io.Reader, fi *os.FileInfo) error {
@@ -188,6 +301,23 @@ func (c *comm) UploadDir(dst string, src string, excl []string) error {
 	}
 }
 
+// UploadDirWithMode implements packer.DirUploader. The delta mode needs SFTP
+// on the remote end, and checksums files with sha256sum when available. The
+// tar mode needs tar and gzip.
+func (c *comm) UploadDirWithMode(mode string, dst string, src string, excl []string) error {
+	log.Printf("[DEBUG] Upload dir '%s' to '%s' (%s)", src, dst, mode)
+	switch mode {
+	case packer.UploadDirFull:
+		return c.UploadDir(dst, src, excl)
+	case packer.UploadDirDelta:
+		return c.deltaUploadDirSession(dst, src)
+	case packer.UploadDirTar:
+		return c.tarUploadDirSession(dst, src)
+	default:
+		return packer.ErrUploadDirModeUnsupported
+	}
+}
+
 func (c *comm) DownloadDir(src string, dst string, excl []string) error {
 	log.Printf("[DEBUG] Download dir '%s' to '%s'", src, dst)
 	scpFunc := func(w io.Writer, stdoutR *bufio.Reader) error {
@@ -362,6 +492,7 @@ func (c *comm) reconnect() (err error) {
 	log.Printf("[DEBUG] handshake complete!")
 	if sshConn != nil {
 		c.client = ssh.NewClient(sshConn, sshChan, req)
+		c.serveAgents(c.client)
 	}
 	c.connectToAgent()
 	err = c.connectTunnels(sshConn)
@@ -468,7 +599,9 @@ func (c *comm) connectToAgent() {
 	// XXX - might want to handle reconnects appending multiple callbacks
 	auth := ssh.PublicKeysCallback(forwardingAgent.Signers)
 	c.config.SSHConfig.Auth = append(c.config.SSHConfig.Auth, auth)
-	agent.ForwardToAgent(c.client, forwardingAgent)
+	c.agentLock.Lock()
+	c.localAgent = forwardingAgent
+	c.agentLock.Unlock()
 
 	// Setup a session to request agent forwarding
 	session, err := c.newSession()
@@ -487,6 +620,74 @@ func (c *comm) connectToAgent() {
 	return
 }
 
+// serveAgents serves the connections of the machine to the forwarded agents.
+// They don't tell which session they come from, so they go to the agent of
+// the latest command started with StartWithAgent, or else to the local agent.
+func (c *comm) serveAgents(client *ssh.Client) {
+	chans := client.HandleChannelOpen("auth-agent@openssh.com")
+	if chans == nil {
+		return
+	}
+
+	go func() {
+		for newChannel := range chans {
+			c.agentLock.Lock()
+			localAgent := c.localAgent
+			var dial func() (io.ReadWriteCloser, error)
+			if n := len(c.agentDials); n > 0 {
+				dial = c.agentDials[n-1].dial
+			}
+			c.agentLock.Unlock()
+
+			if dial == nil && localAgent == nil {
+				newChannel.Reject(ssh.Prohibited, "no agent forwarded")
+				continue
+			}
+
+			channel, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				defer channel.Close()
+				if dial == nil {
+					agent.ServeAgent(localAgent, channel)
+					return
+				}
+
+				conn, err := dial()
+				if err != nil {
+					log.Printf("[ERROR] Error connecting to forwarded agent: %s", err)
+					return
+				}
+				defer conn.Close()
+				go func() {
+					io.Copy(conn, channel)
+					conn.Close()
+				}()
+				io.Copy(channel, conn)
+			}()
+		}
+	}()
+}
+
+// Dial implements packer.Dialer, forwarding the connection from the machine.
+func (c *comm) Dial(network, address string) (net.Conn, error) {
+	if c.client == nil {
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
+		if c.client == nil {
+			return nil, errors.New("client not available")
+		}
+	}
+
+	log.Printf("[DEBUG] forwarding connection to %s %s", network, address)
+	return c.client.Dial(network, address)
+}
+
 func (c *comm) sftpUploadSession(path string, input io.Reader, fi *os.FileInfo) error {
 	sftpFunc := func(client *sftp.Client) error {
 		return c.sftpUploadFile(path, input, client, fi)
@@ -588,6 +789,240 @@ func (c *comm) sftpVisitFile(dst string, src string, fi os.FileInfo, client *sft
 	}
 }
 
+// uploadDirRoot returns the remote directory the contents of src are
+// uploaded to, following the trailing slash rules of UploadDir.
+func uploadDirRoot(dst string, src string) string {
+	if src[len(src)-1] != '/' {
+		return filepath.ToSlash(filepath.Join(dst, filepath.Base(src)))
+	}
+	return dst
+}
+
+func (c *comm) deltaUploadDirSession(dst string, src string) error {
+	rootDst := uploadDirRoot(dst, src)
+
+	// Checksums are more reliable, but fall back to sizes and modification
+	// times if the remote end can't compute them
+	sums, err := c.remoteChecksums(rootDst)
+	if err != nil {
+		log.Printf("[DEBUG] Unable to checksum remote files, comparing sizes and times: %s", err)
+	}
+
+	sftpFunc := func(client *sftp.Client) error {
+		uploaded, unchanged := 0, 0
+		walkFunc := func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relSrc, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			finalDst := filepath.ToSlash(filepath.Join(rootDst, relSrc))
+
+			// Skip the creation of the target destination directory since
+			// it should exist and we might not even own it
+			if finalDst == dst {
+				return nil
+			}
+
+			if info.IsDir() {
+				return c.sftpMkdir(finalDst, client, info)
+			}
+
+			same, err := deltaUnchanged(client, sums, filepath.ToSlash(relSrc), path, finalDst, info)
+			if err != nil {
+				return err
+			}
+			if same {
+				unchanged++
+				return nil
+			}
+
+			uploaded++
+			if err := c.sftpVisitFile(finalDst, path, info, client); err != nil {
+				return err
+			}
+			// Keep the modification time so the next upload can compare it
+			return client.Chtimes(finalDst, info.ModTime(), info.ModTime())
+		}
+
+		if err := filepath.Walk(src, walkFunc); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Uploaded %d changed files, skipped %d unchanged files", uploaded, unchanged)
+		return nil
+	}
+
+	return c.sftpSession(sftpFunc)
+}
+
+// deltaUnchanged reports whether the remote file dst is the same as the local
+// file src, either by checksum if sums is set, or by size and modification
+// time.
+func deltaUnchanged(client *sftp.Client, sums map[string]string, rel string, src string, dst string, fi os.FileInfo) (bool, error) {
+	if sums != nil {
+		remote, ok := sums[rel]
+		if !ok {
+			return false, nil
+		}
+		local, err := fileChecksum(src)
+		if err != nil {
+			return false, err
+		}
+		return local == remote, nil
+	}
+
+	remoteFi, err := client.Lstat(dst)
+	if err != nil {
+		return false, nil
+	}
+	return remoteFi.Size() == fi.Size() && remoteFi.ModTime().Unix() == fi.ModTime().Unix(), nil
+}
+
+// remoteChecksums returns the SHA256 checksums of the files in the remote
+// directory dir, by path relative to it.
+func (c *comm) remoteChecksums(dir string) (map[string]string, error) {
+	session, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	cmd := fmt.Sprintf("if [ -d %[1]s ]; then cd %[1]s && find . -type f -exec sha256sum {} +; fi", shellQuote(dir))
+	if err := session.Run(cmd); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		// Names sha256sum had to escape start with a backslash; they're
+		// just uploaded again.
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[0], "\\") {
+			continue
+		}
+		sums[strings.TrimPrefix(parts[1], "./")] = parts[0]
+	}
+	return sums, scanner.Err()
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *comm) tarUploadDirSession(dst string, src string) error {
+	session, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdinW, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr := new(bytes.Buffer)
+	session.Stderr = stderr
+
+	cmd := fmt.Sprintf("mkdir -p %[1]s && tar -xzf - -C %[1]s", shellQuote(dst))
+	log.Println("[DEBUG] Starting remote tar process: ", cmd)
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	writeErr := writeTarGz(stdinW, src)
+	stdinW.Close()
+
+	// The remote error explains a failed write better
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("Error extracting the upload: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return writeErr
+}
+
+// writeTarGz writes a gzipped tarball of src to w. The entries are prefixed
+// with the name of src unless it has a trailing slash, like UploadDir.
+func writeTarGz(w io.Writer, src string) error {
+	prefix := ""
+	if src[len(src)-1] != '/' {
+		prefix = filepath.Base(src)
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relSrc, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, relSrc))
+		if name == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}
+
+	if err := filepath.Walk(src, walkFunc); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
 func (c *comm) sftpDownloadSession(path string, output io.Writer) error {
 	sftpFunc := func(client *sftp.Client) error {
 		f, err := client.Open(path)
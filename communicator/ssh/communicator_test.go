@@ -3,15 +3,27 @@
 package ssh
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/packer/packer"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // private key for mock server
@@ -119,6 +131,209 @@ func newMockBrokenServer(t *testing.T) string {
 	return l.Addr().String()
 }
 
+// newMockShellServer starts a server that runs commands with the local shell,
+// serves SFTP from the local file system and forwards connections from the
+// host.
+func newMockShellServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for connection: %s", err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, chans, reqs, err := ssh.NewServerConn(c, serverConfig)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					switch newChannel.ChannelType() {
+					case "session":
+						channel, requests, err := newChannel.Accept()
+						if err != nil {
+							continue
+						}
+						go serveMockShellSession(sshConn, channel, requests)
+					case "direct-tcpip":
+						go serveMockDirectTCPIP(newChannel)
+					default:
+						newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveMockDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	ssh.Unmarshal(newChannel.ExtraData(), &payload)
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+	go io.Copy(conn, channel)
+	io.Copy(channel, conn)
+}
+
+// serveMockShellSession serves a session. With agent forwarding, the command
+// list-agent-keys lists the comments of the keys of the forwarded agent.
+func serveMockShellSession(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	agentForwarded := false
+
+	// The pty of the session, read by the interactive shell
+	var ptyLock sync.Mutex
+	var term string
+	var cols, rows uint32
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			var payload struct {
+				Term                      string
+				Cols, Rows, Width, Height uint32
+				Modes                     string
+			}
+			ssh.Unmarshal(req.Payload, &payload)
+			ptyLock.Lock()
+			term, cols, rows = payload.Term, payload.Cols, payload.Rows
+			ptyLock.Unlock()
+			req.Reply(true, nil)
+		case "window-change":
+			var payload struct{ Cols, Rows, Width, Height uint32 }
+			ssh.Unmarshal(req.Payload, &payload)
+			ptyLock.Lock()
+			cols, rows = payload.Cols, payload.Rows
+			ptyLock.Unlock()
+		case "shell":
+			req.Reply(true, nil)
+
+			// A shell printing the size of its pty for each line until exit
+			go func() {
+				scanner := bufio.NewScanner(channel)
+				for {
+					ptyLock.Lock()
+					fmt.Fprintf(channel, "%s %dx%d\n", term, cols, rows)
+					ptyLock.Unlock()
+					if !scanner.Scan() || scanner.Text() == "exit" {
+						break
+					}
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				channel.Close()
+			}()
+		case "auth-agent-req@openssh.com":
+			agentForwarded = true
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(true, nil)
+
+			if strings.TrimSpace(payload.Command) == "list-agent-keys" {
+				status := uint32(1)
+				if agentForwarded {
+					status = listAgentKeys(sshConn, channel)
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			status := 0
+			if err := cmd.Run(); err != nil {
+				status = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = exitErr.ExitCode()
+				}
+			}
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(payload.Name == "sftp", nil)
+
+			server, err := sftp.NewServer(channel, channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func listAgentKeys(sshConn *ssh.ServerConn, w io.Writer) uint32 {
+	agentC, requests, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return 1
+	}
+	defer agentC.Close()
+	go ssh.DiscardRequests(requests)
+
+	keys, err := agent.NewClient(agentC).List()
+	if err != nil {
+		return 1
+	}
+	for _, key := range keys {
+		fmt.Fprintln(w, key.Comment)
+	}
+	return 0
+}
+
+func newMockShellComm(t *testing.T) *comm {
+	address := newMockShellServer(t)
+	config := &Config{
+		Connection: func() (net.Conn, error) {
+			return net.Dial("tcp", address)
+		},
+		SSHConfig: &ssh.ClientConfig{
+			User:            "user",
+			Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		DisableAgentForwarding: true,
+	}
+
+	client, err := New(address, config)
+	if err != nil {
+		t.Fatalf("error connecting to SSH: %s", err)
+	}
+	return client
+}
+
 func TestCommIsCommunicator(t *testing.T) {
 	var raw interface{}
 	raw = &comm{}
@@ -193,6 +408,144 @@ func TestStart(t *testing.T) {
 	client.Start(ctx, cmd)
 }
 
+func TestStartPty(t *testing.T) {
+	client := newMockShellComm(t)
+
+	stdinR, stdinW := io.Pipe()
+	stdout := new(safeBuffer)
+	resize := make(chan packer.PtySize, 1)
+	cmd := &packer.RemoteCmd{
+		Stdin:  stdinR,
+		Stdout: stdout,
+	}
+	err := client.StartPty(context.Background(), cmd, "vt100", packer.PtySize{Width: 80, Height: 24}, resize)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	waitOutput := func(want string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if strings.Contains(stdout.String(), want) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("output %q doesn't contain %q", stdout.String(), want)
+	}
+
+	waitOutput("vt100 80x24\n")
+	resize <- packer.PtySize{Width: 120, Height: 40}
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintln(stdinW, "size")
+	waitOutput("vt100 120x40\n")
+
+	fmt.Fprintln(stdinW, "exit")
+	if status := cmd.Wait(); status != 0 {
+		t.Fatalf("bad exit status: %d", status)
+	}
+	close(resize)
+}
+
+func TestDial(t *testing.T) {
+	// An echo server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	client := newMockShellComm(t)
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+}
+
+func TestStartWithAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test key"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dial := func() (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			agent.ServeAgent(keyring, c2)
+			c2.Close()
+		}()
+		return c1, nil
+	}
+
+	client := newMockShellComm(t)
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: "list-agent-keys",
+		Stdout:  &stdout,
+	}
+	if err := client.StartWithAgent(context.Background(), cmd, dial); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status := cmd.Wait(); status != 0 {
+		t.Fatalf("bad exit status: %d", status)
+	}
+	if stdout.String() != "test key\n" {
+		t.Fatalf("bad: %q", stdout.String())
+	}
+
+	// The agent is only forwarded to that command, and forgotten once it
+	// exited
+	agents := func() int {
+		client.agentLock.Lock()
+		defer client.agentLock.Unlock()
+		return len(client.agentDials)
+	}
+	for i := 0; i < 100 && agents() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := agents(); n != 0 {
+		t.Fatalf("bad: %d agents left", n)
+	}
+}
+
+// safeBuffer is a bytes.Buffer safe for concurrent use.
+type safeBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
 func TestHandshakeTimeout(t *testing.T) {
 	clientConfig := &ssh.ClientConfig{
 		User: "user",
@@ -227,3 +580,96 @@ func TestHandshakeTimeout(t *testing.T) {
 		t.Fatalf("Expected handshake timeout, got: %s", err)
 	}
 }
+
+func testUploadDirTree(t *testing.T) string {
+	src, err := ioutil.TempDir("", "packer-src")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for name, content := range map[string]string{"a": "foo", "sub/b": "bar"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return src
+}
+
+func assertFileContents(t *testing.T, path string, expected string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != expected {
+		t.Fatalf("%s: expected %q, got %q", path, expected, data)
+	}
+}
+
+func TestUploadDirWithMode_tar(t *testing.T) {
+	src := testUploadDirTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "packer-dst")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dst)
+
+	client := newMockShellComm(t)
+	if err := client.UploadDirWithMode(packer.UploadDirTar, dst, src, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	root := filepath.Join(dst, filepath.Base(src))
+	assertFileContents(t, filepath.Join(root, "a"), "foo")
+	assertFileContents(t, filepath.Join(root, "sub", "b"), "bar")
+
+	// With a trailing slash only the contents are uploaded
+	if err := client.UploadDirWithMode(packer.UploadDirTar, dst, src+"/", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assertFileContents(t, filepath.Join(dst, "sub", "b"), "bar")
+}
+
+func TestUploadDirWithMode_delta(t *testing.T) {
+	src := testUploadDirTree(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "packer-dst")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dst)
+
+	client := newMockShellComm(t)
+	if err := client.UploadDirWithMode(packer.UploadDirDelta, dst, src+"/", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assertFileContents(t, filepath.Join(dst, "a"), "foo")
+	assertFileContents(t, filepath.Join(dst, "sub", "b"), "bar")
+
+	// Mark the remote copy of the unchanged file, it must not be uploaded
+	// again
+	marker := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dst, "a"), marker, marker); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := client.UploadDirWithMode(packer.UploadDirDelta, dst, src+"/", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assertFileContents(t, filepath.Join(dst, "sub", "b"), "changed")
+	fi, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !fi.ModTime().Equal(marker) {
+		t.Fatal("unchanged file should not be uploaded again")
+	}
+
+	if err := client.UploadDirWithMode("rsync", dst, src, nil); err != packer.ErrUploadDirModeUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+}
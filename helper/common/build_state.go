@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// The outputs captured and the files produced by the provisioners of a build
+// are kept as JSON in its shared state, so that every plugin of the build can
+// read and add to them.
+const (
+	buildOutputsKey = "outputs"
+	buildFilesKey   = "files"
+)
+
+// SetBuildOutputs adds outputs to the named values captured during the build
+// buildName, which later provisioners and post-processors read with the
+// output template function.
+func SetBuildOutputs(outputs map[string]string, buildName string) error {
+	current, err := RetrieveBuildOutputs(buildName)
+	if err != nil {
+		return err
+	}
+	for k, v := range outputs {
+		current[k] = v
+	}
+	return setBuildState(buildOutputsKey, current, buildName)
+}
+
+// RetrieveBuildOutputs returns the named values captured so far during the
+// build buildName.
+func RetrieveBuildOutputs(buildName string) (map[string]string, error) {
+	outputs := make(map[string]string)
+	if err := retrieveBuildState(buildOutputsKey, &outputs, buildName); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// AddBuildFiles adds files produced by the provisioners of the build
+// buildName to the files of its artifact. Files that were already added are
+// skipped.
+func AddBuildFiles(files []string, buildName string) error {
+	current, err := RetrieveBuildFiles(buildName)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		found := false
+		for _, f := range current {
+			if f == file {
+				found = true
+				break
+			}
+		}
+		if !found {
+			current = append(current, file)
+		}
+	}
+	return setBuildState(buildFilesKey, current, buildName)
+}
+
+// RetrieveBuildFiles returns the files added so far during the build
+// buildName.
+func RetrieveBuildFiles(buildName string) ([]string, error) {
+	var files []string
+	if err := retrieveBuildState(buildFilesKey, &files, buildName); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// RemoveBuildState forgets the outputs and the files of the build buildName.
+func RemoveBuildState(buildName string) {
+	RemoveSharedStateFile(buildOutputsKey, buildName)
+	RemoveSharedStateFile(buildFilesKey, buildName)
+}
+
+// setBuildState stores v as the JSON value of key for the build buildName.
+func setBuildState(key string, v interface{}, buildName string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return SetSharedState(key, string(data), buildName)
+}
+
+// retrieveBuildState reads the JSON value of key for the build buildName
+// into v, which is left as is if there is no value yet.
+func retrieveBuildState(key string, v interface{}, buildName string) error {
+	data, err := RetrieveSharedState(key, buildName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildFiles(t *testing.T) {
+	defer RemoveBuildState("test")
+
+	files, err := RetrieveBuildFiles("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %#v", files)
+	}
+
+	if err := AddBuildFiles([]string{"a.json", "a.xml"}, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Files added again are only listed once
+	if err := AddBuildFiles([]string{"a.json", "b.json", "b.json"}, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files, err = RetrieveBuildFiles("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"a.json", "a.xml", "b.json"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("bad: %#v", files)
+	}
+
+	// Builds don't see each other's files
+	files, err = RetrieveBuildFiles("other")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %#v", files)
+	}
+}
+
+func TestBuildOutputs(t *testing.T) {
+	defer RemoveBuildState("test")
+
+	outputs, err := RetrieveBuildOutputs("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(outputs) != 0 {
+		t.Fatalf("bad: %#v", outputs)
+	}
+
+	if err := SetBuildOutputs(map[string]string{"foo": "1", "bar": "2"}, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := SetBuildOutputs(map[string]string{"foo": "3"}, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	outputs, err = RetrieveBuildOutputs("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if outputs["foo"] != "3" || outputs["bar"] != "2" {
+		t.Fatalf("bad: %#v", outputs)
+	}
+
+	// Builds don't see each other's outputs
+	outputs, err = RetrieveBuildOutputs("other")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(outputs) != 0 {
+		t.Fatalf("bad: %#v", outputs)
+	}
+}
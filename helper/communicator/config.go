@@ -97,6 +97,18 @@ type SSH struct {
 	// The `~` can be used in path and will be expanded to the home directory
 	// of current user.
 	SSHPrivateKeyFile string `mapstructure:"ssh_private_key_file"`
+	// Path to a user certificate, signed by a CA the machine trusts, for the
+	// key in `ssh_private_key_file` or in the SSH agent. The certificate is
+	// offered before the plain key. The `~` can be used in path and will be
+	// expanded to the home directory of current user.
+	SSHCertificateFile string `mapstructure:"ssh_certificate_file"`
+	// Path to the private key of a certificate authority the machine trusts.
+	// If set, Packer signs a user certificate for `ssh_username`, valid for
+	// 24 hours, for the key it authenticates with, including the temporary
+	// key pair it generates. RSA CA keys sign with rsa-sha2-512, since
+	// OpenSSH 8.2 and later reject ssh-rsa signatures. Can't be used with
+	// `ssh_certificate_file`.
+	SSHCAPrivateKeyFile string `mapstructure:"ssh_ca_private_key_file"`
 	// If `true`, a PTY will be requested for the SSH connection. This defaults
 	// to `false`.
 	SSHPty bool `mapstructure:"ssh_pty"`
@@ -117,6 +129,23 @@ type SSH struct {
 	// The number of handshakes to attempt with SSH once it can connect. This
 	// defaults to `10`.
 	SSHHandshakeAttempts int `mapstructure:"ssh_handshake_attempts"`
+	// The fingerprint of the host key the machine must present, as printed
+	// by `ssh-keygen -l`, for example
+	// `SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8`. Legacy MD5
+	// fingerprints are also accepted. By default, host keys are not
+	// verified.
+	SSHHostKeyFingerprint string `mapstructure:"ssh_host_key_fingerprint"`
+	// Path to a `known_hosts` file the host key of the machine must be listed
+	// in. The `~` can be used in path and will be expanded to the home
+	// directory of current user.
+	SSHKnownHostsFile string `mapstructure:"ssh_known_hosts_file"`
+	// If `true`, the host key presented on the first connection is trusted,
+	// and every later connection during the build, including reconnects after
+	// a reboot with `expect_disconnect`, must present the same key. Combined
+	// with `ssh_known_hosts_file`, keys of hosts that aren't in the file yet
+	// are added to it, and hosts already in the file are verified. Defaults
+	// to `false`.
+	SSHTrustOnFirstUse bool `mapstructure:"ssh_trust_on_first_use"`
 	// A bastion host to use for the actual SSH connection.
 	SSHBastionHost string `mapstructure:"ssh_bastion_host"`
 	// The port of the bastion host. Defaults to `22`.
@@ -132,6 +161,26 @@ type SSH struct {
 	// bastion host. The `~` can be used in path and will be expanded to the
 	// home directory of current user.
 	SSHBastionPrivateKeyFile string `mapstructure:"ssh_bastion_private_key_file"`
+	// Path to a user certificate for the key in
+	// `ssh_bastion_private_key_file` or in the SSH agent, used to
+	// authenticate with the bastion host.
+	SSHBastionCertificateFile string `mapstructure:"ssh_bastion_certificate_file"`
+	// The fingerprint of the host key the bastion host must present. See
+	// `ssh_host_key_fingerprint`.
+	SSHBastionHostKeyFingerprint string `mapstructure:"ssh_bastion_host_key_fingerprint"`
+	// Path to a `known_hosts` file the host key of the bastion host must be
+	// listed in. See `ssh_known_hosts_file`.
+	SSHBastionKnownHostsFile string `mapstructure:"ssh_bastion_known_hosts_file"`
+	// Trust the host key of the bastion host on first use. See
+	// `ssh_trust_on_first_use`.
+	SSHBastionTrustOnFirstUse bool `mapstructure:"ssh_bastion_trust_on_first_use"`
+	// An ordered list of bastion hosts to jump through to reach the machine,
+	// like `ProxyJump` in OpenSSH: Packer connects to the first host, from
+	// there to the second, and so on, and connects to the machine from the
+	// last one. Each host has its own address and credentials, see
+	// [bastion chain hops](#bastion-chain-hops). Can't be used with
+	// `ssh_bastion_host` or `ssh_proxy_host`.
+	SSHBastionChain []SSHBastionHop `mapstructure:"ssh_bastion_chain"`
 	// `scp` or `sftp` - How to transfer files, Secure copy (default) or SSH
 	// File Transfer Protocol.
 	SSHFileTransferMethod string `mapstructure:"ssh_file_transfer_method"`
@@ -163,6 +212,37 @@ type SSH struct {
 	SSHPrivateKey []byte
 }
 
+// SSHBastionHop is one of the hosts of `ssh_bastion_chain`.
+type SSHBastionHop struct {
+	// The address of the bastion host.
+	Host string `mapstructure:"host" required:"true"`
+	// The port of the bastion host. Defaults to `22`.
+	Port int `mapstructure:"port"`
+	// The username to connect to the bastion host. Defaults to
+	// `ssh_username`.
+	Username string `mapstructure:"username"`
+	// The password to use to authenticate with the bastion host.
+	Password string `mapstructure:"password"`
+	// Path to a PEM encoded private key file to use to authenticate with the
+	// bastion host. Defaults to `ssh_private_key_file`.
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	// Path to a user certificate for the key in `private_key_file` or in the
+	// SSH agent.
+	CertificateFile string `mapstructure:"certificate_file"`
+	// If `true`, the local SSH agent will be used to authenticate with the
+	// bastion host. Defaults to `false`.
+	AgentAuth bool `mapstructure:"agent_auth"`
+	// The fingerprint of the host key the bastion host must present. See
+	// `ssh_host_key_fingerprint`.
+	HostKeyFingerprint string `mapstructure:"host_key_fingerprint"`
+	// Path to a `known_hosts` file the host key of the bastion host must be
+	// listed in. See `ssh_known_hosts_file`.
+	KnownHostsFile string `mapstructure:"known_hosts_file"`
+	// Trust the host key of the bastion host on first use. See
+	// `ssh_trust_on_first_use`.
+	TrustOnFirstUse bool `mapstructure:"trust_on_first_use"`
+}
+
 type SSHInterface struct {
 	// One of `public_ip`, `private_ip`, `public_dns`, or `private_dns`. If
 	// set, either the public IP address, private IP address, public DNS name
@@ -232,6 +312,81 @@ func (c *Config) ReadSSHPrivateKeyFile() ([]byte, error) {
 	return privateKey, nil
 }
 
+func readCertificateFile(file string) (*ssh.Certificate, error) {
+	path, err := packer.ExpandUser(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error expanding path for SSH certificate: %s", err)
+	}
+	return helperssh.FileCertificate(path)
+}
+
+// agentAuth authenticates with the keys in the SSH agent, and with the
+// certificate for the agent key it was issued for, if any.
+func agentAuth(client agent.ExtendedAgent, cert *ssh.Certificate) ssh.AuthMethod {
+	if cert == nil {
+		return ssh.PublicKeysCallback(client.Signers)
+	}
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers, err := client.Signers()
+		if err != nil {
+			return nil, err
+		}
+		return helperssh.CertSigners(signers, cert)
+	})
+}
+
+// sshBastionHops returns the bastion hosts to jump through, in order: either
+// ssh_bastion_host or the hosts of ssh_bastion_chain.
+func (c *Config) sshBastionHops() []SSHBastionHop {
+	if c.SSHBastionHost == "" {
+		return c.SSHBastionChain
+	}
+	return []SSHBastionHop{{
+		Host:               c.SSHBastionHost,
+		Port:               c.SSHBastionPort,
+		Username:           c.SSHBastionUsername,
+		Password:           c.SSHBastionPassword,
+		PrivateKeyFile:     c.SSHBastionPrivateKeyFile,
+		CertificateFile:    c.SSHBastionCertificateFile,
+		AgentAuth:          c.SSHBastionAgentAuth,
+		HostKeyFingerprint: c.SSHBastionHostKeyFingerprint,
+		KnownHostsFile:     c.SSHBastionKnownHostsFile,
+		TrustOnFirstUse:    c.SSHBastionTrustOnFirstUse,
+	}}
+}
+
+// prepare validates the credentials and host key policy of the hop. prefix is
+// prepended to the option names in errors.
+func (h *SSHBastionHop) prepare(prefix string) []error {
+	var errs []error
+	if h.CertificateFile != "" {
+		if _, err := readCertificateFile(h.CertificateFile); err != nil {
+			errs = append(errs, fmt.Errorf("%scertificate_file is invalid: %s", prefix, err))
+		}
+	}
+
+	if !h.AgentAuth {
+		if h.Password == "" && h.PrivateKeyFile == "" {
+			errs = append(errs, fmt.Errorf(
+				"%spassword or %sprivate_key_file must be specified", prefix, prefix))
+		} else if h.PrivateKeyFile != "" {
+			path, err := packer.ExpandUser(h.PrivateKeyFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf(
+					"%sprivate_key_file is invalid: %s", prefix, err))
+			} else if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"%sprivate_key_file is invalid: %s", prefix, err))
+			} else if _, err := helperssh.FileSigner(path); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"%sprivate_key_file is invalid: %s", prefix, err))
+			}
+		}
+	}
+
+	return append(errs, h.hostKeyPolicy("").prepare(prefix)...)
+}
+
 // SSHConfigFunc returns a function that can be used for the SSH communicator
 // config for connecting to the instance created over SSH using the private key
 // or password.
@@ -239,7 +394,15 @@ func (c *Config) SSHConfigFunc() func(multistep.StateBag) (*ssh.ClientConfig, er
 	return func(state multistep.StateBag) (*ssh.ClientConfig, error) {
 		sshConfig := &ssh.ClientConfig{
 			User:            c.SSHUsername,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: c.sshHostKeyPolicy().callback(state),
+		}
+
+		var cert *ssh.Certificate
+		if c.SSHCertificateFile != "" {
+			var err error
+			if cert, err = readCertificateFile(c.SSHCertificateFile); err != nil {
+				return nil, err
+			}
 		}
 
 		if c.SSHAgentAuth {
@@ -253,7 +416,7 @@ func (c *Config) SSHConfigFunc() func(multistep.StateBag) (*ssh.ClientConfig, er
 				return nil, fmt.Errorf("Cannot connect to SSH Agent socket %q: %s", authSock, err)
 			}
 
-			sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+			sshConfig.Auth = append(sshConfig.Auth, agentAuth(agent.NewClient(sshAgent), cert))
 		}
 
 		var privateKeys [][]byte
@@ -274,11 +437,50 @@ func (c *Config) SSHConfigFunc() func(multistep.StateBag) (*ssh.ClientConfig, er
 			privateKeys = append(privateKeys, c.SSHPrivateKey)
 		}
 
+		var signers []ssh.Signer
 		for _, key := range privateKeys {
 			signer, err := ssh.ParsePrivateKey(key)
 			if err != nil {
 				return nil, fmt.Errorf("Error on parsing SSH private key: %s", err)
 			}
+			signers = append(signers, signer)
+		}
+
+		if cert != nil {
+			certSigners, err := helperssh.CertSigners(signers, cert)
+			if err != nil {
+				return nil, err
+			}
+			// The certificate may be for a key in the agent instead.
+			if len(certSigners) == len(signers) && !c.SSHAgentAuth {
+				return nil, fmt.Errorf("ssh_certificate_file was not issued for any of the private keys")
+			}
+			signers = certSigners
+		}
+
+		if c.SSHCAPrivateKeyFile != "" {
+			path, err := packer.ExpandUser(c.SSHCAPrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			ca, err := helperssh.FileSigner(path)
+			if err != nil {
+				return nil, err
+			}
+
+			// Offer the certificates first, then the plain keys.
+			var certSigners []ssh.Signer
+			for _, signer := range signers {
+				certSigner, err := helperssh.SignUserCertificate(signer, ca, c.SSHUsername, 24*time.Hour)
+				if err != nil {
+					return nil, err
+				}
+				certSigners = append(certSigners, certSigner)
+			}
+			signers = append(certSigners, signers...)
+		}
+
+		for _, signer := range signers {
 			sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(signer))
 		}
 
@@ -391,6 +593,21 @@ func (c *Config) prepareSSH(ctx *interpolate.Context) []error {
 		}
 	}
 
+	for i := range c.SSHBastionChain {
+		hop := &c.SSHBastionChain[i]
+		if hop.Port == 0 {
+			hop.Port = 22
+		}
+
+		if hop.Username == "" {
+			hop.Username = c.SSHUsername
+		}
+
+		if hop.PrivateKeyFile == "" && c.SSHPrivateKeyFile != "" {
+			hop.PrivateKeyFile = c.SSHPrivateKeyFile
+		}
+	}
+
 	if c.SSHProxyHost != "" {
 		if c.SSHProxyPort == 0 {
 			c.SSHProxyPort = 1080
@@ -421,25 +638,40 @@ func (c *Config) prepareSSH(ctx *interpolate.Context) []error {
 		}
 	}
 
-	if c.SSHBastionHost != "" && !c.SSHBastionAgentAuth {
-		if c.SSHBastionPassword == "" && c.SSHBastionPrivateKeyFile == "" {
+	if c.SSHCertificateFile != "" {
+		if _, err := readCertificateFile(c.SSHCertificateFile); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_certificate_file is invalid: %s", err))
+		}
+		if c.SSHCAPrivateKeyFile != "" {
 			errs = append(errs, errors.New(
-				"ssh_bastion_password or ssh_bastion_private_key_file must be specified"))
-		} else if c.SSHBastionPrivateKeyFile != "" {
-			path, err := packer.ExpandUser(c.SSHBastionPrivateKeyFile)
-			if err != nil {
-				errs = append(errs, fmt.Errorf(
-					"ssh_bastion_private_key_file is invalid: %s", err))
-			} else if _, err := os.Stat(path); err != nil {
-				errs = append(errs, fmt.Errorf(
-					"ssh_bastion_private_key_file is invalid: %s", err))
-			} else if _, err := helperssh.FileSigner(path); err != nil {
-				errs = append(errs, fmt.Errorf(
-					"ssh_bastion_private_key_file is invalid: %s", err))
-			}
+				"please specify either ssh_certificate_file or ssh_ca_private_key_file, not both"))
+		}
+	}
+
+	if c.SSHCAPrivateKeyFile != "" {
+		path, err := packer.ExpandUser(c.SSHCAPrivateKeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(
+				"ssh_ca_private_key_file is invalid: %s", err))
+		} else if _, err := helperssh.FileSigner(path); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"ssh_ca_private_key_file is invalid: %s", err))
 		}
 	}
 
+	errs = append(errs, c.sshHostKeyPolicy().prepare("ssh_")...)
+	if c.SSHBastionHost != "" {
+		hop := c.sshBastionHops()[0]
+		errs = append(errs, hop.prepare("ssh_bastion_")...)
+	}
+	for i, hop := range c.SSHBastionChain {
+		prefix := fmt.Sprintf("ssh_bastion_chain[%d].", i)
+		if hop.Host == "" {
+			errs = append(errs, fmt.Errorf("%shost must be specified", prefix))
+		}
+		errs = append(errs, hop.prepare(prefix)...)
+	}
+
 	if c.SSHFileTransferMethod != "scp" && c.SSHFileTransferMethod != "sftp" {
 		errs = append(errs, fmt.Errorf(
 			"ssh_file_transfer_method ('%s') is invalid, valid methods: sftp, scp",
@@ -450,6 +682,15 @@ func (c *Config) prepareSSH(ctx *interpolate.Context) []error {
 		errs = append(errs, errors.New("please specify either ssh_bastion_host or ssh_proxy_host, not both"))
 	}
 
+	if len(c.SSHBastionChain) > 0 {
+		if c.SSHBastionHost != "" {
+			errs = append(errs, errors.New("please specify either ssh_bastion_host or ssh_bastion_chain, not both"))
+		}
+		if c.SSHProxyHost != "" {
+			errs = append(errs, errors.New("please specify either ssh_bastion_chain or ssh_proxy_host, not both"))
+		}
+	}
+
 	for _, v := range c.SSHLocalTunnels {
 		_, err := helperssh.ParseTunnelArgument(v, packerssh.UnsetTunnel)
 		if err != nil {
@@ -1,9 +1,14 @@
 package communicator
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/hashicorp/packer/helper/multistep"
+	helperssh "github.com/hashicorp/packer/helper/ssh"
 	"github.com/hashicorp/packer/template/interpolate"
 	"github.com/masterzen/winrm"
 )
@@ -153,3 +158,77 @@ func TestConfig_winrm(t *testing.T) {
 func testContext(t *testing.T) *interpolate.Context {
 	return nil
 }
+
+func TestConfig_sshCertificate(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	ca, err := helperssh.NewKeyPair(helperssh.CreateKeyPairConfig{Type: helperssh.Ecdsa})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	caPath := filepath.Join(td, "ca")
+	if err := ioutil.WriteFile(caPath, ca.PrivateKeyPemBlock, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The temporary key pair is signed by the CA
+	key, err := helperssh.NewKeyPair(helperssh.CreateKeyPairConfig{Type: helperssh.Ecdsa})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := testConfig()
+	c.SSHCAPrivateKeyFile = caPath
+	c.SSHPrivateKey = key.PrivateKeyPemBlock
+	if err := c.Prepare(testContext(t)); len(err) > 0 {
+		t.Fatalf("bad: %#v", err)
+	}
+	sshConfig, err := c.SSHConfigFunc()(new(multistep.BasicStateBag))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(sshConfig.Auth) != 2 {
+		t.Fatalf("expected a certificate and a key, got %d auth methods", len(sshConfig.Auth))
+	}
+
+	// A certificate file and a CA can't be used together
+	c.SSHCertificateFile = filepath.Join(td, "missing-cert.pub")
+	if err := c.Prepare(testContext(t)); len(err) != 2 {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestConfig_sshBastionChain(t *testing.T) {
+	c := testConfig()
+	c.SSHBastionChain = []SSHBastionHop{
+		{Host: "first.example.com", Password: "secret"},
+		{Host: "second.example.com", Port: 2222, Username: "jump", AgentAuth: true},
+	}
+	if err := c.Prepare(testContext(t)); len(err) > 0 {
+		t.Fatalf("bad: %#v", err)
+	}
+	if hop := c.SSHBastionChain[0]; hop.Port != 22 || hop.Username != c.SSHUsername {
+		t.Fatalf("bad defaults: %#v", hop)
+	}
+	if hop := c.SSHBastionChain[1]; hop.Port != 2222 || hop.Username != "jump" {
+		t.Fatalf("bad: %#v", hop)
+	}
+
+	// Every hop needs a host and credentials
+	c = testConfig()
+	c.SSHBastionChain = []SSHBastionHop{{Password: "secret"}, {Host: "second.example.com"}}
+	if err := c.Prepare(testContext(t)); len(err) != 2 {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	c = testConfig()
+	c.SSHBastionHost = "bastion.example.com"
+	c.SSHBastionPassword = "secret"
+	c.SSHBastionChain = []SSHBastionHop{{Host: "first.example.com", Password: "secret"}}
+	if err := c.Prepare(testContext(t)); len(err) != 1 {
+		t.Fatalf("ssh_bastion_host and ssh_bastion_chain should conflict: %#v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package communicator
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A legacy MD5 fingerprint, as printed by `ssh-keygen -E md5 -l`.
+var md5FingerprintRegexp = regexp.MustCompile(`^([0-9a-f]{2}:){15}[0-9a-f]{2}$`)
+
+// hostKeyPolicy describes how the host key of a server is verified. The
+// target host and the bastion host each have their own.
+type hostKeyPolicy struct {
+	// The expected fingerprint, in the SHA256:... or MD5 format printed by
+	// ssh-keygen.
+	Fingerprint string
+	// A known_hosts file the key must be listed in.
+	KnownHostsFile string
+	// Accept the first key seen and require it on every later connection.
+	// With a known_hosts file, unknown hosts are added to it.
+	TrustOnFirstUse bool
+
+	// The state bag key under which the trusted key is stored, so that it
+	// survives reconnects for the rest of the build.
+	stateKey string
+}
+
+func (p *hostKeyPolicy) enabled() bool {
+	return p.Fingerprint != "" || p.KnownHostsFile != "" || p.TrustOnFirstUse
+}
+
+// prepare validates the policy. prefix is prepended to the option names in
+// errors, for example "ssh_".
+func (p *hostKeyPolicy) prepare(prefix string) []error {
+	var errs []error
+	if p.Fingerprint != "" {
+		fingerprint := normalizeFingerprint(p.Fingerprint)
+		if !strings.HasPrefix(fingerprint, "SHA256:") && !md5FingerprintRegexp.MatchString(fingerprint) {
+			errs = append(errs, fmt.Errorf(
+				"%shost_key_fingerprint must be a SHA256:... or MD5 fingerprint as printed by ssh-keygen", prefix))
+		}
+		if p.KnownHostsFile != "" || p.TrustOnFirstUse {
+			errs = append(errs, fmt.Errorf(
+				"%shost_key_fingerprint can't be used with %sknown_hosts_file or %strust_on_first_use",
+				prefix, prefix, prefix))
+		}
+	}
+
+	if p.KnownHostsFile != "" {
+		path, err := packer.ExpandUser(p.KnownHostsFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sknown_hosts_file is invalid: %s", prefix, err))
+		} else if _, err := os.Stat(path); err != nil && !(os.IsNotExist(err) && p.TrustOnFirstUse) {
+			// A missing file is only fine if we're going to create it
+			errs = append(errs, fmt.Errorf("%sknown_hosts_file is invalid: %s", prefix, err))
+		} else if err == nil {
+			if _, err := knownhosts.New(path); err != nil {
+				errs = append(errs, fmt.Errorf("%sknown_hosts_file is invalid: %s", prefix, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return fingerprint
+	}
+	return strings.ToLower(strings.TrimPrefix(fingerprint, "MD5:"))
+}
+
+// callback returns the HostKeyCallback implementing the policy, or
+// ssh.InsecureIgnoreHostKey if no verification is configured.
+func (p *hostKeyPolicy) callback(state multistep.StateBag) ssh.HostKeyCallback {
+	if !p.enabled() {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	// The trusted key is kept in the state bag when there is one, and here
+	// otherwise.
+	var l sync.Mutex
+	var trusted ssh.PublicKey
+	getTrusted := func() ssh.PublicKey {
+		if state != nil {
+			if key, ok := state.GetOk(p.stateKey); ok {
+				return key.(ssh.PublicKey)
+			}
+			return nil
+		}
+		return trusted
+	}
+	setTrusted := func(key ssh.PublicKey) {
+		if state != nil {
+			state.Put(p.stateKey, key)
+		}
+		trusted = key
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		l.Lock()
+		defer l.Unlock()
+
+		if known := getTrusted(); known != nil {
+			if !bytes.Equal(known.Marshal(), key.Marshal()) {
+				return fmt.Errorf(
+					"host key for %s changed since the first connection: got %s, expected %s",
+					hostname, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(known))
+			}
+			return nil
+		}
+
+		if err := p.verify(hostname, remote, key); err != nil {
+			return err
+		}
+
+		if p.TrustOnFirstUse {
+			log.Printf("[INFO] Trusting host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+			setTrusted(key)
+		}
+		return nil
+	}
+}
+
+// verify checks the key against the fingerprint or known_hosts file.
+func (p *hostKeyPolicy) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if p.Fingerprint != "" {
+		expected := normalizeFingerprint(p.Fingerprint)
+		actual := ssh.FingerprintSHA256(key)
+		if !strings.HasPrefix(expected, "SHA256:") {
+			actual = ssh.FingerprintLegacyMD5(key)
+		}
+		if actual != expected {
+			return fmt.Errorf("host key fingerprint for %s is %s, expected %s",
+				hostname, actual, expected)
+		}
+		return nil
+	}
+
+	if p.KnownHostsFile == "" {
+		return nil
+	}
+
+	path, err := packer.ExpandUser(p.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) && p.TrustOnFirstUse {
+		return addKnownHost(path, hostname, remote, key)
+	}
+
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return err
+	}
+	err = check(hostname, remote, key)
+	if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) == 0 && p.TrustOnFirstUse {
+		return addKnownHost(path, hostname, remote, key)
+	}
+	return err
+}
+
+// addKnownHost appends the key to the known_hosts file at path.
+func addKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	log.Printf("[INFO] Adding host key %s for %s to %s", ssh.FingerprintSHA256(key), hostname, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Error adding host key to %s: %s", path, err)
+	}
+	defer f.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line(addresses, key))
+	return err
+}
+
+// sshHostKeyPolicy returns the host key policy of the target host.
+func (c *Config) sshHostKeyPolicy() *hostKeyPolicy {
+	return &hostKeyPolicy{
+		Fingerprint:     c.SSHHostKeyFingerprint,
+		KnownHostsFile:  c.SSHKnownHostsFile,
+		TrustOnFirstUse: c.SSHTrustOnFirstUse,
+		stateKey:        "ssh_host_key",
+	}
+}
+
+// hostKeyPolicy returns the host key policy of the bastion host. The trusted
+// key is stored under stateKey.
+func (h *SSHBastionHop) hostKeyPolicy(stateKey string) *hostKeyPolicy {
+	return &hostKeyPolicy{
+		Fingerprint:     h.HostKeyFingerprint,
+		KnownHostsFile:  h.KnownHostsFile,
+		TrustOnFirstUse: h.TrustOnFirstUse,
+		stateKey:        stateKey,
+	}
+}
@@ -0,0 +1,141 @@
+package communicator
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return key
+}
+
+var testRemote = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func TestHostKeyPolicy_fingerprint(t *testing.T) {
+	key := testHostKey(t)
+
+	for _, fingerprint := range []string{ssh.FingerprintSHA256(key), "MD5:" + ssh.FingerprintLegacyMD5(key)} {
+		policy := &hostKeyPolicy{Fingerprint: fingerprint}
+		if errs := policy.prepare("ssh_"); len(errs) > 0 {
+			t.Fatalf("bad: %#v", errs)
+		}
+		callback := policy.callback(nil)
+		if err := callback("10.0.0.1:22", testRemote, key); err != nil {
+			t.Fatalf("%s: err: %s", fingerprint, err)
+		}
+		if err := callback("10.0.0.1:22", testRemote, testHostKey(t)); err == nil {
+			t.Fatalf("%s: should reject a different key", fingerprint)
+		}
+	}
+
+	policy := &hostKeyPolicy{Fingerprint: "not a fingerprint"}
+	if errs := policy.prepare("ssh_"); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestHostKeyPolicy_trustOnFirstUse(t *testing.T) {
+	key := testHostKey(t)
+	state := new(multistep.BasicStateBag)
+	policy := &hostKeyPolicy{TrustOnFirstUse: true, stateKey: "ssh_host_key"}
+
+	if err := policy.callback(state)("10.0.0.1:22", testRemote, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Reconnecting, even with a new callback, requires the same key
+	callback := policy.callback(state)
+	if err := callback("10.0.0.1:22", testRemote, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("10.0.0.1:22", testRemote, testHostKey(t)); err == nil {
+		t.Fatal("should reject a changed key")
+	}
+}
+
+func TestHostKeyPolicy_knownHosts(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "known_hosts")
+
+	key := testHostKey(t)
+	policy := &hostKeyPolicy{KnownHostsFile: path}
+	if errs := policy.prepare("ssh_"); len(errs) != 1 {
+		t.Fatalf("a missing file should be invalid: %#v", errs)
+	}
+
+	// Trusting on first use creates the file and adds the host
+	policy = &hostKeyPolicy{KnownHostsFile: path, TrustOnFirstUse: true, stateKey: "ssh_host_key"}
+	if errs := policy.prepare("ssh_"); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if err := policy.callback(new(multistep.BasicStateBag))("example.com:22", testRemote, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.HasPrefix(string(data), "example.com,10.0.0.1 ssh-ed25519 ") {
+		t.Fatalf("bad known_hosts: %s", data)
+	}
+
+	// Known hosts are verified against the file
+	policy = &hostKeyPolicy{KnownHostsFile: path}
+	callback := policy.callback(nil)
+	if err := callback("example.com:22", testRemote, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("example.com:22", testRemote, testHostKey(t)); err == nil {
+		t.Fatal("should reject a different key")
+	}
+	if err := callback("other.example.com:22", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 22}, key); err == nil {
+		t.Fatal("should reject an unknown host")
+	}
+}
+
+func TestConfig_sshHostKey(t *testing.T) {
+	c := testConfig()
+	c.SSHHostKeyFingerprint = "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+	c.SSHTrustOnFirstUse = true
+	errs := c.Prepare(testContext(t))
+	if len(errs) != 1 {
+		t.Fatalf("fingerprint and trust on first use should conflict: %#v", errs)
+	}
+	expected := "ssh_host_key_fingerprint can't be used with ssh_known_hosts_file or ssh_trust_on_first_use"
+	if errs[0].Error() != expected {
+		t.Fatalf("bad error: %s", errs[0])
+	}
+
+	c = testConfig()
+	c.SSHBastionHost = "bastion.example.com"
+	c.SSHBastionPassword = "secret"
+	c.SSHBastionHostKeyFingerprint = "bad"
+	errs = c.Prepare(testContext(t))
+	if len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "ssh_bastion_host_key_fingerprint must be") {
+		t.Fatalf("bad error: %s", errs[0])
+	}
+}
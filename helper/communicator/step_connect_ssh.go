@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -82,24 +83,21 @@ func (s *StepConnectSSH) Cleanup(multistep.StateBag) {
 }
 
 func (s *StepConnectSSH) waitForSSH(state multistep.StateBag, ctx context.Context) (packer.Communicator, error) {
-	// Determine if we're using a bastion host, and if so, retrieve
-	// that configuration. This configuration doesn't change so we
+	// Determine if we're using bastion hosts, and if so, retrieve
+	// their configuration. This configuration doesn't change so we
 	// do this one before entering the retry loop.
-	var bProto, bAddr string
-	var bConf *gossh.ClientConfig
+	var bastions []helperssh.BastionHop
 	var pAddr string
 	var pAuth *proxy.Auth
-	if s.Config.SSHBastionHost != "" {
-		// The protocol is hardcoded for now, but may be configurable one day
-		bProto = "tcp"
-		bAddr = fmt.Sprintf(
-			"%s:%d", s.Config.SSHBastionHost, s.Config.SSHBastionPort)
-
-		conf, err := sshBastionConfig(s.Config)
+	for i, hop := range s.Config.sshBastionHops() {
+		conf, err := sshBastionConfig(&hop, fmt.Sprintf("ssh_bastion_%d_host_key", i), state)
 		if err != nil {
-			return nil, fmt.Errorf("Error configuring bastion: %s", err)
+			return nil, fmt.Errorf("Error configuring bastion %s: %s", hop.Host, err)
 		}
-		bConf = conf
+		bastions = append(bastions, helperssh.BastionHop{
+			Addr:   net.JoinHostPort(hop.Host, strconv.Itoa(hop.Port)),
+			Config: conf,
+		})
 	}
 
 	if s.Config.SSHProxyHost != "" {
@@ -150,13 +148,19 @@ func (s *StepConnectSSH) waitForSSH(state multistep.StateBag, ctx context.Contex
 			continue
 		}
 
+		// Builders may provide their own SSH config, so enforce the host
+		// key policy here.
+		if policy := s.Config.sshHostKeyPolicy(); policy.enabled() {
+			sshConfig.HostKeyCallback = policy.callback(state)
+		}
+
 		// Attempt to connect to SSH port
 		var connFunc func() (net.Conn, error)
 		address := fmt.Sprintf("%s:%d", host, port)
-		if bAddr != "" {
-			// We're using a bastion host, so use the bastion connfunc
-			connFunc = ssh.BastionConnectFunc(
-				bProto, bAddr, bConf, "tcp", address)
+		if len(bastions) > 0 {
+			// We're using bastion hosts, so jump through them
+			connFunc = helperssh.BastionChainConnectFunc(
+				bastions, "tcp", address)
 		} else if pAddr != "" {
 			// Connect via SOCKS5 proxy
 			connFunc = ssh.ProxyConnectFunc(pAddr, pAuth, "tcp", address)
@@ -240,17 +244,27 @@ func (s *StepConnectSSH) waitForSSH(state multistep.StateBag, ctx context.Contex
 	return comm, nil
 }
 
-func sshBastionConfig(config *Config) (*gossh.ClientConfig, error) {
+// sshBastionConfig returns the client configuration for a bastion host. The
+// host key trusted on first use is stored in the state under stateKey.
+func sshBastionConfig(hop *SSHBastionHop, stateKey string, state multistep.StateBag) (*gossh.ClientConfig, error) {
+	var cert *gossh.Certificate
+	if hop.CertificateFile != "" {
+		var err error
+		if cert, err = readCertificateFile(hop.CertificateFile); err != nil {
+			return nil, err
+		}
+	}
+
 	auth := make([]gossh.AuthMethod, 0, 2)
-	if config.SSHBastionPassword != "" {
+	if hop.Password != "" {
 		auth = append(auth,
-			gossh.Password(config.SSHBastionPassword),
+			gossh.Password(hop.Password),
 			gossh.KeyboardInteractive(
-				ssh.PasswordKeyboardInteractive(config.SSHBastionPassword)))
+				ssh.PasswordKeyboardInteractive(hop.Password)))
 	}
 
-	if config.SSHBastionPrivateKeyFile != "" {
-		path, err := packer.ExpandUser(config.SSHBastionPrivateKeyFile)
+	if hop.PrivateKeyFile != "" {
+		path, err := packer.ExpandUser(hop.PrivateKeyFile)
 		if err != nil {
 			return nil, fmt.Errorf(
 				"Error expanding path for SSH bastion private key: %s", err)
@@ -261,10 +275,16 @@ func sshBastionConfig(config *Config) (*gossh.ClientConfig, error) {
 			return nil, err
 		}
 
-		auth = append(auth, gossh.PublicKeys(signer))
+		signers := []gossh.Signer{signer}
+		if cert != nil {
+			if signers, err = helperssh.CertSigners(signers, cert); err != nil {
+				return nil, err
+			}
+		}
+		auth = append(auth, gossh.PublicKeys(signers...))
 	}
 
-	if config.SSHBastionAgentAuth {
+	if hop.AgentAuth {
 		authSock := os.Getenv("SSH_AUTH_SOCK")
 		if authSock == "" {
 			return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
@@ -275,12 +295,12 @@ func sshBastionConfig(config *Config) (*gossh.ClientConfig, error) {
 			return nil, fmt.Errorf("Cannot connect to SSH Agent socket %q: %s", authSock, err)
 		}
 
-		auth = append(auth, gossh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+		auth = append(auth, agentAuth(agent.NewClient(sshAgent), cert))
 	}
 
 	return &gossh.ClientConfig{
-		User:            config.SSHBastionUsername,
+		User:            hop.Username,
 		Auth:            auth,
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hop.hostKeyPolicy(stateKey).callback(state),
 	}, nil
 }
@@ -1,10 +1,14 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -42,3 +46,92 @@ func FileSigner(path string) (ssh.Signer, error) {
 
 	return signer, nil
 }
+
+// FileCertificate reads an SSH certificate, in the format written by
+// `ssh-keygen -s`, from a file.
+func FileCertificate(path string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read certificate '%s': %s", path, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("Failed to read certificate '%s': not a certificate", path)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Failed to read certificate '%s': not a user certificate", path)
+	}
+
+	return cert, nil
+}
+
+// CertSigners returns the signers that authenticate with the certificate,
+// for every signer whose key the certificate was issued for. The
+// certificate signers come first so that they are offered first.
+func CertSigners(signers []ssh.Signer, cert *ssh.Certificate) ([]ssh.Signer, error) {
+	var certSigners []ssh.Signer
+	for _, signer := range signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			continue
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, err
+		}
+		certSigners = append(certSigners, certSigner)
+	}
+
+	return append(certSigners, signers...), nil
+}
+
+// SignUserCertificate issues a user certificate for the signer's key,
+// signed by ca, that is valid for the principal during the given duration.
+func SignUserCertificate(signer ssh.Signer, ca ssh.Signer, principal string, validity time.Duration) (ssh.Signer, error) {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "packer",
+		ValidPrincipals: []string{principal},
+		// Allow for some clock skew with the remote host.
+		ValidAfter:  uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	// OpenSSH 8.2 and later reject certificates signed with ssh-rsa, which
+	// uses SHA-1 and is what RSA signers use by default.
+	if ca.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithmSigner, ok := ca.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, fmt.Errorf("Error signing SSH certificate: the RSA CA key can't sign with %s", ssh.SigAlgoRSASHA2512)
+		}
+		ca = &rsaSHA2Signer{algorithmSigner}
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, fmt.Errorf("Error signing SSH certificate: %s", err)
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// rsaSHA2Signer signs with rsa-sha2-512 rather than ssh-rsa.
+type rsaSHA2Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s *rsaSHA2Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) gossh.Signer {
+	return testSignerType(t, Ecdsa)
+}
+
+func testSignerType(t *testing.T, keyType KeyPairType) gossh.Signer {
+	kp, err := NewKeyPair(CreateKeyPairConfig{Type: keyType})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := gossh.ParsePrivateKey(kp.PrivateKeyPemBlock)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return signer
+}
+
+func TestSignUserCertificate(t *testing.T) {
+	ca := testSigner(t)
+	key := testSigner(t)
+
+	signer, err := SignUserCertificate(key, ca, "packer", time.Hour)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert, ok := signer.PublicKey().(*gossh.Certificate)
+	if !ok {
+		t.Fatalf("should sign with a certificate: %T", signer.PublicKey())
+	}
+
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("packer", cert); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := checker.CheckCert("root", cert); err == nil {
+		t.Fatal("should only be valid for the principal")
+	}
+}
+
+func TestSignUserCertificate_rsaCA(t *testing.T) {
+	ca := testSignerType(t, Rsa)
+	key := testSigner(t)
+
+	signer, err := SignUserCertificate(key, ca, "packer", time.Hour)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert := signer.PublicKey().(*gossh.Certificate)
+	if cert.Signature.Format != gossh.SigAlgoRSASHA2512 {
+		t.Fatalf("bad signature format: %s", cert.Signature.Format)
+	}
+
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("packer", cert); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFileCertificate(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	ca := testSigner(t)
+	key := testSigner(t)
+	signer, err := SignUserCertificate(key, ca, "packer", time.Hour)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	path := filepath.Join(td, "id_ecdsa-cert.pub")
+	if err := ioutil.WriteFile(path, gossh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert, err := FileCertificate(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the key the certificate was issued for gets a certificate signer
+	other := testSigner(t)
+	signers, err := CertSigners([]gossh.Signer{other, key}, cert)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(signers) != 3 {
+		t.Fatalf("expected 3 signers, got %d", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*gossh.Certificate); !ok {
+		t.Fatal("the certificate should be offered first")
+	}
+
+	// A plain public key isn't a certificate
+	if err := ioutil.WriteFile(path, gossh.MarshalAuthorizedKey(key.PublicKey()), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := FileCertificate(path); err == nil {
+		t.Fatal("should error")
+	}
+}
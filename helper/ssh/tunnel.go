@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/packer/communicator/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 // ParseTunnelArgument parses an SSH tunneling argument compatible with the openssh client form.
@@ -43,3 +44,84 @@ func ParseTunnelArgument(forward string, direction ssh.TunnelDirection) (ssh.Tun
 	// So we parsed all that, and are just going to ignore it now. We would
 	// have used the information to set the type here.
 }
+
+// BastionHop is one of the hosts of a bastion chain.
+type BastionHop struct {
+	// The address of the host, in host:port form.
+	Addr   string
+	Config *gossh.ClientConfig
+}
+
+// BastionChainConnectFunc returns a function that connects to addr by jumping
+// through each of the hops in order, like the ProxyJump option of OpenSSH:
+// the first hop is dialed directly and every following one, as well as addr,
+// through the hop before it.
+func BastionChainConnectFunc(hops []BastionHop, proto, addr string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if len(hops) == 0 {
+			return net.Dial(proto, addr)
+		}
+
+		clients := make([]*gossh.Client, 0, len(hops))
+		for i, hop := range hops {
+			var client *gossh.Client
+			var err error
+			if i == 0 {
+				client, err = gossh.Dial("tcp", hop.Addr, hop.Config)
+			} else {
+				client, err = dialThrough(clients[i-1], hop)
+			}
+			if err != nil {
+				closeClients(clients)
+				return nil, fmt.Errorf("Error connecting to bastion %s: %s", hop.Addr, err)
+			}
+			clients = append(clients, client)
+		}
+
+		conn, err := clients[len(clients)-1].Dial(proto, addr)
+		if err != nil {
+			closeClients(clients)
+			return nil, err
+		}
+
+		return &bastionChainConn{
+			Conn:    conn,
+			clients: clients,
+		}, nil
+	}
+}
+
+// dialThrough opens an SSH connection to hop over a direct-tcpip channel of
+// client.
+func dialThrough(client *gossh.Client, hop BastionHop) (*gossh.Client, error) {
+	conn, err := client.Dial("tcp", hop.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := gossh.NewClientConn(conn, hop.Addr, hop.Config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
+
+// closeClients closes the clients of a chain, the last hop first.
+func closeClients(clients []*gossh.Client) error {
+	var err error
+	for i := len(clients) - 1; i >= 0; i-- {
+		err = clients[i].Close()
+	}
+	return err
+}
+
+type bastionChainConn struct {
+	net.Conn
+	clients []*gossh.Client
+}
+
+func (c *bastionChainConn) Close() error {
+	c.Conn.Close()
+	return closeClients(c.clients)
+}
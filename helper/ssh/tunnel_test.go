@@ -1,8 +1,14 @@
 package ssh
 
 import (
-	"github.com/hashicorp/packer/communicator/ssh"
+	"fmt"
+	"io"
+	"net"
+	"sync"
 	"testing"
+
+	"github.com/hashicorp/packer/communicator/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 const (
@@ -76,3 +82,204 @@ func TestInvalidTunnels(t *testing.T) {
 		}
 	}
 }
+
+// testBastion is an in-process SSH server that only forwards direct-tcpip
+// channels, like a bastion host.
+type testBastion struct {
+	Addr    string
+	HostKey gossh.PublicKey
+
+	l        sync.Mutex
+	listener net.Listener
+	dialed   []string
+}
+
+func newTestBastion(t *testing.T, user, password string) *testBastion {
+	hostKey := testSigner(t)
+	config := &gossh.ServerConfig{
+		PasswordCallback: func(c gossh.ConnMetadata, pass []byte) (*gossh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b := &testBastion{
+		Addr:     l.Addr().String(),
+		HostKey:  hostKey.PublicKey(),
+		listener: l,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, config)
+		}
+	}()
+	return b
+}
+
+func (b *testBastion) serve(conn net.Conn, config *gossh.ServerConfig) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			newChan.Reject(gossh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := gossh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+		addr := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+		b.l.Lock()
+		b.dialed = append(b.dialed, addr)
+		b.l.Unlock()
+
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go gossh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.Close()
+		}()
+	}
+}
+
+func (b *testBastion) Dialed() []string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return append([]string(nil), b.dialed...)
+}
+
+func (b *testBastion) Close() {
+	b.listener.Close()
+}
+
+func (b *testBastion) Hop(user, password string) BastionHop {
+	return BastionHop{
+		Addr: b.Addr,
+		Config: &gossh.ClientConfig{
+			User:            user,
+			Auth:            []gossh.AuthMethod{gossh.Password(password)},
+			HostKeyCallback: gossh.FixedHostKey(b.HostKey),
+		},
+	}
+}
+
+// testEchoServer echoes back everything written to it.
+func testEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestBastionChainConnectFunc(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	var bastions []*testBastion
+	var hops []BastionHop
+	for i := 0; i < 3; i++ {
+		user, password := fmt.Sprintf("user%d", i), fmt.Sprintf("secret%d", i)
+		b := newTestBastion(t, user, password)
+		defer b.Close()
+		bastions = append(bastions, b)
+		hops = append(hops, b.Hop(user, password))
+	}
+
+	conn, err := BastionChainConnectFunc(hops, "tcp", echo.Addr().String())()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	// Each bastion connects to the next hop, and the last one to the target
+	expected := []string{bastions[1].Addr, bastions[2].Addr, echo.Addr().String()}
+	for i, b := range bastions {
+		dialed := b.Dialed()
+		if len(dialed) != 1 || dialed[0] != expected[i] {
+			t.Fatalf("bastion %d: expected a connection to %s, got %v", i, expected[i], dialed)
+		}
+	}
+}
+
+func TestBastionChainConnectFunc_errors(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	first := newTestBastion(t, "user", "secret")
+	defer first.Close()
+	second := newTestBastion(t, "user", "secret")
+	defer second.Close()
+
+	// Bad credentials for the second hop
+	hops := []BastionHop{first.Hop("user", "secret"), second.Hop("user", "wrong")}
+	if _, err := BastionChainConnectFunc(hops, "tcp", echo.Addr().String())(); err == nil {
+		t.Fatal("should error")
+	}
+
+	// Unexpected host key for the second hop
+	hops = []BastionHop{first.Hop("user", "secret"), second.Hop("user", "secret")}
+	hops[1].Config.HostKeyCallback = gossh.FixedHostKey(first.HostKey)
+	if _, err := BastionChainConnectFunc(hops, "tcp", echo.Addr().String())(); err == nil {
+		t.Fatal("should error")
+	}
+}
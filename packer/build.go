@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"sync"
+
+	commonhelper "github.com/hashicorp/packer/helper/common"
 )
 
 const (
@@ -77,6 +80,11 @@ type Build interface {
 	// - "abort" - exit without cleanup
 	// - "ask" - ask the user
 	SetOnError(string)
+
+	// SetSessionRecording will record every remote command run and every
+	// file transferred by the provisioners of the build to the given file,
+	// as JSON lines. An empty path disables the recording.
+	SetSessionRecording(string)
 }
 
 // A build struct represents a single build job, the result of which should
@@ -98,6 +106,7 @@ type coreBuild struct {
 	debug         bool
 	force         bool
 	onError       string
+	recording     string
 	l             sync.Mutex
 	prepareCalled bool
 }
@@ -137,15 +146,7 @@ func (b *coreBuild) Prepare() (warn []string, err error) {
 
 	b.prepareCalled = true
 
-	packerConfig := map[string]interface{}{
-		BuildNameConfigKey:     b.name,
-		BuilderTypeConfigKey:   b.builderType,
-		DebugConfigKey:         b.debug,
-		ForceConfigKey:         b.force,
-		OnErrorConfigKey:       b.onError,
-		TemplatePathKey:        b.templatePath,
-		UserVariablesConfigKey: b.variables,
-	}
+	packerConfig := b.packerConfig()
 
 	// Prepare the builder
 	warn, err = b.builder.Prepare(b.builderConfig, packerConfig)
@@ -154,31 +155,31 @@ func (b *coreBuild) Prepare() (warn []string, err error) {
 		return
 	}
 
-	// Prepare the provisioners
+	// Prepare the provisioners. The ones reading outputs are prepared once,
+	// right before they run, when the outputs are captured.
 	for _, coreProv := range b.provisioners {
-		configs := make([]interface{}, len(coreProv.config), len(coreProv.config)+1)
-		copy(configs, coreProv.config)
-		configs = append(configs, packerConfig)
-
-		if err = coreProv.provisioner.Prepare(configs...); err != nil {
+		if usesOutputs(coreProv.config) {
+			continue
+		}
+		if err = coreProv.provisioner.Prepare(coreProv.configs(packerConfig)...); err != nil {
 			return
 		}
 	}
 
 	// Prepare the on-error-cleanup provisioner
-	if b.cleanupProvisioner.pType != "" {
-		configs := make([]interface{}, len(b.cleanupProvisioner.config), len(b.cleanupProvisioner.config)+1)
-		copy(configs, b.cleanupProvisioner.config)
-		configs = append(configs, packerConfig)
-		err = b.cleanupProvisioner.provisioner.Prepare(configs...)
+	if b.cleanupProvisioner.pType != "" && !usesOutputs(b.cleanupProvisioner.config) {
+		err = b.cleanupProvisioner.provisioner.Prepare(b.cleanupProvisioner.configs(packerConfig)...)
 		if err != nil {
 			return
 		}
 	}
 
-	// Prepare the post-processors
+	// Prepare the post-processors, the same way
 	for _, ppSeq := range b.postProcessors {
 		for _, corePP := range ppSeq {
+			if usesOutputs(corePP.config) {
+				continue
+			}
 			err = corePP.processor.Configure(corePP.config, packerConfig)
 			if err != nil {
 				return
@@ -189,6 +190,27 @@ func (b *coreBuild) Prepare() (warn []string, err error) {
 	return
 }
 
+// packerConfig is the configuration of the build that is passed to its
+// builder, provisioners and post-processors.
+func (b *coreBuild) packerConfig() map[string]interface{} {
+	return map[string]interface{}{
+		BuildNameConfigKey:     b.name,
+		BuilderTypeConfigKey:   b.builderType,
+		DebugConfigKey:         b.debug,
+		ForceConfigKey:         b.force,
+		OnErrorConfigKey:       b.onError,
+		TemplatePathKey:        b.templatePath,
+		UserVariablesConfigKey: b.variables,
+	}
+}
+
+// configs returns the configurations the provisioner is prepared with.
+func (p *coreBuildProvisioner) configs(packerConfig map[string]interface{}) []interface{} {
+	configs := make([]interface{}, len(p.config), len(p.config)+1)
+	copy(configs, p.config)
+	return append(configs, packerConfig)
+}
+
 // Runs the actual build. Prepare must be called prior to running this.
 func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error) {
 	if !b.prepareCalled {
@@ -202,6 +224,8 @@ func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error)
 		copy(hooks[hookName], hookList)
 	}
 
+	packerConfig := b.packerConfig()
+
 	// Add a hook for the provisioners if we have provisioners
 	if len(b.provisioners) > 0 {
 		hookedProvisioners := make([]*HookedProvisioner, len(b.provisioners))
@@ -210,15 +234,19 @@ func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error)
 			if len(p.config) > 0 {
 				pConfig = p.config[0]
 			}
+			provisioner := p.provisioner
+			if usesOutputs(p.config) {
+				provisioner = &outputsProvisioner{provisioner, p.configs(packerConfig)}
+			}
 			if b.debug {
 				hookedProvisioners[i] = &HookedProvisioner{
-					&DebuggedProvisioner{Provisioner: p.provisioner},
+					&DebuggedProvisioner{Provisioner: provisioner},
 					pConfig,
 					p.pType,
 				}
 			} else {
 				hookedProvisioners[i] = &HookedProvisioner{
-					p.provisioner,
+					provisioner,
 					pConfig,
 					p.pType,
 				}
@@ -235,8 +263,12 @@ func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error)
 	}
 
 	if b.cleanupProvisioner.pType != "" {
+		provisioner := b.cleanupProvisioner.provisioner
+		if usesOutputs(b.cleanupProvisioner.config) {
+			provisioner = &outputsProvisioner{provisioner, b.cleanupProvisioner.configs(packerConfig)}
+		}
 		hookedCleanupProvisioner := &HookedProvisioner{
-			b.cleanupProvisioner.provisioner,
+			provisioner,
 			b.cleanupProvisioner.config,
 			b.cleanupProvisioner.pType,
 		}
@@ -245,9 +277,32 @@ func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error)
 		}}
 	}
 
-	hook := &DispatchHook{Mapping: hooks}
+	var hook Hook = &DispatchHook{Mapping: hooks}
 	artifacts := make([]Artifact, 0, 1)
 
+	if b.recording != "" {
+		f, err := os.Create(b.recording)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating session recording: %s", err)
+		}
+		defer f.Close()
+
+		recorder := NewSessionRecorder(f)
+		recorder.record(&sessionEvent{Type: "build", Build: b.name})
+		hook = &recordingHook{Hook: hook, recorder: recorder}
+	}
+
+	// Start without the outputs and files of a previous run of this build
+	commonhelper.RemoveBuildState(b.name)
+	defer commonhelper.RemoveBuildState(b.name)
+
+	// The session recording is one of the files of the build
+	if b.recording != "" {
+		if err := commonhelper.AddBuildFiles([]string{b.recording}, b.name); err != nil {
+			log.Printf("[WARN] Unable to add the session recording to the files of build '%s': %s", b.name, err)
+		}
+	}
+
 	// The builder just has a normal Ui, but targeted
 	builderUi := &TargetedUI{
 		Target: b.Name(),
@@ -268,6 +323,28 @@ func (b *coreBuild) Run(ctx context.Context, originalUi Ui) ([]Artifact, error)
 		return nil, nil
 	}
 
+	if b.recording != "" {
+		builderArtifact = &recordedArtifact{Artifact: builderArtifact, recording: b.recording}
+	}
+
+	// Attach the outputs captured by the provisioners
+	outputs, oerr := commonhelper.RetrieveBuildOutputs(b.name)
+	if oerr != nil {
+		log.Printf("[WARN] Unable to read the outputs of build '%s': %s", b.name, oerr)
+	}
+	if len(outputs) > 0 {
+		builderArtifact = &outputsArtifact{Artifact: builderArtifact, outputs: outputs}
+	}
+
+	// Attach the files produced by the provisioners
+	files, ferr := commonhelper.RetrieveBuildFiles(b.name)
+	if ferr != nil {
+		log.Printf("[WARN] Unable to read the files of build '%s': %s", b.name, ferr)
+	}
+	if len(files) > 0 {
+		builderArtifact = &filesArtifact{Artifact: builderArtifact, files: files}
+	}
+
 	errors := make([]error, 0)
 	keepOriginalArtifact := len(b.postProcessors) == 0
 
@@ -282,6 +359,13 @@ PostProcessorRunSeqLoop:
 			}
 
 			builderUi.Say(fmt.Sprintf("Running post-processor: %s", corePP.processorType))
+			// Configure it with the outputs captured by the provisioners
+			if usesOutputs(corePP.config) {
+				if err := corePP.processor.Configure(corePP.config, packerConfig); err != nil {
+					errors = append(errors, fmt.Errorf("Post-processor failed: %s", err))
+					continue PostProcessorRunSeqLoop
+				}
+			}
 			ts := CheckpointReporter.AddSpan(corePP.processorType, "post-processor", corePP.config)
 			artifact, defaultKeep, forceOverride, err := corePP.processor.PostProcess(ctx, ppUi, priorArtifact)
 			ts.End(err)
@@ -358,6 +442,30 @@ PostProcessorRunSeqLoop:
 		}
 	}
 
+	if b.recording != "" {
+		for i, a := range artifacts {
+			if a != builderArtifact {
+				artifacts[i] = &recordedArtifact{Artifact: a, recording: b.recording}
+			}
+		}
+	}
+
+	if len(outputs) > 0 {
+		for i, a := range artifacts {
+			if _, ok := a.(*outputsArtifact); !ok {
+				artifacts[i] = &outputsArtifact{Artifact: a, outputs: outputs}
+			}
+		}
+	}
+
+	if len(files) > 0 {
+		for i, a := range artifacts {
+			if a != builderArtifact {
+				artifacts[i] = &filesArtifact{Artifact: a, files: files}
+			}
+		}
+	}
+
 	if len(errors) > 0 {
 		err = &MultiError{errors}
 	}
@@ -388,3 +496,11 @@ func (b *coreBuild) SetOnError(val string) {
 
 	b.onError = val
 }
+
+func (b *coreBuild) SetSessionRecording(val string) {
+	if b.prepareCalled {
+		panic("prepare has already been called")
+	}
+
+	b.recording = val
+}
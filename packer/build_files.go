@@ -0,0 +1,13 @@
+package packer
+
+// filesArtifact adds the files produced by the provisioners of a build to
+// the files of an artifact.
+type filesArtifact struct {
+	Artifact
+	files []string
+}
+
+func (a *filesArtifact) Files() []string {
+	files := append([]string{}, a.Artifact.Files()...)
+	return append(files, a.files...)
+}
@@ -0,0 +1,56 @@
+package packer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// ArtifactStateOutputs is the artifact state key under which the outputs
+// captured by the provisioners of a build are available, as a
+// map[string]string.
+const ArtifactStateOutputs = "outputs"
+
+// outputsArtifact attaches the outputs captured during the build to an
+// artifact.
+type outputsArtifact struct {
+	Artifact
+	outputs map[string]string
+}
+
+func (a *outputsArtifact) State(name string) interface{} {
+	if name == ArtifactStateOutputs {
+		return a.outputs
+	}
+	return a.Artifact.State(name)
+}
+
+// outputCallRe matches calls to the output template function.
+var outputCallRe = regexp.MustCompile(`{{-?\s*output\s`)
+
+// usesOutputs reports whether the configuration of a provisioner or a
+// post-processor reads outputs with the output template function.
+func usesOutputs(config interface{}) bool {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return false
+	}
+	return outputCallRe.Match(data)
+}
+
+// outputsProvisioner prepares a provisioner right before it runs, so that its
+// configuration renders the outputs captured by the provisioners that ran
+// before it. The build doesn't prepare such provisioners beforehand, since
+// preparing a provisioner twice isn't supported.
+type outputsProvisioner struct {
+	Provisioner
+	configs []interface{}
+}
+
+func (p *outputsProvisioner) Provision(ctx context.Context, ui Ui, comm Communicator) error {
+	if err := p.Provisioner.Prepare(p.configs...); err != nil {
+		return fmt.Errorf("Error rendering outputs: %s", err)
+	}
+	return p.Provisioner.Provision(ctx, ui, comm)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"reflect"
 	"testing"
+
+	commonhelper "github.com/hashicorp/packer/helper/common"
 )
 
 func boolPointer(tf bool) *bool {
@@ -445,3 +447,116 @@ func TestBuild_Cancel(t *testing.T) {
 		t.Fatal("build should err")
 	}
 }
+
+func TestBuild_Run_outputs(t *testing.T) {
+	build := testBuild()
+	build.provisioners[0].provisioner = &MockProvisioner{
+		ProvFunc: func(context.Context) error {
+			return commonhelper.SetBuildOutputs(map[string]string{"ip": "10.0.0.1"}, "test")
+		},
+	}
+	build.Prepare()
+	artifacts, err := build.Run(context.Background(), testUi())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("bad: %#v", artifacts)
+	}
+
+	for _, a := range artifacts {
+		outputs, ok := a.State(ArtifactStateOutputs).(map[string]string)
+		if !ok || outputs["ip"] != "10.0.0.1" {
+			t.Fatalf("bad: %#v", a.State(ArtifactStateOutputs))
+		}
+	}
+
+	// The outputs don't outlive the build
+	outputs, err := commonhelper.RetrieveBuildOutputs("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(outputs) != 0 {
+		t.Fatalf("bad: %#v", outputs)
+	}
+}
+
+func TestBuild_Run_outputsPrepare(t *testing.T) {
+	build := testBuild()
+	capture := &MockProvisioner{
+		ProvFunc: func(context.Context) error {
+			return commonhelper.SetBuildOutputs(map[string]string{"ip": "10.0.0.1"}, "test")
+		},
+	}
+	reader := &MockProvisioner{}
+	build.provisioners = []coreBuildProvisioner{
+		{"mock-provisioner", capture, []interface{}{42}},
+		{"mock-provisioner", reader, []interface{}{map[string]interface{}{"inline": "ping {{ output `ip` }}"}}},
+	}
+	pp := &MockPostProcessor{ArtifactId: "pp"}
+	build.postProcessors = [][]coreBuildPostProcessor{
+		{{pp, "testPP", map[string]interface{}{"custom_data": "{{output `ip`}}"}, boolPointer(true)}},
+	}
+	if _, err := build.Prepare(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The components reading outputs are only prepared when they run
+	if !capture.PrepCalled {
+		t.Fatal("should prepare")
+	}
+	if reader.PrepCalled || pp.ConfigureCalled {
+		t.Fatal("should not prepare before the outputs are captured")
+	}
+
+	capture.PrepCalled = false
+	if _, err := build.Run(context.Background(), testUi()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if capture.PrepCalled {
+		t.Fatal("should not prepare again")
+	}
+	if !reader.PrepCalled || !reader.ProvCalled {
+		t.Fatal("should prepare")
+	}
+	if !reflect.DeepEqual(reader.PrepConfigs, build.provisioners[1].configs(testDefaultPackerConfig())) {
+		t.Fatalf("bad: %#v", reader.PrepConfigs)
+	}
+	if !pp.ConfigureCalled || !pp.PostProcessCalled {
+		t.Fatal("should configure")
+	}
+}
+
+func TestBuild_Run_files(t *testing.T) {
+	build := testBuild()
+	build.provisioners[0].provisioner = &MockProvisioner{
+		ProvFunc: func(context.Context) error {
+			return commonhelper.AddBuildFiles([]string{"report.json"}, "test")
+		},
+	}
+	build.Prepare()
+	artifacts, err := build.Run(context.Background(), testUi())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("bad: %#v", artifacts)
+	}
+
+	for _, a := range artifacts {
+		files := a.Files()
+		if len(files) == 0 || files[len(files)-1] != "report.json" {
+			t.Fatalf("bad: %#v", files)
+		}
+	}
+
+	// The files don't outlive the build
+	files, err := commonhelper.RetrieveBuildFiles("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %#v", files)
+	}
+}
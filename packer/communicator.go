@@ -2,7 +2,9 @@ package packer
 
 import (
 	"context"
+	"errors"
 	"io"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -80,6 +82,78 @@ type Communicator interface {
 	DownloadDir(src string, dst string, exclude []string) error
 }
 
+// The ways a directory can be uploaded with a DirUploader.
+const (
+	// UploadDirFull uploads every file, like UploadDir.
+	UploadDirFull = "full"
+	// UploadDirDelta only uploads the files that differ from the ones
+	// already at the destination.
+	UploadDirDelta = "delta"
+	// UploadDirTar streams a compressed tarball of the directory that is
+	// extracted at the destination.
+	UploadDirTar = "tar"
+)
+
+// ErrUploadDirModeUnsupported is returned by a DirUploader that can't upload
+// directories in the requested mode.
+var ErrUploadDirModeUnsupported = errors.New("upload mode not supported by the communicator")
+
+// A DirUploader is a Communicator that can upload directories in other ways
+// than UploadDir.
+type DirUploader interface {
+	// UploadDirWithMode is like UploadDir, but uploads the directory in the
+	// given mode, one of the UploadDir* constants. It returns
+	// ErrUploadDirModeUnsupported if it can't upload in that mode.
+	UploadDirWithMode(mode string, dst string, src string, exclude []string) error
+}
+
+// PtySize is the size of a pseudo terminal, in characters.
+type PtySize struct {
+	Width  int
+	Height int
+}
+
+// ErrPtyUnsupported is returned by a PtyStarter that can't start commands in
+// a pseudo terminal.
+var ErrPtyUnsupported = errors.New("pseudo terminals not supported by the communicator")
+
+// A PtyStarter is a Communicator that can start commands in a pseudo
+// terminal, for interactive sessions.
+type PtyStarter interface {
+	// StartPty is like Start, but runs the command in a pseudo terminal of
+	// type term and of the given size, or the login shell of the user if the
+	// command is empty. The terminal is resized to every size received on
+	// resize until the command exits. It returns ErrPtyUnsupported if it
+	// can't start commands in a pseudo terminal.
+	StartPty(ctx context.Context, cmd *RemoteCmd, term string, size PtySize, resize <-chan PtySize) error
+}
+
+// ErrDialUnsupported is returned by a Dialer that can't open connections
+// from the machine.
+var ErrDialUnsupported = errors.New("port forwarding not supported by the communicator")
+
+// A Dialer is a Communicator that can open network connections from the
+// machine, like the port forwarding of SSH.
+type Dialer interface {
+	// Dial connects to the address on the named network from the machine.
+	// It returns ErrDialUnsupported if it can't open connections.
+	Dial(network, address string) (net.Conn, error)
+}
+
+// ErrAgentForwardingUnsupported is returned by an AgentForwarder that can't
+// forward SSH agents.
+var ErrAgentForwardingUnsupported = errors.New("agent forwarding not supported by the communicator")
+
+// An AgentForwarder is a Communicator that can forward an SSH agent to the
+// commands it runs.
+type AgentForwarder interface {
+	// StartWithAgent is like Start, but the command can use an SSH agent,
+	// through SSH_AUTH_SOCK. Every connection of the command to the agent
+	// is forwarded to a connection opened with dial. It returns
+	// ErrAgentForwardingUnsupported if it can't forward agents.
+	StartWithAgent(ctx context.Context, cmd *RemoteCmd, dial func() (io.ReadWriteCloser, error)) error
+}
+
 // RunWithUi runs the remote command and streams the output to any configured
 // Writers for stdout/stderr, while also writing each line as it comes to a Ui.
 // RunWithUi will not return until the command finishes or is cancelled.
@@ -20,6 +20,10 @@ type MockCommunicator struct {
 	StartStdin      string
 	StartExitStatus int
 
+	StartPtyCalled bool
+	StartPtyTerm   string
+	StartPtySize   PtySize
+
 	UploadCalled bool
 	UploadPath   string
 	UploadData   string
@@ -27,6 +31,7 @@ type MockCommunicator struct {
 	UploadDirDst     string
 	UploadDirSrc     string
 	UploadDirExclude []string
+	UploadDirMode    string
 
 	DownloadDirDst     string
 	DownloadDirSrc     string
@@ -76,6 +81,21 @@ func (c *MockCommunicator) Start(ctx context.Context, rc *RemoteCmd) error {
 	return nil
 }
 
+func (c *MockCommunicator) StartPty(ctx context.Context, rc *RemoteCmd, term string, size PtySize, resize <-chan PtySize) error {
+	c.StartPtyCalled = true
+	c.StartPtyTerm = term
+	c.StartPtySize = size
+
+	if resize != nil {
+		go func() {
+			for range resize {
+			}
+		}()
+	}
+
+	return c.Start(ctx, rc)
+}
+
 func (c *MockCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
 	c.UploadCalled = true
 	c.UploadPath = path
@@ -98,6 +118,11 @@ func (c *MockCommunicator) UploadDir(dst string, src string, excl []string) erro
 	return nil
 }
 
+func (c *MockCommunicator) UploadDirWithMode(mode string, dst string, src string, excl []string) error {
+	c.UploadDirMode = mode
+	return c.UploadDir(dst, src, excl)
+}
+
 func (c *MockCommunicator) Download(path string, w io.Writer) error {
 	c.DownloadCalled = true
 	c.DownloadPath = path
@@ -3,6 +3,7 @@ package packer
 import (
 	"bytes"
 	"io"
+	"strings"
 	"sync"
 )
 
@@ -35,6 +36,18 @@ func (l *secretFilter) Write(p []byte) (n int, err error) {
 	return l.w.Write(p)
 }
 
+// filter replaces the secrets in s.
+func (l *secretFilter) filter(s string) string {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for secret := range l.s {
+		if secret != "" {
+			s = strings.Replace(s, secret, "<sensitive>", -1)
+		}
+	}
+	return s
+}
+
 func (l *secretFilter) get() (s []string) {
 	l.m.Lock()
 	defer l.m.Unlock()
@@ -103,6 +103,12 @@ func (b *build) SetOnError(val string) {
 	}
 }
 
+func (b *build) SetSessionRecording(val string) {
+	if err := b.client.Call("Build.SetSessionRecording", val, new(interface{})); err != nil {
+		panic(err)
+	}
+}
+
 func (b *build) Cancel() {
 	if err := b.client.Call("Build.Cancel", new(interface{}), new(interface{})); err != nil {
 		panic(err)
@@ -167,6 +173,11 @@ func (b *BuildServer) SetOnError(val *string, reply *interface{}) error {
 	return nil
 }
 
+func (b *BuildServer) SetSessionRecording(val *string, reply *interface{}) error {
+	b.build.SetSessionRecording(*val)
+	return nil
+}
+
 func (b *BuildServer) Cancel(args *interface{}, reply *interface{}) error {
 	if b.contextCancel != nil {
 		b.contextCancel()
@@ -23,6 +23,8 @@ type testBuild struct {
 	setOnErrorCalled bool
 	cancelCalled     bool
 
+	setSessionRecordingCalled bool
+
 	errRunResult bool
 }
 
@@ -63,6 +65,10 @@ func (b *testBuild) SetOnError(string) {
 	b.setOnErrorCalled = true
 }
 
+func (b *testBuild) SetSessionRecording(string) {
+	b.setSessionRecordingCalled = true
+}
+
 func TestBuild(t *testing.T) {
 	b := new(testBuild)
 	client, server := testClientServer(t)
@@ -128,6 +134,12 @@ func TestBuild(t *testing.T) {
 	if !b.setOnErrorCalled {
 		t.Fatal("should be called")
 	}
+
+	// Test SetSessionRecording
+	bClient.SetSessionRecording("build.jsonl")
+	if !b.setSessionRecordingCalled {
+		t.Fatal("should be called")
+	}
 }
 
 func TestBuild_cancel(t *testing.T) {
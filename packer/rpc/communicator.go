@@ -3,8 +3,10 @@ package rpc
 import (
 	"context"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/rpc"
 	"os"
 	"sync"
@@ -38,6 +40,25 @@ type CommunicatorStartArgs struct {
 	ResponseStreamId uint32
 }
 
+type CommunicatorStartPtyArgs struct {
+	CommunicatorStartArgs
+	Term           string
+	Width          int
+	Height         int
+	ResizeStreamId uint32
+}
+
+type CommunicatorStartWithAgentArgs struct {
+	CommunicatorStartArgs
+	AgentStreamId uint32
+}
+
+type CommunicatorDialArgs struct {
+	Network  string
+	Address  string
+	StreamId uint32
+}
+
 type CommunicatorDownloadArgs struct {
 	Path           string
 	WriterStreamId uint32
@@ -55,6 +76,13 @@ type CommunicatorUploadDirArgs struct {
 	Exclude []string
 }
 
+type CommunicatorUploadDirWithModeArgs struct {
+	Mode    string
+	Dst     string
+	Src     string
+	Exclude []string
+}
+
 type CommunicatorDownloadDirArgs struct {
 	Dst     string
 	Src     string
@@ -66,15 +94,188 @@ func Communicator(client *rpc.Client) *communicator {
 }
 
 func (c *communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
+	args, s := c.startArgs(cmd)
+	err = c.client.Call("Communicator.Start", &args, new(interface{}))
+	s.done(err == nil)
+	return
+}
+
+// StartPty implements packer.PtyStarter. Whether pseudo terminals are
+// supported is only known by the communicator on the other side.
+func (c *communicator) StartPty(ctx context.Context, cmd *packer.RemoteCmd, term string, size packer.PtySize, resize <-chan packer.PtySize) error {
+	startArgs, s := c.startArgs(cmd)
+	args := CommunicatorStartPtyArgs{
+		CommunicatorStartArgs: startArgs,
+		Term:                  term,
+		Width:                 size.Width,
+		Height:                size.Height,
+	}
+
+	if resize != nil {
+		args.ResizeStreamId = c.mux.NextId()
+		go func() {
+			conn, err := c.mux.AcceptCancel(args.ResizeStreamId, s.canceled)
+			if err == errAcceptCanceled {
+				return
+			}
+			if err != nil {
+				log.Printf("[ERR] 'resize' accept error: %s", err)
+				return
+			}
+			defer conn.Close()
+
+			encoder := gob.NewEncoder(conn)
+			for size := range resize {
+				if err := encoder.Encode(&size); err != nil {
+					log.Printf("[ERR] 'resize' encode error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	var unsupported bool
+	if err := c.client.Call("Communicator.StartPty", &args, &unsupported); err != nil {
+		s.done(false)
+		return err
+	}
+	if unsupported {
+		s.done(false)
+		return packer.ErrPtyUnsupported
+	}
+
+	s.done(true)
+	return nil
+}
+
+// StartWithAgent implements packer.AgentForwarder. The connections to the
+// agent are opened on this side: the other side asks for them on the agent
+// stream, which answers with the ID of the stream to dial.
+func (c *communicator) StartWithAgent(ctx context.Context, cmd *packer.RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	startArgs, s := c.startArgs(cmd)
+	args := CommunicatorStartWithAgentArgs{
+		CommunicatorStartArgs: startArgs,
+		AgentStreamId:         c.mux.NextId(),
+	}
+
+	// The agent stream isn't dialed if the other side fails before
+	// starting the command
+	go func() {
+		conn, err := c.mux.AcceptCancel(args.AgentStreamId, s.canceled)
+		if err == errAcceptCanceled {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] 'agent' accept error: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		decoder := gob.NewDecoder(conn)
+		encoder := gob.NewEncoder(conn)
+		for {
+			var request bool
+			if err := decoder.Decode(&request); err != nil {
+				return
+			}
+
+			id := c.mux.NextId()
+			go func() {
+				agentC, err := c.mux.Accept(id)
+				if err != nil {
+					log.Printf("[ERR] 'agent' accept error: %s", err)
+					return
+				}
+				defer agentC.Close()
+
+				agentConn, err := dial()
+				if err != nil {
+					log.Printf("[ERR] Error connecting to agent: %s", err)
+					return
+				}
+				defer agentConn.Close()
+				go func() {
+					io.Copy(agentConn, agentC)
+					agentConn.Close()
+				}()
+				io.Copy(agentC, agentConn)
+			}()
+
+			if err := encoder.Encode(id); err != nil {
+				return
+			}
+		}
+	}()
+
+	var unsupported bool
+	if err := c.client.Call("Communicator.StartWithAgent", &args, &unsupported); err != nil {
+		s.done(false)
+		return err
+	}
+	if unsupported {
+		s.done(false)
+		return packer.ErrAgentForwardingUnsupported
+	}
+
+	s.done(true)
+	return nil
+}
+
+// Dial implements packer.Dialer. Whether connections can be opened is only
+// known by the communicator on the other side.
+func (c *communicator) Dial(network, address string) (net.Conn, error) {
+	args := &CommunicatorDialArgs{
+		Network:  network,
+		Address:  address,
+		StreamId: c.mux.NextId(),
+	}
+
+	// The stream isn't dialed if the connection can't be opened
+	cancel := make(chan struct{})
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := c.mux.AcceptCancel(args.StreamId, cancel)
+		if err != nil && err != errAcceptCanceled {
+			log.Printf("[ERR] 'dial' accept error: %s", err)
+		}
+		connCh <- conn
+	}()
+
+	var unsupported bool
+	if err := c.client.Call("Communicator.Dial", args, &unsupported); err != nil {
+		close(cancel)
+		return nil, err
+	}
+	if unsupported {
+		close(cancel)
+		return nil, packer.ErrDialUnsupported
+	}
+
+	conn := <-connCh
+	if conn == nil {
+		return nil, fmt.Errorf("error connecting to %s", address)
+	}
+	return conn, nil
+}
+
+// startArgs serves the streams of cmd and waits for its exit status in the
+// background. Nothing is read from cmd's stdin, and cmd doesn't exit, until
+// the returned cmdStart is done: if the other side didn't start cmd its
+// streams are left alone, so that it can be started some other way.
+func (c *communicator) startArgs(cmd *packer.RemoteCmd) (CommunicatorStartArgs, *cmdStart) {
 	var args CommunicatorStartArgs
 	args.Command = cmd.Command
 
+	s := &cmdStart{
+		started:  make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
 	var wg sync.WaitGroup
 
 	if cmd.Stdin != nil {
 		args.StdinStreamId = c.mux.NextId()
 		go func() {
-			serveSingleCopy("stdin", c.mux, args.StdinStreamId, nil, cmd.Stdin)
+			s.serveCopy("stdin", c.mux, args.StdinStreamId, nil, cmd.Stdin)
 		}()
 	}
 
@@ -83,7 +284,7 @@ func (c *communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) (err er
 		args.StdoutStreamId = c.mux.NextId()
 		go func() {
 			defer wg.Done()
-			serveSingleCopy("stdout", c.mux, args.StdoutStreamId, cmd.Stdout, nil)
+			s.serveCopy("stdout", c.mux, args.StdoutStreamId, cmd.Stdout, nil)
 		}()
 	}
 
@@ -92,7 +293,7 @@ func (c *communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) (err er
 		args.StderrStreamId = c.mux.NextId()
 		go func() {
 			defer wg.Done()
-			serveSingleCopy("stderr", c.mux, args.StderrStreamId, cmd.Stderr, nil)
+			s.serveCopy("stderr", c.mux, args.StderrStreamId, cmd.Stderr, nil)
 		}()
 	}
 
@@ -100,7 +301,13 @@ func (c *communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) (err er
 	args.ResponseStreamId = responseStreamId
 
 	go func() {
-		conn, err := c.mux.Accept(responseStreamId)
+		conn, err := c.mux.AcceptCancel(responseStreamId, s.canceled)
+		if err == errAcceptCanceled || !s.wait() {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
 		wg.Wait()
 		if err != nil {
 			log.Printf("[ERR] Error accepting response stream %d: %s",
@@ -123,8 +330,52 @@ func (c *communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) (err er
 		cmd.SetExited(finished.ExitStatus)
 	}()
 
-	err = c.client.Call("Communicator.Start", &args, new(interface{}))
-	return
+	return args, s
+}
+
+// cmdStart tells the goroutines serving a command whether the other side
+// started it.
+type cmdStart struct {
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+// done is called once the other side answered, with whether it started the
+// command.
+func (s *cmdStart) done(started bool) {
+	if started {
+		close(s.started)
+	} else {
+		close(s.canceled)
+	}
+}
+
+// wait blocks until done is called and returns whether the command started.
+func (s *cmdStart) wait() bool {
+	select {
+	case <-s.started:
+		return true
+	case <-s.canceled:
+		return false
+	}
+}
+
+// serveCopy is serveSingleCopy for the streams of a command, only copied
+// once it started.
+func (s *cmdStart) serveCopy(name string, mux *muxBroker, id uint32, dst io.Writer, src io.Reader) {
+	conn, err := mux.AcceptCancel(id, s.canceled)
+	if err == errAcceptCanceled {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERR] '%s' accept error: %s", name, err)
+		return
+	}
+	if !s.wait() {
+		conn.Close()
+		return
+	}
+	copyConn(name, conn, dst, src)
 }
 
 func (c *communicator) Upload(path string, r io.Reader, fi *os.FileInfo) (err error) {
@@ -161,6 +412,27 @@ func (c *communicator) UploadDir(dst string, src string, exclude []string) error
 	return err
 }
 
+// UploadDirWithMode implements packer.DirUploader. Whether the mode is
+// supported is only known by the communicator on the other side.
+func (c *communicator) UploadDirWithMode(mode string, dst string, src string, exclude []string) error {
+	args := &CommunicatorUploadDirWithModeArgs{
+		Mode:    mode,
+		Dst:     dst,
+		Src:     src,
+		Exclude: exclude,
+	}
+
+	var unsupported bool
+	if err := c.client.Call("Communicator.UploadDirWithMode", args, &unsupported); err != nil {
+		return err
+	}
+	if unsupported {
+		return packer.ErrUploadDirModeUnsupported
+	}
+
+	return nil
+}
+
 func (c *communicator) DownloadDir(src string, dst string, exclude []string) error {
 	args := &CommunicatorDownloadDirArgs{
 		Dst:     dst,
@@ -203,7 +475,138 @@ func (c *communicator) Download(path string, w io.Writer) (err error) {
 
 func (c *CommunicatorServer) Start(args *CommunicatorStartArgs, reply *interface{}) error {
 	ctx := context.TODO()
+	return c.start(args, nil, func(cmd *packer.RemoteCmd) error {
+		return c.c.Start(ctx, cmd)
+	})
+}
+
+func (c *CommunicatorServer) StartPty(args *CommunicatorStartPtyArgs, unsupported *bool) error {
+	ctx := context.TODO()
 
+	s, ok := c.c.(packer.PtyStarter)
+	if !ok {
+		*unsupported = true
+		return nil
+	}
+
+	size := packer.PtySize{Width: args.Width, Height: args.Height}
+	var resize chan packer.PtySize
+	var resizeC io.ReadCloser
+	if args.ResizeStreamId > 0 {
+		conn, err := c.mux.Dial(args.ResizeStreamId)
+		if err != nil {
+			return NewBasicError(err)
+		}
+		resizeC = conn
+		resize = make(chan packer.PtySize)
+	}
+
+	err := c.start(&args.CommunicatorStartArgs, resizeC, func(cmd *packer.RemoteCmd) error {
+		return s.StartPty(ctx, cmd, args.Term, size, resize)
+	})
+	if err == packer.ErrPtyUnsupported {
+		*unsupported = true
+		return nil
+	}
+	if err != nil || resizeC == nil {
+		return err
+	}
+
+	go func() {
+		defer close(resize)
+		decoder := gob.NewDecoder(resizeC)
+		for {
+			var size packer.PtySize
+			if err := decoder.Decode(&size); err != nil {
+				return
+			}
+			resize <- size
+		}
+	}()
+
+	return nil
+}
+
+func (c *CommunicatorServer) StartWithAgent(args *CommunicatorStartWithAgentArgs, unsupported *bool) error {
+	ctx := context.TODO()
+
+	f, ok := c.c.(packer.AgentForwarder)
+	if !ok {
+		*unsupported = true
+		return nil
+	}
+
+	agentC, err := c.mux.Dial(args.AgentStreamId)
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	// Connections to the agent are asked for one at a time
+	var l sync.Mutex
+	encoder := gob.NewEncoder(agentC)
+	decoder := gob.NewDecoder(agentC)
+	dial := func() (io.ReadWriteCloser, error) {
+		l.Lock()
+		defer l.Unlock()
+
+		if err := encoder.Encode(true); err != nil {
+			return nil, err
+		}
+		var id uint32
+		if err := decoder.Decode(&id); err != nil {
+			return nil, err
+		}
+		return c.mux.Dial(id)
+	}
+
+	err = c.start(&args.CommunicatorStartArgs, agentC, func(cmd *packer.RemoteCmd) error {
+		return f.StartWithAgent(ctx, cmd, dial)
+	})
+	if err == packer.ErrAgentForwardingUnsupported {
+		*unsupported = true
+		return nil
+	}
+	return err
+}
+
+func (c *CommunicatorServer) Dial(args *CommunicatorDialArgs, unsupported *bool) error {
+	d, ok := c.c.(packer.Dialer)
+	if !ok {
+		*unsupported = true
+		return nil
+	}
+
+	conn, err := d.Dial(args.Network, args.Address)
+	if err == packer.ErrDialUnsupported {
+		*unsupported = true
+		return nil
+	}
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	streamC, err := c.mux.Dial(args.StreamId)
+	if err != nil {
+		conn.Close()
+		return NewBasicError(err)
+	}
+
+	go func() {
+		defer streamC.Close()
+		defer conn.Close()
+		go func() {
+			io.Copy(conn, streamC)
+			conn.Close()
+		}()
+		io.Copy(streamC, conn)
+	}()
+
+	return nil
+}
+
+// start starts cmd with start, with the streams of args. extra is closed
+// with the streams when cmd exits, or if it fails to start.
+func (c *CommunicatorServer) start(args *CommunicatorStartArgs, extra io.Closer, start func(*packer.RemoteCmd) error) error {
 	// Build the RemoteCmd on this side so that it all pipes over
 	// to the remote side.
 	var cmd packer.RemoteCmd
@@ -212,6 +615,9 @@ func (c *CommunicatorServer) Start(args *CommunicatorStartArgs, reply *interface
 	// Create a channel to signal we're done so that we can close
 	// our stdin/stdout/stderr streams
 	toClose := make([]io.Closer, 0)
+	if extra != nil {
+		toClose = append(toClose, extra)
+	}
 	doneCh := make(chan struct{})
 	go func() {
 		<-doneCh
@@ -263,9 +669,12 @@ func (c *CommunicatorServer) Start(args *CommunicatorStartArgs, reply *interface
 	responseWriter := gob.NewEncoder(responseC)
 
 	// Start the actual command
-	err = c.c.Start(ctx, &cmd)
+	err = start(&cmd)
 	if err != nil {
 		close(doneCh)
+		if err == packer.ErrPtyUnsupported || err == packer.ErrAgentForwardingUnsupported {
+			return err
+		}
 		return NewBasicError(err)
 	}
 
@@ -302,6 +711,21 @@ func (c *CommunicatorServer) UploadDir(args *CommunicatorUploadDirArgs, reply *e
 	return c.c.UploadDir(args.Dst, args.Src, args.Exclude)
 }
 
+func (c *CommunicatorServer) UploadDirWithMode(args *CommunicatorUploadDirWithModeArgs, unsupported *bool) error {
+	u, ok := c.c.(packer.DirUploader)
+	if !ok {
+		*unsupported = true
+		return nil
+	}
+
+	err := u.UploadDirWithMode(args.Mode, args.Dst, args.Src, args.Exclude)
+	if err == packer.ErrUploadDirModeUnsupported {
+		*unsupported = true
+		return nil
+	}
+	return err
+}
+
 func (c *CommunicatorServer) DownloadDir(args *CommunicatorUploadDirArgs, reply *error) error {
 	return c.c.DownloadDir(args.Src, args.Dst, args.Exclude)
 }
@@ -323,7 +747,11 @@ func serveSingleCopy(name string, mux *muxBroker, id uint32, dst io.Writer, src
 		log.Printf("[ERR] '%s' accept error: %s", name, err)
 		return
 	}
+	copyConn(name, conn, dst, src)
+}
 
+// copyConn copies to or from conn, whichever of dst and src is nil.
+func copyConn(name string, conn net.Conn, dst io.Writer, src io.Reader) {
 	// Be sure to close the connection after we're done copying so
 	// that an EOF will successfully be sent to the remote side
 	defer conn.Close()
@@ -2,9 +2,12 @@ package rpc
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"io"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer/packer"
@@ -167,3 +170,184 @@ func TestCommunicator_ImplementsCommunicator(t *testing.T) {
 		t.Fatal("should be a Communicator")
 	}
 }
+
+func TestCommunicatorRPC_uploadDirWithMode(t *testing.T) {
+	c := new(packer.MockCommunicator)
+	client, server := testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(c)
+	remote := client.Communicator().(packer.DirUploader)
+
+	if err := remote.UploadDirWithMode(packer.UploadDirDelta, "foo", "bar", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.UploadDirMode != packer.UploadDirDelta {
+		t.Fatalf("bad: %s", c.UploadDirMode)
+	}
+	if c.UploadDirDst != "foo" || c.UploadDirSrc != "bar" {
+		t.Fatalf("bad: %s %s", c.UploadDirDst, c.UploadDirSrc)
+	}
+
+	// A communicator that only implements packer.Communicator
+	client, server = testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(struct{ packer.Communicator }{c})
+	remote = client.Communicator().(packer.DirUploader)
+
+	err := remote.UploadDirWithMode(packer.UploadDirDelta, "foo", "bar", nil)
+	if err != packer.ErrUploadDirModeUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestCommunicatorRPC_startPty(t *testing.T) {
+	c := new(packer.MockCommunicator)
+	c.StartStdout = "hello"
+	client, server := testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(c)
+	remote := client.Communicator().(packer.PtyStarter)
+
+	stdout := new(bytes.Buffer)
+	cmd := &packer.RemoteCmd{Stdout: stdout}
+	resize := make(chan packer.PtySize)
+	defer close(resize)
+	err := remote.StartPty(context.Background(), cmd, "xterm", packer.PtySize{Width: 80, Height: 24}, resize)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if !c.StartPtyCalled {
+		t.Fatal("should be called")
+	}
+	if c.StartPtyTerm != "xterm" {
+		t.Fatalf("bad: %s", c.StartPtyTerm)
+	}
+	if c.StartPtySize != (packer.PtySize{Width: 80, Height: 24}) {
+		t.Fatalf("bad: %#v", c.StartPtySize)
+	}
+	if stdout.String() != "hello" {
+		t.Fatalf("bad: %q", stdout.String())
+	}
+
+	// A communicator that only implements packer.Communicator
+	client, server = testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(struct{ packer.Communicator }{c})
+	remote = client.Communicator().(packer.PtyStarter)
+
+	err = remote.StartPty(context.Background(), new(packer.RemoteCmd), "xterm", packer.PtySize{}, nil)
+	if err != packer.ErrPtyUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+// dialingCommunicator forwards connections from the host.
+type dialingCommunicator struct {
+	packer.MockCommunicator
+}
+
+func (c *dialingCommunicator) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func TestCommunicatorRPC_dial(t *testing.T) {
+	// An echo server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	client, server := testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(new(dialingCommunicator))
+	remote := client.Communicator().(packer.Dialer)
+
+	conn, err := remote.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	// A communicator that only implements packer.Communicator
+	client, server = testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(new(packer.MockCommunicator))
+	remote = client.Communicator().(packer.Dialer)
+
+	if _, err := remote.Dial("tcp", l.Addr().String()); err != packer.ErrDialUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+// noAgentCommunicator can't forward the agent once it tried to.
+type noAgentCommunicator struct {
+	packer.MockCommunicator
+}
+
+func (c *noAgentCommunicator) StartWithAgent(ctx context.Context, cmd *packer.RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	return packer.ErrAgentForwardingUnsupported
+}
+
+func TestCommunicatorRPC_startWithAgentFallback(t *testing.T) {
+	c := new(noAgentCommunicator)
+	c.StartStdout = "outfoo\n"
+	c.StartExitStatus = 42
+	client, server := testClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(c)
+	remote := client.Communicator()
+
+	stdin := strings.NewReader("infoo\n")
+	stdout := new(bytes.Buffer)
+	cmd := &packer.RemoteCmd{Command: "foo", Stdin: stdin, Stdout: stdout}
+	dial := func() (io.ReadWriteCloser, error) {
+		t.Fatal("the agent shouldn't be dialed")
+		return nil, nil
+	}
+	err := remote.(packer.AgentForwarder).StartWithAgent(context.Background(), cmd, dial)
+	if err != packer.ErrAgentForwardingUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	// The streams of the command that didn't start are left alone, for the
+	// command started without the agent
+	cmd = &packer.RemoteCmd{Command: "foo", Stdin: stdin, Stdout: stdout}
+	if err := remote.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status := cmd.Wait(); status != 42 {
+		t.Fatalf("bad exit status: %d", status)
+	}
+	if c.StartStdin != "infoo\n" {
+		t.Fatalf("bad stdin: %q", c.StartStdin)
+	}
+	if stdout.String() != "outfoo\n" {
+		t.Fatalf("bad stdout: %q", stdout.String())
+	}
+}
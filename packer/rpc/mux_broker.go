@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -59,11 +60,26 @@ func newMuxBrokerServer(rwc io.ReadWriteCloser) (*muxBroker, error) {
 //
 // This should not be called multiple times with the same ID at one time.
 func (m *muxBroker) Accept(id uint32) (net.Conn, error) {
+	return m.AcceptCancel(id, nil)
+}
+
+// errAcceptCanceled is returned by AcceptCancel when it gives up.
+var errAcceptCanceled = errors.New("accept canceled")
+
+// AcceptCancel accepts a connection by ID like Accept, but gives up as soon
+// as cancel is closed, for connections the other side won't dial after all.
+func (m *muxBroker) AcceptCancel(id uint32, cancel <-chan struct{}) (net.Conn, error) {
 	var c net.Conn
 	p := m.getStream(id)
 	select {
 	case c = <-p.ch:
 		close(p.doneCh)
+	case <-cancel:
+		m.Lock()
+		defer m.Unlock()
+		delete(m.streams, id)
+
+		return nil, errAcceptCanceled
 	case <-time.After(5 * time.Second):
 		m.Lock()
 		defer m.Unlock()
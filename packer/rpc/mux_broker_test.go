@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/yamux"
 )
@@ -53,6 +54,28 @@ func TestMuxBroker(t *testing.T) {
 	}
 }
 
+func TestMuxBroker_AcceptCancel(t *testing.T) {
+	c, s := testYamux(t)
+	defer c.Close()
+	defer s.Close()
+
+	bs := newMuxBroker(s)
+	go bs.Run()
+
+	cancel := make(chan struct{})
+	close(cancel)
+	start := time.Now()
+	if _, err := bs.AcceptCancel(5, cancel); err != errAcceptCanceled {
+		t.Fatalf("bad: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("should give up right away")
+	}
+	if len(bs.streams) != 0 {
+		t.Fatalf("bad: %#v", bs.streams)
+	}
+}
+
 func testYamux(t *testing.T) (client *yamux.Session, server *yamux.Session) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -0,0 +1,407 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArtifactStateSessionRecording is the artifact state key under which the
+// path of the session recording of a build is available.
+const ArtifactStateSessionRecording = "session_recording"
+
+// A SessionRecorder writes a record of everything done through the
+// communicators it wraps: every remote command, its output and its exit
+// status, and every upload and download with the SHA256 checksums of the
+// files. The record is written as JSON lines, one event per line. Values
+// registered with LogSecretFilter are redacted.
+type SessionRecorder struct {
+	l      sync.Mutex
+	enc    *json.Encoder
+	lastID int
+}
+
+// sessionEvent is a line of a session recording.
+type sessionEvent struct {
+	Time        time.Time         `json:"time"`
+	Type        string            `json:"type"`
+	ID          int               `json:"id,omitempty"`
+	Build       string            `json:"build,omitempty"`
+	Command     string            `json:"command,omitempty"`
+	Stream      string            `json:"stream,omitempty"`
+	Data        string            `json:"data,omitempty"`
+	ExitStatus  *int              `json:"exit_status,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Destination string            `json:"destination,omitempty"`
+	Mode        string            `json:"mode,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Files       map[string]string `json:"files,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// NewSessionRecorder returns a SessionRecorder writing to w.
+func NewSessionRecorder(w io.Writer) *SessionRecorder {
+	return &SessionRecorder{enc: json.NewEncoder(w)}
+}
+
+// Communicator returns a Communicator recording everything done through c.
+func (r *SessionRecorder) Communicator(c Communicator) Communicator {
+	return &recordingCommunicator{comm: c, recorder: r}
+}
+
+func (r *SessionRecorder) nextID() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.lastID++
+	return r.lastID
+}
+
+func (r *SessionRecorder) record(e *sessionEvent) {
+	e.Time = time.Now().UTC()
+	e.Command = LogSecretFilter.filter(e.Command)
+	e.Data = LogSecretFilter.filter(e.Data)
+	e.Source = LogSecretFilter.filter(e.Source)
+	e.Destination = LogSecretFilter.filter(e.Destination)
+	e.Error = LogSecretFilter.filter(e.Error)
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		log.Printf("[ERR] Failed to write session recording: %s", err)
+	}
+}
+
+func (r *SessionRecorder) recordTransfer(e *sessionEvent, err error) {
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.record(e)
+}
+
+type recordingCommunicator struct {
+	comm     Communicator
+	recorder *SessionRecorder
+}
+
+func (c *recordingCommunicator) Start(ctx context.Context, cmd *RemoteCmd) error {
+	return c.start(cmd, func() error {
+		return c.comm.Start(ctx, cmd)
+	})
+}
+
+// StartWithAgent implements AgentForwarder if the wrapped communicator does.
+func (c *recordingCommunicator) StartWithAgent(ctx context.Context, cmd *RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	f, ok := c.comm.(AgentForwarder)
+	if !ok {
+		return ErrAgentForwardingUnsupported
+	}
+
+	return c.start(cmd, func() error {
+		return f.StartWithAgent(ctx, cmd, dial)
+	})
+}
+
+// start records cmd, started with start. Commands that couldn't be started
+// with an agent aren't recorded, since they're started again without it.
+func (c *recordingCommunicator) start(cmd *RemoteCmd, start func() error) error {
+	id := c.recorder.nextID()
+
+	// The output is recorded once the command is
+	stdout := &recordingWriter{recorder: c.recorder, id: id, stream: "stdout", held: true}
+	stderr := &recordingWriter{recorder: c.recorder, id: id, stream: "stderr", held: true}
+	cmd.Lock()
+	origStdout, origStderr := cmd.Stdout, cmd.Stderr
+	cmd.Stdout = teeWriter(cmd.Stdout, stdout)
+	cmd.Stderr = teeWriter(cmd.Stderr, stderr)
+	cmd.Unlock()
+
+	if err := start(); err != nil {
+		if err == ErrAgentForwardingUnsupported {
+			cmd.Lock()
+			cmd.Stdout, cmd.Stderr = origStdout, origStderr
+			cmd.Unlock()
+			return err
+		}
+		c.recorder.record(&sessionEvent{Type: "command", ID: id, Command: cmd.Command})
+		c.recorder.recordTransfer(&sessionEvent{Type: "exit", ID: id}, err)
+		return err
+	}
+	c.recorder.record(&sessionEvent{Type: "command", ID: id, Command: cmd.Command})
+	stdout.Release()
+	stderr.Release()
+
+	go func() {
+		status := cmd.Wait()
+		stdout.Flush()
+		stderr.Flush()
+		c.recorder.record(&sessionEvent{Type: "exit", ID: id, ExitStatus: &status})
+	}()
+	return nil
+}
+
+// StartPty implements PtyStarter if the wrapped communicator does. The
+// output of interactive sessions isn't recorded, only their exit status.
+func (c *recordingCommunicator) StartPty(ctx context.Context, cmd *RemoteCmd, term string, size PtySize, resize <-chan PtySize) error {
+	s, ok := c.comm.(PtyStarter)
+	if !ok {
+		return ErrPtyUnsupported
+	}
+
+	id := c.recorder.nextID()
+	if err := s.StartPty(ctx, cmd, term, size, resize); err != nil {
+		if err != ErrPtyUnsupported {
+			c.recorder.record(&sessionEvent{Type: "command", ID: id, Command: cmd.Command})
+			c.recorder.recordTransfer(&sessionEvent{Type: "exit", ID: id}, err)
+		}
+		return err
+	}
+	c.recorder.record(&sessionEvent{Type: "command", ID: id, Command: cmd.Command})
+
+	go func() {
+		status := cmd.Wait()
+		c.recorder.record(&sessionEvent{Type: "exit", ID: id, ExitStatus: &status})
+	}()
+	return nil
+}
+
+// Dial implements Dialer if the wrapped communicator does. Forwarded
+// connections aren't recorded.
+func (c *recordingCommunicator) Dial(network, address string) (net.Conn, error) {
+	d, ok := c.comm.(Dialer)
+	if !ok {
+		return nil, ErrDialUnsupported
+	}
+	return d.Dial(network, address)
+}
+
+func (c *recordingCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
+	h := sha256.New()
+	counter := &countingWriter{Writer: h}
+	err := c.comm.Upload(path, io.TeeReader(r, counter), fi)
+	c.recorder.recordTransfer(&sessionEvent{
+		Type:        "upload",
+		Destination: path,
+		Size:        counter.n,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+	}, err)
+	return err
+}
+
+func (c *recordingCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	files := checksumTree(src)
+	err := c.comm.UploadDir(dst, src, exclude)
+	c.recorder.recordTransfer(&sessionEvent{
+		Type:        "upload_dir",
+		Source:      src,
+		Destination: dst,
+		Files:       files,
+	}, err)
+	return err
+}
+
+// UploadDirWithMode implements DirUploader if the wrapped communicator does.
+func (c *recordingCommunicator) UploadDirWithMode(mode string, dst string, src string, exclude []string) error {
+	u, ok := c.comm.(DirUploader)
+	if !ok {
+		return ErrUploadDirModeUnsupported
+	}
+
+	files := checksumTree(src)
+	err := u.UploadDirWithMode(mode, dst, src, exclude)
+	if err == ErrUploadDirModeUnsupported {
+		return err
+	}
+	c.recorder.recordTransfer(&sessionEvent{
+		Type:        "upload_dir",
+		Source:      src,
+		Destination: dst,
+		Mode:        mode,
+		Files:       files,
+	}, err)
+	return err
+}
+
+func (c *recordingCommunicator) Download(path string, w io.Writer) error {
+	h := sha256.New()
+	counter := &countingWriter{Writer: h}
+	err := c.comm.Download(path, io.MultiWriter(w, counter))
+	c.recorder.recordTransfer(&sessionEvent{
+		Type:   "download",
+		Source: path,
+		Size:   counter.n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, err)
+	return err
+}
+
+func (c *recordingCommunicator) DownloadDir(src string, dst string, exclude []string) error {
+	err := c.comm.DownloadDir(src, dst, exclude)
+	c.recorder.recordTransfer(&sessionEvent{
+		Type:        "download_dir",
+		Source:      src,
+		Destination: dst,
+		Files:       checksumTree(dst),
+	}, err)
+	return err
+}
+
+// recordingWriter records the output of a command one line at a time, so
+// that secrets are never split across events.
+type recordingWriter struct {
+	recorder *SessionRecorder
+	id       int
+	stream   string
+
+	l    sync.Mutex
+	buf  []byte
+	held bool
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if !w.held {
+		w.emitLines()
+	}
+	return len(p), nil
+}
+
+// Release records the lines written while the writer was held.
+func (w *recordingWriter) Release() {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.held = false
+	w.emitLines()
+}
+
+func (w *recordingWriter) emitLines() {
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush records the last line if it didn't end with a newline.
+func (w *recordingWriter) Flush() {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *recordingWriter) emit(line []byte) {
+	w.recorder.record(&sessionEvent{
+		Type:   "output",
+		ID:     w.id,
+		Stream: w.stream,
+		Data:   string(line),
+	})
+}
+
+func teeWriter(w io.Writer, tee io.Writer) io.Writer {
+	if w == nil {
+		return tee
+	}
+	return io.MultiWriter(w, tee)
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// checksumTree returns the SHA256 checksums of the regular files in the
+// local directory dir, by path relative to it.
+func checksumTree(dir string) map[string]string {
+	files := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		sum, err := checksumFile(sha256.New(), path)
+		if err != nil {
+			log.Printf("[WARN] Unable to checksum %s for the session recording: %s", path, err)
+			return nil
+		}
+		files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return files
+}
+
+func checksumFile(h hash.Hash, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordingHook records everything done through the communicator given to
+// the hooks it wraps, which covers all the provisioners of a build.
+type recordingHook struct {
+	Hook
+	recorder *SessionRecorder
+}
+
+func (h *recordingHook) Run(ctx context.Context, name string, ui Ui, comm Communicator, data interface{}) error {
+	if comm != nil {
+		comm = h.recorder.Communicator(comm)
+	}
+	return h.Hook.Run(ctx, name, ui, comm, data)
+}
+
+// recordedArtifact attaches the session recording of the build to the
+// artifact of the builder.
+type recordedArtifact struct {
+	Artifact
+	recording string
+}
+
+func (a *recordedArtifact) String() string {
+	return fmt.Sprintf("%s\nSession recording: %s", a.Artifact.String(), a.recording)
+}
+
+func (a *recordedArtifact) State(name string) interface{} {
+	if name == ArtifactStateSessionRecording {
+		return a.recording
+	}
+	return a.Artifact.State(name)
+}
@@ -0,0 +1,221 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readSessionEvents(t *testing.T, data []byte) []sessionEvent {
+	var events []sessionEvent
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var e sessionEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestSessionRecorder(t *testing.T) {
+	LogSecretFilter.Set("hunter2")
+	defer func() {
+		LogSecretFilter.s = make(map[string]struct{})
+	}()
+
+	var out bytes.Buffer
+	mock := &MockCommunicator{
+		StartStdout:     "password is hunter2\nno newline",
+		StartExitStatus: 3,
+	}
+	recorder := NewSessionRecorder(&out)
+	comm := recorder.Communicator(mock)
+
+	cmd := &RemoteCmd{Command: "echo hunter2"}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+	if err := comm.Upload("/tmp/foo", strings.NewReader("foo"), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mock.UploadData != "foo" {
+		t.Fatalf("bad: %s", mock.UploadData)
+	}
+
+	// The exit is recorded asynchronously
+	var events []sessionEvent
+	for i := 0; i < 100; i++ {
+		recorder.l.Lock()
+		events = readSessionEvents(t, out.Bytes())
+		recorder.l.Unlock()
+		if len(events) == 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != 5 {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	byType := make(map[string][]sessionEvent)
+	for _, e := range events {
+		byType[e.Type] = append(byType[e.Type], e)
+	}
+	if e := byType["command"][0]; e.Command != "echo <sensitive>" || e.ID != 1 {
+		t.Fatalf("bad: %#v", e)
+	}
+	output := byType["output"]
+	if len(output) != 2 || output[0].Data != "password is <sensitive>\n" || output[1].Data != "no newline" {
+		t.Fatalf("bad: %#v", output)
+	}
+	if e := byType["exit"][0]; e.ExitStatus == nil || *e.ExitStatus != 3 {
+		t.Fatalf("bad: %#v", e)
+	}
+	// sha256("foo")
+	upload := byType["upload"][0]
+	if upload.SHA256 != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" || upload.Size != 3 {
+		t.Fatalf("bad: %#v", upload)
+	}
+}
+
+func TestSessionRecorder_uploadDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	if err := ioutil.WriteFile(filepath.Join(td, "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var out bytes.Buffer
+	mock := new(MockCommunicator)
+	comm := NewSessionRecorder(&out).Communicator(mock)
+	if err := comm.(DirUploader).UploadDirWithMode(UploadDirTar, "/tmp", td, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mock.UploadDirMode != UploadDirTar {
+		t.Fatalf("bad: %s", mock.UploadDirMode)
+	}
+
+	events := readSessionEvents(t, out.Bytes())
+	if len(events) != 1 || events[0].Files["foo"] != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+		t.Fatalf("bad: %s", out.String())
+	}
+
+	// Communicators that can't upload in other modes aren't recorded
+	out.Reset()
+	comm = NewSessionRecorder(&out).Communicator(struct{ Communicator }{mock})
+	if err := comm.(DirUploader).UploadDirWithMode(UploadDirTar, "/tmp", td, nil); err != ErrUploadDirModeUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("bad: %s", out.String())
+	}
+}
+
+// noAgentCommunicator can't forward the agent once it tried to.
+type noAgentCommunicator struct {
+	MockCommunicator
+}
+
+func (c *noAgentCommunicator) StartWithAgent(ctx context.Context, cmd *RemoteCmd, dial func() (io.ReadWriteCloser, error)) error {
+	return ErrAgentForwardingUnsupported
+}
+
+func TestSessionRecorder_agentForwardingUnsupported(t *testing.T) {
+	var out bytes.Buffer
+	mock := &noAgentCommunicator{MockCommunicator{StartStdout: "foo\n"}}
+	recorder := NewSessionRecorder(&out)
+	comm := recorder.Communicator(mock)
+
+	stdout := new(bytes.Buffer)
+	cmd := &RemoteCmd{Command: "echo foo", Stdout: stdout}
+	err := comm.(AgentForwarder).StartWithAgent(context.Background(), cmd, nil)
+	if err != ErrAgentForwardingUnsupported {
+		t.Fatalf("bad: %#v", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("bad: %s", out.String())
+	}
+	if cmd.Stdout != stdout {
+		t.Fatalf("the output should be left alone: %#v", cmd.Stdout)
+	}
+
+	// The command started without the agent is recorded once
+	cmd = &RemoteCmd{Command: "echo foo", Stdout: stdout}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	var events []sessionEvent
+	for i := 0; i < 100; i++ {
+		recorder.l.Lock()
+		events = readSessionEvents(t, out.Bytes())
+		recorder.l.Unlock()
+		if len(events) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != 3 || events[0].Type != "command" || events[1].Data != "foo\n" || events[2].Type != "exit" {
+		t.Fatalf("bad: %s", out.String())
+	}
+	if stdout.String() != "foo\n" {
+		t.Fatalf("bad: %q", stdout.String())
+	}
+}
+
+func TestBuild_Run_sessionRecording(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "test.jsonl")
+
+	build := testBuild()
+	build.SetSessionRecording(path)
+	build.Prepare()
+	artifacts, err := build.Run(context.Background(), testUi())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("bad: %#v", artifacts)
+	}
+
+	// The recording is attached to the artifacts of the post-processors too
+	for _, a := range artifacts {
+		if a.State(ArtifactStateSessionRecording) != path {
+			t.Fatalf("bad: %#v", a.State(ArtifactStateSessionRecording))
+		}
+		if !strings.Contains(a.String(), path) {
+			t.Fatalf("bad: %s", a.String())
+		}
+		files := a.Files()
+		if len(files) == 0 || files[len(files)-1] != path {
+			t.Fatalf("bad: %#v", files)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	events := readSessionEvents(t, data)
+	if len(events) == 0 || events[0].Type != "build" || events[0].Build != "test" {
+		t.Fatalf("bad: %s", data)
+	}
+}
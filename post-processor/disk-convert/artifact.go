@@ -0,0 +1,43 @@
+package diskconvert
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const BuilderId = "packer.post-processor.disk-convert"
+
+type Artifact struct {
+	Format string
+	Paths  []string
+}
+
+func (a *Artifact) BuilderId() string {
+	return BuilderId
+}
+
+func (*Artifact) Id() string {
+	return ""
+}
+
+func (a *Artifact) Files() []string {
+	return a.Paths
+}
+
+func (a *Artifact) String() string {
+	return fmt.Sprintf("%s disk images: %s", a.Format, strings.Join(a.Paths, ", "))
+}
+
+func (*Artifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *Artifact) Destroy() error {
+	for _, path := range a.Paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
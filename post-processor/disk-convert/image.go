@@ -0,0 +1,168 @@
+package diskconvert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sectorSize is the logical sector size used by every format written by this
+// post-processor.
+const sectorSize = 512
+
+// diskImage is a virtual disk opened for reading. ReadAt addresses the
+// virtual (guest visible) disk, not the file backing it.
+type diskImage interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the virtual size of the disk in bytes.
+	Size() int64
+
+	// Allocated reports whether the range [off, off+length) may contain
+	// data. Images that can't tell return true and let the caller detect
+	// zeroed blocks itself.
+	Allocated(off, length int64) (bool, error)
+}
+
+// openImage opens path as a disk image of the given format. If format is
+// empty the format is detected from the file contents.
+func openImage(path, format string) (diskImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format, err = detectFormat(f, path)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		img, err := newQcow2Image(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return img, nil
+	case "raw":
+		return newRawImage(f)
+	default:
+		f.Close()
+		return nil, fmt.Errorf("Unsupported input format: %s", format)
+	}
+}
+
+// detectFormat guesses the format of an image from its magic bytes. Files
+// with no recognized magic are only treated as raw images if their extension
+// suggests it, so descriptors and logs in the artifact aren't mistaken for
+// disks.
+func detectFormat(f *os.File, path string) (string, error) {
+	header := make([]byte, 8)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(qcow2Magic)):
+		return "qcow2", nil
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return "", fmt.Errorf("%s is already a VHDX image", path)
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return "", fmt.Errorf("%s is already a VMDK image", path)
+	case bytes.HasPrefix(header, []byte(vhdCookie)):
+		return "", fmt.Errorf("%s is already a VHD image", path)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case "", ".raw", ".img":
+		return "raw", nil
+	}
+	return "", errUnknownFormat
+}
+
+var errUnknownFormat = fmt.Errorf("unrecognized disk image format")
+
+// rawImage is a plain disk image where the virtual disk is the file itself.
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func newRawImage(f *os.File) (*rawImage, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{File: f, size: fi.Size()}, nil
+}
+
+func (r *rawImage) Size() int64 {
+	return r.size
+}
+
+func (r *rawImage) Allocated(off, length int64) (bool, error) {
+	return true, nil
+}
+
+// readBlock fills buf with the contents of the virtual disk starting at off,
+// padding with zeros past the end of the disk. It reports whether the block
+// holds any data, skipping the read entirely for unallocated ranges.
+func readBlock(img diskImage, off int64, buf []byte) (bool, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	length := int64(len(buf))
+	if off+length > img.Size() {
+		length = img.Size() - off
+	}
+	if length <= 0 {
+		return false, nil
+	}
+
+	allocated, err := img.Allocated(off, length)
+	if err != nil {
+		return false, err
+	}
+	if !allocated {
+		return false, nil
+	}
+
+	if _, err := img.ReadAt(buf[:length], off); err != nil && err != io.EOF {
+		return false, err
+	}
+	return !isZero(buf), nil
+}
+
+var zeroChunk = make([]byte, 64*1024)
+
+// isZero reports whether buf only contains zero bytes.
+func isZero(buf []byte) bool {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > len(zeroChunk) {
+			n = len(zeroChunk)
+		}
+		if !bytes.Equal(buf[:n], zeroChunk[:n]) {
+			return false
+		}
+		buf = buf[n:]
+	}
+	return true
+}
+
+// roundUp rounds n up to the next multiple of align.
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
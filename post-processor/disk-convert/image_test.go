@@ -0,0 +1,192 @@
+package diskconvert
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testClusterBits = 16
+
+// testDiskContents returns the contents of a sparse test disk: a few
+// scattered blocks of random data in an otherwise empty 80MB disk.
+func testDiskContents() []byte {
+	disk := make([]byte, 80*1024*1024+3*sectorSize)
+	r := rand.New(rand.NewSource(42))
+	for _, off := range []int{0, 5 * 1024 * 1024, 40*1024*1024 + 1000, len(disk) - 4096} {
+		r.Read(disk[off : off+4096])
+	}
+	return disk
+}
+
+// writeTestQcow2 writes disk as a qcow2 v3 image. The first allocated
+// cluster is stored compressed and one empty cluster is marked with the zero
+// flag to exercise those code paths.
+func writeTestQcow2(t *testing.T, path string, disk []byte) {
+	clusterSize := int64(1) << testClusterBits
+	clusters := roundUp(int64(len(disk)), clusterSize) / clusterSize
+	l2Entries := clusterSize / 8
+	l1Size := roundUp(clusters, l2Entries) / l2Entries
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, qcow2Header{
+		Version:       3,
+		ClusterBits:   testClusterBits,
+		Size:          uint64(len(disk)),
+		L1Size:        uint32(l1Size),
+		L1TableOffset: uint64(clusterSize),
+	})
+	copy(header.Bytes(), qcow2Magic)
+	binary.Write(&header, binary.BigEndian, qcow2HeaderV3{RefcountOrder: 4, HeaderLength: 104})
+
+	// Layout: header, L1 table, L2 tables, then data clusters.
+	l1 := make([]uint64, l1Size)
+	l2 := make([]uint64, l1Size*l2Entries)
+	for i := range l1 {
+		l1[i] = uint64(clusterSize * (2 + int64(i)))
+	}
+	next := clusterSize * (2 + l1Size)
+
+	var data bytes.Buffer
+	compressed := false
+	for c := int64(0); c < clusters; c++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, disk[c*clusterSize:])
+		if isZero(cluster) {
+			if c == 1 {
+				l2[c] = qcow2ZeroFlag
+			}
+			continue
+		}
+
+		offset := next + int64(data.Len())
+		if !compressed {
+			compressed = true
+			var z bytes.Buffer
+			w, _ := flate.NewWriter(&z, flate.BestCompression)
+			w.Write(cluster)
+			w.Close()
+			sectors := roundUp(int64(z.Len()), sectorSize) / sectorSize
+			shift := uint(62 - (testClusterBits - 8))
+			l2[c] = qcow2Compressed | uint64(sectors-1)<<shift | uint64(offset)
+			data.Write(z.Bytes())
+			data.Write(make([]byte, roundUp(int64(z.Len()), clusterSize)-int64(z.Len())))
+			continue
+		}
+
+		l2[c] = 1<<63 | uint64(offset)
+		data.Write(cluster)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	var table bytes.Buffer
+	binary.Write(&table, binary.BigEndian, l1)
+	f.WriteAt(header.Bytes(), 0)
+	f.WriteAt(table.Bytes(), clusterSize)
+	table.Reset()
+	binary.Write(&table, binary.BigEndian, l2)
+	f.WriteAt(table.Bytes(), 2*clusterSize)
+	f.WriteAt(data.Bytes(), next)
+}
+
+func testTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer-disk-convert")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return dir
+}
+
+func TestQcow2Image(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	disk := testDiskContents()
+	path := filepath.Join(dir, "disk.qcow2")
+	writeTestQcow2(t, path, disk)
+
+	img, err := openImage(path, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer img.Close()
+
+	if _, ok := img.(*qcow2Image); !ok {
+		t.Fatalf("expected qcow2 image, got %T", img)
+	}
+	if img.Size() != int64(len(disk)) {
+		t.Fatalf("bad size: %d", img.Size())
+	}
+
+	actual := make([]byte, len(disk))
+	if _, err := img.ReadAt(actual, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(actual, disk) {
+		t.Fatal("qcow2 contents differ from the source disk")
+	}
+
+	allocated, err := img.Allocated(10*1024*1024, 1024*1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if allocated {
+		t.Fatal("expected empty range to be unallocated")
+	}
+	allocated, err = img.Allocated(5*1024*1024, 1024*1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !allocated {
+		t.Fatal("expected range with data to be allocated")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		contents string
+		format   string
+		err      bool
+	}{
+		{"disk.qcow2", qcow2Magic + "\x00\x00\x00\x03", "qcow2", false},
+		{"packer-qemu", "data", "raw", false},
+		{"disk.img", "data", "raw", false},
+		{"disk.vmdk", "KDMV", "", true},
+		{"disk.vhdx", "vhdxfile", "", true},
+		{"disk.ovf", "<?xml", "", true},
+	}
+
+	for _, tc := range cases {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		format, err := detectFormat(f, path)
+		f.Close()
+
+		if (err != nil) != tc.err {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if format != tc.format {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.format, format)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package diskconvert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/config"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// Fields from config file
+	Format      string `mapstructure:"format"`
+	Subformat   string `mapstructure:"subformat"`
+	InputFormat string `mapstructure:"input_format"`
+	OutputPath  string `mapstructure:"output"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+type outputPathTemplate struct {
+	BuildName   string
+	BuilderType string
+	Dir         string
+	Name        string
+	Extension   string
+}
+
+// writer writes the virtual disk of img into f.
+type writer func(f *os.File, img diskImage) error
+
+type outputFormat struct {
+	extension  string
+	subformats map[string]writer
+	// The subformat used when none is configured.
+	defaultSubformat string
+}
+
+var outputFormats = map[string]outputFormat{
+	"raw": {
+		extension:        "raw",
+		subformats:       map[string]writer{"raw": writeRaw},
+		defaultSubformat: "raw",
+	},
+	"vhd": {
+		extension: "vhd",
+		subformats: map[string]writer{
+			"dynamic": writeDynamicVHD,
+			"fixed":   writeFixedVHD,
+		},
+		defaultSubformat: "dynamic",
+	},
+	"vhdx": {
+		extension:        "vhdx",
+		subformats:       map[string]writer{"dynamic": writeVHDX},
+		defaultSubformat: "dynamic",
+	},
+	"vmdk": {
+		extension:        "vmdk",
+		subformats:       map[string]writer{"streamOptimized": writeStreamOptimizedVMDK},
+		defaultSubformat: "streamOptimized",
+	},
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{"output"},
+		},
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	errs := new(packer.MultiError)
+
+	if p.config.Format == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("format must be specified"))
+	} else if format, ok := outputFormats[p.config.Format]; !ok {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Unrecognized format: %s", p.config.Format))
+	} else {
+		if p.config.Subformat == "" {
+			p.config.Subformat = format.defaultSubformat
+		}
+		if _, ok := format.subformats[p.config.Subformat]; !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Unrecognized subformat for %s: %s", p.config.Format, p.config.Subformat))
+		}
+	}
+
+	switch p.config.InputFormat {
+	case "", "raw", "qcow2":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("input_format must be one of: raw, qcow2"))
+	}
+
+	if p.config.OutputPath == "" {
+		p.config.OutputPath = "{{.Dir}}/{{.Name}}.{{.Extension}}"
+	}
+
+	if err = interpolate.Validate(p.config.OutputPath, &p.config.ctx); err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Error parsing target template: %s", err))
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, bool, error) {
+	format := outputFormats[p.config.Format]
+	write := format.subformats[p.config.Subformat]
+
+	newArtifact := &Artifact{Format: p.config.Format}
+
+	for _, source := range artifact.Files() {
+		img, err := openImage(source, p.config.InputFormat)
+		if err == errUnknownFormat {
+			ui.Message(fmt.Sprintf("Skipping %s: not a disk image", source))
+			continue
+		}
+		if err != nil {
+			newArtifact.Destroy()
+			return nil, false, false, fmt.Errorf("Error opening %s: %s", source, err)
+		}
+
+		opTpl := &outputPathTemplate{
+			BuildName:   p.config.PackerBuildName,
+			BuilderType: p.config.PackerBuilderType,
+			Dir:         filepath.Dir(source),
+			Name:        strings.TrimSuffix(filepath.Base(source), filepath.Ext(source)),
+			Extension:   format.extension,
+		}
+		p.config.ctx.Data = opTpl
+		target, err := interpolate.Render(p.config.OutputPath, &p.config.ctx)
+		if err != nil {
+			img.Close()
+			newArtifact.Destroy()
+			return nil, false, false, fmt.Errorf("Error interpolating output value: %s", err)
+		}
+		if filepath.Clean(target) == filepath.Clean(source) {
+			img.Close()
+			newArtifact.Destroy()
+			return nil, false, false, fmt.Errorf(
+				"Output path %s would overwrite the input image", target)
+		}
+
+		ui.Say(fmt.Sprintf("Converting %s to %s (%s)", source, p.config.Format, p.config.Subformat))
+		err = convert(img, target, write)
+		img.Close()
+		if err != nil {
+			newArtifact.Destroy()
+			return nil, false, false, fmt.Errorf("Error converting %s: %s", source, err)
+		}
+		newArtifact.Paths = append(newArtifact.Paths, target)
+	}
+
+	if len(newArtifact.Paths) == 0 {
+		return nil, false, false, fmt.Errorf("No disk images found in artifact: %v", artifact.Files())
+	}
+
+	return newArtifact, false, false, nil
+}
+
+// convert writes img to a new file at target, removing the file again if the
+// conversion fails.
+func convert(img diskImage, target string, write writer) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755)); err != nil {
+		return fmt.Errorf("Unable to create dir for %s: %s", target, err)
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f, img); err != nil {
+		f.Close()
+		os.Remove(target)
+		return err
+	}
+	return f.Close()
+}
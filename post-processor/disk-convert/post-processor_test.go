@@ -0,0 +1,275 @@
+package diskconvert
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+func TestPostProcessor_ImplementsPostProcessor(t *testing.T) {
+	var _ packer.PostProcessor = new(PostProcessor)
+}
+
+func TestPostProcessorConfigure(t *testing.T) {
+	cases := []struct {
+		config    map[string]interface{}
+		subformat string
+		err       bool
+	}{
+		{map[string]interface{}{}, "", true},
+		{map[string]interface{}{"format": "qcow2"}, "", true},
+		{map[string]interface{}{"format": "vhd"}, "dynamic", false},
+		{map[string]interface{}{"format": "vhd", "subformat": "fixed"}, "fixed", false},
+		{map[string]interface{}{"format": "vhdx", "subformat": "fixed"}, "", true},
+		{map[string]interface{}{"format": "vmdk"}, "streamOptimized", false},
+		{map[string]interface{}{"format": "raw", "input_format": "vdi"}, "", true},
+	}
+
+	for _, tc := range cases {
+		var p PostProcessor
+		err := p.Configure(tc.config)
+		if (err != nil) != tc.err {
+			t.Fatalf("%v: unexpected error: %v", tc.config, err)
+		}
+		if err == nil && p.config.Subformat != tc.subformat {
+			t.Fatalf("%v: expected subformat %q, got %q", tc.config, tc.subformat, p.config.Subformat)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess(t *testing.T) {
+	disk := testDiskContents()
+
+	cases := []struct {
+		format    string
+		subformat string
+		read      func(t *testing.T, path string, size int) []byte
+	}{
+		{"raw", "", readTestRaw},
+		{"vhd", "fixed", readTestFixedVHD},
+		{"vhd", "dynamic", readTestDynamicVHD},
+		{"vhdx", "", readTestVHDX},
+		{"vmdk", "", readTestVMDK},
+	}
+
+	for _, tc := range cases {
+		dir := testTempDir(t)
+		defer os.RemoveAll(dir)
+
+		source := filepath.Join(dir, "packer-qemu")
+		writeTestQcow2(t, source, disk)
+		ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+
+		var p PostProcessor
+		err := p.Configure(map[string]interface{}{
+			"format":    tc.format,
+			"subformat": tc.subformat,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		artifact := &packer.MockArtifact{
+			FilesValue: []string{source, filepath.Join(dir, "notes.txt")},
+		}
+		result, keep, forceOverride, err := p.PostProcess(context.Background(), packer.TestUi(t), artifact)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.format, err)
+		}
+		if keep || forceOverride {
+			t.Fatalf("%s: should not keep the input artifact", tc.format)
+		}
+
+		files := result.Files()
+		expected := filepath.Join(dir, "packer-qemu."+outputFormats[tc.format].extension)
+		if len(files) != 1 || files[0] != expected {
+			t.Fatalf("%s: bad files: %v", tc.format, files)
+		}
+
+		actual := tc.read(t, files[0], len(disk))
+		if !bytes.Equal(actual[:len(disk)], disk) {
+			t.Fatalf("%s %s: converted image differs from the source disk", tc.format, tc.subformat)
+		}
+		if !isZero(actual[len(disk):]) {
+			t.Fatalf("%s %s: padding after the disk should be empty", tc.format, tc.subformat)
+		}
+
+		if err := result.Destroy(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+			t.Fatalf("%s: converted image should be removed", tc.format)
+		}
+	}
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return b
+}
+
+func readTestRaw(t *testing.T, path string, size int) []byte {
+	b := readTestFile(t, path)
+	if len(b) != size {
+		t.Fatalf("bad size: %d", len(b))
+	}
+	return b
+}
+
+func checkTestVHDFooter(t *testing.T, b []byte, diskType uint32) vhdFooter {
+	var footer vhdFooter
+	binary.Read(bytes.NewReader(b), binary.BigEndian, &footer)
+	if string(footer.Cookie[:]) != vhdCookie || footer.DiskType != diskType {
+		t.Fatalf("bad footer: %#v", footer)
+	}
+
+	sum := footer.Checksum
+	binary.BigEndian.PutUint32(b[64:], 0)
+	if vhdChecksum(b) != sum {
+		t.Fatal("bad footer checksum")
+	}
+	return footer
+}
+
+func readTestFixedVHD(t *testing.T, path string, size int) []byte {
+	b := readTestFile(t, path)
+	footer := checkTestVHDFooter(t, b[len(b)-sectorSize:], vhdTypeFixed)
+	if int(footer.CurrentSize) != len(b)-sectorSize {
+		t.Fatalf("bad size: %d", footer.CurrentSize)
+	}
+	return b[:len(b)-sectorSize]
+}
+
+func readTestDynamicVHD(t *testing.T, path string, size int) []byte {
+	b := readTestFile(t, path)
+	footer := checkTestVHDFooter(t, b[:sectorSize], vhdTypeDynamic)
+	checkTestVHDFooter(t, b[len(b)-sectorSize:], vhdTypeDynamic)
+
+	var header vhdDynamicHeader
+	binary.Read(bytes.NewReader(b[footer.DataOffset:]), binary.BigEndian, &header)
+	if string(header.Cookie[:]) != vhdDynamicCookie {
+		t.Fatalf("bad dynamic header: %#v", header)
+	}
+
+	disk := make([]byte, footer.CurrentSize)
+	bat := make([]uint32, header.MaxTableEntries)
+	binary.Read(bytes.NewReader(b[header.TableOffset:]), binary.BigEndian, bat)
+	for i, entry := range bat {
+		if entry == vhdUnusedBlock {
+			continue
+		}
+		start := int(entry)*sectorSize + sectorSize
+		copy(disk[i*vhdBlockSize:], b[start:start+vhdBlockSize])
+	}
+	return disk
+}
+
+func readTestVHDX(t *testing.T, path string, size int) []byte {
+	b := readTestFile(t, path)
+	if string(b[:8]) != "vhdxfile" {
+		t.Fatal("bad file identifier")
+	}
+
+	checkCRC := func(region []byte) {
+		sum := binary.LittleEndian.Uint32(region[4:])
+		binary.LittleEndian.PutUint32(region[4:], 0)
+		if crc32.Checksum(region, crc32c) != sum {
+			t.Fatalf("bad checksum for %q", region[:4])
+		}
+	}
+	checkCRC(b[vhdxHeader1Offset : vhdxHeader1Offset+4096])
+	checkCRC(b[vhdxHeader2Offset : vhdxHeader2Offset+4096])
+	checkCRC(b[vhdxRegion1Offset : vhdxRegion1Offset+64*1024])
+
+	meta := b[vhdxMetaOffset:]
+	if string(meta[:8]) != "metadata" {
+		t.Fatal("bad metadata table")
+	}
+	var virtualSize uint64
+	entries := binary.LittleEndian.Uint16(meta[10:])
+	for i := 0; i < int(entries); i++ {
+		var entry vhdxMetadataTableEntry
+		binary.Read(bytes.NewReader(meta[32+32*i:]), binary.LittleEndian, &entry)
+		if entry.ItemID == vhdxVirtualDiskSizeItem {
+			virtualSize = binary.LittleEndian.Uint64(meta[entry.Offset:])
+		}
+	}
+	if virtualSize != uint64(roundUp(int64(size), sectorSize)) {
+		t.Fatalf("bad virtual size: %d", virtualSize)
+	}
+
+	disk := make([]byte, roundUp(int64(virtualSize), vhdxBlockSize))
+	chunkRatio := (1 << 23) * sectorSize / vhdxBlockSize
+	blocks := len(disk) / vhdxBlockSize
+	for i := 0; i < blocks; i++ {
+		entry := binary.LittleEndian.Uint64(b[vhdxBATOffset+8*(i+i/chunkRatio):])
+		switch entry & 7 {
+		case 0:
+		case vhdxPayloadBlockFullyPresent:
+			start := int(entry>>20) * vhdxAlignment
+			copy(disk[i*vhdxBlockSize:], b[start:start+vhdxBlockSize])
+		default:
+			t.Fatalf("bad BAT entry: %x", entry)
+		}
+	}
+	return disk
+}
+
+func readTestVMDK(t *testing.T, path string, size int) []byte {
+	b := readTestFile(t, path)
+
+	// The footer is in the third to last sector, followed by its marker and
+	// the end of stream marker.
+	var footer vmdkHeader
+	binary.Read(bytes.NewReader(b[len(b)-2*sectorSize:]), binary.LittleEndian, &footer)
+	if footer.MagicNumber != vmdkMagic || footer.GDOffset == vmdkGDAtEnd {
+		t.Fatalf("bad footer: %#v", footer)
+	}
+	if !bytes.Contains(b[sectorSize:vmdkGrainSize], []byte(`createType="streamOptimized"`)) {
+		t.Fatal("bad descriptor")
+	}
+
+	disk := make([]byte, roundUp(int64(footer.Capacity)*sectorSize, vmdkGrainSize))
+	grains := len(disk) / vmdkGrainSize
+	tables := (grains + vmdkGTEntries - 1) / vmdkGTEntries
+	gd := make([]uint32, tables)
+	binary.Read(bytes.NewReader(b[footer.GDOffset*sectorSize:]), binary.LittleEndian, gd)
+
+	for table, gtOffset := range gd {
+		gt := make([]uint32, vmdkGTEntries)
+		binary.Read(bytes.NewReader(b[int(gtOffset)*sectorSize:]), binary.LittleEndian, gt)
+		for entry, grainOffset := range gt {
+			if grainOffset == 0 {
+				continue
+			}
+			marker := b[int(grainOffset)*sectorSize:]
+			lba := binary.LittleEndian.Uint64(marker)
+			length := binary.LittleEndian.Uint32(marker[8:])
+			if int(lba) != (table*vmdkGTEntries+entry)*vmdkGrainSectors {
+				t.Fatalf("bad grain LBA: %d", lba)
+			}
+
+			r, err := zlib.NewReader(bytes.NewReader(marker[12 : 12+length]))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			grain, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			copy(disk[int(lba)*sectorSize:], grain)
+		}
+	}
+	return disk
+}
@@ -0,0 +1,248 @@
+package diskconvert
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	qcow2OffsetMask = 0x00fffffffffffe00
+	qcow2Compressed = 1 << 62
+	qcow2ZeroFlag   = 1
+
+	// Incompatible feature bits we can't read past.
+	qcow2Corrupt      = 1 << 1
+	qcow2ExternalData = 1 << 2
+	qcow2ExtendedL2   = 1 << 4
+
+	// Number of L2 tables kept in memory while reading.
+	qcow2L2CacheSize = 64
+)
+
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+type qcow2HeaderV3 struct {
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// qcow2Image reads the virtual disk stored in a standalone qcow2 file. Backing
+// files, encryption and external data files aren't supported.
+type qcow2Image struct {
+	f           *os.File
+	size        int64
+	clusterBits uint32
+	clusterSize int64
+	l1          []uint64
+	l2Cache     map[uint64][]uint64
+}
+
+func newQcow2Image(f *os.File) (*qcow2Image, error) {
+	var h qcow2Header
+	if err := binary.Read(io.NewSectionReader(f, 0, 72), binary.BigEndian, &h); err != nil {
+		return nil, fmt.Errorf("Error reading qcow2 header: %s", err)
+	}
+	if string(h.Magic[:]) != qcow2Magic {
+		return nil, fmt.Errorf("Not a qcow2 image")
+	}
+	if h.Version != 2 && h.Version != 3 {
+		return nil, fmt.Errorf("Unsupported qcow2 version %d", h.Version)
+	}
+	if h.Version == 3 {
+		var h3 qcow2HeaderV3
+		if err := binary.Read(io.NewSectionReader(f, 72, 32), binary.BigEndian, &h3); err != nil {
+			return nil, fmt.Errorf("Error reading qcow2 header: %s", err)
+		}
+		if h3.IncompatibleFeatures&qcow2Corrupt != 0 {
+			return nil, fmt.Errorf("qcow2 image is marked corrupt")
+		}
+		if h3.IncompatibleFeatures&qcow2ExternalData != 0 {
+			return nil, fmt.Errorf("qcow2 images with external data files are not supported")
+		}
+		if h3.IncompatibleFeatures&qcow2ExtendedL2 != 0 {
+			return nil, fmt.Errorf("qcow2 images with extended L2 entries are not supported")
+		}
+		if h3.HeaderLength > 104 {
+			compression := make([]byte, 1)
+			if _, err := f.ReadAt(compression, 104); err != nil {
+				return nil, fmt.Errorf("Error reading qcow2 header: %s", err)
+			}
+			if compression[0] != 0 {
+				return nil, fmt.Errorf("qcow2 compression type %d is not supported", compression[0])
+			}
+		}
+	}
+	if h.BackingFileOffset != 0 {
+		return nil, fmt.Errorf("qcow2 images with a backing file are not supported")
+	}
+	if h.CryptMethod != 0 {
+		return nil, fmt.Errorf("Encrypted qcow2 images are not supported")
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return nil, fmt.Errorf("Invalid qcow2 cluster size: 2^%d", h.ClusterBits)
+	}
+
+	img := &qcow2Image{
+		f:           f,
+		size:        int64(h.Size),
+		clusterBits: h.ClusterBits,
+		clusterSize: int64(1) << h.ClusterBits,
+		l1:          make([]uint64, h.L1Size),
+		l2Cache:     make(map[uint64][]uint64),
+	}
+
+	l1 := io.NewSectionReader(f, int64(h.L1TableOffset), int64(h.L1Size)*8)
+	if err := binary.Read(l1, binary.BigEndian, img.l1); err != nil {
+		return nil, fmt.Errorf("Error reading qcow2 L1 table: %s", err)
+	}
+
+	return img, nil
+}
+
+func (q *qcow2Image) Size() int64 {
+	return q.size
+}
+
+func (q *qcow2Image) Close() error {
+	return q.f.Close()
+}
+
+// l2Entry returns the L2 table entry describing the cluster that contains
+// the virtual offset off, or 0 if the cluster is unallocated.
+func (q *qcow2Image) l2Entry(off int64) (uint64, error) {
+	l2Entries := q.clusterSize / 8
+	cluster := off >> q.clusterBits
+	l1Index := cluster / l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, nil
+	}
+
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	table, ok := q.l2Cache[l2Offset]
+	if !ok {
+		table = make([]uint64, l2Entries)
+		r := io.NewSectionReader(q.f, int64(l2Offset), q.clusterSize)
+		if err := binary.Read(r, binary.BigEndian, table); err != nil {
+			return 0, fmt.Errorf("Error reading qcow2 L2 table: %s", err)
+		}
+		if len(q.l2Cache) >= qcow2L2CacheSize {
+			q.l2Cache = make(map[uint64][]uint64)
+		}
+		q.l2Cache[l2Offset] = table
+	}
+
+	return table[cluster%l2Entries], nil
+}
+
+func (q *qcow2Image) Allocated(off, length int64) (bool, error) {
+	end := off + length
+	for off < end {
+		entry, err := q.l2Entry(off)
+		if err != nil {
+			return false, err
+		}
+		if entry&qcow2Compressed != 0 {
+			return true, nil
+		}
+		if entry&qcow2ZeroFlag == 0 && entry&qcow2OffsetMask != 0 {
+			return true, nil
+		}
+		off = (off>>q.clusterBits + 1) << q.clusterBits
+	}
+	return false, nil
+}
+
+func (q *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= q.size {
+			return n, io.EOF
+		}
+
+		inCluster := off & (q.clusterSize - 1)
+		chunk := q.clusterSize - inCluster
+		if remaining := int64(len(p) - n); chunk > remaining {
+			chunk = remaining
+		}
+		if remaining := q.size - off; chunk > remaining {
+			chunk = remaining
+		}
+		dst := p[n : n+int(chunk)]
+
+		entry, err := q.l2Entry(off)
+		if err != nil {
+			return n, err
+		}
+
+		switch {
+		case entry&qcow2Compressed != 0:
+			data, err := q.readCompressed(entry)
+			if err != nil {
+				return n, err
+			}
+			copy(dst, data[inCluster:])
+		case entry&qcow2ZeroFlag != 0 || entry&qcow2OffsetMask == 0:
+			for i := range dst {
+				dst[i] = 0
+			}
+		default:
+			hostOffset := int64(entry&qcow2OffsetMask) + inCluster
+			if _, err := q.f.ReadAt(dst, hostOffset); err != nil {
+				return n, fmt.Errorf("Error reading qcow2 cluster: %s", err)
+			}
+		}
+
+		n += int(chunk)
+		off += chunk
+	}
+	return n, nil
+}
+
+// readCompressed inflates the compressed cluster described by entry.
+func (q *qcow2Image) readCompressed(entry uint64) ([]byte, error) {
+	shift := 62 - (q.clusterBits - 8)
+	hostOffset := int64(entry & (1<<shift - 1))
+	sectors := int64((entry>>shift)&(1<<(q.clusterBits-8)-1)) + 1
+	length := sectors*sectorSize - hostOffset&(sectorSize-1)
+
+	compressed := make([]byte, length)
+	n, err := q.f.ReadAt(compressed, hostOffset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Error reading compressed qcow2 cluster: %s", err)
+	}
+
+	data := make([]byte, q.clusterSize)
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("Error inflating compressed qcow2 cluster: %s", err)
+	}
+	return data, nil
+}
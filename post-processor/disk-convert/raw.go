@@ -0,0 +1,36 @@
+package diskconvert
+
+import (
+	"os"
+)
+
+// rawBlockSize is the granularity at which zeroed ranges are turned into
+// holes when writing raw and fixed VHD images.
+const rawBlockSize = 1024 * 1024
+
+// writeRaw copies the virtual disk into f, seeking over zeroed blocks so the
+// result is sparse on filesystems that support it.
+func writeRaw(f *os.File, img diskImage) error {
+	buf := make([]byte, rawBlockSize)
+	size := img.Size()
+
+	for off := int64(0); off < size; off += rawBlockSize {
+		data, err := readBlock(img, off, buf)
+		if err != nil {
+			return err
+		}
+		if !data {
+			continue
+		}
+
+		chunk := buf
+		if off+int64(len(chunk)) > size {
+			chunk = chunk[:size-off]
+		}
+		if _, err := f.WriteAt(chunk, off); err != nil {
+			return err
+		}
+	}
+
+	return f.Truncate(size)
+}
@@ -0,0 +1,238 @@
+package diskconvert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	vhdCookie        = "conectix"
+	vhdDynamicCookie = "cxsparse"
+
+	vhdTypeFixed   = 2
+	vhdTypeDynamic = 3
+
+	// Block size used for dynamic VHDs, the same as Hyper-V's default.
+	vhdBlockSize = 2 * 1024 * 1024
+
+	vhdUnusedBlock = 0xFFFFFFFF
+)
+
+// VHD timestamps count seconds since January 1st 2000 UTC.
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [192]byte
+	Reserved2         [256]byte
+}
+
+func newVHDFooter(size int64, diskType uint32) (*vhdFooter, error) {
+	footer := &vhdFooter{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        0xFFFFFFFFFFFFFFFF,
+		TimeStamp:         uint32(time.Now().UTC().Sub(vhdEpoch).Seconds()),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+	}
+	copy(footer.Cookie[:], vhdCookie)
+	copy(footer.CreatorApplication[:], "pckr")
+	copy(footer.CreatorHostOS[:], "Wi2k")
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = vhdGeometry(size)
+
+	if _, err := rand.Read(footer.UniqueID[:]); err != nil {
+		return nil, err
+	}
+	return footer, nil
+}
+
+// vhdGeometry computes the CHS geometry stored in the footer, following the
+// algorithm given in the VHD specification.
+func vhdGeometry(size int64) (uint16, uint8, uint8) {
+	totalSectors := size / sectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+
+	return uint16(cylinderTimesHeads / heads), uint8(heads), uint8(sectorsPerTrack)
+}
+
+// vhdChecksum is the one's complement of the byte sum of a structure, which
+// must have its checksum field zeroed.
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+func (footer *vhdFooter) bytes() []byte {
+	footer.Checksum = 0
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, footer)
+	footer.Checksum = vhdChecksum(buf.Bytes())
+
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, footer)
+	return buf.Bytes()
+}
+
+func (h *vhdDynamicHeader) bytes() []byte {
+	h.Checksum = 0
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h)
+	h.Checksum = vhdChecksum(buf.Bytes())
+
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, h)
+	return buf.Bytes()
+}
+
+// writeFixedVHD writes a fixed VHD, which is a raw image followed by a
+// footer. Zeroed blocks are left as holes.
+func writeFixedVHD(f *os.File, img diskImage) error {
+	size := roundUp(img.Size(), sectorSize)
+	footer, err := newVHDFooter(size, vhdTypeFixed)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRaw(f, img); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(footer.bytes(), size)
+	return err
+}
+
+// writeDynamicVHD writes a dynamic VHD in which only blocks holding data are
+// allocated.
+func writeDynamicVHD(f *os.File, img diskImage) error {
+	size := roundUp(img.Size(), sectorSize)
+	footer, err := newVHDFooter(size, vhdTypeDynamic)
+	if err != nil {
+		return err
+	}
+	footer.DataOffset = sectorSize
+
+	blocks := roundUp(size, vhdBlockSize) / vhdBlockSize
+	tableOffset := int64(3 * sectorSize)
+	header := &vhdDynamicHeader{
+		DataOffset:      0xFFFFFFFFFFFFFFFF,
+		TableOffset:     uint64(tableOffset),
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       vhdBlockSize,
+	}
+	copy(header.Cookie[:], vhdDynamicCookie)
+
+	bat := make([]uint32, blocks)
+	for i := range bat {
+		bat[i] = vhdUnusedBlock
+	}
+
+	// Every block is preceded by a sector bitmap, which we always mark as
+	// fully populated.
+	bitmap := bytes.Repeat([]byte{0xFF}, int(roundUp(vhdBlockSize/sectorSize/8, sectorSize)))
+
+	next := tableOffset + roundUp(blocks*4, sectorSize)
+	buf := make([]byte, vhdBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		data, err := readBlock(img, i*vhdBlockSize, buf)
+		if err != nil {
+			return err
+		}
+		if !data {
+			continue
+		}
+
+		bat[i] = uint32(next / sectorSize)
+		if _, err := f.WriteAt(bitmap, next); err != nil {
+			return err
+		}
+		next += int64(len(bitmap))
+		if _, err := f.WriteAt(buf, next); err != nil {
+			return err
+		}
+		next += vhdBlockSize
+	}
+
+	footerBytes := footer.bytes()
+	if _, err := f.WriteAt(footerBytes, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(header.bytes(), sectorSize); err != nil {
+		return err
+	}
+
+	var table bytes.Buffer
+	binary.Write(&table, binary.BigEndian, bat)
+	table.Write(bytes.Repeat([]byte{0xFF}, int(roundUp(blocks*4, sectorSize)-blocks*4)))
+	if _, err := f.WriteAt(table.Bytes(), tableOffset); err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(footerBytes, next)
+	return err
+}
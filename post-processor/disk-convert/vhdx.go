@@ -0,0 +1,275 @@
+package diskconvert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	vhdxAlignment = 1024 * 1024
+
+	// Block size used for the payload, the same as Hyper-V's default for
+	// dynamic disks.
+	vhdxBlockSize = 32 * 1024 * 1024
+
+	vhdxPhysicalSectorSize = 4096
+
+	vhdxHeader1Offset = 64 * 1024
+	vhdxHeader2Offset = 128 * 1024
+	vhdxRegion1Offset = 192 * 1024
+	vhdxRegion2Offset = 256 * 1024
+	vhdxLogOffset     = 1 * vhdxAlignment
+	vhdxLogLength     = 1 * vhdxAlignment
+	vhdxMetaOffset    = 2 * vhdxAlignment
+	vhdxMetaLength    = 1 * vhdxAlignment
+	vhdxBATOffset     = 3 * vhdxAlignment
+
+	vhdxPayloadBlockFullyPresent = 6
+
+	vhdxMetaIsVirtualDisk = 1 << 1
+	vhdxMetaIsRequired    = 1 << 2
+)
+
+var (
+	vhdxBATRegion      = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxFileParametersItem     = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSizeItem    = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxPage83DataItem         = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSizeItem  = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSizeItem = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type vhdxRegionTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [5]uint32
+}
+
+type vhdxMetadataTableEntry struct {
+	ItemID    [16]byte
+	Offset    uint32
+	Length    uint32
+	Flags     uint32
+	Reserved2 uint32
+}
+
+// vhdxGUID converts a GUID from its textual form to the mixed-endian layout
+// used on disk.
+func vhdxGUID(s string) [16]byte {
+	var guid [16]byte
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID: " + s)
+	}
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(guid[8:], b[8:])
+	return guid
+}
+
+func randomGUID() ([16]byte, error) {
+	var guid [16]byte
+	_, err := rand.Read(guid[:])
+	return guid, err
+}
+
+// vhdxStructure serializes v into a zero padded buffer of the given length.
+func vhdxStructure(length int, v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, item := range v {
+		binary.Write(&buf, binary.LittleEndian, item)
+	}
+	out := make([]byte, length)
+	copy(out, buf.Bytes())
+	return out
+}
+
+// vhdxChecksum stores the CRC-32C of b in the checksum field at offset 4.
+func vhdxChecksum(b []byte) []byte {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+	return b
+}
+
+// writeVHDX writes a dynamically sized VHDX image in which only blocks
+// holding data are allocated. The log is left empty.
+func writeVHDX(f *os.File, img diskImage) error {
+	size := roundUp(img.Size(), sectorSize)
+	blocks := roundUp(size, vhdxBlockSize) / vhdxBlockSize
+	chunkRatio := int64(1<<23) * sectorSize / vhdxBlockSize
+	batEntries := blocks + (blocks-1)/chunkRatio
+	batLength := roundUp(batEntries*8, vhdxAlignment)
+
+	// File type identifier
+	creator := utf16.Encode([]rune("packer"))
+	ident := vhdxStructure(64*1024, []byte("vhdxfile"), creator)
+	if _, err := f.WriteAt(ident, 0); err != nil {
+		return err
+	}
+
+	// Headers. Both copies are valid; the one with the highest sequence
+	// number is current.
+	fileWriteGUID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	dataWriteGUID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	for i, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header := vhdxHeader{
+			SequenceNumber: uint64(i),
+			FileWriteGUID:  fileWriteGUID,
+			DataWriteGUID:  dataWriteGUID,
+			Version:        1,
+			LogLength:      vhdxLogLength,
+			LogOffset:      vhdxLogOffset,
+		}
+		copy(header.Signature[:], "head")
+		if _, err := f.WriteAt(vhdxChecksum(vhdxStructure(4096, header)), offset); err != nil {
+			return err
+		}
+	}
+
+	// Region tables
+	regionHeader := vhdxRegionTableHeader{EntryCount: 2}
+	copy(regionHeader.Signature[:], "regi")
+	regions := vhdxChecksum(vhdxStructure(64*1024,
+		regionHeader,
+		vhdxRegionTableEntry{
+			GUID:       vhdxBATRegion,
+			FileOffset: vhdxBATOffset,
+			Length:     uint32(batLength),
+			Required:   1,
+		},
+		vhdxRegionTableEntry{
+			GUID:       vhdxMetadataRegion,
+			FileOffset: vhdxMetaOffset,
+			Length:     vhdxMetaLength,
+			Required:   1,
+		},
+	))
+	for _, offset := range []int64{vhdxRegion1Offset, vhdxRegion2Offset} {
+		if _, err := f.WriteAt(regions, offset); err != nil {
+			return err
+		}
+	}
+
+	// Metadata region
+	if err := writeVHDXMetadata(f, size); err != nil {
+		return err
+	}
+
+	// Payload blocks. The log, metadata and BAT regions occupy the first
+	// megabytes of the file, so data starts right after the BAT.
+	bat := make([]uint64, batLength/8)
+	next := int64(vhdxBATOffset) + batLength
+	buf := make([]byte, vhdxBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		data, err := readBlock(img, i*vhdxBlockSize, buf)
+		if err != nil {
+			return err
+		}
+		if !data {
+			continue
+		}
+
+		if _, err := f.WriteAt(buf, next); err != nil {
+			return err
+		}
+		bat[i+i/chunkRatio] = uint64(next/vhdxAlignment)<<20 | vhdxPayloadBlockFullyPresent
+		next += vhdxBlockSize
+	}
+
+	if _, err := f.WriteAt(vhdxStructure(int(batLength), bat), vhdxBATOffset); err != nil {
+		return err
+	}
+
+	// Make sure the file covers the log and BAT regions even if no block
+	// was allocated.
+	return f.Truncate(next)
+}
+
+func writeVHDXMetadata(f *os.File, size int64) error {
+	diskID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+
+	items := []struct {
+		id    [16]byte
+		flags uint32
+		data  interface{}
+	}{
+		{vhdxFileParametersItem, vhdxMetaIsRequired, []uint32{vhdxBlockSize, 0}},
+		{vhdxVirtualDiskSizeItem, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, uint64(size)},
+		{vhdxPage83DataItem, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, diskID},
+		{vhdxLogicalSectorSizeItem, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, uint32(sectorSize)},
+		{vhdxPhysicalSectorSizeItem, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, uint32(vhdxPhysicalSectorSize)},
+	}
+
+	header := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(header.Signature[:], "metadata")
+	table := []interface{}{header}
+
+	// Item data lives after the 64KB table, each item in its own slot.
+	var data bytes.Buffer
+	const dataOffset = 64 * 1024
+	for _, item := range items {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, item.data)
+		table = append(table, vhdxMetadataTableEntry{
+			ItemID: item.id,
+			Offset: uint32(dataOffset + data.Len()),
+			Length: uint32(b.Len()),
+			Flags:  item.flags,
+		})
+		data.Write(b.Bytes())
+	}
+
+	if _, err := f.WriteAt(vhdxStructure(dataOffset, table...), vhdxMetaOffset); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data.Bytes(), vhdxMetaOffset+dataOffset)
+	return err
+}
@@ -0,0 +1,242 @@
+package diskconvert
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	vmdkMagic = 0x564d444b // "KDMV"
+
+	// Header flags: valid newline detection, compressed grains and markers.
+	vmdkFlags = 1 | 1<<16 | 1<<17
+
+	vmdkCompressDeflate = 1
+
+	vmdkGrainSectors     = 128
+	vmdkGrainSize        = vmdkGrainSectors * sectorSize
+	vmdkGTEntries        = 512
+	vmdkDescriptorOffset = 1
+	vmdkDescriptorSize   = 20
+
+	vmdkGDAtEnd = 0xFFFFFFFFFFFFFFFF
+
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+type vmdkHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+type vmdkMarker struct {
+	Value uint64
+	Size  uint32
+	Type  uint32
+	Pad   [496]byte
+}
+
+// vmdkStream tracks the current position in the stream being written, in
+// sectors.
+type vmdkStream struct {
+	w      *bufio.Writer
+	sector uint64
+}
+
+func (s *vmdkStream) write(v interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		return err
+	}
+	return s.writeSectors(buf.Bytes())
+}
+
+// writeSectors writes b padded to a whole number of sectors.
+func (s *vmdkStream) writeSectors(b []byte) error {
+	padded := roundUp(int64(len(b)), sectorSize)
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(make([]byte, padded-int64(len(b)))); err != nil {
+		return err
+	}
+	s.sector += uint64(padded / sectorSize)
+	return nil
+}
+
+func (s *vmdkStream) marker(markerType uint32, value uint64) error {
+	return s.write(vmdkMarker{Value: value, Type: markerType})
+}
+
+// writeStreamOptimizedVMDK writes a streamOptimized VMDK, the format used
+// inside OVAs and accepted by vSphere for imports. Grains that contain only
+// zeros are omitted.
+func writeStreamOptimizedVMDK(f *os.File, img diskImage) error {
+	capacity := uint64(roundUp(img.Size(), sectorSize) / sectorSize)
+	grains := (capacity + vmdkGrainSectors - 1) / vmdkGrainSectors
+	tables := (grains + vmdkGTEntries - 1) / vmdkGTEntries
+
+	header := vmdkHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            3,
+		Flags:              vmdkFlags,
+		Capacity:           capacity,
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   vmdkDescriptorOffset,
+		DescriptorSize:     vmdkDescriptorSize,
+		NumGTEsPerGT:       vmdkGTEntries,
+		GDOffset:           vmdkGDAtEnd,
+		OverHead:           vmdkGrainSectors,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  vmdkCompressDeflate,
+	}
+
+	s := &vmdkStream{w: bufio.NewWriter(f)}
+	if err := s.write(header); err != nil {
+		return err
+	}
+
+	descriptor := vmdkDescriptor(filepath.Base(f.Name()), capacity)
+	if len(descriptor) > vmdkDescriptorSize*sectorSize {
+		return fmt.Errorf("VMDK descriptor is too large")
+	}
+	if err := s.writeSectors(append([]byte(descriptor), make([]byte, vmdkDescriptorSize*sectorSize-len(descriptor))...)); err != nil {
+		return err
+	}
+	if err := s.writeSectors(make([]byte, (header.OverHead-s.sector)*sectorSize)); err != nil {
+		return err
+	}
+
+	gd := make([]uint32, tables)
+	gt := make([]uint32, vmdkGTEntries)
+	buf := make([]byte, vmdkGrainSize)
+	var compressed bytes.Buffer
+
+	for table := uint64(0); table < tables; table++ {
+		for i := range gt {
+			gt[i] = 0
+		}
+
+		for entry := uint64(0); entry < vmdkGTEntries; entry++ {
+			grain := table*vmdkGTEntries + entry
+			if grain >= grains {
+				break
+			}
+
+			lba := grain * vmdkGrainSectors
+			data, err := readBlock(img, int64(lba)*sectorSize, buf)
+			if err != nil {
+				return err
+			}
+			if !data {
+				continue
+			}
+
+			compressed.Reset()
+			zw := zlib.NewWriter(&compressed)
+			if _, err := zw.Write(buf); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+
+			// A grain marker is the LBA and compressed size followed
+			// directly by the compressed data.
+			gt[entry] = uint32(s.sector)
+			grainData := make([]byte, 12+compressed.Len())
+			binary.LittleEndian.PutUint64(grainData[0:], lba)
+			binary.LittleEndian.PutUint32(grainData[8:], uint32(compressed.Len()))
+			copy(grainData[12:], compressed.Bytes())
+			if err := s.writeSectors(grainData); err != nil {
+				return err
+			}
+		}
+
+		if err := s.marker(vmdkMarkerGT, vmdkGTEntries*4/sectorSize); err != nil {
+			return err
+		}
+		gd[table] = uint32(s.sector)
+		if err := s.write(gt); err != nil {
+			return err
+		}
+	}
+
+	if err := s.marker(vmdkMarkerGD, uint64(roundUp(int64(tables)*4, sectorSize)/sectorSize)); err != nil {
+		return err
+	}
+	header.GDOffset = s.sector
+	if err := s.write(gd); err != nil {
+		return err
+	}
+
+	if err := s.marker(vmdkMarkerFooter, 1); err != nil {
+		return err
+	}
+	if err := s.write(header); err != nil {
+		return err
+	}
+	if err := s.marker(vmdkMarkerEOS, 0); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+const vmdkDescriptorTemplate = `# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "lsilogic"
+`
+
+func vmdkDescriptor(name string, capacity uint64) string {
+	cylinders := capacity / (255 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+
+	cid := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	return fmt.Sprintf(vmdkDescriptorTemplate, cid, capacity, name, cylinders)
+}
@@ -60,7 +60,10 @@ func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact
 		importRepo += ":" + p.config.Tag
 	}
 
-	driver := &docker.DockerDriver{Ctx: &p.config.ctx, Ui: ui}
+	driver, err := docker.ArtifactDriver(artifact, ui, &p.config.ctx)
+	if err != nil {
+		return nil, false, false, err
+	}
 
 	ui.Message("Importing image: " + artifact.Id())
 	ui.Message("Repository: " + importRepo)
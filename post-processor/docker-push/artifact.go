@@ -0,0 +1,47 @@
+package dockerpush
+
+import (
+	"fmt"
+	"strings"
+)
+
+const BuilderIdRegistry = "packer.post-processor.docker-push"
+
+// RegistryArtifact is an image pushed to a registry through the registry
+// HTTP API.
+type RegistryArtifact struct {
+	Registry   string
+	Repository string
+	Tags       []string
+	// Digest of the manifest, as reported by the registry.
+	Digest string
+}
+
+func (*RegistryArtifact) BuilderId() string {
+	return BuilderIdRegistry
+}
+
+func (*RegistryArtifact) Files() []string {
+	return nil
+}
+
+func (a *RegistryArtifact) Id() string {
+	if a.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", a.Registry, a.Repository, a.Digest)
+	}
+	return fmt.Sprintf("%s/%s:%s", a.Registry, a.Repository, a.Tags[0])
+}
+
+func (a *RegistryArtifact) String() string {
+	return fmt.Sprintf("Pushed image %s/%s with tags: %s",
+		a.Registry, a.Repository, strings.Join(a.Tags, ", "))
+}
+
+func (*RegistryArtifact) State(name string) interface{} {
+	return nil
+}
+
+// Destroy does nothing: images pushed to a registry are never deleted.
+func (*RegistryArtifact) Destroy() error {
+	return nil
+}
@@ -0,0 +1,334 @@
+package dockerpush
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// localImage is an image read from an OCI image layout or a `docker save`
+// style tarball, ready to be pushed to a registry.
+type localImage struct {
+	// The manifest exactly as it will be uploaded.
+	Manifest          []byte
+	ManifestMediaType string
+	// The config and layer blobs referenced by the manifest.
+	Blobs []descriptor
+	// The image reference recorded in the archive, if any.
+	Reference string
+
+	open    func(digest string) (io.ReadCloser, error)
+	cleanup []string
+}
+
+// Open returns the content of the blob with the given digest.
+func (img *localImage) Open(digest string) (io.ReadCloser, error) {
+	return img.open(digest)
+}
+
+// Close removes any temporary files created while reading the image.
+func (img *localImage) Close() error {
+	for _, path := range img.cleanup {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// imageFS abstracts over an image layout stored in a directory or a tar
+// file.
+type imageFS interface {
+	Open(name string) (io.ReadCloser, error)
+	Exists(name string) bool
+}
+
+type dirFS string
+
+func (d dirFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirFS) Exists(name string) bool {
+	_, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(name)))
+	return err == nil
+}
+
+// tarFS reads files out of a tar archive. Every lookup scans the archive,
+// which is fine for the handful of files an image is made of.
+type tarFS string
+
+type tarEntry struct {
+	io.Reader
+	f *os.File
+}
+
+func (e *tarEntry) Close() error {
+	return e.f.Close()
+}
+
+func (t tarFS) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == name && hdr.Typeflag != tar.TypeDir {
+			return &tarEntry{Reader: tr, f: f}, nil
+		}
+	}
+
+	f.Close()
+	return nil, fmt.Errorf("%s not found in %s", name, string(t))
+}
+
+func (t tarFS) Exists(name string) bool {
+	r, err := t.Open(name)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+func readJSON(fs imageFS, name string, v interface{}) ([]byte, error) {
+	r, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", name, err)
+	}
+	return data, nil
+}
+
+// openLocalImage reads the image stored at path, which may be an OCI image
+// layout directory, an OCI image layout tar archive or a `docker save`
+// tarball.
+func openLocalImage(path string) (*localImage, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs imageFS = tarFS(path)
+	if fi.IsDir() {
+		fs = dirFS(path)
+	}
+
+	switch {
+	case fs.Exists("oci-layout"):
+		return openOCILayout(fs)
+	case fs.Exists("manifest.json"):
+		return openDockerArchive(fs)
+	default:
+		return nil, fmt.Errorf("%s is not an OCI image layout or docker image archive", path)
+	}
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func openOCILayout(fs imageFS) (*localImage, error) {
+	var idx index
+	if _, err := readJSON(fs, "index.json", &idx); err != nil {
+		return nil, err
+	}
+	if len(idx.Manifests) != 1 {
+		return nil, fmt.Errorf("Expected exactly one image in the OCI layout, found %d", len(idx.Manifests))
+	}
+
+	desc := idx.Manifests[0]
+	var m manifest
+	data, err := readJSON(fs, blobPath(desc.Digest), &m)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = mediaTypeOCIManifest
+	}
+
+	return &localImage{
+		Manifest:          data,
+		ManifestMediaType: mediaType,
+		Blobs:             append(m.Layers, m.Config),
+		Reference:         desc.Annotations["io.containerd.image.name"],
+		open: func(digest string) (io.ReadCloser, error) {
+			return fs.Open(blobPath(digest))
+		},
+	}, nil
+}
+
+// openDockerArchive reads a `docker save` tarball. Its layers are stored
+// uncompressed, so they are compressed into temporary files and the image
+// is described with an OCI manifest.
+func openDockerArchive(fs imageFS) (*localImage, error) {
+	var manifests []dockerArchiveManifest
+	if _, err := readJSON(fs, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+	if len(manifests) != 1 {
+		return nil, fmt.Errorf("Expected exactly one image in the archive, found %d", len(manifests))
+	}
+	dm := manifests[0]
+
+	img := &localImage{ManifestMediaType: mediaTypeOCIManifest}
+	if len(dm.RepoTags) > 0 {
+		img.Reference = dm.RepoTags[0]
+	}
+	files := make(map[string]string)
+
+	config, err := compressBlob(fs, dm.Config, false)
+	if err != nil {
+		return nil, err
+	}
+	img.cleanup = append(img.cleanup, config.path)
+	files[config.desc.Digest] = config.path
+
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        config.desc,
+	}
+	m.Config.MediaType = mediaTypeOCIConfig
+
+	for _, layerPath := range dm.Layers {
+		layer, err := compressBlob(fs, layerPath, true)
+		if err != nil {
+			img.Close()
+			return nil, err
+		}
+		img.cleanup = append(img.cleanup, layer.path)
+		files[layer.desc.Digest] = layer.path
+
+		layer.desc.MediaType = mediaTypeOCILayer
+		m.Layers = append(m.Layers, layer.desc)
+	}
+
+	img.Manifest, err = json.Marshal(m)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	img.Blobs = append(m.Layers, m.Config)
+	img.open = func(digest string) (io.ReadCloser, error) {
+		path, ok := files[digest]
+		if !ok {
+			return nil, fmt.Errorf("Unknown blob %s", digest)
+		}
+		return os.Open(path)
+	}
+	return img, nil
+}
+
+type tempBlob struct {
+	desc descriptor
+	path string
+}
+
+// compressBlob copies a file out of the archive into a temporary file,
+// gzip compressing it if requested, and computes its digest.
+func compressBlob(fs imageFS, name string, compress bool) (*tempBlob, error) {
+	r, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	tf, err := ioutil.TempFile("", "packer-blob")
+	if err != nil {
+		return nil, err
+	}
+	defer tf.Close()
+
+	h := sha256.New()
+	counter := &countingWriter{}
+	out := io.MultiWriter(tf, h, counter)
+	if compress {
+		gz := gzip.NewWriter(out)
+		_, err = io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = io.Copy(out, r)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return nil, err
+	}
+
+	return &tempBlob{
+		desc: descriptor{
+			Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			Size:   counter.n,
+		},
+		path: tf.Name(),
+	}, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -3,6 +3,7 @@ package dockerpush
 import (
 	"context"
 	"fmt"
+	"net/http"
 
 	"github.com/hashicorp/packer/builder/docker"
 	"github.com/hashicorp/packer/common"
@@ -25,11 +26,19 @@ type Config struct {
 	EcrLogin               bool   `mapstructure:"ecr_login"`
 	docker.AwsAccessConfig `mapstructure:",squash"`
 
+	RegistryAPI      bool     `mapstructure:"registry_api"`
+	Repository       string   `mapstructure:"repository"`
+	Tags             []string `mapstructure:"tags"`
+	InsecureRegistry bool     `mapstructure:"insecure_registry"`
+
 	ctx interpolate.Context
 }
 
 type PostProcessor struct {
 	Driver docker.Driver
+	// HTTPClient is used to talk to the registry when registry_api is set.
+	// The default client is used if nil.
+	HTTPClient *http.Client
 
 	config Config
 }
@@ -49,10 +58,23 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 	if p.config.EcrLogin && p.config.LoginServer == "" {
 		return fmt.Errorf("ECR login requires login server to be provided.")
 	}
+
+	if !p.config.RegistryAPI && (p.config.Repository != "" || len(p.config.Tags) > 0 || p.config.InsecureRegistry) {
+		return fmt.Errorf("repository, tags and insecure_registry can only be used with registry_api")
+	}
+	if p.config.Repository != "" {
+		if _, err := parseReference(p.config.Repository); err != nil {
+			return fmt.Errorf("Invalid repository: %s", err)
+		}
+	}
 	return nil
 }
 
 func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, bool, error) {
+	if p.config.RegistryAPI {
+		return p.pushToRegistry(ui, artifact)
+	}
+
 	if artifact.BuilderId() != dockerimport.BuilderId &&
 		artifact.BuilderId() != dockertag.BuilderId {
 		err := fmt.Errorf(
@@ -63,8 +85,12 @@ func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact
 
 	driver := p.Driver
 	if driver == nil {
-		// If no driver is set, then we use the real driver
-		driver = &docker.DockerDriver{Ctx: &p.config.ctx, Ui: ui}
+		// If no driver is set, then we use the driver of the artifact
+		var err error
+		driver, err = docker.ArtifactDriver(artifact, ui, &p.config.ctx)
+		if err != nil {
+			return nil, false, false, err
+		}
 	}
 
 	if p.config.EcrLogin {
@@ -114,3 +140,95 @@ func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact
 
 	return artifact, true, false, nil
 }
+
+// pushToRegistry uploads the image archive or OCI layout in the artifact
+// directly to the registry, without going through a Docker daemon.
+func (p *PostProcessor) pushToRegistry(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, bool, error) {
+	files := artifact.Files()
+	if len(files) != 1 {
+		return nil, false, false, fmt.Errorf(
+			"Can only push an artifact with a single image archive or OCI layout, found %d files: %v",
+			len(files), files)
+	}
+
+	img, err := openLocalImage(files[0])
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer img.Close()
+
+	name := p.config.Repository
+	if name == "" {
+		name = img.Reference
+	}
+	if name == "" {
+		return nil, false, false, fmt.Errorf(
+			"The image in %s has no name, repository must be specified", files[0])
+	}
+	ref, err := parseReference(name)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	tags := p.config.Tags
+	if len(tags) == 0 {
+		tag := ref.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+		tags = []string{tag}
+	}
+
+	if p.config.EcrLogin {
+		ui.Message("Fetching ECR credentials...")
+
+		username, password, err := p.config.EcrGetLogin(p.config.LoginServer)
+		if err != nil {
+			return nil, false, false, err
+		}
+
+		p.config.LoginUsername = username
+		p.config.LoginPassword = password
+	}
+
+	client := newRegistryClient(p.HTTPClient, ref, p.config.InsecureRegistry,
+		p.config.LoginUsername, p.config.LoginPassword)
+
+	for _, blob := range img.Blobs {
+		exists, err := client.blobExists(blob.Digest)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if exists {
+			ui.Message(fmt.Sprintf("Layer %s already exists", blob.Digest))
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Uploading %s (%d bytes)", blob.Digest, blob.Size))
+		r, err := img.Open(blob.Digest)
+		if err != nil {
+			return nil, false, false, err
+		}
+		err = client.uploadBlob(blob.Digest, blob.Size, r)
+		r.Close()
+		if err != nil {
+			return nil, false, false, err
+		}
+	}
+
+	result := &RegistryArtifact{
+		Registry:   ref.Registry,
+		Repository: ref.Repository,
+	}
+	for _, tag := range tags {
+		ui.Message(fmt.Sprintf("Pushing: %s/%s:%s", ref.Registry, ref.Repository, tag))
+		digest, err := client.putManifest(tag, img.ManifestMediaType, img.Manifest)
+		if err != nil {
+			return nil, false, false, err
+		}
+		result.Digest = digest
+		result.Tags = append(result.Tags, tag)
+	}
+
+	return result, true, false, nil
+}
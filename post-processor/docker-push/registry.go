@@ -0,0 +1,352 @@
+package dockerpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	// Docker Hub's API isn't served from the name used in image references.
+	dockerHubEndpoint = "registry-1.docker.io"
+
+	// Size of each PATCH request when uploading blobs.
+	defaultChunkSize = 10 * 1024 * 1024
+)
+
+// reference is an image reference split into the registry host, the
+// repository name and the tag.
+type reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+// parseReference splits name the way the docker CLI does: the first path
+// component is a registry host if it looks like one, otherwise the image is
+// on Docker Hub.
+func parseReference(name string) (*reference, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty image reference")
+	}
+	if strings.Contains(name, "@") {
+		return nil, fmt.Errorf("image reference %s must not contain a digest", name)
+	}
+
+	ref := &reference{Registry: defaultRegistry}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		name = parts[1]
+	}
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// registryClient pushes images with the Docker Registry HTTP API v2.
+type registryClient struct {
+	client   *http.Client
+	endpoint *url.URL
+	repo     string
+	username string
+	password string
+	// Size of each chunk sent when uploading blobs.
+	chunkSize int
+
+	// The authorization header to send, obtained from the last challenge.
+	authorization string
+}
+
+func newRegistryClient(client *http.Client, ref *reference, insecure bool, username, password string) *registryClient {
+	host := ref.Registry
+	if host == defaultRegistry {
+		host = dockerHubEndpoint
+	}
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &registryClient{
+		client:    client,
+		endpoint:  &url.URL{Scheme: scheme, Host: host},
+		repo:      ref.Repository,
+		username:  username,
+		password:  password,
+		chunkSize: defaultChunkSize,
+	}
+}
+
+func (c *registryClient) url(format string, args ...interface{}) string {
+	return c.endpoint.String() + fmt.Sprintf(format, args...)
+}
+
+// do sends a request, authenticating and retrying once if the registry asks
+// for credentials. The body is a byte slice so it can be sent again.
+func (c *registryClient) do(method, u string, header http.Header, body []byte) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		return c.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(challenge); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// authenticate answers a WWW-Authenticate challenge, fetching a bearer
+// token from the realm the registry points to if needed.
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry requires credentials")
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(c.username, c.password)
+		c.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		return c.fetchToken(params)
+	default:
+		return fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+}
+
+func (c *registryClient) fetchToken(params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+
+	q := realm.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	q.Set("scope", fmt.Sprintf("repository:%s:pull,push", c.repo))
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error requesting registry token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error requesting registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("Error decoding registry token: %s", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("registry returned an empty token")
+	}
+
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a header such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+func responseError(resp *http.Response, action string) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("Error %s: %s %s", action, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// blobExists reports whether the registry already has the blob, in which
+// case it doesn't need to be uploaded again.
+func (c *registryClient) blobExists(digest string) (bool, error) {
+	resp, err := c.do("HEAD", c.url("/v2/%s/blobs/%s", c.repo, digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(resp, "checking for blob "+digest)
+	}
+}
+
+// resolve turns the Location header of an upload response into an absolute
+// URL.
+func (c *registryClient) resolve(resp *http.Response) (*url.URL, error) {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return nil, fmt.Errorf("registry returned an invalid upload location: %q", resp.Header.Get("Location"))
+	}
+	return resp.Request.URL.ResolveReference(location), nil
+}
+
+// uploadBlob uploads r, of the given size and digest, in chunks.
+func (c *registryClient) uploadBlob(digest string, size int64, r io.Reader) error {
+	resp, err := c.do("POST", c.url("/v2/%s/blobs/uploads/", c.repo), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError(resp, "starting blob upload")
+	}
+	location, err := c.resolve(resp)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, c.chunkSize)
+	var offset int64
+	for offset < size {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+		resp, err := c.do("PATCH", location.String(), header, buf[:n])
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+			err := responseError(resp, "uploading blob "+digest)
+			resp.Body.Close()
+			return err
+		}
+		resp.Body.Close()
+		if location, err = c.resolve(resp); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	if offset != size {
+		return fmt.Errorf("blob %s is %d bytes, expected %d", digest, offset, size)
+	}
+
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+	complete, err := c.do("PUT", location.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer complete.Body.Close()
+	if complete.StatusCode != http.StatusCreated {
+		return responseError(complete, "completing upload of blob "+digest)
+	}
+	return nil
+}
+
+// putManifest uploads the manifest under the given tag and returns the
+// digest the registry computed for it.
+func (c *registryClient) putManifest(tag, mediaType string, manifest []byte) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+	resp, err := c.do("PUT", c.url("/v2/%s/manifests/%s", c.repo, tag), header, manifest)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp, "uploading manifest for tag "+tag)
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
@@ -0,0 +1,312 @@
+package dockerpush
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/packer/builder/docker"
+	"github.com/hashicorp/packer/packer"
+)
+
+// testRegistry is a minimal in-memory implementation of the parts of the
+// registry API used when pushing, protected by token authentication.
+type testRegistry struct {
+	*httptest.Server
+
+	sync.Mutex
+	blobs     map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	manifests map[string][]byte
+	patches   int
+	nextID    int
+}
+
+const testToken = "s3cr3t-token"
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string]*bytes.Buffer),
+		manifests: make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:foo/bar:pull,push" {
+			t.Errorf("bad scope: %s", req.URL.Query().Get("scope"))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+testToken {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Lock()
+		defer r.Unlock()
+		r.serve(t, w, req)
+	})
+
+	r.Server = httptest.NewServer(mux)
+	return r
+}
+
+func (r *testRegistry) serve(t *testing.T, w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/foo/bar/")
+	body, _ := ioutil.ReadAll(req.Body)
+
+	switch {
+	case req.Method == "HEAD" && strings.HasPrefix(path, "blobs/sha256:"):
+		if _, ok := r.blobs[strings.TrimPrefix(path, "blobs/")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == "POST" && path == "blobs/uploads/":
+		r.nextID++
+		id := strconv.Itoa(r.nextID)
+		r.uploads[id] = new(bytes.Buffer)
+		w.Header().Set("Location", "/v2/foo/bar/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "PATCH" && strings.HasPrefix(path, "blobs/uploads/"):
+		id := strings.TrimPrefix(path, "blobs/uploads/")
+		upload := r.uploads[id]
+		expected := fmt.Sprintf("%d-%d", upload.Len(), upload.Len()+len(body)-1)
+		if req.Header.Get("Content-Range") != expected {
+			t.Errorf("bad Content-Range: %s, expected %s", req.Header.Get("Content-Range"), expected)
+		}
+		r.patches++
+		upload.Write(body)
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "PUT" && strings.HasPrefix(path, "blobs/uploads/"):
+		upload := r.uploads[strings.TrimPrefix(path, "blobs/uploads/")]
+		digest := req.URL.Query().Get("digest")
+		if fmt.Sprintf("sha256:%x", sha256.Sum256(upload.Bytes())) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = upload.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "PUT" && strings.HasPrefix(path, "manifests/"):
+		var m manifest
+		json.Unmarshal(body, &m)
+		for _, blob := range append(m.Layers, m.Config) {
+			if _, ok := r.blobs[blob.Digest]; !ok {
+				t.Errorf("manifest references missing blob %s", blob.Digest)
+			}
+		}
+		r.manifests[strings.TrimPrefix(path, "manifests/")] = body
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(body)))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// testImageArchive writes an image archive in the given format, using the
+// docker builder's exporter.
+func testImageArchive(t *testing.T, dir, format, tag string) string {
+	var rootfs bytes.Buffer
+	tw := tar.NewWriter(&rootfs)
+	tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	rootfsPath := filepath.Join(dir, "rootfs.tar")
+	if err := ioutil.WriteFile(rootfsPath, rootfs.Bytes(), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	archive := &docker.ImageArchive{
+		RootFS: rootfsPath,
+		Config: &docker.ImageConfig{Cmd: []string{"/hello"}},
+		Tag:    tag,
+		OS:     "linux",
+	}
+	path := filepath.Join(dir, format+".tar")
+	if err := archive.Write(format, path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path
+}
+
+func TestParseReference(t *testing.T) {
+	cases := map[string]reference{
+		"ubuntu":                           {"docker.io", "library/ubuntu", ""},
+		"hashicorp/packer:1.5":             {"docker.io", "hashicorp/packer", "1.5"},
+		"localhost:5000/foo/bar":           {"localhost:5000", "foo/bar", ""},
+		"registry.example.com/foo/bar:1.0": {"registry.example.com", "foo/bar", "1.0"},
+	}
+	for name, expected := range cases {
+		ref, err := parseReference(name)
+		if err != nil {
+			t.Fatalf("%s: err: %s", name, err)
+		}
+		if *ref != expected {
+			t.Fatalf("%s: bad reference: %#v", name, ref)
+		}
+	}
+
+	if _, err := parseReference("foo/bar@sha256:abcd"); err == nil {
+		t.Fatal("should error on digest references")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:foo/bar:pull,push"`)
+	if scheme != "Bearer" {
+		t.Fatalf("bad scheme: %s", scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:foo/bar:pull,push",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Fatalf("bad params: %#v", params)
+	}
+}
+
+func TestRegistryClient_chunkedUpload(t *testing.T) {
+	registry := newTestRegistry(t)
+	defer registry.Close()
+
+	ref := &reference{Registry: strings.TrimPrefix(registry.URL, "http://"), Repository: "foo/bar"}
+	client := newRegistryClient(nil, ref, true, "user", "pass")
+	client.chunkSize = 10
+
+	data := []byte("this blob is uploaded in several chunks")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if err := client.uploadBlob(digest, int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if registry.patches != 4 {
+		t.Fatalf("expected 4 chunks, got %d", registry.patches)
+	}
+	if !bytes.Equal(registry.blobs[digest], data) {
+		t.Fatalf("bad blob: %q", registry.blobs[digest])
+	}
+
+	exists, err := client.blobExists(digest)
+	if err != nil || !exists {
+		t.Fatalf("blob should exist: %v", err)
+	}
+}
+
+func TestPostProcessor_PostProcess_registryAPI(t *testing.T) {
+	for _, format := range []string{docker.ExportFormatOCI, docker.ExportFormatDockerArchive} {
+		registry := newTestRegistry(t)
+		defer registry.Close()
+		host := strings.TrimPrefix(registry.URL, "http://")
+
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := testImageArchive(t, dir, format, host+"/foo/bar:1.0")
+
+		var p PostProcessor
+		err = p.Configure(map[string]interface{}{
+			"registry_api":      true,
+			"insecure_registry": true,
+			"tags":              []string{"1.0", "latest"},
+			"login_username":    "user",
+			"login_password":    "pass",
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		artifact := &packer.MockArtifact{FilesValue: []string{path}}
+		result, keep, _, err := p.PostProcess(context.Background(), testUi(), artifact)
+		if err != nil {
+			t.Fatalf("%s: err: %s", format, err)
+		}
+		if !keep {
+			t.Fatal("should keep")
+		}
+
+		if len(registry.blobs) != 2 {
+			t.Fatalf("%s: expected a config and a layer blob, got %d", format, len(registry.blobs))
+		}
+		if !bytes.Equal(registry.manifests["1.0"], registry.manifests["latest"]) || registry.manifests["1.0"] == nil {
+			t.Fatalf("%s: both tags should point to the manifest", format)
+		}
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(registry.manifests["1.0"]))
+		if result.Id() != host+"/foo/bar@"+digest {
+			t.Fatalf("%s: bad id: %s", format, result.Id())
+		}
+
+		// Pushing again reuses the existing layers
+		patches := registry.patches
+		if _, _, _, err := p.PostProcess(context.Background(), testUi(), artifact); err != nil {
+			t.Fatalf("%s: err: %s", format, err)
+		}
+		if registry.patches != patches {
+			t.Fatalf("%s: existing blobs should not be uploaded again", format)
+		}
+	}
+}
+
+func TestPostProcessor_PostProcess_registryAPIBadCredentials(t *testing.T) {
+	registry := newTestRegistry(t)
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var p PostProcessor
+	err = p.Configure(map[string]interface{}{
+		"registry_api":      true,
+		"insecure_registry": true,
+		"repository":        host + "/foo/bar",
+		"login_username":    "user",
+		"login_password":    "wrong",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	artifact := &packer.MockArtifact{FilesValue: []string{testImageArchive(t, dir, docker.ExportFormatOCI, "")}}
+	if _, _, _, err := p.PostProcess(context.Background(), testUi(), artifact); err == nil {
+		t.Fatal("should fail with bad credentials")
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatal("nothing should be pushed")
+	}
+}
+
+func TestPostProcessor_Configure_registryAPI(t *testing.T) {
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"tags": []string{"latest"}}); err == nil {
+		t.Fatal("tags should require registry_api")
+	}
+}
@@ -66,8 +66,12 @@ func (p *PostProcessor) PostProcess(ctx context.Context, ui packer.Ui, artifact
 
 	driver := p.Driver
 	if driver == nil {
-		// If no driver is set, then we use the real driver
-		driver = &docker.DockerDriver{Ctx: &p.config.ctx, Ui: ui}
+		// If no driver is set, then we use the driver of the artifact
+		var err error
+		driver, err = docker.ArtifactDriver(artifact, ui, &p.config.ctx)
+		if err != nil {
+			return nil, false, false, err
+		}
 	}
 
 	ui.Message("Saving image: " + artifact.Id())
@@ -118,3 +118,26 @@ func TestPostProcessor_PostProcess_Force(t *testing.T) {
 		t.Fatal("bad force")
 	}
 }
+
+func TestPostProcessor_PostProcess_ArtifactDriver(t *testing.T) {
+	p := testPP(t)
+
+	// The image is tagged with the driver that built it, such as podman
+	driver := &docker.MockDriver{}
+	artifact := &docker.ImportArtifact{
+		BuilderIdValue: docker.BuilderIdImport,
+		Driver:         driver,
+		IdValue:        "1234567890abcdef",
+	}
+
+	result, _, _, err := p.PostProcess(context.Background(), testUi(), artifact)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !driver.TagImageCalled {
+		t.Fatal("should call TagImage on the driver of the artifact")
+	}
+	if result.(*docker.ImportArtifact).Driver != driver {
+		t.Fatal("the driver should be kept in the new artifact")
+	}
+}
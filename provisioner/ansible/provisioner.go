@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,7 +50,16 @@ type Config struct {
 	AnsibleEnvVars []string `mapstructure:"ansible_env_vars"`
 
 	// The main playbook file to execute.
-	PlaybookFile         string   `mapstructure:"playbook_file"`
+	PlaybookFile string `mapstructure:"playbook_file"`
+
+	// The playbook files to execute in order, instead of PlaybookFile.
+	PlaybookFiles []string `mapstructure:"playbook_files"`
+
+	// Variables of the host and of groups, written into the generated
+	// inventory.
+	InventoryVars map[string]string            `mapstructure:"inventory_vars"`
+	GroupVars     map[string]map[string]string `mapstructure:"group_vars"`
+
 	Groups               []string `mapstructure:"groups"`
 	EmptyGroups          []string `mapstructure:"empty_groups"`
 	HostAlias            string   `mapstructure:"host_alias"`
@@ -113,9 +124,33 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	}
 
 	var errs *packer.MultiError
-	err = validateFileConfig(p.config.PlaybookFile, "playbook_file", true)
-	if err != nil {
-		errs = packer.MultiErrorAppend(errs, err)
+	// Check that either playbook_file or playbook_files is specified
+	if len(p.config.PlaybookFiles) != 0 && p.config.PlaybookFile != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Either playbook_file or playbook_files can be specified, not both"))
+	}
+	if len(p.config.PlaybookFiles) == 0 && p.config.PlaybookFile == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Either playbook_file or playbook_files must be specified"))
+	}
+	if p.config.PlaybookFile != "" {
+		err = validateFileConfig(p.config.PlaybookFile, "playbook_file", true)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+	for _, playbookFile := range p.config.PlaybookFiles {
+		if err := validateFileConfig(playbookFile, "playbook_files", true); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	// The variables can only be written into the generated inventory
+	if p.config.InventoryFile != "" {
+		if len(p.config.InventoryVars) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inventory_vars can't be used with inventory_file"))
+		}
+		if len(p.config.GroupVars) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("group_vars can't be used with inventory_file"))
+		}
 	}
 
 	// Check that the galaxy file exists, if configured
@@ -328,23 +363,8 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		}
 		defer os.Remove(tf.Name())
 
-		host := fmt.Sprintf("%s ansible_host=127.0.0.1 ansible_user=%s ansible_port=%d\n",
-			p.config.HostAlias, p.config.User, p.config.LocalPort)
-		if p.ansibleMajVersion < 2 {
-			host = fmt.Sprintf("%s ansible_ssh_host=127.0.0.1 ansible_ssh_user=%s ansible_ssh_port=%d\n",
-				p.config.HostAlias, p.config.User, p.config.LocalPort)
-		}
-
 		w := bufio.NewWriter(tf)
-		w.WriteString(host)
-		for _, group := range p.config.Groups {
-			fmt.Fprintf(w, "[%s]\n%s", group, host)
-		}
-
-		for _, group := range p.config.EmptyGroups {
-			fmt.Fprintf(w, "[%s]\n", group)
-		}
-
+		w.WriteString(p.inventory())
 		if err := w.Flush(); err != nil {
 			tf.Close()
 			return fmt.Errorf("Error preparing inventory file: %s", err)
@@ -356,13 +376,122 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		}()
 	}
 
-	if err := p.executeAnsible(ui, comm, k.privKeyFile); err != nil {
-		return fmt.Errorf("Error executing Ansible: %s", err)
+	extraVarsFile, err := p.createExtraVarsFile()
+	if err != nil {
+		return fmt.Errorf("Error preparing extra vars file: %s", err)
+	}
+	defer os.Remove(extraVarsFile)
+
+	// Fetch external dependencies
+	if len(p.config.GalaxyFile) > 0 {
+		if err := p.executeGalaxy(ui, comm); err != nil {
+			return fmt.Errorf("Error executing Ansible Galaxy: %s", err)
+		}
+	}
+
+	playbookFiles := p.config.PlaybookFiles
+	if p.config.PlaybookFile != "" {
+		playbookFiles = []string{p.config.PlaybookFile}
+	}
+	for _, playbookFile := range playbookFiles {
+		if err := p.executeAnsible(ui, comm, k.privKeyFile, playbookFile, extraVarsFile); err != nil {
+			return fmt.Errorf("Error executing Ansible: %s", err)
+		}
 	}
 
 	return nil
 }
 
+// inventory returns the content of the generated inventory, with the host
+// in its groups and the configured variables.
+func (p *Provisioner) inventory() string {
+	host := fmt.Sprintf("%s ansible_host=127.0.0.1 ansible_user=%s ansible_port=%d",
+		p.config.HostAlias, p.config.User, p.config.LocalPort)
+	if p.ansibleMajVersion < 2 {
+		host = fmt.Sprintf("%s ansible_ssh_host=127.0.0.1 ansible_ssh_user=%s ansible_ssh_port=%d",
+			p.config.HostAlias, p.config.User, p.config.LocalPort)
+	}
+	for _, k := range sortedKeys(p.config.InventoryVars) {
+		host += fmt.Sprintf(" %s=%s", k, quoteInventoryValue(p.config.InventoryVars[k]))
+	}
+	host += "\n"
+
+	var b strings.Builder
+	b.WriteString(host)
+	for _, group := range p.config.Groups {
+		fmt.Fprintf(&b, "[%s]\n%s", group, host)
+	}
+
+	for _, group := range p.config.EmptyGroups {
+		fmt.Fprintf(&b, "[%s]\n", group)
+	}
+
+	groups := make([]string, 0, len(p.config.GroupVars))
+	for group := range p.config.GroupVars {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		// Values of group variables are taken as is up to the end of
+		// the line
+		fmt.Fprintf(&b, "[%s:vars]\n", group)
+		vars := p.config.GroupVars[group]
+		for _, k := range sortedKeys(vars) {
+			fmt.Fprintf(&b, "%s=%s\n", k, vars[k])
+		}
+	}
+
+	return b.String()
+}
+
+// createExtraVarsFile writes the metadata of the build into a JSON file of
+// extra variables, and returns its path. User variables may be sensitive, so
+// they aren't passed on the command line.
+func (p *Provisioner) createExtraVarsFile() (string, error) {
+	userVars := p.config.PackerUserVars
+	if userVars == nil {
+		userVars = map[string]string{}
+	}
+	extraVars := map[string]interface{}{
+		"packer_build_name":     p.config.PackerBuildName,
+		"packer_builder_type":   p.config.PackerBuilderType,
+		"packer_user_variables": userVars,
+	}
+	data, err := json.Marshal(extraVars)
+	if err != nil {
+		return "", err
+	}
+
+	tf, err := tmp.File("packer-ansible-extra-vars*.json")
+	if err != nil {
+		return "", err
+	}
+	defer tf.Close()
+	if _, err := tf.Write(data); err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+	return tf.Name(), nil
+}
+
+// quoteInventoryValue quotes the value of a host variable, which Ansible
+// splits like a shell.
+func quoteInventoryValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n'\"\\#") {
+		return v
+	}
+	return "'" + strings.Replace(v, "'", `'"'"'`, -1) + "'"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (p *Provisioner) executeGalaxy(ui packer.Ui, comm packer.Communicator) error {
 	galaxyFile := filepath.ToSlash(p.config.GalaxyFile)
 
@@ -423,20 +552,13 @@ func (p *Provisioner) executeGalaxy(ui packer.Ui, comm packer.Communicator) erro
 	return nil
 }
 
-func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, privKeyFile string) error {
-	playbook, _ := filepath.Abs(p.config.PlaybookFile)
+func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, privKeyFile string, playbookFile string, extraVarsFile string) error {
+	playbook, _ := filepath.Abs(playbookFile)
 	inventory := p.config.InventoryFile
 
 	var envvars []string
 
-	// Fetch external dependencies
-	if len(p.config.GalaxyFile) > 0 {
-		if err := p.executeGalaxy(ui, comm); err != nil {
-			return fmt.Errorf("Error executing Ansible Galaxy: %s", err)
-		}
-	}
-	args := []string{"--extra-vars", fmt.Sprintf("packer_build_name=%s packer_builder_type=%s -o IdentitiesOnly=yes",
-		p.config.PackerBuildName, p.config.PackerBuilderType),
+	args := []string{"--extra-vars", "@" + extraVarsFile,
 		"-i", inventory, playbook}
 	if len(privKeyFile) > 0 {
 		// Changed this from using --private-key to supplying -e ansible_ssh_private_key_file as the latter
@@ -129,6 +129,124 @@ func TestProvisionerPrepare_PlaybookFile(t *testing.T) {
 	}
 }
 
+func TestProvisionerPrepare_PlaybookFiles(t *testing.T) {
+	var p Provisioner
+	config := testConfig(t)
+	defer os.Remove(config["command"].(string))
+
+	playbook_file, err := ioutil.TempFile("", "playbook")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(playbook_file.Name())
+
+	config["playbook_files"] = []string{playbook_file.Name(), playbook_file.Name()}
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Both can't be specified
+	config["playbook_file"] = playbook_file.Name()
+	p = Provisioner{}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	delete(config, "playbook_file")
+	config["playbook_files"] = []string{playbook_file.Name(), "doesnotexist"}
+	p = Provisioner{}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_InventoryVars(t *testing.T) {
+	var p Provisioner
+	config := testConfig(t)
+	defer os.Remove(config["command"].(string))
+
+	playbook_file, err := ioutil.TempFile("", "playbook")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(playbook_file.Name())
+
+	config["playbook_file"] = playbook_file.Name()
+	config["inventory_vars"] = map[string]string{"foo": "bar"}
+	config["group_vars"] = map[string]interface{}{
+		"web": map[string]string{"port": "80"},
+	}
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.InventoryVars["foo"] != "bar" || p.config.GroupVars["web"]["port"] != "80" {
+		t.Fatalf("bad: %#v %#v", p.config.InventoryVars, p.config.GroupVars)
+	}
+
+	// The variables can't be written into a custom inventory
+	config["inventory_file"] = playbook_file.Name()
+	p = Provisioner{}
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerInventory(t *testing.T) {
+	var p Provisioner
+	p.ansibleMajVersion = 2
+	p.config.HostAlias = "default"
+	p.config.User = "packer"
+	p.config.LocalPort = 2222
+	p.config.Groups = []string{"web"}
+	p.config.EmptyGroups = []string{"db"}
+	p.config.InventoryVars = map[string]string{
+		"b": "two words",
+		"a": "it's",
+		"c": "1",
+	}
+	p.config.GroupVars = map[string]map[string]string{
+		"web": {"port": "80", "name": "a b"},
+		"all": {"env": "test"},
+	}
+
+	host := `default ansible_host=127.0.0.1 ansible_user=packer ansible_port=2222 a='it'"'"'s' b='two words' c=1` + "\n"
+	expected := host +
+		"[web]\n" + host +
+		"[db]\n" +
+		"[all:vars]\nenv=test\n" +
+		"[web:vars]\nname=a b\nport=80\n"
+	if inventory := p.inventory(); inventory != expected {
+		t.Fatalf("bad inventory:\n%s\nexpected:\n%s", inventory, expected)
+	}
+}
+
+func TestProvisionerCreateExtraVarsFile(t *testing.T) {
+	var p Provisioner
+	p.config.PackerBuildName = "vbox"
+	p.config.PackerBuilderType = "virtualbox-iso"
+	p.config.PackerUserVars = map[string]string{"region": "eu"}
+
+	path, err := p.createExtraVarsFile()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := `{"packer_build_name":"vbox","packer_builder_type":"virtualbox-iso","packer_user_variables":{"region":"eu"}}`
+	if string(data) != expected {
+		t.Fatalf("bad: %s", data)
+	}
+}
+
 func TestProvisionerPrepare_HostKeyFile(t *testing.T) {
 	var p Provisioner
 	config := testConfig(t)
@@ -0,0 +1,440 @@
+// This package implements a provisioner for Packer that verifies the state
+// of the machine with declarative checks, run over the communicator.
+package assert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/config"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/provisioner"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// The OS of the machine, which decides the commands the checks run.
+	GuestOSType string `mapstructure:"guest_os_type"`
+
+	// Read the files with sudo, on unix guests.
+	UseSudo bool `mapstructure:"use_sudo"`
+
+	Files    []FileCheck    `mapstructure:"files"`
+	Packages []PackageCheck `mapstructure:"packages"`
+	Services []ServiceCheck `mapstructure:"services"`
+	Ports    []PortCheck    `mapstructure:"ports"`
+	Commands []CommandCheck `mapstructure:"commands"`
+	Users    []UserCheck    `mapstructure:"users"`
+
+	ctx interpolate.Context
+}
+
+// FileCheck checks that a file exists, or not, and optionally its mode,
+// owner and content.
+type FileCheck struct {
+	Path string `mapstructure:"path"`
+	// Defaults to true.
+	Exists *bool `mapstructure:"exists"`
+	// The octal mode of the file, like 0644.
+	Mode  string `mapstructure:"mode"`
+	Owner string `mapstructure:"owner"`
+	// A regular expression the content of the file must match.
+	Content string `mapstructure:"content"`
+
+	contentRe *regexp.Regexp
+}
+
+// PackageCheck checks that a package is installed, or not.
+type PackageCheck struct {
+	Name string `mapstructure:"name"`
+	// Defaults to true.
+	Installed *bool `mapstructure:"installed"`
+}
+
+// ServiceCheck checks that a service starts at boot and that it is running.
+// Only enabled is checked, and expected, by default.
+type ServiceCheck struct {
+	Name    string `mapstructure:"name"`
+	Enabled *bool  `mapstructure:"enabled"`
+	Running *bool  `mapstructure:"running"`
+}
+
+// PortCheck checks that something listens on a port, or not.
+type PortCheck struct {
+	Port int `mapstructure:"port"`
+	// tcp or udp, defaults to tcp.
+	Protocol string `mapstructure:"protocol"`
+	// Defaults to true.
+	Listening *bool `mapstructure:"listening"`
+}
+
+// CommandCheck checks the exit code and the output of a command.
+type CommandCheck struct {
+	Command string `mapstructure:"command"`
+	// Defaults to 0.
+	ExitCode int `mapstructure:"exit_code"`
+	// Regular expressions the outputs must match.
+	Stdout string `mapstructure:"stdout"`
+	Stderr string `mapstructure:"stderr"`
+
+	stdoutRe *regexp.Regexp
+	stderrRe *regexp.Regexp
+}
+
+// UserCheck checks that a user exists, or not.
+type UserCheck struct {
+	Name string `mapstructure:"name"`
+	// Defaults to true.
+	Exists *bool `mapstructure:"exists"`
+}
+
+// check is a single check run by the provisioner. run returns a description
+// of the failure, empty if the check passed, or an error if the check
+// couldn't run.
+type check struct {
+	name string
+	run  func(ctx context.Context, comm packer.Communicator) (string, error)
+}
+
+type Provisioner struct {
+	config        Config
+	guestCommands *provisioner.GuestCommands
+}
+
+var modeRe = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.GuestOSType == "" {
+		p.config.GuestOSType = provisioner.DefaultOSType
+	}
+	p.config.GuestOSType = strings.ToLower(p.config.GuestOSType)
+
+	var errs *packer.MultiError
+	p.guestCommands, err = provisioner.NewGuestCommands(p.config.GuestOSType, p.config.UseSudo)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid guest_os_type: %q", p.config.GuestOSType))
+	}
+
+	for i := range p.config.Files {
+		f := &p.config.Files[i]
+		if f.Path == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: path must be specified", i))
+		}
+		if f.Mode != "" {
+			if !modeRe.MatchString(f.Mode) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: mode must be an octal mode: %s", i, f.Mode))
+			} else if p.config.GuestOSType == provisioner.WindowsOSType {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: mode can't be checked on windows", i))
+			}
+		}
+		if f.Content != "" {
+			if f.contentRe, err = regexp.Compile(f.Content); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: content is invalid: %s", i, err))
+			}
+		}
+	}
+
+	for i, pkg := range p.config.Packages {
+		if pkg.Name == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("packages[%d]: name must be specified", i))
+		}
+	}
+
+	for i, svc := range p.config.Services {
+		if svc.Name == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("services[%d]: name must be specified", i))
+		}
+	}
+
+	for i := range p.config.Ports {
+		port := &p.config.Ports[i]
+		if port.Port < 1 || port.Port > 65535 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ports[%d]: port must be between 1 and 65535", i))
+		}
+		if port.Protocol == "" {
+			port.Protocol = "tcp"
+		}
+		port.Protocol = strings.ToLower(port.Protocol)
+		if port.Protocol != "tcp" && port.Protocol != "udp" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ports[%d]: protocol must be tcp or udp", i))
+		}
+	}
+
+	for i := range p.config.Commands {
+		c := &p.config.Commands[i]
+		if c.Command == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("commands[%d]: command must be specified", i))
+		}
+		if c.Stdout != "" {
+			if c.stdoutRe, err = regexp.Compile(c.Stdout); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("commands[%d]: stdout is invalid: %s", i, err))
+			}
+		}
+		if c.Stderr != "" {
+			if c.stderrRe, err = regexp.Compile(c.Stderr); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("commands[%d]: stderr is invalid: %s", i, err))
+			}
+		}
+	}
+
+	for i, user := range p.config.Users {
+		if user.Name == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("users[%d]: name must be specified", i))
+		}
+	}
+
+	if len(p.checks()) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("At least one check must be specified"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	checks := p.checks()
+	ui.Say(fmt.Sprintf("Running %d checks...", len(checks)))
+
+	var failures []string
+	for _, c := range checks {
+		failure, err := c.run(ctx, comm)
+		if err != nil {
+			return fmt.Errorf("Error checking %s: %s", c.name, err)
+		}
+		if failure != "" {
+			ui.Error(fmt.Sprintf("FAIL: %s: %s", c.name, failure))
+			failures = append(failures, fmt.Sprintf("%s: %s", c.name, failure))
+			continue
+		}
+		ui.Message(fmt.Sprintf("PASS: %s", c.name))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d checks failed:\n%s",
+			len(failures), len(checks), strings.Join(failures, "\n"))
+	}
+
+	ui.Say(fmt.Sprintf("All %d checks passed", len(checks)))
+	return nil
+}
+
+// checks returns the checks of the configuration, in order.
+func (p *Provisioner) checks() []check {
+	var checks []check
+	for _, f := range p.config.Files {
+		checks = append(checks, check{fmt.Sprintf("file %s", f.Path), p.fileCheck(f)})
+	}
+	for _, pkg := range p.config.Packages {
+		checks = append(checks, check{fmt.Sprintf("package %s", pkg.Name), p.packageCheck(pkg)})
+	}
+	for _, svc := range p.config.Services {
+		checks = append(checks, check{fmt.Sprintf("service %s", svc.Name), p.serviceCheck(svc)})
+	}
+	for _, port := range p.config.Ports {
+		checks = append(checks, check{fmt.Sprintf("port %d/%s", port.Port, port.Protocol), p.portCheck(port)})
+	}
+	for _, c := range p.config.Commands {
+		checks = append(checks, check{fmt.Sprintf("command %q", c.Command), p.commandCheck(c)})
+	}
+	for _, user := range p.config.Users {
+		checks = append(checks, check{fmt.Sprintf("user %s", user.Name), p.userCheck(user)})
+	}
+	return checks
+}
+
+func (p *Provisioner) fileCheck(f FileCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		stdout, stderr, exitStatus, err := run(ctx, comm, p.guestCommands.FileStat(f.Path))
+		if err != nil {
+			return "", err
+		}
+		exists, err := predicateResult(exitStatus, stderr)
+		if err != nil {
+			return "", err
+		}
+		if expected := boolOr(f.Exists, true); exists != expected {
+			if expected {
+				return "does not exist", nil
+			}
+			return "exists", nil
+		}
+		if !exists {
+			return "", nil
+		}
+
+		var failures []string
+		fields := strings.Fields(stdout)
+		if len(fields) < 2 {
+			return "", fmt.Errorf("unexpected output: %q", stdout)
+		}
+		mode, owner := fields[0], strings.Join(fields[1:], " ")
+		if f.Mode != "" && strings.TrimLeft(mode, "0") != strings.TrimLeft(f.Mode, "0") {
+			failures = append(failures, fmt.Sprintf("mode is %s, expected %s", mode, f.Mode))
+		}
+		if f.Owner != "" && !strings.EqualFold(owner, f.Owner) {
+			failures = append(failures, fmt.Sprintf("owner is %s, expected %s", owner, f.Owner))
+		}
+		if f.contentRe != nil {
+			content, _, exitStatus, err := run(ctx, comm, p.guestCommands.ReadFile(f.Path))
+			if err != nil {
+				return "", err
+			}
+			if exitStatus != 0 {
+				failures = append(failures, fmt.Sprintf("content can't be read, exit status %d", exitStatus))
+			} else if !f.contentRe.MatchString(content) {
+				failures = append(failures, fmt.Sprintf("content doesn't match %q", f.Content))
+			}
+		}
+		return strings.Join(failures, ", "), nil
+	}
+}
+
+func (p *Provisioner) packageCheck(pkg PackageCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		return p.predicate(ctx, comm, p.guestCommands.PackageInstalled(pkg.Name),
+			boolOr(pkg.Installed, true), "is installed", "is not installed")
+	}
+}
+
+func (p *Provisioner) serviceCheck(svc ServiceCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		enabled := svc.Enabled
+		if enabled == nil && svc.Running == nil {
+			t := true
+			enabled = &t
+		}
+
+		var failures []string
+		if enabled != nil {
+			failure, err := p.predicate(ctx, comm, p.guestCommands.ServiceEnabled(svc.Name),
+				*enabled, "is enabled", "is not enabled")
+			if err != nil {
+				return "", err
+			}
+			if failure != "" {
+				failures = append(failures, failure)
+			}
+		}
+		if svc.Running != nil {
+			failure, err := p.predicate(ctx, comm, p.guestCommands.ServiceRunning(svc.Name),
+				*svc.Running, "is running", "is not running")
+			if err != nil {
+				return "", err
+			}
+			if failure != "" {
+				failures = append(failures, failure)
+			}
+		}
+		return strings.Join(failures, ", "), nil
+	}
+}
+
+func (p *Provisioner) portCheck(port PortCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		return p.predicate(ctx, comm, p.guestCommands.PortListening(port.Protocol, port.Port),
+			boolOr(port.Listening, true), "is listening", "is not listening")
+	}
+}
+
+func (p *Provisioner) commandCheck(c CommandCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		stdout, stderr, exitStatus, err := run(ctx, comm, c.Command)
+		if err != nil {
+			return "", err
+		}
+
+		var failures []string
+		if exitStatus != c.ExitCode {
+			failures = append(failures, fmt.Sprintf("exit code is %d, expected %d", exitStatus, c.ExitCode))
+		}
+		if c.stdoutRe != nil && !c.stdoutRe.MatchString(stdout) {
+			failures = append(failures, fmt.Sprintf("stdout doesn't match %q", c.Stdout))
+		}
+		if c.stderrRe != nil && !c.stderrRe.MatchString(stderr) {
+			failures = append(failures, fmt.Sprintf("stderr doesn't match %q", c.Stderr))
+		}
+		return strings.Join(failures, ", "), nil
+	}
+}
+
+func (p *Provisioner) userCheck(user UserCheck) func(context.Context, packer.Communicator) (string, error) {
+	return func(ctx context.Context, comm packer.Communicator) (string, error) {
+		return p.predicate(ctx, comm, p.guestCommands.UserExists(user.Name),
+			boolOr(user.Exists, true), "exists", "does not exist")
+	}
+}
+
+// predicate runs a command which exits with 0 if a predicate holds and with
+// 1 if it doesn't, and returns the failure if the result isn't the expected
+// one.
+func (p *Provisioner) predicate(ctx context.Context, comm packer.Communicator, command string,
+	expected bool, holds string, doesNotHold string) (string, error) {
+	_, stderr, exitStatus, err := run(ctx, comm, command)
+	if err != nil {
+		return "", err
+	}
+	actual, err := predicateResult(exitStatus, stderr)
+	if err != nil {
+		return "", err
+	}
+	if actual != expected {
+		if actual {
+			return holds, nil
+		}
+		return doesNotHold, nil
+	}
+	return "", nil
+}
+
+// predicateResult is the result of a predicate command. Exit statuses other
+// than 0 and 1 mean that the predicate can't be checked on the machine.
+func predicateResult(exitStatus int, stderr string) (bool, error) {
+	switch exitStatus {
+	case 0:
+		return true, nil
+	case 1:
+		return false, nil
+	}
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return false, fmt.Errorf("can't be checked on the machine, exit status %d: %s", exitStatus, stderr)
+	}
+	return false, fmt.Errorf("can't be checked on the machine, exit status %d", exitStatus)
+}
+
+func run(ctx context.Context, comm packer.Communicator, command string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+
+	if err := comm.Start(ctx, cmd); err != nil {
+		return "", "", 0, err
+	}
+	cmd.Wait()
+	return stdout.String(), stderr.String(), cmd.ExitStatus(), nil
+}
+
+func boolOr(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
@@ -0,0 +1,188 @@
+package assert
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// testCommunicator answers commands containing a key of responses with a
+// fixed output and exit status.
+type testCommunicator struct {
+	packer.MockCommunicator
+
+	responses map[string]testResponse
+	commands  []string
+}
+
+type testResponse struct {
+	stdout     string
+	exitStatus int
+}
+
+func (c *testCommunicator) Start(ctx context.Context, rc *packer.RemoteCmd) error {
+	c.commands = append(c.commands, rc.Command)
+	for key, resp := range c.responses {
+		if strings.Contains(rc.Command, key) {
+			if rc.Stdout != nil {
+				rc.Stdout.Write([]byte(resp.stdout))
+			}
+			rc.SetExited(resp.exitStatus)
+			return nil
+		}
+	}
+	rc.SetExited(0)
+	return nil
+}
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"files": []map[string]interface{}{
+			{"path": "/etc/nginx/nginx.conf", "mode": "0644", "owner": "root", "content": "worker_processes"},
+		},
+		"packages": []map[string]interface{}{{"name": "nginx"}},
+		"services": []map[string]interface{}{{"name": "nginx", "running": true}},
+		"ports":    []map[string]interface{}{{"port": 80}},
+		"commands": []map[string]interface{}{{"command": "nginx -v", "stdout": "^$"}},
+		"users":    []map[string]interface{}{{"name": "www-data"}, {"name": "guest", "exists": false}},
+	}
+}
+
+func TestProvisioner_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &Provisioner{}
+	if _, ok := raw.(packer.Provisioner); !ok {
+		t.Fatalf("must be a Provisioner")
+	}
+}
+
+func TestProvisionerPrepare(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.Ports[0].Protocol != "tcp" {
+		t.Fatalf("bad protocol: %s", p.config.Ports[0].Protocol)
+	}
+	if len(p.checks()) != 7 {
+		t.Fatalf("bad: %d checks", len(p.checks()))
+	}
+}
+
+func TestProvisionerPrepare_errors(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{}); err == nil {
+		t.Fatal("should have error without checks")
+	}
+
+	config := map[string]interface{}{
+		"files":    []map[string]interface{}{{"path": "foo", "mode": "rw", "content": "("}},
+		"ports":    []map[string]interface{}{{"port": 0, "protocol": "sctp"}},
+		"commands": []map[string]interface{}{{"stdout": "["}},
+		"users":    []map[string]interface{}{{}},
+	}
+	p = Provisioner{}
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if n := len(err.(*packer.MultiError).Errors); n != 7 {
+		t.Fatalf("bad: %d errors: %s", n, err)
+	}
+
+	config = map[string]interface{}{
+		"guest_os_type": "windows",
+		"files":         []map[string]interface{}{{"path": "C:\\foo", "mode": "0644"}},
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should not check modes on windows")
+	}
+}
+
+func TestProvisionerProvision(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &testCommunicator{
+		responses: map[string]testResponse{
+			"stat -c": {stdout: "644 root\n"},
+			"cat '":   {stdout: "worker_processes auto;\n"},
+			"id 'g":   {exitStatus: 1},
+		},
+	}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(comm.commands) != 8 {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerProvision_failures(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &testCommunicator{
+		responses: map[string]testResponse{
+			"stat -c":             {stdout: "600 nginx\n"},
+			"cat '":               {stdout: "events {}\n"},
+			"systemctl is-active": {exitStatus: 1},
+			"ss -lnt":             {exitStatus: 1},
+			"nginx -v":            {stdout: "nginx version: nginx/1.14.0\n"},
+			"id 'guest'":          {exitStatus: 0},
+			"id 'www-data'":       {exitStatus: 1},
+			"dpkg-query -W -f=":   {exitStatus: 0},
+		},
+	}
+	err := p.Provision(context.Background(), packer.TestUi(t), comm)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Every failed check is reported
+	expected := []string{
+		"6 of 7 checks failed",
+		"file /etc/nginx/nginx.conf: mode is 600, expected 0644, owner is nginx, expected root, content doesn't match",
+		"service nginx: is not running",
+		"port 80/tcp: is not listening",
+		`command "nginx -v": stdout doesn't match`,
+		"user www-data: does not exist",
+		"user guest: exists",
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Fatalf("expected %q in error: %s", e, err)
+		}
+	}
+}
+
+func TestProvisionerProvision_unavailable(t *testing.T) {
+	cases := map[string]map[string]interface{}{
+		"ss -lnt": {"ports": []map[string]interface{}{{"port": 80, "listening": false}}},
+		"stat -c": {"files": []map[string]interface{}{{"path": "/etc/motd", "exists": false}}},
+		"dpkg":    {"packages": []map[string]interface{}{{"name": "telnet", "installed": false}}},
+	}
+
+	for key, config := range cases {
+		var p Provisioner
+		if err := p.Prepare(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// A check that can't run is an error, not a pass or a failure
+		comm := &testCommunicator{
+			responses: map[string]testResponse{key: {exitStatus: 2}},
+		}
+		err := p.Provision(context.Background(), packer.TestUi(t), comm)
+		if err == nil || !strings.Contains(err.Error(), "can't be checked on the machine, exit status 2") {
+			t.Fatalf("%s: bad error: %v", key, err)
+		}
+	}
+}
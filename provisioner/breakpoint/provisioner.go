@@ -2,7 +2,9 @@ package breakpoint
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 
 	"golang.org/x/sync/errgroup"
 
@@ -17,6 +19,7 @@ type Config struct {
 
 	Note    string `mapstructure:"note"`
 	Disable bool   `mapstructure:"disable"`
+	Shell   bool   `mapstructure:"shell"`
 
 	ctx interpolate.Context
 }
@@ -58,6 +61,16 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		ui.Say("Pausing at breakpoint provisioner.")
 	}
 
+	if p.config.Shell {
+		err := p.shell(ctx, ui, comm)
+		if err == nil {
+			return nil
+		}
+		if err != errShellUnavailable {
+			return err
+		}
+	}
+
 	message := fmt.Sprintf(
 		"Press enter to continue.")
 
@@ -78,3 +91,66 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 	}
 	return nil
 }
+
+// errShellUnavailable is returned by shell when the user can't get a shell,
+// and should press enter to continue instead.
+var errShellUnavailable = errors.New("interactive shell unavailable")
+
+// shell runs an interactive shell on the machine, in the terminal of the
+// user. It returns once the shell exits.
+func (p *Provisioner) shell(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	s, ok := comm.(packer.PtyStarter)
+	if !ok {
+		ui.Error("The communicator doesn't support interactive shells.")
+		return errShellUnavailable
+	}
+
+	t, err := openTTY()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error opening terminal for interactive shell: %s", err))
+		return errShellUnavailable
+	}
+	defer t.Close()
+
+	ui.Say("Starting interactive shell. Exit the shell to continue.")
+	err = runShell(ctx, s, t)
+	if err == packer.ErrPtyUnsupported {
+		ui.Error("The communicator doesn't support interactive shells.")
+		return errShellUnavailable
+	}
+	if err != nil {
+		return fmt.Errorf("Error running interactive shell: %s", err)
+	}
+	return nil
+}
+
+// runShell runs the login shell of the communicator user in a pseudo terminal
+// mirroring t, until it exits.
+func runShell(ctx context.Context, s packer.PtyStarter, t terminal) error {
+	size, err := t.Size()
+	if err != nil {
+		return err
+	}
+
+	restore, err := t.MakeRaw()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	resized, stop := t.Resized()
+	defer stop()
+
+	cmd := &packer.RemoteCmd{
+		Stdin:  t,
+		Stdout: t,
+		Stderr: t,
+	}
+	if err := s.StartPty(ctx, cmd, t.Term(), size, resized); err != nil {
+		return err
+	}
+
+	status := cmd.Wait()
+	log.Printf("Interactive shell exited with %d", status)
+	return nil
+}
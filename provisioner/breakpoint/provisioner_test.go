@@ -0,0 +1,282 @@
+package breakpoint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sshcomm "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProvisioner_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &Provisioner{}
+	if _, ok := raw.(packer.Provisioner); !ok {
+		t.Fatalf("must be a Provisioner")
+	}
+}
+
+func TestProvisionerPrepare_shell(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{"shell": true}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.config.Shell {
+		t.Fatal("shell should be set")
+	}
+}
+
+func TestProvisionerProvision_shellUnsupported(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{"shell": true}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &askUi{BasicUi: &packer.BasicUi{Writer: out, ErrorWriter: out}}
+	// A communicator that can't start pseudo terminals
+	comm := struct{ packer.Communicator }{new(packer.MockCommunicator)}
+	if err := p.Provision(context.Background(), ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(out.String(), "doesn't support interactive shells") {
+		t.Fatalf("bad: %s", out.String())
+	}
+	if ui.query != "Press enter to continue." {
+		t.Fatalf("bad: %q", ui.query)
+	}
+}
+
+// askUi is a BasicUi answering every question with enter.
+type askUi struct {
+	*packer.BasicUi
+	query string
+}
+
+func (u *askUi) Ask(query string) (string, error) {
+	u.query = query
+	return "", nil
+}
+
+func TestRunShell(t *testing.T) {
+	comm := newShellComm(t)
+
+	stdinR, stdinW := io.Pipe()
+	term := &testTerminal{
+		Reader:  stdinR,
+		size:    packer.PtySize{Width: 80, Height: 24},
+		resized: make(chan packer.PtySize),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runShell(context.Background(), comm, term)
+	}()
+
+	term.waitOutput(t, "vt100 80x24\r\n")
+	if !term.isRaw() {
+		t.Fatal("terminal should be raw")
+	}
+
+	term.resized <- packer.PtySize{Width: 120, Height: 40}
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintln(stdinW, "size")
+	term.waitOutput(t, "vt100 120x40\r\n")
+
+	fmt.Fprintln(stdinW, "exit")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell should have exited")
+	}
+	if term.isRaw() {
+		t.Fatal("terminal should be restored")
+	}
+}
+
+// testTerminal is a terminal reading from Reader, which records what is
+// written to it.
+type testTerminal struct {
+	io.Reader
+	size    packer.PtySize
+	resized chan packer.PtySize
+
+	l   sync.Mutex
+	out bytes.Buffer
+	raw bool
+}
+
+func (t *testTerminal) Write(p []byte) (int, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.out.Write(p)
+}
+
+func (t *testTerminal) Term() string { return "vt100" }
+
+func (t *testTerminal) Size() (packer.PtySize, error) { return t.size, nil }
+
+func (t *testTerminal) MakeRaw() (func(), error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.raw = true
+	return func() {
+		t.l.Lock()
+		defer t.l.Unlock()
+		t.raw = false
+	}, nil
+}
+
+func (t *testTerminal) Resized() (<-chan packer.PtySize, func()) {
+	return t.resized, func() { close(t.resized) }
+}
+
+func (t *testTerminal) isRaw() bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.raw
+}
+
+func (t *testTerminal) waitOutput(tt *testing.T, want string) {
+	tt.Helper()
+	for i := 0; i < 100; i++ {
+		t.l.Lock()
+		out := t.out.String()
+		t.l.Unlock()
+		if strings.Contains(out, want) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	tt.Fatalf("output %q doesn't contain %q", t.out.String(), want)
+}
+
+// newShellComm connects to an in-process SSH server, whose shell prints the
+// type and size of its pseudo terminal for every line until exit.
+func newShellComm(t *testing.T) packer.PtyStarter {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, serverConfig)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go serveShellSession(channel, requests)
+				}
+			}()
+		}
+	}()
+
+	address := l.Addr().String()
+	comm, err := sshcomm.New(address, &sshcomm.Config{
+		Connection: func() (net.Conn, error) {
+			return net.Dial("tcp", address)
+		},
+		SSHConfig: &ssh.ClientConfig{
+			User:            "user",
+			Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		DisableAgentForwarding: true,
+	})
+	if err != nil {
+		t.Fatalf("error connecting to SSH: %s", err)
+	}
+	return comm
+}
+
+func serveShellSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var l sync.Mutex
+	var term string
+	var cols, rows uint32
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			var payload struct {
+				Term                      string
+				Cols, Rows, Width, Height uint32
+				Modes                     string
+			}
+			ssh.Unmarshal(req.Payload, &payload)
+			l.Lock()
+			term, cols, rows = payload.Term, payload.Cols, payload.Rows
+			l.Unlock()
+			req.Reply(true, nil)
+		case "window-change":
+			var payload struct{ Cols, Rows, Width, Height uint32 }
+			ssh.Unmarshal(req.Payload, &payload)
+			l.Lock()
+			cols, rows = payload.Cols, payload.Rows
+			l.Unlock()
+		case "shell":
+			req.Reply(true, nil)
+			go func() {
+				scanner := bufio.NewScanner(channel)
+				for {
+					l.Lock()
+					fmt.Fprintf(channel, "%s %dx%d\r\n", term, cols, rows)
+					l.Unlock()
+					if !scanner.Scan() || scanner.Text() == "exit" {
+						break
+					}
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				channel.Close()
+			}()
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
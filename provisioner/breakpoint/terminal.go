@@ -0,0 +1,117 @@
+package breakpoint
+
+import (
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/hashicorp/packer/packer"
+	sshterminal "golang.org/x/crypto/ssh/terminal"
+)
+
+// terminal is the terminal of the user an interactive shell runs in.
+type terminal interface {
+	io.ReadWriter
+
+	// Term returns the type of the terminal, like xterm.
+	Term() string
+
+	// Size returns the current size of the terminal.
+	Size() (packer.PtySize, error)
+
+	// MakeRaw puts the terminal in raw mode, and returns a function
+	// restoring its previous mode.
+	MakeRaw() (restore func(), err error)
+
+	// Resized returns a channel receiving the size of the terminal every
+	// time it is resized. The channel is closed once stop is called.
+	Resized() (resized <-chan packer.PtySize, stop func())
+}
+
+// tty is the controlling terminal of the process.
+type tty struct {
+	*os.File
+}
+
+func (t *tty) Term() string {
+	if term := os.Getenv("TERM"); term != "" {
+		return term
+	}
+	return "xterm"
+}
+
+func (t *tty) Size() (packer.PtySize, error) {
+	var size packer.PtySize
+	err := t.control(func(fd int) (err error) {
+		size.Width, size.Height, err = sshterminal.GetSize(fd)
+		return err
+	})
+	return size, err
+}
+
+func (t *tty) MakeRaw() (func(), error) {
+	var state *sshterminal.State
+	err := t.control(func(fd int) (err error) {
+		state, err = sshterminal.MakeRaw(fd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		t.control(func(fd int) error {
+			return sshterminal.Restore(fd, state)
+		})
+	}, nil
+}
+
+func (t *tty) Resized() (<-chan packer.PtySize, func()) {
+	sigCh := make(chan os.Signal, 1)
+	notifyResize(sigCh)
+
+	resized := make(chan packer.PtySize)
+	done := make(chan struct{})
+	go func() {
+		defer close(resized)
+		for {
+			select {
+			case <-sigCh:
+			case <-done:
+				return
+			}
+
+			size, err := t.Size()
+			if err != nil {
+				continue
+			}
+			select {
+			case resized <- size:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return resized, func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
+
+// control runs f with the file descriptor of the terminal. Unlike Fd, it
+// keeps the file non blocking, so that closing it interrupts pending reads.
+func (t *tty) control(f func(fd int) error) error {
+	rc, err := t.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package breakpoint
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// openTTY opens the controlling terminal of the process. Packer may have
+// closed stdin, so it isn't used.
+func openTTY() (*tty, error) {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &tty{f}, nil
+}
+
+func notifyResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
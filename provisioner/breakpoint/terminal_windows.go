@@ -0,0 +1,14 @@
+package breakpoint
+
+import (
+	"errors"
+	"os"
+)
+
+func openTTY() (*tty, error) {
+	return nil, errors.New("interactive shells are not supported on Windows")
+}
+
+// The console is not notified of resizes, the size of the pseudo terminal
+// is the one it had when the shell started.
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,119 @@
+package chefsolo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The command exporting a Policyfile lock to a local repository
+var chefCommand = "chef"
+
+// exportPolicy prepares the chef repository of the configured policy,
+// exporting or extracting it to the local directory dir if needed. It
+// returns the path of the repository and the name of the policy.
+func (p *Provisioner) exportPolicy(dir string) (string, string, error) {
+	switch {
+	case p.config.PolicyfileLock != "":
+		cmd := exec.Command(chefCommand, "export", p.config.PolicyfileLock, dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", "", fmt.Errorf("Error running %s: %s\n%s",
+				strings.Join(cmd.Args, " "), err, out)
+		}
+	default:
+		fi, err := os.Stat(p.config.PolicyArchive)
+		if err != nil {
+			return "", "", err
+		}
+		if fi.IsDir() {
+			// Already exported without --archive
+			dir = p.config.PolicyArchive
+		} else if err := extractPolicyArchive(p.config.PolicyArchive, dir); err != nil {
+			return "", "", fmt.Errorf("Error extracting policy archive: %s", err)
+		}
+	}
+
+	name, err := policyName(dir)
+	if err != nil {
+		return "", "", err
+	}
+	return dir, name, nil
+}
+
+// policyName reads the name of the policy exported to dir from its lock.
+func policyName(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "Policyfile.lock.json"))
+	if err != nil {
+		return "", err
+	}
+
+	var lock struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return "", fmt.Errorf("Error parsing Policyfile.lock.json: %s", err)
+	}
+	if lock.Name == "" {
+		return "", fmt.Errorf("Policyfile.lock.json has no policy name")
+	}
+	return lock.Name, nil
+}
+
+// extractPolicyArchive extracts an archive created with chef export
+// --archive to dir.
+func extractPolicyArchive(archive string, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if path != filepath.Clean(dir) && !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s is outside of the archive", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
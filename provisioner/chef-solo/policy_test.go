@@ -0,0 +1,224 @@
+package chefsolo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// policyCommunicator records the commands, uploads and directory uploads of
+// a policy run.
+type policyCommunicator struct {
+	packer.MockCommunicator
+
+	commands []string
+	uploads  map[string]string
+	dirs     map[string][]string
+}
+
+func (c *policyCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.commands = append(c.commands, cmd.Command)
+	return c.MockCommunicator.Start(ctx, cmd)
+}
+
+func (c *policyCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.uploads[path] = string(data)
+	return nil
+}
+
+func (c *policyCommunicator) UploadDir(dst string, src string, excl []string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		c.dirs[dst] = append(c.dirs[dst], filepath.ToSlash(rel))
+		return err
+	})
+}
+
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	}
+}
+
+func newPolicyCommunicator() *policyCommunicator {
+	return &policyCommunicator{
+		uploads: make(map[string]string),
+		dirs:    make(map[string][]string),
+	}
+}
+
+func testPolicyArchive(t *testing.T) string {
+	f, err := ioutil.TempFile("", "packer-chef-policy")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	lock, err := ioutil.ReadFile("test-fixtures/Policyfile.lock.json")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files := map[string]string{
+		"Policyfile.lock.json":                     string(lock),
+		"policies/base-4f1a6b9e0c2d.json":          string(lock),
+		"cookbook_artifacts/base-1234/metadata.rb": "name 'base'",
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return f.Name()
+}
+
+func TestProvisionerPrepare_policy(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["policyfile_lock"] = "test-fixtures/Policyfile.lock.json"
+
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(p.config.ExecuteCommand, "chef-client --local-mode") {
+		t.Fatalf("unexpected execute command: %s", p.config.ExecuteCommand)
+	}
+
+	p = Provisioner{}
+	config["policy_archive"] = "test-fixtures"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	p = Provisioner{}
+	delete(config, "policy_archive")
+	config["run_list"] = []string{"recipe[base]"}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	p = Provisioner{}
+	config = testConfig()
+	config["policy_archive"] = "/does/not/exist.tgz"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_policyArchive(t *testing.T) {
+	archive := testPolicyArchive(t)
+	defer os.Remove(archive)
+
+	var p Provisioner
+	config := testConfig()
+	config["policy_archive"] = archive
+	config["skip_install"] = true
+	config["json"] = map[string]interface{}{"foo": "bar"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := newPolicyCommunicator()
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := comm.dirs["/tmp/packer-chef-solo/policy"]
+	if len(files) != 3 {
+		t.Fatalf("bad policy upload: %#v", comm.dirs)
+	}
+
+	clientRb := comm.uploads["/tmp/packer-chef-solo/client.rb"]
+	for _, line := range []string{
+		`chef_repo_path "/tmp/packer-chef-solo/policy"`,
+		`policy_name "base"`,
+		`policy_group "local"`,
+		`use_policyfile true`,
+	} {
+		if !strings.Contains(clientRb, line) {
+			t.Fatalf("missing %q in config:\n%s", line, clientRb)
+		}
+	}
+	if json := comm.uploads["/tmp/packer-chef-solo/node.json"]; strings.Contains(json, "run_list") {
+		t.Fatalf("bad node json: %s", json)
+	}
+
+	// The previous policy is removed first, and the staging directory last
+	expected := []string{
+		"mkdir -p '/tmp/packer-chef-solo'",
+		"chmod 0777 '/tmp/packer-chef-solo'",
+		"rm -rf '/tmp/packer-chef-solo/policy'",
+		"mkdir -p '/tmp/packer-chef-solo/policy'",
+		"chmod 0777 '/tmp/packer-chef-solo/policy'",
+		"chef-client --local-mode --no-color -c /tmp/packer-chef-solo/client.rb -j /tmp/packer-chef-solo/node.json",
+		"rm -rf '/tmp/packer-chef-solo'",
+	}
+	if len(comm.commands) != len(expected) {
+		t.Fatalf("bad commands: %#v", comm.commands)
+	}
+	for i, cmd := range comm.commands {
+		if !strings.HasSuffix(cmd, expected[i]) {
+			t.Fatalf("bad command %d: %s", i, cmd)
+		}
+	}
+}
+
+func TestProvisionerProvision_policyfileLock(t *testing.T) {
+	chefCommand = "test-fixtures/chef"
+	defer func() { chefCommand = "chef" }()
+
+	var p Provisioner
+	config := testConfig()
+	config["policyfile_lock"] = "test-fixtures/Policyfile.lock.json"
+	config["skip_install"] = true
+	config["skip_clean_staging_directory"] = true
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := newPolicyCommunicator()
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if files := comm.dirs["/tmp/packer-chef-solo/policy"]; len(files) != 1 || files[0] != "Policyfile.lock.json" {
+		t.Fatalf("bad policy upload: %#v", comm.dirs)
+	}
+	if !strings.Contains(comm.uploads["/tmp/packer-chef-solo/client.rb"], `policy_name "base"`) {
+		t.Fatalf("bad config: %s", comm.uploads["/tmp/packer-chef-solo/client.rb"])
+	}
+	last := comm.commands[len(comm.commands)-1]
+	if !strings.Contains(last, "chef-client") {
+		t.Fatalf("staging directory should be kept: %#v", comm.commands)
+	}
+}
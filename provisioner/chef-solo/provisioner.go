@@ -21,21 +21,24 @@ import (
 )
 
 type guestOSTypeConfig struct {
-	executeCommand string
-	installCommand string
-	stagingDir     string
+	executeCommand       string
+	policyExecuteCommand string
+	installCommand       string
+	stagingDir           string
 }
 
 var guestOSTypeConfigs = map[string]guestOSTypeConfig{
 	provisioner.UnixOSType: {
-		executeCommand: "{{if .Sudo}}sudo {{end}}chef-solo --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
-		installCommand: "curl -L https://omnitruck.chef.io/install.sh | {{if .Sudo}}sudo {{end}}bash -s --{{if .Version}} -v {{.Version}}{{end}}",
-		stagingDir:     "/tmp/packer-chef-solo",
+		executeCommand:       "{{if .Sudo}}sudo {{end}}chef-solo --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
+		policyExecuteCommand: "{{if .Sudo}}sudo {{end}}chef-client --local-mode --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
+		installCommand:       "curl -L https://omnitruck.chef.io/install.sh | {{if .Sudo}}sudo {{end}}bash -s --{{if .Version}} -v {{.Version}}{{end}}",
+		stagingDir:           "/tmp/packer-chef-solo",
 	},
 	provisioner.WindowsOSType: {
-		executeCommand: "c:/opscode/chef/bin/chef-solo.bat --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
-		installCommand: "powershell.exe -Command \". { iwr -useb https://omnitruck.chef.io/install.ps1 } | iex; Install-Project{{if .Version}} -version {{.Version}}{{end}}\"",
-		stagingDir:     "C:/Windows/Temp/packer-chef-solo",
+		executeCommand:       "c:/opscode/chef/bin/chef-solo.bat --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
+		policyExecuteCommand: "c:/opscode/chef/bin/chef-client.bat --local-mode --no-color -c {{.ConfigPath}} -j {{.JsonPath}}",
+		installCommand:       "powershell.exe -Command \". { iwr -useb https://omnitruck.chef.io/install.ps1 } | iex; Install-Project{{if .Version}} -version {{.Version}}{{end}}\"",
+		stagingDir:           "C:/Windows/Temp/packer-chef-solo",
 	},
 }
 
@@ -54,9 +57,12 @@ type Config struct {
 	InstallCommand             string   `mapstructure:"install_command"`
 	RemoteCookbookPaths        []string `mapstructure:"remote_cookbook_paths"`
 	Json                       map[string]interface{}
+	PolicyArchive              string   `mapstructure:"policy_archive"`
+	PolicyfileLock             string   `mapstructure:"policyfile_lock"`
 	PreventSudo                bool     `mapstructure:"prevent_sudo"`
 	RunList                    []string `mapstructure:"run_list"`
 	SkipInstall                bool     `mapstructure:"skip_install"`
+	SkipCleanStagingDirectory  bool     `mapstructure:"skip_clean_staging_directory"`
 	StagingDir                 string   `mapstructure:"staging_directory"`
 	GuestOSType                string   `mapstructure:"guest_os_type"`
 	Version                    string   `mapstructure:"version"`
@@ -78,6 +84,8 @@ type ConfigTemplate struct {
 	EnvironmentsPath           string
 	ChefEnvironment            string
 	ChefLicense                string
+	PolicyPath                 string
+	PolicyName                 string
 
 	// Templates don't support boolean statements until Go 1.2. In the
 	// mean time, we do this.
@@ -132,6 +140,9 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 
 	if p.config.ExecuteCommand == "" {
 		p.config.ExecuteCommand = p.guestOSTypeConfig.executeCommand
+		if p.policyMode() {
+			p.config.ExecuteCommand = p.guestOSTypeConfig.policyExecuteCommand
+		}
 	}
 
 	if p.config.InstallCommand == "" {
@@ -164,6 +175,39 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if p.config.PolicyArchive != "" && p.config.PolicyfileLock != "" {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Only one of policy_archive or policyfile_lock can be specified."))
+	}
+
+	if p.config.PolicyArchive != "" {
+		if _, err := os.Stat(p.config.PolicyArchive); err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Bad policy archive '%s': %s", p.config.PolicyArchive, err))
+		}
+	}
+
+	if p.config.PolicyfileLock != "" {
+		pFileInfo, err := os.Stat(p.config.PolicyfileLock)
+
+		if err != nil || pFileInfo.IsDir() {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Bad Policyfile lock '%s': %s", p.config.PolicyfileLock, err))
+		}
+	}
+
+	// The policy replaces the run list and the cookbooks, roles and
+	// environments
+	if p.policyMode() {
+		if len(p.config.RunList) > 0 || len(p.config.CookbookPaths) > 0 ||
+			len(p.config.RemoteCookbookPaths) > 0 || p.config.RolesPath != "" ||
+			p.config.EnvironmentsPath != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf(
+				"run_list, cookbook_paths, remote_cookbook_paths, roles_path and "+
+					"environments_path can't be used with a policy."))
+		}
+	}
+
 	for _, path := range p.config.CookbookPaths {
 		pFileInfo, err := os.Stat(path)
 
@@ -249,6 +293,10 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		return fmt.Errorf("Error creating staging directory: %s", err)
 	}
 
+	if p.policyMode() {
+		return p.provisionPolicy(ui, comm)
+	}
+
 	cookbookPaths := make([]string, 0, len(p.config.CookbookPaths))
 	for i, path := range p.config.CookbookPaths {
 		targetPath := fmt.Sprintf("%s/cookbooks-%d", p.config.StagingDir, i)
@@ -308,6 +356,75 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 	return nil
 }
 
+// policyMode tells if the provisioner runs a Policyfile with chef-client in
+// local mode instead of chef-solo.
+func (p *Provisioner) policyMode() bool {
+	return p.config.PolicyArchive != "" || p.config.PolicyfileLock != ""
+}
+
+func (p *Provisioner) provisionPolicy(ui packer.Ui, comm packer.Communicator) (err error) {
+	if !p.config.SkipCleanStagingDirectory {
+		defer func() {
+			if rerr := p.removeDir(ui, comm, p.config.StagingDir); rerr != nil && err == nil {
+				err = fmt.Errorf("Error removing staging directory: %s", rerr)
+			}
+		}()
+	}
+
+	tmp, err := ioutil.TempDir("", "packer-chef-policy")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	ui.Message("Exporting policy")
+	localPolicyPath, policyName, err := p.exportPolicy(filepath.Join(tmp, "policy"))
+	if err != nil {
+		return fmt.Errorf("Error exporting policy: %s", err)
+	}
+
+	// Start from a clean repository on every run, chef-client adds the node
+	// and its cache to it
+	policyPath := fmt.Sprintf("%s/policy", p.config.StagingDir)
+	if err := p.removeDir(ui, comm, policyPath); err != nil {
+		return fmt.Errorf("Error removing previous policy: %s", err)
+	}
+	if err := p.uploadDirectory(ui, comm, policyPath, localPolicyPath); err != nil {
+		return fmt.Errorf("Error uploading policy: %s", err)
+	}
+
+	encryptedDataBagSecretPath := ""
+	if p.config.EncryptedDataBagSecretPath != "" {
+		encryptedDataBagSecretPath = fmt.Sprintf("%s/encrypted_data_bag_secret", p.config.StagingDir)
+		if err := p.uploadFile(ui, comm, encryptedDataBagSecretPath, p.config.EncryptedDataBagSecretPath); err != nil {
+			return fmt.Errorf("Error uploading encrypted data bag secret: %s", err)
+		}
+	}
+
+	p.config.ctx.Data = &ConfigTemplate{
+		PolicyPath:                    policyPath,
+		PolicyName:                    policyName,
+		EncryptedDataBagSecretPath:    encryptedDataBagSecretPath,
+		HasEncryptedDataBagSecretPath: encryptedDataBagSecretPath != "",
+		ChefLicense:                   p.config.ChefLicense,
+	}
+	configPath, err := p.uploadConfig(ui, comm, "client.rb", DefaultPolicyConfigTemplate)
+	if err != nil {
+		return fmt.Errorf("Error creating Chef config file: %s", err)
+	}
+
+	jsonPath, err := p.createJson(ui, comm)
+	if err != nil {
+		return fmt.Errorf("Error creating JSON attributes: %s", err)
+	}
+
+	if err := p.executeChef(ui, comm, configPath, jsonPath); err != nil {
+		return fmt.Errorf("Error executing Chef: %s", err)
+	}
+
+	return nil
+}
+
 func (p *Provisioner) uploadDirectory(ui packer.Ui, comm packer.Communicator, dst string, src string) error {
 	if err := p.createDir(ui, comm, dst); err != nil {
 		return err
@@ -345,8 +462,27 @@ func (p *Provisioner) createConfig(ui packer.Ui, comm packer.Communicator, local
 		cookbook_paths[i] = fmt.Sprintf(`"%s"`, path)
 	}
 
+	p.config.ctx.Data = &ConfigTemplate{
+		CookbookPaths:                 strings.Join(cookbook_paths, ","),
+		RolesPath:                     rolesPath,
+		DataBagsPath:                  dataBagsPath,
+		EncryptedDataBagSecretPath:    encryptedDataBagSecretPath,
+		EnvironmentsPath:              environmentsPath,
+		HasRolesPath:                  rolesPath != "",
+		HasDataBagsPath:               dataBagsPath != "",
+		HasEncryptedDataBagSecretPath: encryptedDataBagSecretPath != "",
+		HasEnvironmentsPath:           environmentsPath != "",
+		ChefEnvironment:               chefEnvironment,
+		ChefLicense:                   chefLicense,
+	}
+	return p.uploadConfig(ui, comm, "solo.rb", DefaultConfigTemplate)
+}
+
+// uploadConfig renders the config template, or defaultTpl if there is none,
+// with the current template data and uploads it to the staging directory.
+func (p *Provisioner) uploadConfig(ui packer.Ui, comm packer.Communicator, name string, defaultTpl string) (string, error) {
 	// Read the template
-	tpl := DefaultConfigTemplate
+	tpl := defaultTpl
 	if p.config.ConfigTemplate != "" {
 		f, err := os.Open(p.config.ConfigTemplate)
 		if err != nil {
@@ -362,25 +498,12 @@ func (p *Provisioner) createConfig(ui packer.Ui, comm packer.Communicator, local
 		tpl = string(tplBytes)
 	}
 
-	p.config.ctx.Data = &ConfigTemplate{
-		CookbookPaths:                 strings.Join(cookbook_paths, ","),
-		RolesPath:                     rolesPath,
-		DataBagsPath:                  dataBagsPath,
-		EncryptedDataBagSecretPath:    encryptedDataBagSecretPath,
-		EnvironmentsPath:              environmentsPath,
-		HasRolesPath:                  rolesPath != "",
-		HasDataBagsPath:               dataBagsPath != "",
-		HasEncryptedDataBagSecretPath: encryptedDataBagSecretPath != "",
-		HasEnvironmentsPath:           environmentsPath != "",
-		ChefEnvironment:               chefEnvironment,
-		ChefLicense:                   chefLicense,
-	}
 	configString, err := interpolate.Render(tpl, &p.config.ctx)
 	if err != nil {
 		return "", err
 	}
 
-	remotePath := filepath.ToSlash(filepath.Join(p.config.StagingDir, "solo.rb"))
+	remotePath := filepath.ToSlash(filepath.Join(p.config.StagingDir, name))
 	if err := comm.Upload(remotePath, bytes.NewReader([]byte(configString)), nil); err != nil {
 		return "", err
 	}
@@ -441,6 +564,21 @@ func (p *Provisioner) createDir(ui packer.Ui, comm packer.Communicator, dir stri
 	return nil
 }
 
+func (p *Provisioner) removeDir(ui packer.Ui, comm packer.Communicator, dir string) error {
+	ui.Message(fmt.Sprintf("Removing directory: %s", dir))
+	ctx := context.TODO()
+
+	cmd := &packer.RemoteCmd{Command: p.guestCommands.RemoveDir(dir)}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+	if cmd.ExitStatus() != 0 {
+		return fmt.Errorf("Non-zero exit status. See output above for more info.")
+	}
+
+	return nil
+}
+
 func (p *Provisioner) executeChef(ui packer.Ui, comm packer.Communicator, config string, json string) error {
 	p.config.ctx.Data = &ExecuteTemplate{
 		ConfigPath: config,
@@ -594,3 +732,16 @@ environment_path "{{.EnvironmentsPath}}"
 environment "{{.ChefEnvironment}}"
 {{end}}
 `
+
+var DefaultPolicyConfigTemplate = `
+chef_license "{{.ChefLicense}}"
+local_mode true
+chef_repo_path "{{.PolicyPath}}"
+use_policyfile true
+policy_document_native_api true
+policy_group "local"
+policy_name "{{.PolicyName}}"
+{{if .HasEncryptedDataBagSecretPath}}
+encrypted_data_bag_secret "{{.EncryptedDataBagSecretPath}}"
+{{end}}
+`
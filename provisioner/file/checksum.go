@@ -0,0 +1,143 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// verifyFile compares the SHA256 checksum of the file at path on the
+// machine with sum, the checksum of the local side of the transfer.
+func (p *Provisioner) verifyFile(ctx context.Context, ui packer.Ui, comm packer.Communicator, path string, sum string) error {
+	out, err := p.runChecksumCommand(ctx, comm, p.guestCommands.Sha256(path))
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return fmt.Errorf("Unexpected output computing the checksum of %s: %q", path, out)
+	}
+	if remote := strings.ToLower(fields[0]); remote != sum {
+		return fmt.Errorf("Checksum mismatch for %s: %s locally, %s on the machine", path, sum, remote)
+	}
+
+	ui.Message(fmt.Sprintf("Verified the checksum of %s", path))
+	return nil
+}
+
+// verifyDir compares the SHA256 checksums of the files of the local
+// directory with the ones of the remote directory. Every file of the source
+// side, the local one if upload is true, must have a matching copy on the
+// other side.
+func (p *Provisioner) verifyDir(ctx context.Context, ui packer.Ui, comm packer.Communicator, local string, remote string, upload bool) error {
+	localSums, err := localChecksums(local)
+	if err != nil {
+		return err
+	}
+	remoteSums, err := p.remoteChecksums(ctx, comm, remote)
+	if err != nil {
+		return err
+	}
+
+	src, dst := remoteSums, localSums
+	if upload {
+		src, dst = localSums, remoteSums
+	}
+	for rel, sum := range src {
+		got, ok := dst[rel]
+		if !ok {
+			return fmt.Errorf("Checksum mismatch for %s: the file wasn't transferred", rel)
+		}
+		if got != sum {
+			return fmt.Errorf("Checksum mismatch for %s: %s locally, %s on the machine",
+				rel, localSums[rel], remoteSums[rel])
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Verified the checksums of %d files in %s", len(src), remote))
+	return nil
+}
+
+// remoteChecksums returns the SHA256 checksums of the files below the
+// directory dir on the machine, by path relative to it.
+func (p *Provisioner) remoteChecksums(ctx context.Context, comm packer.Communicator, dir string) (map[string]string, error) {
+	if dir != "/" {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	out, err := p.runChecksumCommand(ctx, comm, p.guestCommands.Sha256Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/"
+	sums := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "  ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		rel := strings.Replace(parts[1], "\\", "/", -1)
+		rel = strings.TrimPrefix(rel, prefix)
+		rel = strings.TrimPrefix(rel, "./")
+		sums[rel] = strings.ToLower(parts[0])
+	}
+	return sums, nil
+}
+
+func (p *Provisioner) runChecksumCommand(ctx context.Context, comm packer.Communicator, command string) (string, error) {
+	var out, outErr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  &out,
+		Stderr:  &outErr,
+	}
+
+	if err := comm.Start(ctx, cmd); err != nil {
+		return "", fmt.Errorf("Error computing checksums: %s", err)
+	}
+
+	cmd.Wait()
+	if cmd.ExitStatus() != 0 {
+		return "", fmt.Errorf("Error computing checksums, exit status %d: %s",
+			cmd.ExitStatus(), strings.TrimSpace(outErr.String()))
+	}
+	return out.String(), nil
+}
+
+// localChecksums returns the SHA256 checksums of the files below the local
+// directory dir, by slash separated path relative to it.
+func localChecksums(dir string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return sums, err
+}
@@ -1,17 +1,24 @@
 package file
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/provisioner"
 	"github.com/hashicorp/packer/template/interpolate"
 )
 
@@ -31,11 +38,47 @@ type Config struct {
 	// False if the sources have to exist.
 	Generated bool
 
+	// How directories are uploaded: "full" uploads every file, "delta" only
+	// the files that changed, and "tar" a compressed tarball.
+	UploadMode string `mapstructure:"upload_mode"`
+
+	// Render the source files as templates, with the user variables,
+	// build_name and build_type available, before uploading them.
+	Template bool `mapstructure:"template"`
+
+	// The content of the file to upload, instead of a source.
+	Content string `mapstructure:"content"`
+
+	// The permissions and owner set on the uploaded files with chmod and
+	// chown.
+	Mode  string `mapstructure:"mode"`
+	Owner string `mapstructure:"owner"`
+
+	// Run chmod and chown with sudo, since only root can usually change the
+	// owner of a file.
+	UseSudo bool `mapstructure:"use_sudo"`
+
+	// Compare the SHA256 checksums of the files on both sides after each
+	// transfer.
+	VerifyChecksum bool `mapstructure:"verify_checksum"`
+
+	// The OS of the machine, which decides how checksums are computed
+	// there.
+	GuestOSType string `mapstructure:"guest_os_type"`
+
 	ctx interpolate.Context
 }
 
+// ErrContentSourceConflict is returned when both content and a source are
+// given.
+var ErrContentSourceConflict = errors.New("Cannot specify source file AND content")
+
+// modeRe matches the octal and symbolic modes understood by chmod.
+var modeRe = regexp.MustCompile(`^([0-7]{3,4}|[ugoa]*[-+=][rwxXst]*(,[ugoa]*[-+=][rwxXst]*)*)$`)
+
 type Provisioner struct {
-	config Config
+	config        Config
+	guestCommands *provisioner.GuestCommands
 }
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
@@ -54,30 +97,91 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.Direction = "upload"
 	}
 
+	if p.config.UploadMode == "" {
+		p.config.UploadMode = packer.UploadDirFull
+	}
+
+	if p.config.GuestOSType == "" {
+		p.config.GuestOSType = provisioner.DefaultOSType
+	}
+	p.config.GuestOSType = strings.ToLower(p.config.GuestOSType)
+
 	var errs *packer.MultiError
 
+	p.guestCommands, err = provisioner.NewGuestCommands(p.config.GuestOSType, p.config.UseSudo)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
 	if p.config.Direction != "download" && p.config.Direction != "upload" {
 		errs = packer.MultiErrorAppend(errs,
 			errors.New("Direction must be one of: download, upload."))
 	}
+
+	switch p.config.UploadMode {
+	case packer.UploadDirFull, packer.UploadDirDelta, packer.UploadDirTar:
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("upload_mode must be one of: full, delta, tar."))
+	}
 	if p.config.Source != "" {
 		p.config.Sources = append(p.config.Sources, p.config.Source)
 	}
 
 	if p.config.Direction == "upload" {
 		for _, src := range p.config.Sources {
-			if _, err := os.Stat(src); p.config.Generated == false && err != nil {
+			info, err := os.Stat(src)
+			if p.config.Generated == false && err != nil {
 				errs = packer.MultiErrorAppend(errs,
 					fmt.Errorf("Bad source '%s': %s", src, err))
+			} else if err == nil && info.IsDir() && p.config.Template {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad source '%s': only files can be templates", src))
 			}
 		}
 	}
 
-	if len(p.config.Sources) < 1 {
+	if p.config.Content != "" {
+		if len(p.config.Sources) > 0 {
+			errs = packer.MultiErrorAppend(errs, ErrContentSourceConflict)
+		}
+		if p.config.Direction != "upload" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Content can only be uploaded."))
+		}
+		if strings.HasSuffix(p.config.Destination, "/") {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Destination must be a file path when uploading content."))
+		}
+	} else if len(p.config.Sources) < 1 {
 		errs = packer.MultiErrorAppend(errs,
 			errors.New("Source must be specified."))
 	}
 
+	if (p.config.Mode != "" || p.config.Owner != "") && p.config.Direction != "upload" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Mode and owner can only be set when uploading."))
+	}
+
+	if (p.config.Mode != "" || p.config.Owner != "") && p.config.GuestOSType == provisioner.WindowsOSType {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Mode and owner can't be set on Windows guests."))
+	}
+
+	if p.config.VerifyChecksum && p.config.Direction == "download" {
+		for _, src := range p.config.Sources {
+			if strings.ContainsAny(src, "*?[") {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad source '%s': the checksums of wildcard downloads can't be verified", src))
+			}
+		}
+	}
+
+	if p.config.Mode != "" && !modeRe.MatchString(p.config.Mode) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Bad mode '%s': must be an octal or symbolic chmod mode", p.config.Mode))
+	}
+
 	if p.config.Destination == "" {
 		errs = packer.MultiErrorAppend(errs,
 			errors.New("Destination must be specified."))
@@ -92,13 +196,15 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 
 func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
 	if p.config.Direction == "download" {
-		return p.ProvisionDownload(ui, comm)
+		return p.ProvisionDownload(ctx, ui, comm)
+	} else if p.config.Content != "" {
+		return p.provisionContent(ctx, ui, comm)
 	} else {
-		return p.ProvisionUpload(ui, comm)
+		return p.ProvisionUpload(ctx, ui, comm)
 	}
 }
 
-func (p *Provisioner) ProvisionDownload(ui packer.Ui, comm packer.Communicator) error {
+func (p *Provisioner) ProvisionDownload(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
 	for _, src := range p.config.Sources {
 		dst := p.config.Destination
 		ui.Say(fmt.Sprintf("Downloading %s => %s", src, dst))
@@ -118,7 +224,18 @@ func (p *Provisioner) ProvisionDownload(ui packer.Ui, comm packer.Communicator)
 		}
 		// if the src was a dir, download the dir
 		if strings.HasSuffix(src, "/") || strings.ContainsAny(src, "*?[") {
-			return comm.DownloadDir(src, dst, nil)
+			if err := comm.DownloadDir(src, dst, nil); err != nil {
+				return err
+			}
+			if p.config.VerifyChecksum {
+				// The directory itself is downloaded into the destination
+				root := filepath.Join(dst, path.Base(src))
+				if info, err := os.Stat(root); err != nil || !info.IsDir() {
+					root = dst
+				}
+				return p.verifyDir(ctx, ui, comm, root, src, false)
+			}
+			return nil
 		}
 
 		f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
@@ -128,18 +245,25 @@ func (p *Provisioner) ProvisionDownload(ui packer.Ui, comm packer.Communicator)
 		defer f.Close()
 
 		// Create MultiWriter for the current progress
-		pf := io.MultiWriter(f)
+		h := sha256.New()
+		pf := io.MultiWriter(f, h)
 
 		// Download the file
 		if err = comm.Download(src, pf); err != nil {
 			ui.Error(fmt.Sprintf("Download failed: %s", err))
 			return err
 		}
+
+		if p.config.VerifyChecksum {
+			if err := p.verifyFile(ctx, ui, comm, src, hex.EncodeToString(h.Sum(nil))); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func (p *Provisioner) ProvisionUpload(ui packer.Ui, comm packer.Communicator) error {
+func (p *Provisioner) ProvisionUpload(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
 	for _, src := range p.config.Sources {
 		dst := p.config.Destination
 
@@ -152,7 +276,24 @@ func (p *Provisioner) ProvisionUpload(ui packer.Ui, comm packer.Communicator) er
 
 		// If we're uploading a directory, short circuit and do that
 		if info.IsDir() {
-			return comm.UploadDir(p.config.Destination, src, nil)
+			if err := p.uploadDir(ui, comm, src); err != nil {
+				return err
+			}
+
+			// Without a trailing slash the directory itself is uploaded
+			root := dst
+			if !strings.HasSuffix(src, "/") {
+				root = path.Join(dst, filepath.Base(src))
+			}
+			if p.config.VerifyChecksum {
+				if err := p.verifyDir(ctx, ui, comm, src, root, true); err != nil {
+					return err
+				}
+			}
+			if err := p.setPermissions(ctx, ui, comm, root, true); err != nil {
+				return err
+			}
+			continue
 		}
 
 		// We're uploading a file...
@@ -171,11 +312,28 @@ func (p *Provisioner) ProvisionUpload(ui packer.Ui, comm packer.Communicator) er
 			dst = dst + filepath.Base(src)
 		}
 
-		pf := ui.TrackProgress(filepath.Base(src), 0, info.Size(), f)
+		var r io.ReadCloser = f
+		size := info.Size()
+		if p.config.Template {
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			rendered, err := interpolate.Render(string(data), &p.config.ctx)
+			if err != nil {
+				return fmt.Errorf("Error rendering template %s: %s", src, err)
+			}
+			r = ioutil.NopCloser(strings.NewReader(rendered))
+			size = int64(len(rendered))
+			fi = &renderedFileInfo{FileInfo: fi, size: size}
+		}
+
+		pf := ui.TrackProgress(filepath.Base(src), 0, size, r)
 		defer pf.Close()
 
 		// Upload the file
-		if err = comm.Upload(dst, pf, &fi); err != nil {
+		h := sha256.New()
+		if err = comm.Upload(dst, io.TeeReader(pf, h), &fi); err != nil {
 			if strings.Contains(err.Error(), "Error restoring file") {
 				ui.Error(fmt.Sprintf("Upload failed: %s; this can occur when "+
 					"your file destination is a folder without a trailing "+
@@ -184,6 +342,105 @@ func (p *Provisioner) ProvisionUpload(ui packer.Ui, comm packer.Communicator) er
 			ui.Error(fmt.Sprintf("Upload failed: %s", err))
 			return err
 		}
+
+		if p.config.VerifyChecksum {
+			if err := p.verifyFile(ctx, ui, comm, dst, hex.EncodeToString(h.Sum(nil))); err != nil {
+				return err
+			}
+		}
+
+		if err := p.setPermissions(ctx, ui, comm, dst, false); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// provisionContent uploads the inline content to the destination.
+func (p *Provisioner) provisionContent(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	dst := p.config.Destination
+	ui.Say(fmt.Sprintf("Uploading content => %s", dst))
+
+	if err := comm.Upload(dst, bytes.NewBufferString(p.config.Content), nil); err != nil {
+		ui.Error(fmt.Sprintf("Upload failed: %s", err))
+		return err
+	}
+
+	if p.config.VerifyChecksum {
+		sum := sha256.Sum256([]byte(p.config.Content))
+		if err := p.verifyFile(ctx, ui, comm, dst, hex.EncodeToString(sum[:])); err != nil {
+			return err
+		}
+	}
+
+	return p.setPermissions(ctx, ui, comm, dst, false)
+}
+
+// setPermissions sets the configured mode and owner of the uploaded path,
+// recursively if it is a directory.
+func (p *Provisioner) setPermissions(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, recursive bool) error {
+	flags := ""
+	if recursive {
+		flags = "-R "
+	}
+
+	var commands []string
+	if p.config.Mode != "" {
+		commands = append(commands, fmt.Sprintf("chmod %s%s %s", flags, p.config.Mode, shellQuote(dst)))
+	}
+	if p.config.Owner != "" {
+		commands = append(commands, fmt.Sprintf("chown %s%s %s", flags, shellQuote(p.config.Owner), shellQuote(dst)))
+	}
+
+	for _, command := range commands {
+		command = p.guestCommands.WithSudo(command)
+		cmd := &packer.RemoteCmd{Command: command}
+		if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+			return err
+		}
+		if cmd.ExitStatus() != 0 {
+			err := fmt.Errorf(
+				"Non-zero exit status running '%s': %d", command, cmd.ExitStatus())
+			if !p.config.UseSudo {
+				err = fmt.Errorf("%s. Set use_sudo if the user Packer connects as "+
+					"isn't allowed to change the mode or owner", err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single argument of a unix shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// renderedFileInfo is the FileInfo of a source file rendered as a template,
+// whose size is the one of the rendered content.
+type renderedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *renderedFileInfo) Size() int64 {
+	return fi.size
+}
+
+// uploadDir uploads the directory src in the configured mode, or every file
+// if the communicator doesn't support it.
+func (p *Provisioner) uploadDir(ui packer.Ui, comm packer.Communicator, src string) error {
+	if p.config.UploadMode != packer.UploadDirFull {
+		if u, ok := comm.(packer.DirUploader); ok {
+			err := u.UploadDirWithMode(p.config.UploadMode, p.config.Destination, src, nil)
+			if err != packer.ErrUploadDirModeUnsupported {
+				return err
+			}
+		}
+		ui.Message(fmt.Sprintf(
+			"The communicator doesn't support the %s upload mode, uploading every file",
+			p.config.UploadMode))
+	}
+
+	return comm.UploadDir(p.config.Destination, src, nil)
+}
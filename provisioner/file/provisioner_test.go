@@ -186,7 +186,7 @@ func TestProvisionDownloadMkdirAll(t *testing.T) {
 			Writer: b,
 		}
 		comm := &packer.MockCommunicator{}
-		err = p.ProvisionDownload(ui, comm)
+		err = p.ProvisionDownload(context.Background(), ui, comm)
 		if err != nil {
 			t.Fatalf("should successfully provision: %s", err)
 		}
@@ -208,3 +208,332 @@ func TestProvisionDownloadMkdirAll(t *testing.T) {
 		}
 	}
 }
+
+func TestProvisionerPrepare_UploadMode(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["source"] = "."
+
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.UploadMode != packer.UploadDirFull {
+		t.Fatalf("bad: %s", p.config.UploadMode)
+	}
+
+	p = Provisioner{}
+	config["upload_mode"] = "rsync"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestProvisionerProvision_UploadMode(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	var p Provisioner
+	config := testConfig()
+	config["source"] = td
+	config["upload_mode"] = "delta"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.UploadDirMode != packer.UploadDirDelta || comm.UploadDirSrc != td {
+		t.Fatalf("bad: %#v", comm)
+	}
+
+	// Communicators that don't support it upload every file
+	plain := &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), struct{ packer.Communicator }{plain}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if plain.UploadDirMode != "" || plain.UploadDirSrc != td {
+		t.Fatalf("bad: %#v", plain)
+	}
+}
+
+func TestProvisionerPrepare_Content(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "hello"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p = Provisioner{}
+	config["source"] = "."
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should not allow both source and content")
+	}
+
+	p = Provisioner{}
+	delete(config, "source")
+	config["destination"] = "/tmp/"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should require a file destination")
+	}
+}
+
+func TestProvisionerPrepare_Mode(t *testing.T) {
+	cases := map[string]bool{
+		"0644":       true,
+		"755":        true,
+		"u+x":        true,
+		"u=rw,go=r":  true,
+		"0999":       false,
+		"; rm -rf /": false,
+	}
+
+	for mode, valid := range cases {
+		var p Provisioner
+		config := testConfig()
+		config["content"] = "hello"
+		config["mode"] = mode
+		err := p.Prepare(config)
+		if valid && err != nil {
+			t.Fatalf("%s: err: %s", mode, err)
+		}
+		if !valid && err == nil {
+			t.Fatalf("%s: should error", mode)
+		}
+	}
+}
+
+func TestProvisionerProvision_Template(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err = tf.Write([]byte("{{user `foo`}} from {{build_name}}")); err != nil {
+		t.Fatalf("error writing tempfile: %s", err)
+	}
+	tf.Close()
+
+	var p Provisioner
+	config := map[string]interface{}{
+		"source":      tf.Name(),
+		"destination": "something",
+		"template":    true,
+		"mode":        "0600",
+		"owner":       "root:root",
+
+		packer.BuildNameConfigKey:     "vm",
+		packer.UserVariablesConfigKey: map[string]string{"foo": "bar"},
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.UploadData != "bar from vm" {
+		t.Fatalf("bad: %s", comm.UploadData)
+	}
+	if comm.StartCmd.Command != "chown 'root:root' 'something'" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerProvision_Content(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "hello"
+	config["mode"] = "0600"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.UploadPath != "something" || comm.UploadData != "hello" {
+		t.Fatalf("bad: %#v", comm)
+	}
+	if comm.StartCmd.Command != "chmod 0600 'something'" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm = &packer.MockCommunicator{StartExitStatus: 1}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err == nil {
+		t.Fatal("should fail when chmod fails")
+	}
+}
+
+func TestProvisionerProvision_OwnerQuoting(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "hello"
+	config["destination"] = "it's"
+	config["owner"] = "app'; rm -rf /; '"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := `chown 'app'\''; rm -rf /; '\''' 'it'\''s'`
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerProvision_OwnerSudo(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "hello"
+	config["destination"] = "/etc/app.conf"
+	config["owner"] = "app"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// chown fails for users other than root
+	comm := &packer.MockCommunicator{StartExitStatus: 1}
+	err := p.Provision(context.Background(), packer.TestUi(t), comm)
+	if err == nil || !strings.Contains(err.Error(), "Set use_sudo") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	config["use_sudo"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &packer.MockCommunicator{}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := `sudo chown 'app' '/etc/app.conf'`
+	if comm.StartCmd.Command != expected {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerPrepare_ModeWindows(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "hello"
+	config["guest_os_type"] = "windows"
+	config["owner"] = "app"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should reject owner on Windows guests")
+	}
+}
+
+func TestProvisionerProvision_VerifyChecksum(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["content"] = "foo"
+	config["verify_checksum"] = true
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// sha256("foo")
+	comm := &packer.MockCommunicator{
+		StartStdout: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  something\n",
+	}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.StartCmd.Command != "sha256sum 'something'" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	comm = &packer.MockCommunicator{
+		StartStdout: "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c  something\n",
+	}
+	err := p.Provision(context.Background(), packer.TestUi(t), comm)
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("should fail on mismatch: %v", err)
+	}
+
+	// Windows
+	p = Provisioner{}
+	config["guest_os_type"] = "windows"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &packer.MockCommunicator{
+		StartStdout: "2C26B46B68FFC68FF99B453C1D30413413422D706483BFA0F98A5E886266E7AE\r\n",
+	}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(comm.StartCmd.Command, "Get-FileHash") {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestProvisionerProvision_VerifyChecksumDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	if err := os.Mkdir(filepath.Join(td, "sub"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "sub", "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p Provisioner
+	config := testConfig()
+	config["source"] = td + "/"
+	config["destination"] = "/tmp/dir"
+	config["verify_checksum"] = true
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{
+		StartStdout: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  /tmp/dir/sub/foo\n",
+	}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.StartCmd.Command != "find '/tmp/dir' -type f -exec sha256sum {} +" {
+		t.Fatalf("bad: %s", comm.StartCmd.Command)
+	}
+
+	// A file missing on the machine
+	comm = &packer.MockCommunicator{StartStdout: "\n"}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err == nil {
+		t.Fatal("should fail when a file is missing")
+	}
+}
+
+func TestProvisionerPrepare_VerifyChecksum(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["source"] = "/tmp/*.log"
+	config["direction"] = "download"
+	config["verify_checksum"] = true
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should not verify wildcard downloads")
+	}
+
+	p = Provisioner{}
+	config["source"] = "/tmp/foo"
+	config["guest_os_type"] = "plan9"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should require a valid guest_os_type")
+	}
+}
@@ -15,6 +15,17 @@ type guestOSTypeCommand struct {
 	removeDir string
 	statPath  string
 	mv        string
+	sha256    string
+	sha256Dir string
+
+	fileStat         string
+	readFile         string
+	packageInstalled string
+	serviceEnabled   string
+	serviceRunning   string
+	tcpListening     string
+	udpListening     string
+	userExists       string
 }
 
 var guestOSTypeCommands = map[string]guestOSTypeCommand{
@@ -24,6 +35,17 @@ var guestOSTypeCommands = map[string]guestOSTypeCommand{
 		removeDir: "rm -rf '%s'",
 		statPath:  "stat '%s'",
 		mv:        "mv '%s' '%s'",
+		sha256:    "sha256sum '%s'",
+		sha256Dir: "find '%s' -type f -exec sha256sum {} +",
+
+		fileStat:         "[ -e '%[1]s' ] || exit 1; stat -c '%%a %%U' '%[1]s' 2>/dev/null || stat -f '%%Lp %%Su' '%[1]s' || exit 2",
+		readFile:         "cat '%s'",
+		packageInstalled: "if command -v dpkg-query >/dev/null 2>&1; then dpkg-query -W -f='${Status}' '%[1]s' 2>/dev/null | grep -q 'ok installed' || exit 1; elif command -v rpm >/dev/null 2>&1; then rpm -q '%[1]s' >/dev/null 2>&1 || exit 1; elif command -v apk >/dev/null 2>&1; then apk info -e '%[1]s' >/dev/null 2>&1 || exit 1; else exit 2; fi",
+		serviceEnabled:   "command -v systemctl >/dev/null 2>&1 || exit 2; systemctl is-enabled --quiet '%s' || exit 1",
+		serviceRunning:   "command -v systemctl >/dev/null 2>&1 || exit 2; systemctl is-active --quiet '%s' || exit 1",
+		tcpListening:     "command -v ss >/dev/null 2>&1 || exit 2; ss -lnt | awk '{print $4}' | grep -Eq ':%d$' || exit 1",
+		udpListening:     "command -v ss >/dev/null 2>&1 || exit 2; ss -lnu | awk '{print $4}' | grep -Eq ':%d$' || exit 1",
+		userExists:       "id '%s' >/dev/null 2>&1 || exit 1",
 	},
 	WindowsOSType: {
 		chmod:     "echo 'skipping chmod %s %s'", // no-op
@@ -31,6 +53,17 @@ var guestOSTypeCommands = map[string]guestOSTypeCommand{
 		removeDir: "powershell.exe -Command \"rm %s -recurse -force\"",
 		statPath:  "powershell.exe -Command { if (test-path %s) { exit 0 } else { exit 1 } }",
 		mv:        "powershell.exe -Command \"mv %s %s -force\"",
+		sha256:    "powershell.exe -Command \"(Get-FileHash -Algorithm SHA256 -Path %s).Hash\"",
+		sha256Dir: "powershell.exe -Command \"Set-Location %s; Get-ChildItem -Recurse -File | ForEach-Object { (Get-FileHash -Algorithm SHA256 -LiteralPath $_.FullName).Hash + '  ' + (Resolve-Path -Relative $_.FullName) }\"",
+
+		fileStat:         "powershell.exe -Command \"if (-not (Test-Path -LiteralPath %[1]s)) { exit 1 }; '- ' + (Get-Acl -LiteralPath %[1]s).Owner\"",
+		readFile:         "powershell.exe -Command \"Get-Content -Raw -Path %s\"",
+		packageInstalled: "powershell.exe -Command \"if (-not (Get-Command Get-Package -ErrorAction SilentlyContinue)) { exit 2 }; if (Get-Package -Name %s -ErrorAction SilentlyContinue) { exit 0 } else { exit 1 }\"",
+		serviceEnabled:   "powershell.exe -Command \"if ((Get-Service -Name %s -ErrorAction SilentlyContinue).StartType -eq 'Automatic') { exit 0 } else { exit 1 }\"",
+		serviceRunning:   "powershell.exe -Command \"if ((Get-Service -Name %s -ErrorAction SilentlyContinue).Status -eq 'Running') { exit 0 } else { exit 1 }\"",
+		tcpListening:     "powershell.exe -Command \"if (-not (Get-Command Get-NetTCPConnection -ErrorAction SilentlyContinue)) { exit 2 }; if (Get-NetTCPConnection -State Listen -LocalPort %d -ErrorAction SilentlyContinue) { exit 0 } else { exit 1 }\"",
+		udpListening:     "powershell.exe -Command \"if (-not (Get-Command Get-NetUDPEndpoint -ErrorAction SilentlyContinue)) { exit 2 }; if (Get-NetUDPEndpoint -LocalPort %d -ErrorAction SilentlyContinue) { exit 0 } else { exit 1 }\"",
+		userExists:       "powershell.exe -Command \"if (-not (Get-Command Get-LocalUser -ErrorAction SilentlyContinue)) { exit 2 }; if (Get-LocalUser -Name %s -ErrorAction SilentlyContinue) { exit 0 } else { exit 1 }\"",
 	},
 }
 
@@ -78,9 +111,84 @@ func (g *GuestCommands) MovePath(srcPath string, dstPath string) string {
 	return g.sudo(fmt.Sprintf(g.commands().mv, g.escapePath(srcPath), g.escapePath(dstPath)))
 }
 
+// Sha256 returns a command printing the SHA256 checksum of the file at path
+// as the first field of its output.
+func (g *GuestCommands) Sha256(path string) string {
+	return g.sudo(fmt.Sprintf(g.commands().sha256, g.escapePath(path)))
+}
+
+// Sha256Dir returns a command printing, for every file under the directory
+// path, its SHA256 checksum followed by two spaces and its path, either
+// below path or relative to it.
+func (g *GuestCommands) Sha256Dir(path string) string {
+	return g.sudo(fmt.Sprintf(g.commands().sha256Dir, g.escapePath(path)))
+}
+
+// The commands checking the state of the machine exit with 0 if it holds,
+// with 1 if it doesn't, and with another exit status if it can't be checked,
+// for example because the command they need isn't installed.
+
+// FileStat returns a command printing the octal mode and the owner of the
+// file at path, separated by a space. The mode is "-" on Windows.
+func (g *GuestCommands) FileStat(path string) string {
+	return g.sudoShell(fmt.Sprintf(g.commands().fileStat, g.escapePath(path)))
+}
+
+// ReadFile returns a command printing the content of the file at path.
+func (g *GuestCommands) ReadFile(path string) string {
+	return g.sudo(fmt.Sprintf(g.commands().readFile, g.escapePath(path)))
+}
+
+// PackageInstalled returns a command exiting with 0 if the package name is
+// installed.
+func (g *GuestCommands) PackageInstalled(name string) string {
+	return fmt.Sprintf(g.commands().packageInstalled, name)
+}
+
+// ServiceEnabled returns a command exiting with 0 if the service name
+// starts at boot.
+func (g *GuestCommands) ServiceEnabled(name string) string {
+	return fmt.Sprintf(g.commands().serviceEnabled, name)
+}
+
+// ServiceRunning returns a command exiting with 0 if the service name is
+// running.
+func (g *GuestCommands) ServiceRunning(name string) string {
+	return fmt.Sprintf(g.commands().serviceRunning, name)
+}
+
+// PortListening returns a command exiting with 0 if something listens on
+// the tcp or udp port.
+func (g *GuestCommands) PortListening(protocol string, port int) string {
+	if protocol == "udp" {
+		return fmt.Sprintf(g.commands().udpListening, port)
+	}
+	return fmt.Sprintf(g.commands().tcpListening, port)
+}
+
+// UserExists returns a command exiting with 0 if the user name exists.
+func (g *GuestCommands) UserExists(name string) string {
+	return fmt.Sprintf(g.commands().userExists, name)
+}
+
+// WithSudo returns cmd run with sudo on unix guests when Sudo is set, for
+// commands built by the provisioners themselves.
+func (g *GuestCommands) WithSudo(cmd string) string {
+	return g.sudo(cmd)
+}
+
 func (g *GuestCommands) sudo(cmd string) string {
 	if g.GuestOSType == UnixOSType && g.Sudo {
 		return "sudo " + cmd
 	}
 	return cmd
 }
+
+// sudoShell is sudo for commands made of several commands, which run in a
+// shell as a whole.
+func (g *GuestCommands) sudoShell(cmd string) string {
+	if g.GuestOSType == UnixOSType && g.Sudo {
+		return "sudo sh -c '" + strings.Replace(cmd, "'", `'\''`, -1) + "'"
+	}
+	return cmd
+}
@@ -1,6 +1,11 @@
 package provisioner
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -193,3 +198,149 @@ func TestMovePath(t *testing.T) {
 		t.Fatalf("Unexpected Windows remove dir cmd: %s", cmd)
 	}
 }
+
+func TestSha256(t *testing.T) {
+	// *nix
+	guestCmd, err := NewGuestCommands(UnixOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", UnixOSType)
+	}
+	cmd := guestCmd.Sha256("/tmp/somefile")
+	if cmd != "sha256sum '/tmp/somefile'" {
+		t.Fatalf("Unexpected Unix sha256 cmd: %s", cmd)
+	}
+	cmd = guestCmd.Sha256Dir("/tmp/somedir")
+	if cmd != "find '/tmp/somedir' -type f -exec sha256sum {} +" {
+		t.Fatalf("Unexpected Unix sha256 dir cmd: %s", cmd)
+	}
+
+	// sudo *nix
+	guestCmd, err = NewGuestCommands(UnixOSType, true)
+	if err != nil {
+		t.Fatalf("Failed to create new sudo GuestCommands for OS: %s", UnixOSType)
+	}
+	cmd = guestCmd.Sha256("/tmp/somefile")
+	if cmd != "sudo sha256sum '/tmp/somefile'" {
+		t.Fatalf("Unexpected Unix sudo sha256 cmd: %s", cmd)
+	}
+
+	// Windows OS w/ space in path
+	guestCmd, err = NewGuestCommands(WindowsOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", WindowsOSType)
+	}
+	cmd = guestCmd.Sha256("C:\\Temp\\Some File")
+	if cmd != "powershell.exe -Command \"(Get-FileHash -Algorithm SHA256 -Path C:\\Temp\\Some` File).Hash\"" {
+		t.Fatalf("Unexpected Windows sha256 cmd: %s", cmd)
+	}
+}
+
+// runUnixCommand runs a unix guest command with the local shell, with PATH
+// set to path, and returns its output and exit status.
+func runUnixCommand(t *testing.T, command string, path string) (string, int) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix commands can't run on windows")
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = []string{"PATH=" + path}
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return string(out), 0
+}
+
+func TestFileStat(t *testing.T) {
+	guestCmd, err := NewGuestCommands(UnixOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", UnixOSType)
+	}
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+	os.Chmod(tf.Name(), 0640)
+
+	out, status := runUnixCommand(t, guestCmd.FileStat(tf.Name()), os.Getenv("PATH"))
+	if status != 0 || len(strings.Fields(out)) != 2 || strings.Fields(out)[0] != "640" {
+		t.Fatalf("Unexpected Unix stat result: %d %q", status, out)
+	}
+	if _, status := runUnixCommand(t, guestCmd.FileStat(tf.Name()+"-missing"), os.Getenv("PATH")); status != 1 {
+		t.Fatalf("Unexpected Unix stat exit status for a missing file: %d", status)
+	}
+	if _, status := runUnixCommand(t, guestCmd.FileStat(tf.Name()), ""); status < 2 {
+		t.Fatalf("Unexpected Unix stat exit status without stat: %d", status)
+	}
+
+	// sudo *nix runs the whole command with sudo
+	guestCmd, err = NewGuestCommands(UnixOSType, true)
+	if err != nil {
+		t.Fatalf("Failed to create new sudo GuestCommands for OS: %s", UnixOSType)
+	}
+	cmd := guestCmd.FileStat("/etc/passwd")
+	if !strings.HasPrefix(cmd, "sudo sh -c '[ -e '\\''/etc/passwd'\\'' ] || exit 1; ") {
+		t.Fatalf("Unexpected Unix sudo stat cmd: %s", cmd)
+	}
+
+	// Windows OS w/ space in path
+	guestCmd, err = NewGuestCommands(WindowsOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", WindowsOSType)
+	}
+	cmd = guestCmd.FileStat("C:\\Temp\\Some File")
+	if cmd != "powershell.exe -Command \"if (-not (Test-Path -LiteralPath C:\\Temp\\Some` File)) { exit 1 }; '- ' + (Get-Acl -LiteralPath C:\\Temp\\Some` File).Owner\"" {
+		t.Fatalf("Unexpected Windows stat cmd: %s", cmd)
+	}
+}
+
+func TestPackageInstalled(t *testing.T) {
+	guestCmd, err := NewGuestCommands(UnixOSType, true)
+	if err != nil {
+		t.Fatalf("Failed to create new sudo GuestCommands for OS: %s", UnixOSType)
+	}
+
+	// Without any package manager, the package can't be checked
+	empty, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(empty)
+	if _, status := runUnixCommand(t, guestCmd.PackageInstalled("nginx"), empty); status != 2 {
+		t.Fatalf("Unexpected Unix package exit status without a package manager: %d", status)
+	}
+}
+
+func TestPortListening(t *testing.T) {
+	guestCmd, err := NewGuestCommands(UnixOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", UnixOSType)
+	}
+	cmd := guestCmd.PortListening("udp", 53)
+	if cmd != "command -v ss >/dev/null 2>&1 || exit 2; ss -lnu | awk '{print $4}' | grep -Eq ':53$' || exit 1" {
+		t.Fatalf("Unexpected Unix udp port cmd: %s", cmd)
+	}
+
+	// Without ss, the port can't be checked
+	empty, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(empty)
+	if _, status := runUnixCommand(t, cmd, empty); status != 2 {
+		t.Fatalf("Unexpected Unix port exit status without ss: %d", status)
+	}
+
+	guestCmd, err = NewGuestCommands(WindowsOSType, false)
+	if err != nil {
+		t.Fatalf("Failed to create new GuestCommands for OS: %s", WindowsOSType)
+	}
+	cmd = guestCmd.PortListening("tcp", 5985)
+	if cmd != "powershell.exe -Command \"if (-not (Get-Command Get-NetTCPConnection -ErrorAction SilentlyContinue)) { exit 2 }; if (Get-NetTCPConnection -State Listen -LocalPort 5985 -ErrorAction SilentlyContinue) { exit 0 } else { exit 1 }\"" {
+		t.Fatalf("Unexpected Windows tcp port cmd: %s", cmd)
+	}
+}
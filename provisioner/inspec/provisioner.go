@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -27,6 +29,7 @@ import (
 
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/common/adapter"
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/packer"
 	"github.com/hashicorp/packer/template/interpolate"
@@ -34,6 +37,22 @@ import (
 
 var SupportedBackends = map[string]bool{"docker": true, "local": true, "ssh": true, "winrm": true}
 
+// ImpactThresholds are the named fail thresholds, matching the impact ranges
+// InSpec reports controls in.
+var ImpactThresholds = map[string]float64{
+	"none":     0.0,
+	"low":      0.01,
+	"medium":   0.4,
+	"high":     0.7,
+	"critical": 0.9,
+}
+
+// Exit statuses of inspec exec when controls failed or were skipped
+const (
+	exitFailedControls  = 100
+	exitSkippedControls = 101
+)
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 	ctx                 interpolate.Context
@@ -56,6 +75,13 @@ type Config struct {
 	LocalPort            int      `mapstructure:"local_port"`
 	SSHHostKeyFile       string   `mapstructure:"ssh_host_key_file"`
 	SSHAuthorizedKeyFile string   `mapstructure:"ssh_authorized_key_file"`
+
+	// The directory the JSON and JUnit reports are written to
+	ReportDirectory string `mapstructure:"report_directory"`
+
+	// Only fail when a control with at least this impact failed, either a
+	// number between 0 and 1 or one of the ImpactThresholds
+	FailThreshold string `mapstructure:"fail_threshold"`
 }
 
 type Provisioner struct {
@@ -64,6 +90,7 @@ type Provisioner struct {
 	done             chan struct{}
 	inspecVersion    string
 	inspecMajVersion uint
+	failImpact       float64
 }
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
@@ -139,6 +166,17 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if p.config.ReportDirectory == "" {
+		p.config.ReportDirectory = "inspec-reports"
+	}
+
+	if p.config.FailThreshold != "" {
+		p.failImpact, err = parseFailThreshold(p.config.FailThreshold)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
 	if p.config.User == "" {
 		usr, err := user.Current()
 		if err != nil {
@@ -339,6 +377,15 @@ func (p *Provisioner) executeInspec(ui packer.Ui, comm packer.Communicator, priv
 
 	args = append(args, "--input-file")
 	args = append(args, p.config.AttributesFiles...)
+
+	if err := os.MkdirAll(p.config.ReportDirectory, 0755); err != nil {
+		return fmt.Errorf("Error creating report directory: %s", err)
+	}
+	jsonReport, junitReport, err := p.reportFiles()
+	if err != nil {
+		return fmt.Errorf("Error naming the reports: %s", err)
+	}
+	args = append(args, "--reporter", "cli", "json:"+jsonReport, "junit:"+junitReport)
 	args = append(args, p.config.ExtraArguments...)
 
 	if len(p.config.InspecEnvVars) > 0 {
@@ -391,13 +438,144 @@ func (p *Provisioner) executeInspec(ui packer.Ui, comm packer.Communicator, priv
 	}
 	wg.Wait()
 	err = cmd.Wait()
+
+	// The reports are kept even if controls failed
+	var reports []string
+	for _, report := range []string{jsonReport, junitReport} {
+		if _, err := os.Stat(report); err == nil {
+			reports = append(reports, report)
+		}
+	}
+	if len(reports) > 0 {
+		ui.Message(fmt.Sprintf("Inspec reports: %s", strings.Join(reports, ", ")))
+		if err := commonhelper.AddBuildFiles(reports, p.config.PackerBuildName); err != nil {
+			return fmt.Errorf("Error adding reports to the artifact: %s", err)
+		}
+	}
+
 	if err != nil {
-		return fmt.Errorf("Non-zero exit status: %s", err)
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || p.config.FailThreshold == "" {
+			return fmt.Errorf("Non-zero exit status: %s", err)
+		}
+		switch exitErr.ExitCode() {
+		case exitFailedControls, exitSkippedControls:
+		default:
+			return fmt.Errorf("Non-zero exit status: %s", err)
+		}
+	}
+
+	if p.config.FailThreshold != "" {
+		return p.checkFailThreshold(ui, jsonReport)
 	}
 
 	return nil
 }
 
+// reportFileRe matches the characters of a profile that are not kept in the
+// name of its reports.
+var reportFileRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// reportFiles returns the paths of the JSON and JUnit reports of this run,
+// named after the build and the profile. A number is appended when another
+// run of the build already wrote reports with that name.
+func (p *Provisioner) reportFiles() (string, string, error) {
+	name := p.config.PackerBuildName
+	if name == "" {
+		name = "inspec"
+	}
+	profile := strings.TrimSuffix(filepath.Base(p.config.Profile), ".git")
+	if profile = reportFileRe.ReplaceAllString(profile, "_"); profile != "" {
+		name += "-" + profile
+	}
+
+	files, err := commonhelper.RetrieveBuildFiles(p.config.PackerBuildName)
+	if err != nil {
+		return "", "", err
+	}
+	base := filepath.Join(p.config.ReportDirectory, name)
+	for i := 2; ; i++ {
+		used := false
+		for _, f := range files {
+			if f == base+".json" || f == base+".xml" {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return base + ".json", base + ".xml", nil
+		}
+		base = filepath.Join(p.config.ReportDirectory, fmt.Sprintf("%s-%d", name, i))
+	}
+}
+
+// inspecReport is the part of the output of the InSpec JSON reporter used to
+// apply the fail threshold.
+type inspecReport struct {
+	Profiles []struct {
+		Name     string `json:"name"`
+		Controls []struct {
+			ID      string  `json:"id"`
+			Impact  float64 `json:"impact"`
+			Results []struct {
+				Status string `json:"status"`
+			} `json:"results"`
+		} `json:"controls"`
+	} `json:"profiles"`
+}
+
+// checkFailThreshold fails if a control with an impact at or above the fail
+// threshold has failed results in the JSON report.
+func (p *Provisioner) checkFailThreshold(ui packer.Ui, jsonReport string) error {
+	data, err := ioutil.ReadFile(jsonReport)
+	if err != nil {
+		return fmt.Errorf("Error reading JSON report: %s", err)
+	}
+	var report inspecReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return fmt.Errorf("Error parsing JSON report: %s", err)
+	}
+
+	var failed []string
+	for _, profile := range report.Profiles {
+		for _, control := range profile.Controls {
+			passed := true
+			for _, result := range control.Results {
+				if result.Status == "failed" {
+					passed = false
+					break
+				}
+			}
+			if passed {
+				continue
+			}
+
+			if control.Impact >= p.failImpact {
+				failed = append(failed, control.ID)
+				ui.Error(fmt.Sprintf("Control %s failed with impact %.1f", control.ID, control.Impact))
+			} else {
+				ui.Message(fmt.Sprintf("Ignoring failed control %s with impact %.1f", control.ID, control.Impact))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d controls failed with an impact of at least %s", len(failed), p.config.FailThreshold)
+	}
+	return nil
+}
+
+func parseFailThreshold(threshold string) (float64, error) {
+	if impact, ok := ImpactThresholds[strings.ToLower(threshold)]; ok {
+		return impact, nil
+	}
+	impact, err := strconv.ParseFloat(threshold, 64)
+	if err != nil || impact < 0 || impact > 1 {
+		return 0, fmt.Errorf("fail_threshold: %s must be a number between 0 and 1 or one of none, low, medium, high or critical", threshold)
+	}
+	return impact, nil
+}
+
 func validateFileConfig(name string, config string, req bool) error {
 	if req {
 		if name == "" {
@@ -1,15 +1,18 @@
 package inspec
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"testing"
 
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/packer"
 )
 
@@ -32,6 +35,14 @@ func testConfig(t *testing.T) map[string]interface{} {
 	return m
 }
 
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	}
+}
+
 func TestProvisioner_Impl(t *testing.T) {
 	var raw interface{}
 	raw = &Provisioner{}
@@ -291,3 +302,164 @@ func TestInspecGetVersionError(t *testing.T) {
 		t.Fatal("Error message should include command name")
 	}
 }
+
+func TestProvisionerPrepare_FailThreshold(t *testing.T) {
+	cases := []struct {
+		Threshold string
+		Impact    float64
+		Err       bool
+	}{
+		{"high", 0.7, false},
+		{"Critical", 0.9, false},
+		{"0.5", 0.5, false},
+		{"1.5", 0, true},
+		{"severe", 0, true},
+	}
+
+	for _, tc := range cases {
+		var p Provisioner
+		config := testConfig(t)
+		defer os.Remove(config["command"].(string))
+		config["profile"] = "test"
+		config["fail_threshold"] = tc.Threshold
+
+		err := p.Prepare(config)
+		if (err != nil) != tc.Err {
+			t.Fatalf("%s: bad error: %v", tc.Threshold, err)
+		}
+		if !tc.Err && p.failImpact != tc.Impact {
+			t.Fatalf("%s: bad impact: %f", tc.Threshold, p.failImpact)
+		}
+	}
+}
+
+func testReportProvisioner(t *testing.T, exit int, threshold string) (*Provisioner, string) {
+	dir, err := ioutil.TempDir("", "packer-inspec")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p Provisioner
+	config := map[string]interface{}{
+		"command":           path.Join(wd, "test-fixtures", "report"),
+		"profile":           "test",
+		"backend":           "local",
+		"report_directory":  dir,
+		"fail_threshold":    threshold,
+		"packer_build_name": "inspec-test",
+		"inspec_env_vars": []string{
+			"INSPEC_REPORT=" + path.Join(wd, "test-fixtures", "report.json"),
+			fmt.Sprintf("INSPEC_EXIT=%d", exit),
+		},
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return &p, dir
+}
+
+func TestProvisionerExecuteInspec_Reports(t *testing.T) {
+	defer commonhelper.RemoveBuildState("inspec-test")
+	p, dir := testReportProvisioner(t, 0, "")
+	defer os.RemoveAll(dir)
+
+	if err := p.executeInspec(testUi(), new(packer.MockCommunicator), ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		path.Join(dir, "inspec-test-test.json"),
+		path.Join(dir, "inspec-test-test.xml"),
+	}
+	files, err := commonhelper.RetrieveBuildFiles("inspec-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("bad: %#v", files)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestProvisionerExecuteInspec_ReportsTwice(t *testing.T) {
+	defer commonhelper.RemoveBuildState("inspec-test")
+	p, dir := testReportProvisioner(t, 0, "")
+	defer os.RemoveAll(dir)
+
+	// A second run in the same build keeps the reports of the first one
+	for i := 0; i < 2; i++ {
+		if err := p.executeInspec(testUi(), new(packer.MockCommunicator), ""); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	expected := []string{
+		path.Join(dir, "inspec-test-test.json"),
+		path.Join(dir, "inspec-test-test.xml"),
+		path.Join(dir, "inspec-test-test-2.json"),
+		path.Join(dir, "inspec-test-test-2.xml"),
+	}
+	files, err := commonhelper.RetrieveBuildFiles("inspec-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("bad: %#v", files)
+	}
+}
+
+func TestProvisionerExecuteInspec_FailedControls(t *testing.T) {
+	defer commonhelper.RemoveBuildState("inspec-test")
+	p, dir := testReportProvisioner(t, exitFailedControls, "")
+	defer os.RemoveAll(dir)
+
+	// Without a threshold any failed control fails the build, but the reports
+	// are kept
+	err := p.executeInspec(testUi(), new(packer.MockCommunicator), "")
+	if err == nil || !strings.Contains(err.Error(), "exit status 100") {
+		t.Fatalf("bad: %v", err)
+	}
+	files, err := commonhelper.RetrieveBuildFiles("inspec-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("bad: %#v", files)
+	}
+}
+
+func TestProvisionerExecuteInspec_FailThreshold(t *testing.T) {
+	cases := []struct {
+		Threshold string
+		Exit      int
+		Err       string
+	}{
+		{"high", exitFailedControls, ""},
+		{"medium", exitFailedControls, "1 controls failed"},
+		{"low", exitFailedControls, "2 controls failed"},
+		{"critical", exitSkippedControls, ""},
+		{"critical", 1, "exit status 1"},
+	}
+
+	for _, tc := range cases {
+		p, dir := testReportProvisioner(t, tc.Exit, tc.Threshold)
+		err := p.executeInspec(testUi(), new(packer.MockCommunicator), "")
+		os.RemoveAll(dir)
+		commonhelper.RemoveBuildState("inspec-test")
+
+		if tc.Err == "" && err != nil {
+			t.Fatalf("%s: err: %s", tc.Threshold, err)
+		}
+		if tc.Err != "" && (err == nil || !strings.Contains(err.Error(), tc.Err)) {
+			t.Fatalf("%s: bad: %v", tc.Threshold, err)
+		}
+	}
+}
@@ -69,6 +69,10 @@ type Config struct {
 
 	ExecutionPolicy ExecutionPolicy `mapstructure:"execution_policy"`
 
+	// The OS of the guest machine, "windows" or "unix". On unix, the scripts
+	// are run with PowerShell Core, pwsh, usually over SSH
+	GuestOSType string `mapstructure:"guest_os_type"`
+
 	ctx interpolate.Context
 }
 
@@ -91,6 +95,12 @@ func (p *Provisioner) defaultExecuteCommand() string {
 	baseCmd := `& { if (Test-Path variable:global:ProgressPreference)` +
 		`{set-variable -name variable:global:ProgressPreference -value 'SilentlyContinue'};` +
 		`. {{.Vars}}; &'{{.Path}}'; exit $LastExitCode }`
+	if p.config.GuestOSType == provisioner.UnixOSType {
+		// The command goes through the login shell of the user, and the
+		// execution policy doesn't apply outside of Windows
+		return fmt.Sprintf(`pwsh -NoProfile -NonInteractive -Command "%s"`,
+			strings.Replace(baseCmd, "$", `\$`, -1))
+	}
 	if p.config.ExecutionPolicy == ExecutionPolicyNone {
 		return baseCmd
 	} else {
@@ -121,6 +131,11 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		return err
 	}
 
+	if p.config.GuestOSType == "" {
+		p.config.GuestOSType = provisioner.WindowsOSType
+	}
+	p.config.GuestOSType = strings.ToLower(p.config.GuestOSType)
+
 	if p.config.EnvVarFormat == "" {
 		p.config.EnvVarFormat = `$env:%s="%s"; `
 	}
@@ -145,14 +160,19 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.StartRetryTimeout = 5 * time.Minute
 	}
 
+	tempDir := `c:/Windows/Temp`
+	if p.config.GuestOSType == provisioner.UnixOSType {
+		tempDir = `/tmp`
+	}
+
 	if p.config.RemotePath == "" {
 		uuid := uuid.TimeOrderedUUID()
-		p.config.RemotePath = fmt.Sprintf(`c:/Windows/Temp/script-%s.ps1`, uuid)
+		p.config.RemotePath = fmt.Sprintf(`%s/script-%s.ps1`, tempDir, uuid)
 	}
 
 	if p.config.RemoteEnvVarPath == "" {
 		uuid := uuid.TimeOrderedUUID()
-		p.config.RemoteEnvVarPath = fmt.Sprintf(`c:/Windows/Temp/packer-ps-env-vars-%s.ps1`, uuid)
+		p.config.RemoteEnvVarPath = fmt.Sprintf(`%s/packer-ps-env-vars-%s.ps1`, tempDir, uuid)
 	}
 
 	if p.config.Scripts == nil {
@@ -164,6 +184,19 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	}
 
 	var errs error
+	switch p.config.GuestOSType {
+	case provisioner.WindowsOSType:
+	case provisioner.UnixOSType:
+		// Elevation relies on Windows scheduled tasks
+		if p.config.ElevatedUser != "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("elevated_user is only supported with a windows guest_os_type, use sudo in execute_command instead"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Invalid guest_os_type: \"%s\"", p.config.GuestOSType))
+	}
+
 	if p.config.Script != "" && len(p.config.Scripts) > 0 {
 		errs = packer.MultiErrorAppend(errs,
 			errors.New("Only one of script or scripts can be specified."))
@@ -257,7 +290,7 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		if err != nil {
 			return fmt.Errorf("Error stating powershell script: %s", err)
 		}
-		if strings.HasSuffix(p.config.RemotePath, `\`) {
+		if strings.HasSuffix(p.config.RemotePath, `\`) || strings.HasSuffix(p.config.RemotePath, "/") {
 			// path is a directory
 			p.config.RemotePath += filepath.Base((fi).Name())
 		}
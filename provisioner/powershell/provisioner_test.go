@@ -147,6 +147,41 @@ func TestProvisionerPrepare_Elevated(t *testing.T) {
 	}
 }
 
+func TestProvisionerPrepare_GuestOSType(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["guest_os_type"] = "Unix"
+
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.GuestOSType != "unix" {
+		t.Errorf("unexpected guest os type: %s", p.config.GuestOSType)
+	}
+	matched, _ := regexp.MatchString("^/tmp/script-.*.ps1$", p.config.RemotePath)
+	if !matched {
+		t.Errorf("unexpected remote path: %s", p.config.RemotePath)
+	}
+	matched, _ = regexp.MatchString("^/tmp/packer-ps-env-vars-.*.ps1$", p.config.RemoteEnvVarPath)
+	if !matched {
+		t.Errorf("unexpected remote env var path: %s", p.config.RemoteEnvVarPath)
+	}
+
+	// Elevation isn't available outside of Windows
+	p = Provisioner{}
+	config["elevated_user"] = "vagrant"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	p = Provisioner{}
+	config = testConfig()
+	config["guest_os_type"] = "macos"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
 func TestProvisionerPrepare_Script(t *testing.T) {
 	config := testConfig()
 	delete(config, "inline")
@@ -432,6 +467,35 @@ func TestProvisionerProvision_Inline(t *testing.T) {
 	}
 }
 
+func TestProvisionerProvision_InlineUnix(t *testing.T) {
+	config := testConfig()
+	config["guest_os_type"] = "unix"
+	config["inline"] = []string{"Write-Output $env:FOO"}
+	config["environment_vars"] = []string{"FOO=BAR"}
+	config["valid_exit_codes"] = []int{0, 200}
+	p := new(Provisioner)
+	comm := new(packer.MockCommunicator)
+	comm.StartExitStatus = 200
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cmd := comm.StartCmd.Command
+	re := regexp.MustCompile(`^pwsh -NoProfile -NonInteractive -Command "& { if \(Test-Path variable:global:ProgressPreference\){set-variable -name variable:global:ProgressPreference -value 'SilentlyContinue'};\. /tmp/packer-ps-env-vars-[[:alnum:]]{8}-[[:alnum:]]{4}-[[:alnum:]]{4}-[[:alnum:]]{4}-[[:alnum:]]{12}\.ps1; &'/tmp/script-[[:alnum:]-]+\.ps1'; exit \\\$LastExitCode }"$`)
+	if !re.MatchString(cmd) {
+		t.Fatalf("Got unexpected command: %s", cmd)
+	}
+	if !strings.HasPrefix(comm.UploadPath, "/tmp/script-") || comm.UploadData != "Write-Output $env:FOO\n" {
+		t.Fatalf("Got unexpected upload to %s: %s", comm.UploadPath, comm.UploadData)
+	}
+	if vars := p.createFlattenedEnvVars(false); !strings.Contains(vars, `$env:FOO="BAR"; `) {
+		t.Fatalf("Got unexpected env vars: %s", vars)
+	}
+}
+
 func TestProvisionerProvision_Scripts(t *testing.T) {
 	tempFile, _ := ioutil.TempFile("", "packer")
 	defer os.Remove(tempFile.Name())
@@ -46,6 +46,18 @@ type Config struct {
 	// An array of local paths of modules to upload.
 	ModulePaths []string `mapstructure:"module_paths"`
 
+	// Path to a Puppetfile whose modules are installed with r10k, on the
+	// guest unless ResolveModulesLocally is set.
+	PuppetfilePath string `mapstructure:"puppetfile_path"`
+
+	// If true, the Puppetfile is resolved with a local r10k and the modules
+	// are cached and uploaded.
+	ResolveModulesLocally bool `mapstructure:"resolve_modules_locally"`
+
+	// The command used to install the modules of the Puppetfile on the
+	// guest.
+	R10kCommand string `mapstructure:"r10k_command"`
+
 	// The main manifest file to apply to kick off the entire thing.
 	ManifestFile string `mapstructure:"manifest_file"`
 
@@ -77,6 +89,7 @@ type Config struct {
 
 type guestOSTypeConfig struct {
 	executeCommand   string
+	r10kCommand      string
 	facterVarsFmt    string
 	facterVarsJoiner string
 	modulePathJoiner string
@@ -100,6 +113,7 @@ var guestOSTypeConfigs = map[string]guestOSTypeConfig{
 			`{{if ne .ManifestDir ""}}--manifestdir='{{.ManifestDir}}' {{end}}` +
 			`{{if ne .ExtraArguments ""}}{{.ExtraArguments}} {{end}}` +
 			"{{.ManifestFile}}",
+		r10kCommand:      "{{if .Sudo}}sudo -E {{end}}r10k puppetfile install --puppetfile '{{.Puppetfile}}' --moduledir '{{.ModuleDir}}'",
 		facterVarsFmt:    "FACTER_%s='%s'",
 		facterVarsJoiner: " ",
 		modulePathJoiner: ":",
@@ -117,6 +131,7 @@ var guestOSTypeConfigs = map[string]guestOSTypeConfig{
 			`{{if ne .ManifestDir ""}}--manifestdir='{{.ManifestDir}}' {{end}}` +
 			`{{if ne .ExtraArguments ""}}{{.ExtraArguments}} {{end}}` +
 			"{{.ManifestFile}}",
+		r10kCommand:      `r10k puppetfile install --puppetfile "{{.Puppetfile}}" --moduledir "{{.ModuleDir}}"`,
 		facterVarsFmt:    `SET "FACTER_%s=%s"`,
 		facterVarsJoiner: " & ",
 		modulePathJoiner: ";",
@@ -162,6 +177,7 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 			Exclude: []string{
 				"execute_command",
 				"extra_arguments",
+				"r10k_command",
 			},
 		},
 	}, raws...)
@@ -190,6 +206,10 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.ExecuteCommand = p.guestOSTypeConfig.executeCommand
 	}
 
+	if p.config.R10kCommand == "" {
+		p.config.R10kCommand = p.guestOSTypeConfig.r10kCommand
+	}
+
 	if p.config.StagingDir == "" {
 		p.config.StagingDir = p.guestOSTypeConfig.stagingDir
 	}
@@ -250,6 +270,20 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if p.config.PuppetfilePath != "" {
+		info, err := os.Stat(p.config.PuppetfilePath)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("puppetfile_path is invalid: %s", err))
+		} else if info.IsDir() {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("puppetfile_path must point to a file"))
+		}
+	} else if p.config.ResolveModulesLocally {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("resolve_modules_locally requires a puppetfile_path"))
+	}
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
@@ -299,6 +333,18 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		modulePaths = append(modulePaths, targetPath)
 	}
 
+	// Install the modules of the Puppetfile, after the local ones in the
+	// module path
+	if p.config.PuppetfilePath != "" {
+		ui.Message(fmt.Sprintf("Resolving Puppetfile: %s", p.config.PuppetfilePath))
+		path, err := p.resolvePuppetfile(ui, comm)
+		if err != nil {
+			return fmt.Errorf("Error resolving Puppetfile: %s", err)
+		}
+
+		modulePaths = append(modulePaths, path)
+	}
+
 	// Upload manifests
 	remoteManifestFile, err := p.uploadManifests(ui, comm)
 	if err != nil {
@@ -0,0 +1,153 @@
+package puppetmasterless
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// The r10k command resolving Puppetfiles locally
+var r10kCommand = "r10k"
+
+type R10kTemplate struct {
+	ModuleDir  string
+	Puppetfile string
+	Sudo       bool
+}
+
+// puppetfileHash identifies the modules resolved from the Puppetfile by its
+// content, where the module versions are pinned.
+func (p *Provisioner) puppetfileHash() (string, error) {
+	data, err := ioutil.ReadFile(p.config.PuppetfilePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// resolvePuppetfile installs the modules of the Puppetfile on the guest, or
+// uploads the modules resolved locally, and returns their remote path.
+func (p *Provisioner) resolvePuppetfile(ui packer.Ui, comm packer.Communicator) (string, error) {
+	hash, err := p.puppetfileHash()
+	if err != nil {
+		return "", err
+	}
+
+	if p.config.ResolveModulesLocally {
+		localPath, err := p.resolvePuppetfileLocally(ui, hash)
+		if err != nil {
+			return "", err
+		}
+
+		ui.Message(fmt.Sprintf("Uploading Puppetfile modules from: %s", localPath))
+		remotePath := fmt.Sprintf("%s/puppetfile-modules", p.config.StagingDir)
+		if err := p.uploadDirectory(ui, comm, remotePath, localPath); err != nil {
+			return "", fmt.Errorf("Error uploading Puppetfile modules: %s", err)
+		}
+		return remotePath, nil
+	}
+
+	// The modules are kept in the staging directory by the hash of the
+	// Puppetfile, for the next runs in this build
+	ctx := context.TODO()
+	remotePath := fmt.Sprintf("%s/puppetfile-%s", p.config.StagingDir, hash)
+	cmd := &packer.RemoteCmd{Command: p.guestCommands.StatPath(remotePath)}
+	if err := comm.Start(ctx, cmd); err != nil {
+		return "", err
+	}
+	if cmd.Wait() == 0 {
+		ui.Message(fmt.Sprintf("Using Puppetfile modules resolved in: %s", remotePath))
+		return remotePath, nil
+	}
+
+	ui.Message("Uploading Puppetfile...")
+	f, err := os.Open(p.config.PuppetfilePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	remotePuppetfile := fmt.Sprintf("%s/Puppetfile", p.config.StagingDir)
+	if err := comm.Upload(remotePuppetfile, f, nil); err != nil {
+		return "", fmt.Errorf("Error uploading Puppetfile: %s", err)
+	}
+
+	p.config.ctx.Data = &R10kTemplate{
+		ModuleDir:  remotePath,
+		Puppetfile: remotePuppetfile,
+		Sudo:       !p.config.PreventSudo,
+	}
+	command, err := interpolate.Render(p.config.R10kCommand, &p.config.ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ui.Message(fmt.Sprintf("Running r10k: %s", command))
+	cmd = &packer.RemoteCmd{Command: command}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return "", err
+	}
+	if cmd.ExitStatus() != 0 {
+		// Don't leave partially installed modules for the next run
+		if err := p.removeDir(ui, comm, remotePath); err != nil {
+			log.Printf("Error removing %s: %s", remotePath, err)
+		}
+		return "", fmt.Errorf("r10k exited with a non-zero exit status: %d", cmd.ExitStatus())
+	}
+
+	return remotePath, nil
+}
+
+// resolvePuppetfileLocally installs the modules of the Puppetfile in the
+// packer cache, unless they are already there, and returns their path.
+func (p *Provisioner) resolvePuppetfileLocally(ui packer.Ui, hash string) (string, error) {
+	cachePath, err := packer.CachePath("puppetfile-" + hash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(cachePath); err == nil {
+		ui.Message(fmt.Sprintf("Using cached Puppetfile modules: %s", cachePath))
+		return cachePath, nil
+	}
+
+	puppetfile, err := filepath.Abs(p.config.PuppetfilePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Install next to the cache so that a failed run isn't cached
+	tmp, err := ioutil.TempDir(filepath.Dir(cachePath), "puppetfile-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.Command(r10kCommand, "puppetfile", "install",
+		"--puppetfile", puppetfile, "--moduledir", tmp)
+	ui.Message(fmt.Sprintf("Running r10k: %s", strings.Join(cmd.Args, " ")))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("r10k failed: %s\n%s", err, out)
+	}
+
+	if err := os.Rename(tmp, cachePath); err != nil {
+		// Another build with the same Puppetfile may have cached the
+		// modules in the meantime
+		if _, statErr := os.Stat(cachePath); statErr == nil {
+			ui.Message(fmt.Sprintf("Using cached Puppetfile modules: %s", cachePath))
+			return cachePath, nil
+		}
+		return "", err
+	}
+	return cachePath, nil
+}
@@ -0,0 +1,254 @@
+package puppetmasterless
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// puppetfileCommunicator records the commands run, and fails the ones
+// containing failOn.
+type puppetfileCommunicator struct {
+	packer.MockCommunicator
+
+	commands []string
+	failOn   []string
+}
+
+func (c *puppetfileCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.commands = append(c.commands, cmd.Command)
+
+	status := 0
+	for _, s := range c.failOn {
+		if strings.Contains(cmd.Command, s) {
+			status = 1
+		}
+	}
+	go cmd.SetExited(status)
+	return nil
+}
+
+func (c *puppetfileCommunicator) ran(s string) bool {
+	for _, cmd := range c.commands {
+		if strings.Contains(cmd, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func testPuppetfileUi() packer.Ui {
+	return &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+}
+
+func TestProvisionerPrepare_puppetfilePath(t *testing.T) {
+	config, tempfile := testConfig()
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
+
+	config["resolve_modules_locally"] = true
+	p := new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["puppetfile_path"] = "test-fixtures"
+	p = new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["puppetfile_path"] = "test-fixtures/Puppetfile"
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerProvision_puppetfileGuest(t *testing.T) {
+	config, tempfile := testConfig()
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
+	config["puppetfile_path"] = "test-fixtures/Puppetfile"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	hash, err := p.puppetfileHash()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	moduleDir := "/tmp/packer-puppet-masterless/puppetfile-" + hash
+
+	// Not resolved yet
+	comm := &puppetfileCommunicator{failOn: []string{"stat "}}
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	r10k := "sudo -E r10k puppetfile install --puppetfile '/tmp/packer-puppet-masterless/Puppetfile' --moduledir '" + moduleDir + "'"
+	if !comm.ran(r10k) {
+		t.Fatalf("r10k didn't run: %#v", comm.commands)
+	}
+	last := comm.commands[len(comm.commands)-1]
+	if !strings.Contains(last, "--modulepath='"+moduleDir+"'") {
+		t.Fatalf("bad command: %s", last)
+	}
+
+	// Already resolved
+	comm = &puppetfileCommunicator{}
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("r10k") {
+		t.Fatalf("r10k shouldn't run: %#v", comm.commands)
+	}
+
+	// A failed resolution fails before running Puppet
+	comm = &puppetfileCommunicator{failOn: []string{"stat ", "r10k "}}
+	err = p.Provision(context.Background(), testPuppetfileUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "r10k exited") {
+		t.Fatalf("bad: %v", err)
+	}
+	if !comm.ran("rm -rf '"+moduleDir+"'") || comm.ran("puppet apply") {
+		t.Fatalf("bad commands: %#v", comm.commands)
+	}
+
+	// r10k runs without sudo like puppet
+	config["prevent_sudo"] = true
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &puppetfileCommunicator{failOn: []string{"stat "}}
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("r10k") || comm.ran("sudo") {
+		t.Fatalf("bad commands: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerProvision_puppetfileLocal(t *testing.T) {
+	config, tempfile := testConfig()
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
+
+	cacheDir, err := ioutil.TempDir("", "packer-cache")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	os.Setenv("PACKER_CACHE_DIR", cacheDir)
+	defer os.Unsetenv("PACKER_CACHE_DIR")
+
+	r10kCommand = "test-fixtures/r10k"
+	defer func() { r10kCommand = "r10k" }()
+
+	config["puppetfile_path"] = "test-fixtures/Puppetfile"
+	config["resolve_modules_locally"] = true
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	hash, err := p.puppetfileHash()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &puppetfileCommunicator{}
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cachePath, _ := packer.CachePath("puppetfile-" + hash)
+	if _, err := os.Stat(cachePath + "/stdlib/metadata.json"); err != nil {
+		t.Fatalf("modules not cached: %s", err)
+	}
+	if comm.UploadDirDst != "/tmp/packer-puppet-masterless/puppetfile-modules" || comm.UploadDirSrc != cachePath+"/" {
+		t.Fatalf("bad upload: %s -> %s", comm.UploadDirSrc, comm.UploadDirDst)
+	}
+
+	// The cached modules are used without r10k
+	r10kCommand = "false"
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A failed resolution isn't cached
+	config["puppetfile_path"] = "test-fixtures/Puppetfile.fail"
+	r10kCommand = "test-fixtures/r10k"
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &puppetfileCommunicator{}
+	err = p.Provision(context.Background(), testPuppetfileUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "r10k failed") {
+		t.Fatalf("bad: %v", err)
+	}
+	if comm.ran("puppet apply") {
+		t.Fatalf("puppet shouldn't run: %#v", comm.commands)
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad cache: %d entries", len(entries))
+	}
+}
+
+func TestProvisionerProvision_puppetfileLocalCached(t *testing.T) {
+	config, tempfile := testConfig()
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
+
+	cacheDir, err := ioutil.TempDir("", "packer-cache")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	os.Setenv("PACKER_CACHE_DIR", cacheDir)
+	defer os.Unsetenv("PACKER_CACHE_DIR")
+
+	config["puppetfile_path"] = "test-fixtures/Puppetfile"
+	config["resolve_modules_locally"] = true
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	hash, err := p.puppetfileHash()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cachePath, _ := packer.CachePath("puppetfile-" + hash)
+
+	// Another build caches the modules while r10k runs
+	script := filepath.Join(cacheDir, "r10k")
+	r10k, err := filepath.Abs("test-fixtures/r10k")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data := fmt.Sprintf("#!/bin/sh\n%s \"$@\" && %s \"$1\" \"$2\" \"$3\" \"$4\" \"$5\" '%s'\n", r10k, r10k, cachePath)
+	if err := ioutil.WriteFile(script, []byte(data), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	r10kCommand = script
+	defer func() { r10kCommand = "r10k" }()
+
+	comm := &puppetfileCommunicator{}
+	if err := p.Provision(context.Background(), testPuppetfileUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.UploadDirSrc != cachePath+"/" {
+		t.Fatalf("bad upload: %s", comm.UploadDirSrc)
+	}
+}
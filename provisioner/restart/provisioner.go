@@ -0,0 +1,208 @@
+// This package implements a provisioner for Packer that restarts Linux and
+// Unix machines and waits for them to come back.
+package restart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/common/retry"
+	"github.com/hashicorp/packer/helper/config"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+var DefaultRestartCommand = "shutdown -r now"
+var DefaultRestartCheckCommand = `echo "$(hostname) restarted."`
+
+// DefaultBootIDCommand prints an identifier changing at every boot, on Linux
+// and on the BSDs.
+var DefaultBootIDCommand = "cat /proc/sys/kernel/random/boot_id 2>/dev/null || sysctl -n kern.boottime"
+
+var retryableSleep = 5 * time.Second
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// The command used to restart the guest machine
+	RestartCommand string `mapstructure:"restart_command"`
+
+	// The command used to check if the guest machine is ready after the
+	// restart. It is retried until it exits with 0, and its output is
+	// displayed to the user
+	RestartCheckCommand string `mapstructure:"restart_check_command"`
+
+	// The command printing an identifier of the current boot of the guest
+	// machine, used to tell that it restarted
+	BootIDCommand string `mapstructure:"boot_id_command"`
+
+	// The timeout for waiting for the machine to restart
+	RestartTimeout time.Duration `mapstructure:"restart_timeout"`
+
+	ctx interpolate.Context
+}
+
+type Provisioner struct {
+	config Config
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{},
+		},
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.RestartCommand == "" {
+		p.config.RestartCommand = DefaultRestartCommand
+	}
+
+	if p.config.RestartCheckCommand == "" {
+		p.config.RestartCheckCommand = DefaultRestartCheckCommand
+	}
+
+	if p.config.BootIDCommand == "" {
+		p.config.BootIDCommand = DefaultBootIDCommand
+	}
+
+	if p.config.RestartTimeout == 0 {
+		p.config.RestartTimeout = 5 * time.Minute
+	}
+
+	var errs *packer.MultiError
+	if p.config.RestartTimeout < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("restart_timeout must be positive"))
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	// Without a boot identifier, the restart is only detected by the
+	// connection dropping
+	bootID, err := p.bootID(ctx, comm)
+	if err != nil {
+		return fmt.Errorf("Error reading boot identifier: %s", err)
+	}
+	if bootID == "" {
+		log.Printf("No boot identifier, waiting for the connection to drop")
+	} else {
+		log.Printf("Boot identifier before restart: %s", bootID)
+	}
+
+	ui.Say("Restarting Machine")
+	cmd := &packer.RemoteCmd{Command: p.config.RestartCommand}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+
+	// The machine may go down before the command returns
+	if cmd.ExitStatus() != 0 && cmd.ExitStatus() != packer.CmdDisconnect {
+		return fmt.Errorf("Restart script exited with non-zero exit status: %d", cmd.ExitStatus())
+	}
+
+	ui.Say("Waiting for machine to restart...")
+	ctx, cancel := context.WithTimeout(ctx, p.config.RestartTimeout)
+	defer cancel()
+
+	// The connection dropping during the restart command is enough to know
+	// that the machine went down, since the communicator may reconnect
+	// before any other command fails
+	down := cmd.ExitStatus() == packer.CmdDisconnect
+	err = p.waitForRestart(ctx, comm, bootID, down)
+	if err == nil {
+		err = p.waitForReady(ctx, ui, comm)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timeout waiting for machine to restart.")
+	}
+	if err != nil {
+		ui.Error(err.Error())
+		return err
+	}
+
+	ui.Say("Machine successfully restarted, moving on")
+	return nil
+}
+
+// waitForRestart waits for the machine to go down and come back: for its
+// boot identifier to change, or without one for a command to fail unless it
+// is already known to be down. The communicator reconnects on the next
+// command once the machine is back.
+func (p *Provisioner) waitForRestart(ctx context.Context, comm packer.Communicator, bootID string, down bool) error {
+	return retry.Config{
+		RetryDelay: func() time.Duration { return retryableSleep },
+	}.Run(ctx, func(ctx context.Context) error {
+		id, err := p.bootID(ctx, comm)
+		if err != nil {
+			log.Printf("Machine is down: %s", err)
+			down = true
+			return err
+		}
+
+		switch {
+		case bootID != "" && id != "" && id != bootID:
+			log.Printf("Boot identifier after restart: %s", id)
+			return nil
+		case bootID == "" && down:
+			return nil
+		}
+		return errors.New("machine didn't restart yet")
+	})
+}
+
+// waitForReady runs the restart check command until it succeeds.
+func (p *Provisioner) waitForReady(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	log.Printf("Checking that the machine is ready with: '%s'", p.config.RestartCheckCommand)
+	return retry.Config{
+		RetryDelay: func() time.Duration { return retryableSleep },
+	}.Run(ctx, func(ctx context.Context) error {
+		cmd := &packer.RemoteCmd{Command: p.config.RestartCheckCommand}
+		if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+			return err
+		}
+		if cmd.ExitStatus() != 0 {
+			return fmt.Errorf("restart check exited with %d", cmd.ExitStatus())
+		}
+		return nil
+	})
+}
+
+// bootID returns the output of the boot identifier command, or an empty
+// string if the command failed on the machine. It returns an error if the
+// command couldn't run.
+func (p *Provisioner) bootID(ctx context.Context, comm packer.Communicator) (string, error) {
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: p.config.BootIDCommand,
+		Stdout:  &stdout,
+	}
+	if err := comm.Start(ctx, cmd); err != nil {
+		return "", err
+	}
+	status := cmd.Wait()
+	if status == packer.CmdDisconnect {
+		return "", errors.New("disconnected")
+	}
+	if status != 0 {
+		log.Printf("Boot identifier command exited with %d", status)
+		return "", nil
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
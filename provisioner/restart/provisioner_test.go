@@ -0,0 +1,236 @@
+package restart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	}
+}
+
+// rebootingCommunicator simulates a machine which is down for a number of
+// commands after the restart command, and comes back with a new boot
+// identifier.
+type rebootingCommunicator struct {
+	packer.MockCommunicator
+
+	BootID     string
+	NewBootID  string
+	DownFor    int
+	NoReboot   bool
+	CheckFails int
+
+	down     int
+	commands []string
+}
+
+func (c *rebootingCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.commands = append(c.commands, cmd.Command)
+	if c.down > 0 {
+		c.down--
+		return errors.New("connection refused")
+	}
+
+	status, stdout := 127, ""
+	switch cmd.Command {
+	case DefaultRestartCommand:
+		status = 0
+		if !c.NoReboot {
+			c.down = c.DownFor
+			c.BootID = c.NewBootID
+			status = packer.CmdDisconnect
+		}
+	case DefaultBootIDCommand:
+		status = 1
+		if c.BootID != "" {
+			status, stdout = 0, c.BootID+"\n"
+		}
+	case DefaultRestartCheckCommand:
+		status = 1
+		if c.CheckFails > 0 {
+			c.CheckFails--
+		} else {
+			status, stdout = 0, "host restarted.\n"
+		}
+	}
+
+	// Like a real command, the output is written after Start returns
+	go func() {
+		cmd.Stdout.Write([]byte(stdout))
+		cmd.SetExited(status)
+	}()
+	return nil
+}
+
+func TestProvisioner_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &Provisioner{}
+	if _, ok := raw.(packer.Provisioner); !ok {
+		t.Fatalf("must be a Provisioner")
+	}
+}
+
+func TestProvisionerPrepare_Defaults(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.RestartTimeout != 5*time.Minute {
+		t.Errorf("unexpected restart timeout: %s", p.config.RestartTimeout)
+	}
+	if p.config.RestartCommand != DefaultRestartCommand {
+		t.Errorf("unexpected restart command: %s", p.config.RestartCommand)
+	}
+	if p.config.RestartCheckCommand != DefaultRestartCheckCommand {
+		t.Errorf("unexpected restart check command: %s", p.config.RestartCheckCommand)
+	}
+	if p.config.BootIDCommand != DefaultBootIDCommand {
+		t.Errorf("unexpected boot id command: %s", p.config.BootIDCommand)
+	}
+}
+
+func TestProvisionerPrepare_InvalidTimeout(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["restart_timeout"] = "-1m"
+
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_BootID(t *testing.T) {
+	retryableSleep = time.Millisecond
+	var p Provisioner
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &rebootingCommunicator{
+		BootID:     "a",
+		NewBootID:  "b",
+		DownFor:    2,
+		CheckFails: 1,
+	}
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		DefaultBootIDCommand,
+		DefaultRestartCommand,
+		DefaultBootIDCommand, // down
+		DefaultBootIDCommand, // down
+		DefaultBootIDCommand,
+		DefaultRestartCheckCommand, // not ready
+		DefaultRestartCheckCommand,
+	}
+	if strings.Join(comm.commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad commands: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerProvision_BootIDUnchanged(t *testing.T) {
+	retryableSleep = time.Millisecond
+	var p Provisioner
+	config := testConfig()
+	config["restart_timeout"] = "50ms"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The machine is back, but didn't actually restart
+	comm := &rebootingCommunicator{
+		BootID:    "a",
+		NewBootID: "a",
+		DownFor:   1,
+	}
+	err := p.Provision(context.Background(), testUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestProvisionerProvision_NoBootID(t *testing.T) {
+	retryableSleep = time.Millisecond
+	var p Provisioner
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &rebootingCommunicator{DownFor: 1}
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	last := comm.commands[len(comm.commands)-1]
+	if last != DefaultRestartCheckCommand {
+		t.Fatalf("bad: %#v", comm.commands)
+	}
+}
+
+func TestProvisionerProvision_NoBootIDReconnected(t *testing.T) {
+	retryableSleep = time.Millisecond
+	var p Provisioner
+	config := testConfig()
+	config["restart_timeout"] = "50ms"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The machine is back before the next command, which reconnects
+	comm := &rebootingCommunicator{DownFor: 0}
+	if err := p.Provision(context.Background(), testUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerProvision_NoRestart(t *testing.T) {
+	retryableSleep = time.Millisecond
+	var p Provisioner
+	config := testConfig()
+	config["restart_timeout"] = "50ms"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &rebootingCommunicator{NoReboot: true}
+	err := p.Provision(context.Background(), testUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestProvisionerProvision_RestartCommandFail(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["restart_command"] = "false"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &rebootingCommunicator{BootID: "a"}
+	err := p.Provision(context.Background(), testUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "non-zero exit status: 127") {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -5,8 +5,12 @@ package saltmasterless
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -48,6 +52,9 @@ type Config struct {
 	// Remote path to the salt pillar roots
 	RemotePillarRoots string `mapstructure:"remote_pillar_roots"`
 
+	// Pillar data passed inline to salt-call, overriding the pillar roots
+	Pillar map[string]interface{} `mapstructure:"pillar"`
+
 	// Where files will be copied before moving to the /srv/salt directory
 	TempConfigDir string `mapstructure:"temp_config_dir"`
 
@@ -76,6 +83,10 @@ type Provisioner struct {
 	config            Config
 	guestOSTypeConfig guestOSTypeConfig
 	guestCommands     *provisioner.GuestCommands
+
+	// The pillar data as JSON, kept out of CmdArgs since it usually holds
+	// secrets
+	pillar []byte
 }
 
 type guestOSTypeConfig struct {
@@ -199,6 +210,16 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		cmd_args.WriteString(" --retcode-passthrough")
 	}
 
+	if len(p.config.Pillar) > 0 {
+		p.pillar, err = json.Marshal(p.config.Pillar)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("pillar: %s", err))
+		}
+	}
+
+	// The results are parsed to report failed states
+	cmd_args.WriteString(" --out=json")
+
 	if p.config.LogLevel == "" {
 		cmd_args.WriteString(" -l info")
 	} else {
@@ -206,6 +227,14 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		cmd_args.WriteString(p.config.LogLevel)
 	}
 
+	for _, arg := range strings.Fields(p.config.SaltCallArgs) {
+		switch name := strings.SplitN(arg, "=", 2)[0]; name {
+		case "--out", "--output", "--out-file", "--output-file", "--out-file-append", "--output-file-append":
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("salt_call_args can't contain %s, the JSON output of salt-call is used to check the states", name))
+		}
+	}
+
 	if p.config.SaltCallArgs != "" {
 		cmd_args.WriteString(" ")
 		cmd_args.WriteString(p.config.SaltCallArgs)
@@ -340,8 +369,32 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		}
 	}
 
-	ui.Message(fmt.Sprintf("Running: salt-call --local %s", p.config.CmdArgs))
-	cmd := &packer.RemoteCmd{Command: p.sudo(fmt.Sprintf("%s --local %s", filepath.Join(p.config.SaltBinDir, "salt-call"), p.config.CmdArgs))}
+	cmdArgs, shownArgs := p.config.CmdArgs, p.config.CmdArgs
+	if len(p.pillar) > 0 {
+		if p.config.GuestOSType == provisioner.WindowsOSType {
+			cmdArgs += " pillar=" + p.quote(string(p.pillar))
+			shownArgs += " pillar=<sensitive>"
+		} else {
+			// Read the pillar from a file, so that it doesn't show in the
+			// output
+			dst = filepath.ToSlash(filepath.Join(p.config.TempConfigDir, "pillar.json"))
+			ui.Message("Uploading pillar data")
+			if err = p.uploadPillar(ui, comm, dst); err != nil {
+				return fmt.Errorf("Error uploading pillar data to remote: %s", err)
+			}
+			defer p.removePillar(ui, comm, dst)
+
+			cmdArgs += ` pillar="$(cat ` + p.quote(dst) + `)"`
+			shownArgs = cmdArgs
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Running: salt-call --local %s", shownArgs))
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: p.sudo(fmt.Sprintf("%s --local %s", filepath.Join(p.config.SaltBinDir, "salt-call"), cmdArgs)),
+		Stdout:  &stdout,
+	}
 	if err = cmd.RunWithUi(ctx, comm, ui); err != nil || cmd.ExitStatus() != 0 {
 		if err == nil {
 			err = fmt.Errorf("Bad exit status: %d", cmd.ExitStatus())
@@ -350,9 +403,87 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		return fmt.Errorf("Error executing salt-call: %s", err)
 	}
 
+	// Several versions of salt exit with 0 even though states failed
+	failed, err := reportStateResults(ui, stdout.Bytes())
+	if err != nil {
+		if p.config.NoExitOnFailure {
+			log.Printf("Unable to parse the salt-call results: %s", err)
+			return nil
+		}
+		return fmt.Errorf("Error parsing the salt-call results: %s", err)
+	}
+	if failed > 0 && !p.config.NoExitOnFailure {
+		return fmt.Errorf("Error executing salt-call: %d states failed", failed)
+	}
+
 	return nil
 }
 
+// stateResult is the result of a state in the JSON output of salt-call.
+type stateResult struct {
+	ID      string                 `json:"__id__"`
+	Name    string                 `json:"name"`
+	Result  *bool                  `json:"result"`
+	Comment interface{}            `json:"comment"`
+	Changes map[string]interface{} `json:"changes"`
+}
+
+// reportStateResults reports how many states of the JSON output of salt-call
+// changed or failed, and returns the number of failed states. Errors
+// preventing the states to run, like rendering errors, count as failed
+// states.
+func reportStateResults(ui packer.Ui, out []byte) (int, error) {
+	var results struct {
+		Local json.RawMessage `json:"local"`
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return 0, err
+	}
+	if results.Local == nil {
+		return 0, errors.New("no local results")
+	}
+
+	var errs []string
+	if err := json.Unmarshal(results.Local, &errs); err == nil {
+		for _, e := range errs {
+			ui.Error(e)
+		}
+		return len(errs), nil
+	}
+
+	var states map[string]stateResult
+	if err := json.Unmarshal(results.Local, &states); err != nil {
+		return 0, err
+	}
+
+	var changed, failed int
+	for key, state := range states {
+		if len(state.Changes) > 0 {
+			changed++
+		}
+		if state.Result != nil && !*state.Result {
+			failed++
+			id := state.ID
+			if id == "" {
+				id = key
+			}
+			ui.Error(fmt.Sprintf("State %s failed: %v", id, state.Comment))
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Salt states: %d run, %d changed, %d failed",
+		len(states), changed, failed))
+	return failed, nil
+}
+
+// quote quotes an argument of salt-call for the shell of the guest.
+func (p *Provisioner) quote(arg string) string {
+	if p.config.GuestOSType == provisioner.WindowsOSType {
+		return `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
 // Prepends sudo to supplied command if config says to
 func (p *Provisioner) sudo(cmd string) string {
 	if p.config.DisableSudo || (p.config.GuestOSType == provisioner.WindowsOSType) {
@@ -410,6 +541,47 @@ func (p *Provisioner) uploadFile(ui packer.Ui, comm packer.Communicator, dst, sr
 	return nil
 }
 
+// uploadPillar uploads the pillar data to dst, readable only by the user
+// Packer connects as.
+func (p *Provisioner) uploadPillar(ui packer.Ui, comm packer.Communicator, dst string) error {
+	f, err := ioutil.TempFile("", "packer-salt-pillar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = f.Write(p.pillar); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, temp_dst := filepath.Split(dst)
+
+	if err = comm.Upload(temp_dst, f, &fi); err != nil {
+		return err
+	}
+
+	return p.moveFile(ui, comm, dst, temp_dst)
+}
+
+// removePillar removes the pillar data uploaded by uploadPillar.
+func (p *Provisioner) removePillar(ui packer.Ui, comm packer.Communicator, dst string) {
+	ui.Message("Removing pillar data")
+	cmd := &packer.RemoteCmd{
+		Command: p.guestCommands.RemoveDir(dst),
+	}
+	if err := cmd.RunWithUi(context.TODO(), comm, ui); err != nil || cmd.ExitStatus() != 0 {
+		ui.Error(fmt.Sprintf("Unable to remove pillar data %s, remove it manually", dst))
+	}
+}
+
 func (p *Provisioner) moveFile(ui packer.Ui, comm packer.Communicator, dst string, src string) error {
 	ctx := context.TODO()
 
@@ -1,6 +1,9 @@
 package saltmasterless
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -325,3 +328,238 @@ func TestProvisionerPrepare_GuestOSType(t *testing.T) {
 		t.Fatalf("GuestOSType should be 'windows'")
 	}
 }
+
+func TestProvisionerPrepare_Pillar(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["pillar"] = map[string]interface{}{
+		"app": map[string]interface{}{
+			"version": "{{user `version`}}",
+			"owner":   "it's me",
+		},
+	}
+	config[packer.UserVariablesConfigKey] = map[string]string{
+		"version": "1.2.3",
+	}
+
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `{"app":{"owner":"it's me","version":"1.2.3"}}`
+	if string(p.pillar) != expected {
+		t.Fatalf("bad pillar: %s", p.pillar)
+	}
+	if strings.Contains(p.config.CmdArgs, "pillar=") {
+		t.Fatalf("pillar shouldn't be set in CmdArgs: %s", p.config.CmdArgs)
+	}
+	if !strings.Contains(p.config.CmdArgs, "--out=json") {
+		t.Fatal("--out=json should be set in CmdArgs")
+	}
+}
+
+func TestProvisionerPrepare_SaltCallArgsOut(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+	config["salt_call_args"] = "--state-output=changes --out-indent=2"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, args := range []string{"--out=yaml", "--out yaml", "--out-file=/tmp/out"} {
+		config["salt_call_args"] = args
+		p = Provisioner{}
+		if err := p.Prepare(config); err == nil {
+			t.Fatalf("%s: should have error", args)
+		}
+	}
+}
+
+// pillarCommunicator records the commands run and the uploaded files.
+type pillarCommunicator struct {
+	packer.MockCommunicator
+
+	commands []string
+	mode     os.FileMode
+}
+
+func (c *pillarCommunicator) Start(ctx context.Context, rc *packer.RemoteCmd) error {
+	c.commands = append(c.commands, rc.Command)
+	return c.MockCommunicator.Start(ctx, rc)
+}
+
+func (c *pillarCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
+	if fi != nil {
+		c.mode = (*fi).Mode()
+	}
+	return c.MockCommunicator.Upload(path, r, fi)
+}
+
+func TestProvisionerProvision_Pillar(t *testing.T) {
+	config := testConfig()
+	config["skip_bootstrap"] = true
+	config["pillar"] = map[string]interface{}{
+		"password": "secret",
+	}
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := testSaltUi()
+	comm := new(pillarCommunicator)
+	comm.StartStdout = strings.Replace(testStateResults, "%s", "true", 1)
+	if err := p.Provision(context.Background(), ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The pillar is uploaded to a file only the user can read, and removed
+	// after the run
+	if comm.UploadData != `{"password":"secret"}` {
+		t.Fatalf("bad pillar: %s", comm.UploadData)
+	}
+	if comm.mode.Perm() != 0600 {
+		t.Fatalf("bad mode: %s", comm.mode)
+	}
+	run := comm.commands[len(comm.commands)-2]
+	if !strings.Contains(run, ` pillar="$(cat '/tmp/salt/pillar.json')"`) {
+		t.Fatalf("bad command: %s", run)
+	}
+	if remove := comm.commands[len(comm.commands)-1]; !strings.Contains(remove, "rm -rf '/tmp/salt/pillar.json'") {
+		t.Fatalf("bad command: %s", remove)
+	}
+	if strings.Contains(ui.Writer.(*bytes.Buffer).String(), "secret") {
+		t.Fatalf("pillar shown in output: %s", ui.Writer)
+	}
+
+	// Windows guests get the pillar inline, but it isn't shown
+	config["guest_os_type"] = "windows"
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui = testSaltUi()
+	comm = new(pillarCommunicator)
+	comm.StartStdout = strings.Replace(testStateResults, "%s", "true", 1)
+	if err := p.Provision(context.Background(), ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	run = comm.commands[len(comm.commands)-1]
+	if !strings.Contains(run, ` pillar="{\"password\":\"secret\"}"`) {
+		t.Fatalf("bad command: %s", run)
+	}
+	if strings.Contains(ui.Writer.(*bytes.Buffer).String(), "secret") {
+		t.Fatalf("pillar shown in output: %s", ui.Writer)
+	}
+}
+
+const testStateResults = `{
+    "local": {
+        "pkg_|-nginx_|-nginx_|-installed": {
+            "__id__": "nginx",
+            "name": "nginx",
+            "result": true,
+            "comment": "The following packages were installed/updated: nginx",
+            "changes": {"nginx": {"new": "1.14.0", "old": ""}}
+        },
+        "file_|-config_|-/etc/nginx/nginx.conf_|-managed": {
+            "__id__": "config",
+            "name": "/etc/nginx/nginx.conf",
+            "result": %s,
+            "comment": "Source file salt://nginx/nginx.conf not found",
+            "changes": {}
+        },
+        "service_|-nginx_|-nginx_|-running": {
+            "__id__": "nginx-service",
+            "name": "nginx",
+            "result": true,
+            "comment": "The service nginx is already running",
+            "changes": {}
+        }
+    }
+}`
+
+func testSaltUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	}
+}
+
+func TestProvisionerProvision_FailedStates(t *testing.T) {
+	config := testConfig()
+	config["skip_bootstrap"] = true
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// salt-call exits with 0 even though a state failed
+	ui := testSaltUi()
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = strings.Replace(testStateResults, "%s", "false", 1)
+	err := p.Provision(context.Background(), ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "1 states failed") {
+		t.Fatalf("bad: %v", err)
+	}
+	if !strings.Contains(ui.ErrorWriter.(*bytes.Buffer).String(), "State config failed: Source file salt://nginx/nginx.conf not found") {
+		t.Fatalf("bad errors: %s", ui.ErrorWriter)
+	}
+
+	// Unless failures are ignored
+	config["no_exit_on_failure"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(context.Background(), testSaltUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerProvision_StateResults(t *testing.T) {
+	config := testConfig()
+	config["skip_bootstrap"] = true
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := testSaltUi()
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = strings.Replace(testStateResults, "%s", "true", 1)
+	if err := p.Provision(context.Background(), ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(ui.Writer.(*bytes.Buffer).String(), "Salt states: 3 run, 1 changed, 0 failed") {
+		t.Fatalf("bad output: %s", ui.Writer)
+	}
+
+	// Errors preventing the states to run fail the build
+	comm.StartStdout = `{"local": ["Rendering SLS 'base:nginx' failed: mapping values are not allowed here"]}`
+	err := p.Provision(context.Background(), testSaltUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "1 states failed") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Results which can't be parsed fail the build
+	comm.StartStdout = "local:\n  ----------\n"
+	err = p.Provision(context.Background(), testSaltUi(), comm)
+	if err == nil || !strings.Contains(err.Error(), "Error parsing the salt-call results") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Unless failures are ignored
+	config["no_exit_on_failure"] = true
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(context.Background(), testSaltUi(), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
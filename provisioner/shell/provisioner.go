@@ -4,7 +4,9 @@ package shell
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +20,7 @@ import (
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/common/retry"
 	"github.com/hashicorp/packer/common/shell"
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/packer"
 	"github.com/hashicorp/packer/packer/tmp"
@@ -57,6 +60,14 @@ type Config struct {
 
 	ExpectDisconnect bool `mapstructure:"expect_disconnect"`
 
+	// Capture the lines of the output of the scripts like
+	// `PACKER_OUTPUT key=value` as outputs of the build.
+	CaptureOutputs bool `mapstructure:"capture_outputs"`
+
+	// The remote path of a JSON file written by the scripts, whose values
+	// are captured as outputs of the build.
+	OutputsFile string `mapstructure:"outputs_file"`
+
 	startRetryTimeout time.Duration
 	ctx               interpolate.Context
 	// name of the tmp environment variable file, if UseEnvVarFile is true
@@ -301,6 +312,7 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		// and then the command is executed but the file doesn't exist
 		// any longer.
 		var cmd *packer.RemoteCmd
+		var stdout bytes.Buffer
 		err = retry.Config{StartTimeout: p.config.startRetryTimeout}.Run(ctx, func(ctx context.Context) error {
 			if _, err := f.Seek(0, 0); err != nil {
 				return err
@@ -326,6 +338,10 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 			cmd.Wait()
 
 			cmd = &packer.RemoteCmd{Command: command}
+			if p.config.CaptureOutputs {
+				stdout.Reset()
+				cmd.Stdout = &stdout
+			}
 			return cmd.RunWithUi(ctx, comm, ui)
 		})
 
@@ -347,6 +363,12 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 			return err
 		}
 
+		if p.config.CaptureOutputs {
+			if err := p.setOutputs(ui, parseOutputs(stdout.String())); err != nil {
+				return err
+			}
+		}
+
 		if !p.config.SkipClean {
 
 			// Delete the temporary file we created. We retry this a few times
@@ -363,6 +385,12 @@ func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, comm packer.C
 		}
 	}
 
+	if p.config.OutputsFile != "" {
+		if err := p.captureOutputsFile(ui, comm); err != nil {
+			return err
+		}
+	}
+
 	if p.config.RawPauseAfter != "" {
 		ui.Say(fmt.Sprintf("Pausing %s after this provisioner...", p.config.PauseAfter))
 		select {
@@ -426,6 +454,11 @@ func (p *Provisioner) escapeEnvVars() ([]string, map[string]string) {
 		envVars["PACKER_HTTP_PORT"] = httpPort
 	}
 
+	// tell the scripts where to write their outputs
+	if p.config.OutputsFile != "" {
+		envVars["PACKER_OUTPUTS_FILE"] = p.config.OutputsFile
+	}
+
 	// Split vars into key/value components
 	for _, envVar := range p.config.Vars {
 		keyValue := strings.SplitN(envVar, "=", 2)
@@ -465,3 +498,80 @@ func (p *Provisioner) createFlattenedEnvVars() (flattened string) {
 	}
 	return
 }
+
+// outputPrefix starts the lines of output captured with capture_outputs.
+const outputPrefix = "PACKER_OUTPUT "
+
+// parseOutputs returns the values of the `PACKER_OUTPUT key=value` lines of
+// the output of a script.
+func parseOutputs(output string) map[string]string {
+	outputs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, outputPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, outputPrefix), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		outputs[kv[0]] = kv[1]
+	}
+	return outputs
+}
+
+// captureOutputsFile captures the values of the JSON object in the outputs
+// file written by the scripts. Values that aren't strings are captured as
+// JSON.
+func (p *Provisioner) captureOutputsFile(ui packer.Ui, comm packer.Communicator) error {
+	var buf bytes.Buffer
+	if err := comm.Download(p.config.OutputsFile, &buf); err != nil {
+		return fmt.Errorf("Error downloading outputs file %s: %s", p.config.OutputsFile, err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+		return fmt.Errorf("Error parsing outputs file %s: %s", p.config.OutputsFile, err)
+	}
+
+	outputs := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			outputs[k] = s
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		outputs[k] = string(data)
+	}
+
+	if err := p.setOutputs(ui, outputs); err != nil {
+		return err
+	}
+
+	if !p.config.SkipClean {
+		return p.cleanupRemoteFile(p.config.OutputsFile, comm)
+	}
+	return nil
+}
+
+// setOutputs adds outputs to the outputs of the build.
+func (p *Provisioner) setOutputs(ui packer.Ui, outputs map[string]string) error {
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(outputs))
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ui.Message(fmt.Sprintf("Captured outputs: %s", strings.Join(keys, ", ")))
+
+	if err := commonhelper.SetBuildOutputs(outputs, p.config.PackerBuildName); err != nil {
+		return fmt.Errorf("Error saving outputs: %s", err)
+	}
+	return nil
+}
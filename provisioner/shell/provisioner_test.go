@@ -1,12 +1,14 @@
 package shell
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
 	"testing"
 
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/packer"
 )
 
@@ -468,3 +470,68 @@ func TestProvisionerRemotePathDefaultsSuccessfully(t *testing.T) {
 		t.Fatalf("remote path does not match the expected default regex")
 	}
 }
+
+func TestParseOutputs(t *testing.T) {
+	outputs := parseOutputs("installing...\nPACKER_OUTPUT version=1.2.3\r\nPACKER_OUTPUT url=http://a/?b=c\nPACKER_OUTPUT bad\n")
+	if len(outputs) != 2 || outputs["version"] != "1.2.3" || outputs["url"] != "http://a/?b=c" {
+		t.Fatalf("bad: %#v", outputs)
+	}
+}
+
+func TestProvisionerProvision_CaptureOutputs(t *testing.T) {
+	defer commonhelper.RemoveBuildState("test")
+
+	var p Provisioner
+	config := testConfig()
+	config["capture_outputs"] = true
+	config["outputs_file"] = "/tmp/outputs.json"
+	config["packer_build_name"] = "test"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &packer.MockCommunicator{
+		StartStdout:  "PACKER_OUTPUT ip=10.0.0.1\n",
+		DownloadData: `{"version": "1.2.3", "ports": [22, 80]}`,
+	}
+	if err := p.Provision(context.Background(), packer.TestUi(t), comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.DownloadPath != "/tmp/outputs.json" {
+		t.Fatalf("bad: %s", comm.DownloadPath)
+	}
+
+	outputs, err := commonhelper.RetrieveBuildOutputs("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if outputs["ip"] != "10.0.0.1" || outputs["version"] != "1.2.3" || outputs["ports"] != "[22,80]" {
+		t.Fatalf("bad: %#v", outputs)
+	}
+
+	// Later provisioners read them when the build prepares them, right
+	// before they run
+	p = Provisioner{}
+	config = map[string]interface{}{
+		"inline":            []interface{}{"ping {{ output `ip` }}"},
+		"environment_vars":  []interface{}{"VERSION={{output `version`}}"},
+		"packer_build_name": "test",
+	}
+	commonhelper.RemoveBuildState("test")
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.Inline[0] != "ping {{ output `ip` }}" {
+		t.Fatalf("bad: %#v", p.config.Inline)
+	}
+	if err := commonhelper.SetBuildOutputs(outputs, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p = Provisioner{}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.Inline[0] != "ping 10.0.0.1" || p.config.Vars[0] != "VERSION=1.2.3" {
+		t.Fatalf("bad: %#v %#v", p.config.Inline, p.config.Vars)
+	}
+}
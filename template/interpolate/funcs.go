@@ -12,6 +12,7 @@ import (
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/packer/common/uuid"
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/version"
 	vaultapi "github.com/hashicorp/vault/api"
 	strftime "github.com/jehiah/go-strftime"
@@ -43,6 +44,7 @@ var FuncGens = map[string]interface{}{
 	"consul_key":     funcGenConsul,
 	"vault":          funcGenVault,
 	"sed":            funcGenSed,
+	"output":         funcGenOutput,
 
 	"replace":     replace,
 	"replace_all": replace_all,
@@ -186,6 +188,32 @@ func funcGenUser(ctx *Context) interface{} {
 	}
 }
 
+// deferredOutput is what a call to the output function renders to while the
+// value isn't captured yet.
+const deferredOutput = "{{ output `%s` }}"
+
+// funcGenOutput reads the named values captured by provisioners during the
+// build. The build prepares the provisioners and post-processors using
+// outputs right before they run. A value that hasn't been captured by then
+// renders back to the call.
+func funcGenOutput(ctx *Context) interface{} {
+	return func(k string) (string, error) {
+		if ctx == nil || ctx.BuildName == "" {
+			return fmt.Sprintf(deferredOutput, k), nil
+		}
+
+		outputs, err := commonhelper.RetrieveBuildOutputs(ctx.BuildName)
+		if err != nil {
+			return "", err
+		}
+		val, ok := outputs[k]
+		if !ok {
+			return fmt.Sprintf(deferredOutput, k), nil
+		}
+		return val, nil
+	}
+}
+
 func funcGenUuid(ctx *Context) interface{} {
 	return func() string {
 		return uuid.TimeOrderedUUID()
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	commonhelper "github.com/hashicorp/packer/helper/common"
 	"github.com/hashicorp/packer/version"
 )
 
@@ -318,6 +319,34 @@ func TestFuncUser(t *testing.T) {
 	}
 }
 
+func TestFuncOutput(t *testing.T) {
+	defer commonhelper.RemoveBuildState("foo")
+
+	ctx := &Context{BuildName: "foo"}
+	i := &I{Value: "{{output `ip`}}"}
+
+	// Not captured yet, so it can be rendered again later
+	result, err := i.Render(ctx)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "{{ output `ip` }}" {
+		t.Fatalf("Got: %s", result)
+	}
+
+	if err := commonhelper.SetBuildOutputs(map[string]string{"ip": "10.0.0.1"}, "foo"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	i = &I{Value: result}
+	result, err = i.Render(ctx)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "10.0.0.1" {
+		t.Fatalf("Got: %s", result)
+	}
+}
+
 func TestFuncPackerVersion(t *testing.T) {
 	template := `{{packer_version}}`
 